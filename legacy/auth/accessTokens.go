@@ -0,0 +1,184 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"eurovision-api/db"
+	"eurovision-api/models"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// every personal access token starts with this prefix so AuthMiddleware
+	// can tell it apart from a JWT
+	AccessTokenPrefix = "evr_pat_"
+
+	defaultAccessTokenExpiryDays = 90
+	maxAccessTokenExpiryDays     = 365
+	maxAccessTokenNameLen        = 100
+
+	// last used times are only written once per interval to avoid an update
+	// on every request
+	accessTokenTouchInterval = time.Minute
+)
+
+// scopes that can be granted to personal access tokens
+const (
+	ScopeRankingsRead  = "rankings:read"
+	ScopeRankingsWrite = "rankings:write"
+	ScopeVotesRead     = "votes:read"
+	ScopeVotesWrite    = "votes:write"
+)
+
+var validScopes = map[string]bool{
+	ScopeRankingsRead:  true,
+	ScopeRankingsWrite: true,
+	ScopeVotesRead:     true,
+	ScopeVotesWrite:    true,
+}
+
+var (
+	ErrInvalidTokenName   = errors.New("token name is required and must be at most 100 characters")
+	ErrInvalidScopes      = errors.New("at least one valid scope is required")
+	ErrInvalidTokenExpiry = errors.New("expires_in_days must be between 1 and 365")
+	ErrAccessTokenExpired = errors.New("access token expired")
+	ErrAccessTokenUnknown = errors.New("access token not found")
+)
+
+/**
+ * hashes a personal access token for storage and lookup. Tokens have 256
+ * bits of randomness so a fast hash is sufficient.
+ */
+func hashAccessToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+/**
+ * creates a personal access token for the user. Returns the plaintext token,
+ * which is never stored and cannot be retrieved again, along with its record.
+ * An expiresInDays of 0 uses the default expiry.
+ */
+func (s *Service) CreateAccessToken(userID, name string, scopes []string, expiresInDays int, client ClientInfo) (string, *models.PersonalAccessToken, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > maxAccessTokenNameLen {
+		return "", nil, ErrInvalidTokenName
+	}
+
+	if len(scopes) == 0 {
+		return "", nil, ErrInvalidScopes
+	}
+	seen := map[string]bool{}
+	uniqueScopes := []string{}
+	for _, scope := range scopes {
+		if !validScopes[scope] {
+			return "", nil, ErrInvalidScopes
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			uniqueScopes = append(uniqueScopes, scope)
+		}
+	}
+
+	if expiresInDays == 0 {
+		expiresInDays = defaultAccessTokenExpiryDays
+	}
+	if expiresInDays < 1 || expiresInDays > maxAccessTokenExpiryDays {
+		return "", nil, ErrInvalidTokenExpiry
+	}
+
+	secret, err := randomURLSafeString(32)
+	if err != nil {
+		return "", nil, err
+	}
+	plaintext := AccessTokenPrefix + secret
+
+	now := time.Now()
+	expiresAt := now.Add(time.Duration(expiresInDays) * 24 * time.Hour)
+
+	token := &models.PersonalAccessToken{
+		ID:          uuid.New().String(),
+		UserID:      userID,
+		Name:        name,
+		TokenHash:   hashAccessToken(plaintext),
+		TokenPrefix: plaintext[:len(AccessTokenPrefix)+4],
+		Scopes:      uniqueScopes,
+		ExpiresAt:   &expiresAt,
+		CreatedAt:   now,
+	}
+
+	if err := db.CreateAccessToken(token); err != nil {
+		return "", nil, err
+	}
+
+	recordSecurityEvent(models.SecurityEvent{
+		UserID: userID,
+		Event:  EventAccessTokenCreated,
+		Details: map[string]interface{}{
+			"token_id": token.ID,
+			"name":     token.Name,
+			"scopes":   token.Scopes,
+		},
+	}, client, nil)
+
+	return plaintext, token, nil
+}
+
+/**
+ * lists the user's personal access tokens
+ */
+func (s *Service) ListAccessTokens(userID string) ([]models.PersonalAccessToken, error) {
+	return db.GetAccessTokensByUserID(userID)
+}
+
+/**
+ * revokes one of the user's personal access tokens
+ */
+func (s *Service) RevokeAccessToken(userID, tokenID string, client ClientInfo) error {
+	deleted, err := db.DeleteAccessToken(userID, tokenID)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return ErrAccessTokenUnknown
+	}
+
+	recordSecurityEvent(models.SecurityEvent{
+		UserID:  userID,
+		Event:   EventAccessTokenRevoked,
+		Details: map[string]interface{}{"token_id": tokenID},
+	}, client, nil)
+
+	return nil
+}
+
+/**
+ * resolves a personal access token presented as a bearer token
+ */
+func validateAccessToken(plaintext string) (*models.PersonalAccessToken, error) {
+	token, err := db.GetAccessTokenByHash(hashAccessToken(plaintext))
+	if err != nil {
+		return nil, ErrAccessTokenUnknown
+	}
+
+	now := time.Now()
+
+	if token.ExpiresAt != nil && token.ExpiresAt.Before(now) {
+		return nil, ErrAccessTokenExpired
+	}
+
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) > accessTokenTouchInterval {
+		go func(tokenID string) {
+			if err := db.TouchAccessToken(tokenID, now); err != nil {
+				logrus.WithError(err).Warn("Failed to record access token use")
+			}
+		}(token.ID)
+	}
+
+	return token, nil
+}
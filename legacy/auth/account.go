@@ -0,0 +1,404 @@
+package auth
+
+import (
+	"errors"
+	"eurovision-api/db"
+	"eurovision-api/models"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const defaultDeletionGraceDays = 14
+
+var ErrSameEmail = errors.New("new email is the same as the current email")
+
+/*
+Reauthentication is what a signed in user sends to prove it is really them
+before a sensitive account change. Accounts with a password confirm it.
+Accounts without one confirm with a TOTP or recovery code when 2FA is
+enabled, and otherwise through a link emailed to their current address.
+*/
+type Reauthentication struct {
+	Password     string
+	Code         string
+	RecoveryCode string
+}
+
+/**
+ * checks the user's reauthentication. Returns false without an error when
+ * the account has neither a password nor 2FA, so the change must be
+ * confirmed by email instead.
+ */
+func (s *Service) reauthenticate(user *models.User, proof Reauthentication) (bool, error) {
+	if user.PasswordHash != "" {
+		if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(proof.Password)); err != nil {
+			return false, ErrInvalidCredentials
+		}
+		return true, nil
+	}
+
+	if user.TOTPEnabled {
+		if err := s.verifySecondFactor(user, proof.Code, proof.RecoveryCode); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	return false, nil
+}
+
+/**
+ * returns the number of days between a deletion request and the account
+ * actually being deleted, from ACCOUNT_DELETION_GRACE_DAYS
+ */
+func deletionGracePeriod() time.Duration {
+	days, err := strconv.Atoi(os.Getenv("ACCOUNT_DELETION_GRACE_DAYS"))
+	if err != nil || days < 0 {
+		days = defaultDeletionGraceDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+/**
+ * schedules the user's account for deletion after the grace period and emails
+ * them a cancellation link. Accounts that can't reauthenticate directly are
+ * instead emailed a link to confirm the deletion, and a zero time is returned.
+ */
+func (s *Service) RequestAccountDeletion(userID string, proof Reauthentication, client ClientInfo) (time.Time, error) {
+	user, err := db.GetUserByID(userID)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	verified, err := s.reauthenticate(user, proof)
+	if err == ErrInvalidCredentials || err == ErrInvalidMFACode {
+		recordSecurityEvent(models.SecurityEvent{UserID: user.ID, Event: EventDeletionRequested}, client, err)
+		return time.Time{}, err
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if !verified {
+		token, err := issueAuthToken(user.ID, TokenPurposeConfirmDeletion, confirmChangeTokenTTL)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		recordSecurityEvent(models.SecurityEvent{
+			UserID:  user.ID,
+			Event:   EventDeletionRequested,
+			Details: map[string]interface{}{"awaiting_confirmation": true},
+		}, client, nil)
+
+		return time.Time{}, s.sendAccountDeletionConfirmEmail(user, token)
+	}
+
+	return s.scheduleAccountDeletion(user, client)
+}
+
+/**
+ * schedules an account deletion using the token emailed to an account that
+ * has neither a password nor 2FA
+ */
+func (s *Service) ConfirmAccountDeletion(token string, client ClientInfo) (time.Time, error) {
+	record, err := consumeAuthToken(token, TokenPurposeConfirmDeletion)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	user, err := db.GetUserByID(record.UserID)
+	if err != nil {
+		return time.Time{}, ErrInvalidToken
+	}
+
+	return s.scheduleAccountDeletion(user, client)
+}
+
+func (s *Service) scheduleAccountDeletion(user *models.User, client ClientInfo) (time.Time, error) {
+	now := time.Now()
+	scheduledFor := now.Add(deletionGracePeriod())
+
+	if err := db.ScheduleUserDeletion(user.ID, now, scheduledFor); err != nil {
+		return time.Time{}, err
+	}
+
+	token, err := issueAuthToken(user.ID, TokenPurposeCancelDeletion, scheduledFor.Sub(now))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	logrus.Infof("User %s scheduled for deletion at %s", user.ID, scheduledFor)
+
+	recordSecurityEvent(models.SecurityEvent{
+		UserID:  user.ID,
+		Event:   EventDeletionRequested,
+		Details: map[string]interface{}{"scheduled_for": scheduledFor},
+	}, client, nil)
+
+	return scheduledFor, s.sendAccountDeletionEmail(user, token, scheduledFor)
+}
+
+/**
+ * cancels a pending account deletion using the token from the email
+ */
+func (s *Service) CancelAccountDeletion(token string, client ClientInfo) error {
+	record, err := consumeAuthToken(token, TokenPurposeCancelDeletion)
+	if err != nil {
+		return err
+	}
+
+	cancelled, err := db.CancelUserDeletion(record.UserID)
+	if err != nil {
+		if err == db.ErrUserNotFound {
+			return ErrInvalidToken
+		}
+		return err
+	}
+	if !cancelled {
+		return ErrInvalidToken
+	}
+
+	recordSecurityEvent(models.SecurityEvent{UserID: record.UserID, Event: EventDeletionCancelled}, client, nil)
+
+	return nil
+}
+
+/**
+ * changes the password of a signed in user after checking the current one.
+ * All sessions and personal access tokens are revoked, the old address is
+ * notified and the current client gets a JWT for a new session.
+ */
+func (s *Service) ChangePassword(userID, currentPassword, newPassword string, client ClientInfo) (string, error) {
+	user, err := db.GetUserByID(userID)
+	if err != nil {
+		return "", err
+	}
+
+	if user.PasswordHash == "" {
+		return "", ErrRegistrationIncomplete
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(currentPassword)); err != nil {
+		recordSecurityEvent(models.SecurityEvent{UserID: user.ID, Event: EventPasswordChanged}, client, ErrInvalidCredentials)
+		return "", ErrInvalidCredentials
+	}
+
+	if err := validatePassword(newPassword, user.Email); err != nil {
+		return "", err
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+
+	if err := db.ChangePassword(user.ID, string(hashedPassword), now); err != nil {
+		return "", err
+	}
+
+	if err := db.RevokeUserSessions(user.ID, "", now); err != nil {
+		return "", err
+	}
+
+	if err := db.DeleteUserAccessTokens(user.ID); err != nil {
+		return "", err
+	}
+
+	recordSecurityEvent(models.SecurityEvent{UserID: user.ID, Event: EventPasswordChanged}, client, nil)
+
+	if err := s.sendPasswordChangedEmail(user); err != nil {
+		logrus.WithError(err).Errorf("Failed to send password changed notice to user %s", user.ID)
+	}
+
+	return s.startSession(user, client)
+}
+
+/**
+ * starts an email change. The new address receives a confirmation link and
+ * the current address keeps working, and is notified, until it is confirmed.
+ * Accounts that can't reauthenticate directly first get a link at their
+ * current address to approve the change, in which case true is returned.
+ */
+func (s *Service) RequestEmailChange(userID string, proof Reauthentication, newEmail string, client ClientInfo) (bool, error) {
+	newEmail = normalizeEmail(newEmail)
+
+	if err := validateEmail(newEmail); err != nil {
+		return false, ErrInvalidEmail
+	}
+
+	user, err := db.GetUserByID(userID)
+	if err != nil {
+		return false, err
+	}
+
+	verified, err := s.reauthenticate(user, proof)
+	if err == ErrInvalidCredentials || err == ErrInvalidMFACode {
+		recordSecurityEvent(models.SecurityEvent{UserID: user.ID, Event: EventEmailChangeRequested}, client, err)
+		return false, err
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if strings.EqualFold(newEmail, user.Email) {
+		return false, ErrSameEmail
+	}
+
+	exists, err := db.EmailExists(newEmail)
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		return false, ErrEmailExists
+	}
+
+	// links already sent for an earlier pending address must not confirm this one
+	if err := revokeEmailChangeTokens(user.ID); err != nil {
+		return false, err
+	}
+
+	if err := db.SetPendingEmailChange(user.ID, newEmail); err != nil {
+		return false, err
+	}
+
+	recordSecurityEvent(models.SecurityEvent{
+		UserID:  user.ID,
+		Event:   EventEmailChangeRequested,
+		Details: map[string]interface{}{"new_email": newEmail, "awaiting_approval": !verified},
+	}, client, nil)
+
+	if !verified {
+		token, err := issueEmailAuthToken(user.ID, TokenPurposeApproveEmailChange, newEmail, confirmChangeTokenTTL)
+		if err != nil {
+			return false, err
+		}
+		return true, s.sendEmailChangeApproveEmail(user, newEmail, token)
+	}
+
+	if err := s.sendEmailChangeConfirmation(user, newEmail); err != nil {
+		return false, err
+	}
+
+	if err := s.sendEmailChangeRequestedEmail(user, newEmail); err != nil {
+		logrus.WithError(err).Errorf("Failed to send email change notice to user %s", user.ID)
+	}
+
+	return false, nil
+}
+
+/**
+ * approves a pending email change using the token sent to the current
+ * address, and sends the usual confirmation link to the new one
+ */
+func (s *Service) ApproveEmailChange(token string, client ClientInfo) error {
+	record, err := consumeAuthToken(token, TokenPurposeApproveEmailChange)
+	if err != nil {
+		return err
+	}
+
+	user, err := db.GetUserByID(record.UserID)
+	if err != nil {
+		return ErrInvalidToken
+	}
+
+	if user.PendingEmail == "" || record.Email != user.PendingEmail {
+		return ErrInvalidToken
+	}
+
+	recordSecurityEvent(models.SecurityEvent{
+		UserID:  user.ID,
+		Event:   EventEmailChangeApproved,
+		Details: map[string]interface{}{"new_email": user.PendingEmail},
+	}, client, nil)
+
+	return s.sendEmailChangeConfirmation(user, user.PendingEmail)
+}
+
+func (s *Service) sendEmailChangeConfirmation(user *models.User, newEmail string) error {
+	token, err := issueEmailAuthToken(user.ID, TokenPurposeChangeEmail, newEmail, changeEmailTokenTTL)
+	if err != nil {
+		return err
+	}
+
+	return s.sendEmailChangeConfirmationEmail(user, newEmail, token)
+}
+
+/**
+ * invalidates the links sent for a pending email change, whenever the
+ * pending address is replaced or confirmed
+ */
+func revokeEmailChangeTokens(userID string) error {
+	for _, purpose := range []string{TokenPurposeApproveEmailChange, TokenPurposeChangeEmail} {
+		if err := db.DeleteAuthTokens(userID, purpose); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+ * confirms a pending email change using the token sent to the new address.
+ * The token only confirms the address it was sent to, so a link for an
+ * earlier pending address is refused. All sessions are revoked so the user
+ * signs in again with the new email.
+ */
+func (s *Service) ConfirmEmailChange(token string, client ClientInfo) error {
+	record, err := consumeAuthToken(token, TokenPurposeChangeEmail)
+	if err != nil {
+		return err
+	}
+
+	user, err := db.GetUserByID(record.UserID)
+	if err != nil {
+		return ErrInvalidToken
+	}
+
+	if user.PendingEmail == "" || record.Email != user.PendingEmail {
+		return ErrInvalidToken
+	}
+
+	// the address may have been registered since the change was requested
+	exists, err := db.EmailExists(user.PendingEmail)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrEmailExists
+	}
+
+	oldEmail := user.Email
+
+	now := time.Now()
+
+	if err := db.CompleteEmailChange(user.ID, user.PendingEmail, now); err != nil {
+		return err
+	}
+
+	if err := db.RevokeUserSessions(user.ID, "", now); err != nil {
+		return err
+	}
+
+	if err := revokeEmailChangeTokens(user.ID); err != nil {
+		return err
+	}
+
+	recordSecurityEvent(models.SecurityEvent{
+		UserID:  user.ID,
+		Event:   EventEmailChanged,
+		Details: map[string]interface{}{"old_email": oldEmail, "new_email": user.PendingEmail},
+	}, client, nil)
+
+	if err := s.sendEmailChangedEmail(user, oldEmail, user.PendingEmail); err != nil {
+		logrus.WithError(err).Errorf("Failed to send email changed notice to user %s", user.ID)
+	}
+
+	return nil
+}
@@ -0,0 +1,185 @@
+package auth
+
+import (
+	"eurovision-api/db"
+	"eurovision-api/mailer"
+	"eurovision-api/models"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var emailTokenPattern = regexp.MustCompile(`token=([^\s"&<]+)`)
+
+/**
+ * creates a confirmed user with the password, removed when the test ends
+ */
+func createTestUser(t *testing.T, password string) *models.User {
+	t.Helper()
+
+	user := &models.User{
+		ID:        uuid.New().String(),
+		Email:     "user-" + uuid.New().String() + "@example.com",
+		Role:      models.RoleUser,
+		Confirmed: true,
+		CreatedAt: time.Now(),
+	}
+	if password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		user.PasswordHash = string(hash)
+	}
+
+	if err := db.CreateUser(user); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	t.Cleanup(func() { db.DeleteUserCascade(user.ID) })
+
+	return user
+}
+
+/**
+ * returns the token from the link in the latest email sent to the address
+ */
+func emailedToken(t *testing.T, memory *mailer.MemoryMailer, to string) string {
+	t.Helper()
+
+	msg := memory.LastTo(to)
+	if msg == nil {
+		t.Fatalf("no email sent to %s", to)
+	}
+	match := emailTokenPattern.FindStringSubmatch(msg.Text)
+	if match == nil {
+		t.Fatalf("email to %s has no link:\n%s", to, msg.Text)
+	}
+	token, err := url.QueryUnescape(match[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestEmailChangeLinksOnlyConfirmTheirAddress(t *testing.T) {
+	requireES(t)
+
+	const password = "correct horse battery staple"
+	proof := Reauthentication{Password: password}
+
+	tests := []struct {
+		name string
+		// leaves the user with a pending address and returns a link token
+		// that must not confirm it
+		stale func(s *Service, memory *mailer.MemoryMailer, user *models.User) string
+	}{
+		{
+			name: "link for an earlier pending address",
+			stale: func(s *Service, memory *mailer.MemoryMailer, user *models.User) string {
+				first := "first-" + user.Email
+				if _, err := s.RequestEmailChange(user.ID, proof, first, ClientInfo{}); err != nil {
+					t.Fatalf("RequestEmailChange: %v", err)
+				}
+				token := emailedToken(t, memory, first)
+
+				if _, err := s.RequestEmailChange(user.ID, proof, "second-"+user.Email, ClientInfo{}); err != nil {
+					t.Fatalf("RequestEmailChange: %v", err)
+				}
+				return token
+			},
+		},
+		{
+			name: "token issued for another address",
+			stale: func(s *Service, memory *mailer.MemoryMailer, user *models.User) string {
+				token, err := issueEmailAuthToken(user.ID, TokenPurposeChangeEmail, "other-"+user.Email, time.Hour)
+				if err != nil {
+					t.Fatalf("issueEmailAuthToken: %v", err)
+				}
+				if err := db.SetPendingEmailChange(user.ID, "pending-"+user.Email); err != nil {
+					t.Fatalf("SetPendingEmailChange: %v", err)
+				}
+				return token
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			memory := mailer.NewMemoryMailer()
+			s := &Service{mailer: memory}
+			user := createTestUser(t, password)
+
+			token := tt.stale(s, memory, user)
+			if err := s.ConfirmEmailChange(token, ClientInfo{}); err != ErrInvalidToken {
+				t.Fatalf("ConfirmEmailChange = %v, want %v", err, ErrInvalidToken)
+			}
+
+			current, err := db.GetUserByID(user.ID)
+			if err != nil {
+				t.Fatalf("GetUserByID: %v", err)
+			}
+			if current.Email != user.Email {
+				t.Errorf("email changed to %s", current.Email)
+			}
+		})
+	}
+}
+
+func TestEmailChangeConfirmsTheLatestAddress(t *testing.T) {
+	requireES(t)
+
+	const password = "correct horse battery staple"
+	memory := mailer.NewMemoryMailer()
+	s := &Service{mailer: memory}
+	user := createTestUser(t, password)
+
+	newEmail := "new-" + user.Email
+	if _, err := s.RequestEmailChange(user.ID, Reauthentication{Password: password}, newEmail, ClientInfo{}); err != nil {
+		t.Fatalf("RequestEmailChange: %v", err)
+	}
+
+	if err := s.ConfirmEmailChange(emailedToken(t, memory, newEmail), ClientInfo{}); err != nil {
+		t.Fatalf("ConfirmEmailChange: %v", err)
+	}
+
+	current, err := db.GetUserByID(user.ID)
+	if err != nil {
+		t.Fatalf("GetUserByID: %v", err)
+	}
+	if current.Email != newEmail || current.PendingEmail != "" {
+		t.Errorf("email = %s pending %q, want %s and nothing pending", current.Email, current.PendingEmail, newEmail)
+	}
+}
+
+func TestEmailChangeApprovalOnlyApprovesItsAddress(t *testing.T) {
+	requireES(t)
+
+	memory := mailer.NewMemoryMailer()
+	s := &Service{mailer: memory}
+	// passwordless, so changes are approved from the current address first
+	user := createTestUser(t, "")
+
+	awaiting, err := s.RequestEmailChange(user.ID, Reauthentication{}, "first-"+user.Email, ClientInfo{})
+	if err != nil || !awaiting {
+		t.Fatalf("RequestEmailChange = %v, %v, want approval to be required", awaiting, err)
+	}
+	approval := emailedToken(t, memory, user.Email)
+
+	if _, err := s.RequestEmailChange(user.ID, Reauthentication{}, "second-"+user.Email, ClientInfo{}); err != nil {
+		t.Fatalf("RequestEmailChange: %v", err)
+	}
+	if err := s.ApproveEmailChange(approval, ClientInfo{}); err != ErrInvalidToken {
+		t.Errorf("ApproveEmailChange with the first link = %v, want %v", err, ErrInvalidToken)
+	}
+
+	if err := s.ApproveEmailChange(emailedToken(t, memory, user.Email), ClientInfo{}); err != nil {
+		t.Fatalf("ApproveEmailChange: %v", err)
+	}
+	if memory.LastTo("second-"+user.Email) == nil {
+		t.Errorf("no confirmation link sent to the approved address")
+	}
+}
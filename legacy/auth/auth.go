@@ -3,20 +3,26 @@ package auth
 import (
 	"errors"
 	"eurovision-api/db"
+	"eurovision-api/mailer"
+	"eurovision-api/models"
 	"fmt"
 	"net/mail"
-	"net/smtp"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/time/rate"
 )
 
 const (
-	tokenExpiryHours = 24
-	minPasswordLen   = 8
+	minPasswordLen = 8
+	// bcrypt ignores anything past 72 bytes
+	maxPasswordLen = 72
+
+	// minimum time between two verification emails to the same address
+	verificationResendCooldown = time.Minute
 )
 
 var (
@@ -33,86 +39,190 @@ var (
 	ErrUnconfirmedEmail       = errors.New("email not confirmed")
 	ErrUserNotFound           = errors.New("user not found")
 	ErrRegistrationIncomplete = errors.New("registration not completed")
+	ErrAccountDisabled        = errors.New("account disabled")
+	ErrPasswordResetRequired  = errors.New("password reset required")
 )
 
-func generateConfirmationToken() (string, time.Time) {
-	token := uuid.New().String()
-	expiry := time.Now().Add(tokenExpiryHours * time.Hour)
-	return token, expiry
-}
-
 func validateEmail(email string) error {
 	_, err := mail.ParseAddress(email)
 	return err
 }
 
-func validatePassword(password string) error {
+/**
+ * emails are stored and looked up lowercase so each address belongs to a
+ * single account whatever case it is typed in
+ */
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+/**
+ * keeps the user's locale only when there are email templates for it, so
+ * unsupported locales fall back to the default instead of being stored
+ */
+func normalizeUserLocale(locale string) string {
+	if !mailer.SupportedLocale(locale) {
+		return ""
+	}
+	return mailer.NormalizeLocale(locale)
+}
+
+/**
+ * checks the password's length, whether it appears in a known breach and how
+ * guessable it is. userInputs are account details like the email address that
+ * the password shouldn't be based on.
+ */
+func validatePassword(password string, userInputs ...string) error {
 	if len(password) < minPasswordLen {
-		return ErrWeakPassword
+		return &PasswordRejectedError{
+			Reason:      PasswordTooShort,
+			Suggestions: []string{fmt.Sprintf("Use at least %d characters", minPasswordLen)},
+		}
 	}
+
+	if len(password) > maxPasswordLen {
+		return &PasswordRejectedError{
+			Reason:      PasswordTooLong,
+			Suggestions: []string{fmt.Sprintf("Use at most %d bytes", maxPasswordLen)},
+		}
+	}
+
+	if isBreachedPassword(password) {
+		return &PasswordRejectedError{
+			Reason:      PasswordBreached,
+			Warning:     "This password has appeared in a data breach",
+			Suggestions: []string{"Choose a password you haven't used anywhere else"},
+		}
+	}
+
+	strength := EstimatePasswordStrength(password, userInputs)
+	if strength.Score < minPasswordScore {
+		return &PasswordRejectedError{
+			Reason:      PasswordTooGuessable,
+			Score:       &strength.Score,
+			Warning:     strength.Warning,
+			Suggestions: strength.Suggestions,
+		}
+	}
+
 	return nil
 }
 
-func sendVerificationEmail(to, token string) error {
+/**
+ * builds a link into the frontend from APP_BASE_URL
+ */
+func appURL(path, token string) string {
+	return fmt.Sprintf("%s/%s?token=%s", os.Getenv("APP_BASE_URL"), path, url.QueryEscape(token))
+}
 
-	baseURL := os.Getenv("APP_BASE_URL")
-	verifyURL := fmt.Sprintf("%s/complete-registration?token=%s", baseURL, token)
+func (s *Service) sendVerificationEmail(user *models.User, token string) error {
+	return s.sendEmail(user.Email, user.Locale, "verify_email", map[string]interface{}{
+		"URL":         appURL("complete-registration", token),
+		"ExpiryHours": int(verifyEmailTokenTTL.Hours()),
+	})
+}
 
-	subject := "Complete Your Registration"
-	body := fmt.Sprintf(`
-		Hello Eurovision-Ranker user!
-		
-		Click the link below to verify your email and set your password:
-		%s
-		
-		This link will expire in %d hours.
-		
-		If you didn't create this account, please ignore this email.
-	`, verifyURL, tokenExpiryHours)
+func (s *Service) sendPasswordResetEmail(user *models.User, token string) error {
+	return s.sendEmail(user.Email, user.Locale, "password_reset", map[string]interface{}{
+		"URL":         appURL("reset-password", token),
+		"ExpiryHours": int(resetPasswordTokenTTL.Hours()),
+	})
+}
 
-	return sendEmail(to, subject, body)
+func (s *Service) sendMagicLinkEmail(user *models.User, token string) error {
+	return s.sendEmail(user.Email, user.Locale, "magic_link", map[string]interface{}{
+		"URL":           appURL("magic-login", token),
+		"ExpiryMinutes": int(magicLoginTokenTTL.Minutes()),
+	})
 }
 
-func sendPasswordResetEmail(to, token string) error {
+func (s *Service) sendAccountDeletionEmail(user *models.User, token string, scheduledFor time.Time) error {
+	return s.sendEmail(user.Email, user.Locale, "account_deletion", map[string]interface{}{
+		"URL":          appURL("cancel-account-deletion", token),
+		"ScheduledFor": scheduledFor.Format("2 January 2006"),
+	})
+}
 
-	baseURL := os.Getenv("APP_BASE_URL")
+func (s *Service) sendAccountDeletionConfirmEmail(user *models.User, token string) error {
+	return s.sendEmail(user.Email, user.Locale, "account_deletion_confirm", map[string]interface{}{
+		"URL":           appURL("confirm-account-deletion", token),
+		"ExpiryMinutes": int(confirmChangeTokenTTL.Minutes()),
+	})
+}
 
-	resetURL := fmt.Sprintf("%s/reset-password?token=%s", baseURL, token)
+func (s *Service) sendPasswordChangedEmail(user *models.User) error {
+	return s.sendEmail(user.Email, user.Locale, "password_changed", nil)
+}
 
-	subject := "Reset Your Password"
-	body := fmt.Sprintf(`
-		Hello Eurovision-Ranker user!
-		
-		Click the link below to reset your password:
-		%s
-		
-		This link will expire in %d hours.
-		
-		If you didn't request this password reset, please ignore this email.
-	`, resetURL, tokenExpiryHours)
+func (s *Service) sendEmailChangeConfirmationEmail(user *models.User, newEmail, token string) error {
+	return s.sendEmail(newEmail, user.Locale, "email_change_confirm", map[string]interface{}{
+		"URL":         appURL("confirm-email-change", token),
+		"ExpiryHours": int(changeEmailTokenTTL.Hours()),
+	})
+}
 
-	return sendEmail(to, subject, body)
+func (s *Service) sendEmailChangeApproveEmail(user *models.User, newEmail, token string) error {
+	return s.sendEmail(user.Email, user.Locale, "email_change_approve", map[string]interface{}{
+		"URL":           appURL("approve-email-change", token),
+		"NewEmail":      newEmail,
+		"ExpiryMinutes": int(confirmChangeTokenTTL.Minutes()),
+	})
 }
 
-func sendEmail(to, subject, body string) error {
+func (s *Service) sendEmailChangeRequestedEmail(user *models.User, newEmail string) error {
+	return s.sendEmail(user.Email, user.Locale, "email_change_requested", map[string]interface{}{
+		"NewEmail": newEmail,
+	})
+}
 
-	from := os.Getenv("EMAIL_USER")
-	password := os.Getenv("EMAIL_PASSWORD")
-	host := os.Getenv("SMTP_HOST")
-	port := os.Getenv("SMTP_PORT")
+func (s *Service) sendEmailChangedEmail(user *models.User, oldEmail, newEmail string) error {
+	return s.sendEmail(oldEmail, user.Locale, "email_changed", map[string]interface{}{
+		"NewEmail": newEmail,
+	})
+}
 
-	msg := fmt.Sprintf("To: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s",
-		to, subject, body)
+func (s *Service) sendAccountLockedEmail(user *models.User, token string, lockedUntil time.Time) error {
+	return s.sendEmail(user.Email, user.Locale, "account_locked", map[string]interface{}{
+		"URL":         appURL("unlock-account", token),
+		"LockedUntil": lockedUntil.UTC().Format("15:04 on 2 January 2006"),
+	})
+}
 
-	auth := smtp.PlainAuth("", from, password, host)
+/**
+ * renders the named template in the recipient's locale and hands it to the
+ * configured mailer
+ */
+func (s *Service) sendEmail(to, locale, template string, data map[string]interface{}) error {
+	msg, err := mailer.Render(template, locale, data)
+	if err != nil {
+		return err
+	}
+	msg.To = to
 
-	return smtp.SendMail(host+":"+port, auth, from, []string{to}, []byte(msg))
+	return s.mailer.Send(msg)
 }
 
-// Cleanup job to remove unconfirmed users
+// Cleanup job to remove unconfirmed users 48 hours after their last verification email
 func cleanupUnconfirmedUsers() {
 	cutoff := time.Now().Add(-48 * time.Hour)
 	if err := db.DeleteUnconfirmedUsers(cutoff); err != nil {
 		logrus.Error("Failed to cleanup unconfirmed users", "error", err)
 	}
 }
+
+// Cleanup job to delete accounts whose deletion grace period has ended
+func purgeDeletedAccounts() {
+	userIDs, err := db.GetUserIDsDueForDeletion(time.Now())
+	if err != nil {
+		logrus.WithError(err).Error("Failed to find accounts due for deletion")
+		return
+	}
+
+	for _, userID := range userIDs {
+		if err := db.DeleteUserCascade(userID); err != nil {
+			logrus.WithError(err).Errorf("Failed to delete account %s", userID)
+			continue
+		}
+		logrus.Infof("Deleted account %s after grace period", userID)
+	}
+}
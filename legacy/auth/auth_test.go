@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"eurovision-api/mailer"
+	"eurovision-api/models"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestAuthEmailsCarryTheirLinks(t *testing.T) {
+	t.Setenv("APP_BASE_URL", "https://eurovision.example")
+
+	const token = "tok/en+="
+	escaped := url.QueryEscape(token)
+	user := &models.User{ID: "user-1", Email: "fan@example.com", Locale: "en"}
+
+	tests := []struct {
+		name    string
+		send    func(s *Service) error
+		to      string
+		subject string
+		link    string
+		html    bool
+	}{
+		{
+			name:    "registration",
+			send:    func(s *Service) error { return s.sendVerificationEmail(user, token) },
+			to:      user.Email,
+			subject: "Complete Your Registration",
+			link:    "https://eurovision.example/complete-registration?token=" + escaped,
+			html:    true,
+		},
+		{
+			name:    "password reset",
+			send:    func(s *Service) error { return s.sendPasswordResetEmail(user, token) },
+			to:      user.Email,
+			subject: "Reset Your Password",
+			link:    "https://eurovision.example/reset-password?token=" + escaped,
+			html:    true,
+		},
+		{
+			name:    "magic link",
+			send:    func(s *Service) error { return s.sendMagicLinkEmail(user, token) },
+			to:      user.Email,
+			subject: "Your Login Link",
+			link:    "https://eurovision.example/magic-login?token=" + escaped,
+			html:    true,
+		},
+		{
+			name:    "email change confirmation goes to the new address",
+			send:    func(s *Service) error { return s.sendEmailChangeConfirmationEmail(user, "new@example.com", token) },
+			to:      "new@example.com",
+			subject: "Confirm Your New Email Address",
+			link:    "https://eurovision.example/confirm-email-change?token=" + escaped,
+		},
+		{
+			name:    "email change approval goes to the current address",
+			send:    func(s *Service) error { return s.sendEmailChangeApproveEmail(user, "new@example.com", token) },
+			to:      user.Email,
+			subject: "Approve Your Email Change",
+			link:    "https://eurovision.example/approve-email-change?token=" + escaped,
+		},
+		{
+			name:    "account deletion confirmation",
+			send:    func(s *Service) error { return s.sendAccountDeletionConfirmEmail(user, token) },
+			to:      user.Email,
+			subject: "Confirm Your Account Deletion",
+			link:    "https://eurovision.example/confirm-account-deletion?token=" + escaped,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outbox := mailer.NewMemoryMailer()
+			s := &Service{mailer: outbox}
+
+			if err := tt.send(s); err != nil {
+				t.Fatalf("send: %v", err)
+			}
+
+			messages := outbox.Messages()
+			if len(messages) != 1 {
+				t.Fatalf("sent %d messages, want 1", len(messages))
+			}
+
+			msg := outbox.LastTo(tt.to)
+			if msg == nil {
+				t.Fatalf("nothing sent to %s, sent to %s", tt.to, messages[0].To)
+			}
+			if msg.Subject != tt.subject {
+				t.Errorf("subject = %q, want %q", msg.Subject, tt.subject)
+			}
+			if !strings.Contains(msg.Text, tt.link) {
+				t.Errorf("text doesn't contain %s:\n%s", tt.link, msg.Text)
+			}
+			if tt.html && !strings.Contains(msg.HTML, tt.link) {
+				t.Errorf("html doesn't contain %s", tt.link)
+			}
+		})
+	}
+}
+
+func TestAuthEmailsUseTheUsersLocale(t *testing.T) {
+	tests := []struct {
+		locale  string
+		subject string
+	}{
+		{"de", "Dein Anmeldelink"},
+		{"de-AT", "Dein Anmeldelink"},
+		{"fr", "Your Login Link"},
+		{"", "Your Login Link"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.locale, func(t *testing.T) {
+			outbox := mailer.NewMemoryMailer()
+			s := &Service{mailer: outbox}
+
+			user := &models.User{Email: "fan@example.com", Locale: tt.locale}
+			if err := s.sendMagicLinkEmail(user, "token"); err != nil {
+				t.Fatalf("send: %v", err)
+			}
+
+			if msg := outbox.LastTo(user.Email); msg == nil || msg.Subject != tt.subject {
+				t.Errorf("got %+v, want subject %q", msg, tt.subject)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SHA-1 hashes are split like the Have I Been Pwned range API: the first five
+// hex characters select a bucket and the other 35 are looked up inside it
+const breachedHashPrefixLen = 5
+
+// bundled hashes of well known breached passwords, keyed by prefix
+var bundledBreachedHashes = loadBundledBreachedHashes()
+
+/**
+ * reads data/breached_prefixes.txt, which has one PREFIX:SUFFIX line per
+ * breached password. They are the passwords ranked after the 30,000 in
+ * common_passwords.txt in zxcvbn's list of leaked passwords, so the two
+ * lists don't overlap.
+ */
+func loadBundledBreachedHashes() map[string]map[string]bool {
+	data, err := dataFS.ReadFile("data/breached_prefixes.txt")
+	if err != nil {
+		panic("missing breached password list")
+	}
+
+	hashes := map[string]map[string]bool{}
+	for _, line := range strings.Split(string(data), "\n") {
+		prefix, suffix, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			continue
+		}
+		if hashes[prefix] == nil {
+			hashes[prefix] = map[string]bool{}
+		}
+		hashes[prefix][suffix] = true
+	}
+	return hashes
+}
+
+/**
+ * warns when BREACHED_PASSWORDS_DIR isn't set, since the bundled list only
+ * covers a small share of breached passwords, and fails when it doesn't
+ * point at a directory
+ */
+func CheckBreachedPasswordsDir() error {
+	dir := os.Getenv("BREACHED_PASSWORDS_DIR")
+	if dir == "" {
+		logrus.Warn("BREACHED_PASSWORDS_DIR is not set, only the bundled breached password list is checked")
+		return nil
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("error reading BREACHED_PASSWORDS_DIR: %v", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("BREACHED_PASSWORDS_DIR %s is not a directory", dir)
+	}
+
+	return nil
+}
+
+/**
+ * reports whether the password appears in a known breach. The bundled list
+ * is always checked. BREACHED_PASSWORDS_DIR may point at a full offline copy
+ * of the Have I Been Pwned range files, one <PREFIX>.txt per prefix holding
+ * SUFFIX:COUNT lines, so only the bucket for this password is read.
+ */
+func isBreachedPassword(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:breachedHashPrefixLen], hash[breachedHashPrefixLen:]
+
+	if bundledBreachedHashes[prefix][suffix] {
+		return true
+	}
+
+	dir := os.Getenv("BREACHED_PASSWORDS_DIR")
+	if dir == "" {
+		return false
+	}
+
+	found, err := rangeFileContains(filepath.Join(dir, prefix+".txt"), suffix)
+	if err != nil {
+		// a missing bucket shouldn't block password changes
+		logrus.WithError(err).Warnf("Failed to read breached password range %s", prefix)
+		return false
+	}
+	return found
+}
+
+func rangeFileContains(path, suffix string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lineSuffix, _, _ := strings.Cut(scanner.Text(), ":")
+		if strings.EqualFold(strings.TrimSpace(lineSuffix), suffix) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBundledBreachedPasswords(t *testing.T) {
+	tests := []struct {
+		password string
+		breached bool
+	}{
+		// ranked after the common password list, and strong enough by the
+		// estimate alone
+		{"nightcrawler", true},
+		{"palantir", true},
+		{"calculator", true},
+		// in the common password list instead
+		{"password", false},
+		{"qwertyuiop", false},
+		// the bundled hashes are of the lowercase passwords
+		{"NightCrawler", false},
+		{"correct horse battery staple", false},
+	}
+
+	for _, tt := range tests {
+		if got := isBreachedPassword(tt.password); got != tt.breached {
+			t.Errorf("isBreachedPassword(%q) = %v, want %v", tt.password, got, tt.breached)
+		}
+	}
+
+	if EstimatePasswordStrength("nightcrawler", nil).Score < minPasswordScore {
+		t.Errorf("nightcrawler is rejected by the estimate, so doesn't show the breach list is needed")
+	}
+}
+
+func TestBundledListsDontOverlap(t *testing.T) {
+	for word := range rankedDictionaries[dictionaryCommon] {
+		sum := sha1.Sum([]byte(word))
+		hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+		if bundledBreachedHashes[hash[:breachedHashPrefixLen]][hash[breachedHashPrefixLen:]] {
+			t.Fatalf("%q is in both the common password list and the breached hashes", word)
+		}
+	}
+
+	if n := len(rankedDictionaries[dictionaryCommon]); n < 30000 {
+		t.Errorf("common password list has %d words, want 30000", n)
+	}
+}
+
+func TestBreachedPasswordsDir(t *testing.T) {
+	dir := t.TempDir()
+
+	// "kq8#Vz!p2Lw9" isn't in the bundled list
+	sum := sha1.Sum([]byte("kq8#Vz!p2Lw9"))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	rangeFile := "0018A45C4D1DEF81644B54AB7F969B88D65:1\r\n" + strings.ToLower(hash[5:]) + ":3\r\n"
+	if err := os.WriteFile(filepath.Join(dir, hash[:5]+".txt"), []byte(rangeFile), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if isBreachedPassword("kq8#Vz!p2Lw9") {
+		t.Fatalf("password is breached without BREACHED_PASSWORDS_DIR")
+	}
+
+	t.Setenv("BREACHED_PASSWORDS_DIR", dir)
+	if err := CheckBreachedPasswordsDir(); err != nil {
+		t.Fatalf("CheckBreachedPasswordsDir: %v", err)
+	}
+	if !isBreachedPassword("kq8#Vz!p2Lw9") {
+		t.Errorf("password in the range file isn't breached")
+	}
+	// a missing range file doesn't block the password
+	if isBreachedPassword("correct horse battery staple") {
+		t.Errorf("password without a range file is breached")
+	}
+
+	t.Setenv("BREACHED_PASSWORDS_DIR", filepath.Join(dir, hash[:5]+".txt"))
+	if err := CheckBreachedPasswordsDir(); err == nil {
+		t.Errorf("CheckBreachedPasswordsDir accepted a file")
+	}
+}
@@ -6,11 +6,18 @@ import (
 
 /*
  * StartCleanupJob starts a cleanup job that runs every 24 hours to remove
- * unconfirmed users that have not confirmed their email address within 24 hours.
+ * unconfirmed users that have not confirmed their email address within 24 hours,
+ * to delete accounts whose deletion grace period has ended, and to delete
+ * expired emailed tokens and sessions, and security events past their
+ * retention period.
  */
 func StartCleanupJob() {
 	ticker := time.NewTicker(24 * time.Hour)
 	for range ticker.C {
 		cleanupUnconfirmedUsers()
+		purgeDeletedAccounts()
+		purgeExpiredAuthTokens()
+		purgeExpiredSessions()
+		purgeOldSecurityEvents()
 	}
 }
@@ -0,0 +1,173 @@
+package auth
+
+import (
+	"errors"
+	"eurovision-api/db"
+	"eurovision-api/models"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// failed attempts before each further attempt must wait, doubling from one second
+	loginDelayThreshold = 3
+	maxLoginDelay       = 5 * time.Minute
+
+	// failed attempts before the account is locked
+	loginLockoutThreshold = 10
+	loginLockoutDuration  = 30 * time.Minute
+)
+
+var (
+	ErrAccountLocked  = errors.New("account temporarily locked after too many failed login attempts")
+	ErrLoginThrottled = errors.New("too many failed login attempts, try again later")
+)
+
+/*
+LoginBlockedError is returned when a login is refused because of earlier
+failures. It wraps ErrAccountLocked or ErrLoginThrottled and says how long the
+client should wait.
+*/
+type LoginBlockedError struct {
+	Reason     error
+	RetryAfter time.Duration
+}
+
+func (e *LoginBlockedError) Error() string {
+	return fmt.Sprintf("%s (retry after %s)", e.Reason, e.RetryAfter.Round(time.Second))
+}
+
+func (e *LoginBlockedError) Unwrap() error {
+	return e.Reason
+}
+
+/**
+ * returns how long a client must wait after the last failure before trying
+ * again, given the number of consecutive failed attempts
+ */
+func loginDelay(failedAttempts int) time.Duration {
+	if failedAttempts < loginDelayThreshold {
+		return 0
+	}
+
+	delay := time.Second << uint(failedAttempts-loginDelayThreshold)
+	if delay > maxLoginDelay || delay <= 0 {
+		return maxLoginDelay
+	}
+	return delay
+}
+
+/**
+ * refuses the login if the account is locked or the client has to wait
+ * before another attempt. An expired lock resets the failure counter.
+ */
+func checkLoginAllowed(user *models.User, now time.Time) error {
+	if user.IsLocked(now) {
+		return &LoginBlockedError{Reason: ErrAccountLocked, RetryAfter: user.LockedUntil.Sub(now)}
+	}
+
+	if user.LockedUntil != nil {
+		// the lock has run out, start counting again
+		if err := db.ResetFailedLogins(user.ID); err != nil {
+			return err
+		}
+		user.FailedLoginAttempts = 0
+		user.LockedUntil = nil
+		user.LastFailedLoginAt = nil
+		return nil
+	}
+
+	if user.LastFailedLoginAt != nil {
+		retryAt := user.LastFailedLoginAt.Add(loginDelay(user.FailedLoginAttempts))
+		if retryAt.After(now) {
+			return &LoginBlockedError{Reason: ErrLoginThrottled, RetryAfter: retryAt.Sub(now)}
+		}
+	}
+
+	return nil
+}
+
+/**
+ * counts a failed password or second factor attempt. Once the threshold is
+ * reached the account is locked and the owner is emailed an unlock link.
+ * Returns the error the login should fail with.
+ */
+func (s *Service) recordFailedLogin(user *models.User, failure error, client ClientInfo) error {
+	now := time.Now()
+
+	if err := db.RecordFailedLogin(user.ID, now); err != nil {
+		logrus.WithError(err).Errorf("Failed to record failed login for user %s", user.ID)
+		return failure
+	}
+
+	if user.FailedLoginAttempts+1 < loginLockoutThreshold {
+		return failure
+	}
+
+	lockedUntil := now.Add(loginLockoutDuration)
+
+	if err := db.LockUser(user.ID, lockedUntil); err != nil {
+		logrus.WithError(err).Errorf("Failed to lock user %s", user.ID)
+		return failure
+	}
+
+	logrus.Warnf("Locked user %s after %d failed login attempts", user.ID, user.FailedLoginAttempts+1)
+
+	recordSecurityEvent(models.SecurityEvent{
+		UserID:  user.ID,
+		Event:   EventAccountLocked,
+		Details: map[string]interface{}{"locked_until": lockedUntil},
+	}, client, nil)
+
+	unlockToken, err := issueAuthToken(user.ID, TokenPurposeUnlockAccount, loginLockoutDuration)
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to issue unlock token for user %s", user.ID)
+	} else if err := s.sendAccountLockedEmail(user, unlockToken, lockedUntil); err != nil {
+		logrus.WithError(err).Errorf("Failed to send unlock email to user %s", user.ID)
+	}
+
+	return &LoginBlockedError{Reason: ErrAccountLocked, RetryAfter: loginLockoutDuration}
+}
+
+/**
+ * clears the failure counter after a successful login
+ */
+func clearFailedLogins(user *models.User) {
+	if user.FailedLoginAttempts == 0 && user.LockedUntil == nil {
+		return
+	}
+
+	if err := db.ResetFailedLogins(user.ID); err != nil {
+		logrus.WithError(err).Errorf("Failed to reset failed logins for user %s", user.ID)
+	}
+}
+
+/**
+ * unlocks an account using the token from the lockout email
+ */
+func (s *Service) UnlockAccount(token string, client ClientInfo) error {
+	record, err := consumeAuthToken(token, TokenPurposeUnlockAccount)
+	if err != nil {
+		return err
+	}
+
+	if err := db.ResetFailedLogins(record.UserID); err != nil {
+		if err == db.ErrUserNotFound {
+			return ErrInvalidToken
+		}
+		return err
+	}
+
+	recordSecurityEvent(models.SecurityEvent{UserID: record.UserID, Event: EventAccountUnlocked}, client, nil)
+
+	return nil
+}
+
+/**
+ * unlocks an account on behalf of an admin
+ */
+func (s *Service) AdminUnlockAccount(userID string) error {
+	return db.ResetFailedLogins(userID)
+}
@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"eurovision-api/db"
+	"eurovision-api/models"
+
+	"github.com/sirupsen/logrus"
+)
+
+/**
+ * emails a one-time login link. Only confirmed, active accounts get one;
+ * other addresses are ignored so the response doesn't reveal whether an
+ * account exists.
+ */
+func (s *Service) RequestMagicLink(email string, client ClientInfo) error {
+	email = normalizeEmail(email)
+
+	if err := validateEmail(email); err != nil {
+		return ErrInvalidEmail
+	}
+
+	user, err := db.GetUserByEmail(email)
+	if err != nil {
+		logrus.Infof("Magic link requested for non-existent email: %s", email)
+		recordSecurityEvent(models.SecurityEvent{Email: email, Event: EventMagicLinkRequested}, client, ErrUserNotFound)
+		return nil
+	}
+
+	if !user.Confirmed || user.Disabled {
+		return nil
+	}
+
+	token, err := issueAuthToken(user.ID, TokenPurposeMagicLogin, magicLoginTokenTTL)
+	if err != nil {
+		return err
+	}
+
+	recordSecurityEvent(models.SecurityEvent{UserID: user.ID, Event: EventMagicLinkRequested}, client, nil)
+
+	return s.sendMagicLinkEmail(user, token)
+}
+
+/**
+ * exchanges a magic link token for a session. The link proves control of the
+ * inbox, the same as the unlock link, so it also clears failed logins. A
+ * second factor is still required when the account has 2FA enabled.
+ */
+func (s *Service) CompleteMagicLinkLogin(token string, client ClientInfo) (*LoginResult, error) {
+	user, result, err := s.completeMagicLinkLogin(token, client)
+	// unknown tokens can't be tied to an account, so aren't worth recording
+	if user != nil {
+		recordLogin(loginMethodMagicLink, "", user, client, result, err)
+	}
+	return result, err
+}
+
+func (s *Service) completeMagicLinkLogin(token string, client ClientInfo) (*models.User, *LoginResult, error) {
+	record, err := consumeAuthToken(token, TokenPurposeMagicLogin)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user, err := db.GetUserByID(record.UserID)
+	if err != nil {
+		return nil, nil, ErrInvalidToken
+	}
+
+	if user.Disabled {
+		return user, nil, ErrAccountDisabled
+	}
+
+	if user.PasswordResetRequired {
+		return user, nil, ErrPasswordResetRequired
+	}
+
+	if !user.TOTPEnabled {
+		clearFailedLogins(user)
+	}
+
+	result, err := s.completeLogin(user, client)
+	return user, result, err
+}
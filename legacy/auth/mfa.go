@@ -0,0 +1,283 @@
+package auth
+
+import (
+	"errors"
+	"eurovision-api/db"
+	"eurovision-api/models"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	mfaTokenTTL     = 5 * time.Minute
+	mfaTokenPurpose = "mfa_pending"
+)
+
+var (
+	ErrMFAAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	ErrMFANotEnabled     = errors.New("two-factor authentication is not enabled")
+	ErrMFANotEnrolling   = errors.New("no two-factor enrollment in progress")
+	ErrInvalidMFACode    = errors.New("invalid two-factor code")
+	ErrInvalidMFAToken   = errors.New("invalid or expired mfa token")
+)
+
+/*
+LoginResult is the outcome of a successful first login step. Token is set when
+the user is fully authenticated. When the account has 2FA enabled, MFAToken is
+set instead and must be exchanged with a TOTP or recovery code through
+CompleteMFALogin.
+*/
+type LoginResult struct {
+	Token    string
+	MFAToken string
+}
+
+type TOTPEnrollment struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauth_uri"`
+}
+
+/**
+ * starts a session and issues its JWT, or a short-lived mfa pending token
+ * when the user has 2FA enabled
+ */
+func (s *Service) completeLogin(user *models.User, client ClientInfo) (*LoginResult, error) {
+	if user.TOTPEnabled {
+		mfaToken, err := s.signMFAToken(user)
+		if err != nil {
+			return nil, err
+		}
+		return &LoginResult{MFAToken: mfaToken}, nil
+	}
+
+	token, err := s.startSession(user, client)
+	if err != nil {
+		return nil, err
+	}
+	return &LoginResult{Token: token}, nil
+}
+
+/**
+ * signs the intermediate token handed out between the password and code
+ * steps. AuthMiddleware rejects it because it carries a purpose.
+ */
+func (s *Service) signMFAToken(user *models.User) (string, error) {
+	return s.tokens.Issue(&Claims{
+		UserID:  user.ID,
+		Purpose: mfaTokenPurpose,
+	}, mfaTokenTTL)
+}
+
+/**
+ * exchanges an mfa pending token and a TOTP or recovery code for the full JWT
+ */
+func (s *Service) CompleteMFALogin(mfaToken, code, recoveryCode string, client ClientInfo) (string, error) {
+	user, token, err := s.completeMFALogin(mfaToken, code, recoveryCode, client)
+	// a bad mfa token can't be tied to an account, so isn't worth recording
+	if user != nil {
+		recordLogin(loginMethodMFA, "", user, client, &LoginResult{Token: token}, err)
+	}
+	return token, err
+}
+
+func (s *Service) completeMFALogin(mfaToken, code, recoveryCode string, client ClientInfo) (*models.User, string, error) {
+	claims, err := s.tokens.Parse(mfaToken)
+	if err != nil || claims.Purpose != mfaTokenPurpose {
+		return nil, "", ErrInvalidMFAToken
+	}
+
+	user, err := db.GetUserByID(claims.UserID)
+	if err != nil {
+		return nil, "", ErrInvalidMFAToken
+	}
+
+	if user.Disabled {
+		return user, "", ErrAccountDisabled
+	}
+
+	if err := checkLoginAllowed(user, time.Now()); err != nil {
+		return user, "", err
+	}
+
+	if err := s.verifySecondFactor(user, code, recoveryCode); err != nil {
+		if err == ErrInvalidMFACode {
+			return user, "", s.recordFailedLogin(user, err, client)
+		}
+		return user, "", err
+	}
+
+	clearFailedLogins(user)
+
+	token, err := s.startSession(user, client)
+	return user, token, err
+}
+
+/**
+ * checks a TOTP code or, if no code is given, a recovery code. Both are
+ * single use.
+ */
+func (s *Service) verifySecondFactor(user *models.User, code, recoveryCode string) error {
+	if !user.TOTPEnabled {
+		return ErrMFANotEnabled
+	}
+
+	if code != "" {
+		step, ok := validateTOTP(user.TOTPSecret, code, time.Now())
+		if !ok {
+			return ErrInvalidMFACode
+		}
+
+		fresh, err := db.MarkTOTPStepUsed(user.ID, step)
+		if err != nil {
+			return err
+		}
+		if !fresh {
+			return ErrInvalidMFACode
+		}
+		return nil
+	}
+
+	if recoveryCode != "" {
+		consumed, err := db.ConsumeRecoveryCode(user.ID, hashRecoveryCode(recoveryCode))
+		if err != nil {
+			return err
+		}
+		if !consumed {
+			return ErrInvalidMFACode
+		}
+		return nil
+	}
+
+	return ErrInvalidMFACode
+}
+
+/**
+ * starts 2FA enrollment by generating a secret. 2FA is not enabled until the
+ * user proves they can generate codes with VerifyTOTPEnrollment.
+ */
+func (s *Service) BeginTOTPEnrollment(userID string) (*TOTPEnrollment, error) {
+	user, err := db.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.TOTPEnabled {
+		return nil, ErrMFAAlreadyEnabled
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.SetPendingTOTPSecret(user.ID, secret); err != nil {
+		return nil, err
+	}
+
+	return &TOTPEnrollment{
+		Secret:     secret,
+		OTPAuthURI: totpURI(secret, user.Email),
+	}, nil
+}
+
+/**
+ * verifies the first code from the authenticator app, enables 2FA and returns
+ * the plaintext recovery codes. They are only ever shown this once.
+ */
+func (s *Service) VerifyTOTPEnrollment(userID, code string, client ClientInfo) ([]string, error) {
+	user, err := db.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.TOTPEnabled {
+		return nil, ErrMFAAlreadyEnabled
+	}
+
+	if user.TOTPPendingSecret == "" {
+		return nil, ErrMFANotEnrolling
+	}
+
+	step, ok := validateTOTP(user.TOTPPendingSecret, code, time.Now())
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.EnableTOTP(user.ID, hashes); err != nil {
+		return nil, err
+	}
+
+	if _, err := db.MarkTOTPStepUsed(user.ID, step); err != nil {
+		return nil, err
+	}
+
+	recordSecurityEvent(models.SecurityEvent{UserID: user.ID, Event: EventMFAEnabled}, client, nil)
+
+	return codes, nil
+}
+
+/**
+ * turns off 2FA. Requires the current password, when the account has one,
+ * and a valid TOTP or recovery code.
+ */
+func (s *Service) DisableTOTP(userID, password, code, recoveryCode string, client ClientInfo) error {
+	user, err := db.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+
+	if user.PasswordHash != "" {
+		if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+			recordSecurityEvent(models.SecurityEvent{UserID: user.ID, Event: EventMFADisabled}, client, ErrInvalidCredentials)
+			return ErrInvalidCredentials
+		}
+	}
+
+	if err := s.verifySecondFactor(user, code, recoveryCode); err != nil {
+		if err == ErrInvalidMFACode {
+			recordSecurityEvent(models.SecurityEvent{UserID: user.ID, Event: EventMFADisabled}, client, err)
+		}
+		return err
+	}
+
+	if err := db.DisableTOTP(user.ID); err != nil {
+		return err
+	}
+
+	recordSecurityEvent(models.SecurityEvent{UserID: user.ID, Event: EventMFADisabled}, client, nil)
+
+	return nil
+}
+
+/**
+ * replaces the user's recovery codes after verifying a current TOTP code
+ */
+func (s *Service) RegenerateRecoveryCodes(userID, code string, client ClientInfo) ([]string, error) {
+	user, err := db.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.verifySecondFactor(user, code, ""); err != nil {
+		return nil, err
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.ReplaceRecoveryCodes(user.ID, hashes); err != nil {
+		return nil, err
+	}
+
+	recordSecurityEvent(models.SecurityEvent{UserID: user.ID, Event: EventRecoveryCodesRegenerated}, client, nil)
+
+	return codes, nil
+}
@@ -3,84 +3,52 @@ package auth
 import (
 	"context"
 	"errors"
+	"eurovision-api/db"
+	"eurovision-api/models"
 	"net/http"
 	"strings"
-	"time"
 
 	"github.com/golang-jwt/jwt"
+	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 )
 
-var jwtSecret []byte
+var tokenIssuer *TokenIssuer
 
 // Claims represents the JWT claims structure
 type Claims struct {
 	UserID string `json:"user_id"`
+	Email  string `json:"email,omitempty"`
 	Role   string `json:"role,omitempty"`
+	// the session the token belongs to. Tokens issued before sessions were
+	// tracked don't have one
+	SessionID string `json:"sid,omitempty"`
+	// set on special purpose tokens, such as the mfa pending token, which
+	// must never be accepted as a session
+	Purpose string `json:"purpose,omitempty"`
 	jwt.StandardClaims
 }
 
 /**
- * initialize the JWT secret key. This should be called once at the start of the application.
+ * sets the issuer AuthMiddleware verifies tokens with. This should be called once at the start of the application.
  */
-func Initialize(secret string) {
-	jwtSecret = []byte(secret)
+func Initialize(issuer *TokenIssuer) {
+	tokenIssuer = issuer
 }
 
 /**
- * generate new JWT token for the given user ID and role. The token will expire in 24 hours.
- */
-func GenerateToken(userID, role string) (string, error) {
-	// set expiration to 24 hours
-	expirationTime := time.Now().Add(24 * time.Hour)
-
-	claims := &Claims{
-		UserID: userID,
-		Role:   role,
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expirationTime.Unix(),
-			IssuedAt:  time.Now().Unix(),
-		},
-	}
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtSecret)
-	if err != nil {
-		return "", err
-	}
-
-	return tokenString, nil
-}
-
-/**
- * parse the token string and validate it using the secret key. If the token is valid,
+ * parse the token string and validate it with the issuer's keys. If the token is valid,
  * return the claims. If the token is invalid, return an error.
  */
 func validateToken(tokenString string) (*Claims, error) {
-	claims := &Claims{}
-
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		// validate the signing method
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, errors.New("unexpected signing method")
-		}
-		return jwtSecret, nil
-	})
-
-	if err != nil {
-		return nil, err
-	}
-
-	if !token.Valid {
-		return nil, errors.New("invalid token")
-	}
-
-	return claims, nil
+	return tokenIssuer.Parse(tokenString)
 }
 
 /**
- * checks for a valid JWT token in the Authorization header. If the token is valid,
- * extract the user ID and role from the token and add it to the request context.
+ * checks for a valid JWT or personal access token in the Authorization header. If
+ * the token is valid and the account is still active, the user ID and current role
+ * are added to the request context. Personal access tokens are only accepted on
+ * routes wrapped with RequireScope, and their scopes are added to the context.
  */
 func AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -100,22 +68,169 @@ func AuthMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		claims, err := validateToken(parts[1])
+		var userID string
+		var claims *Claims
+		var accessToken *models.PersonalAccessToken
+
+		if strings.HasPrefix(parts[1], AccessTokenPrefix) {
+			token, err := validateAccessToken(parts[1])
+			if err != nil {
+				logrus.WithError(err).Error("Invalid access token")
+				returnGeneric401(w)
+				return
+			}
+
+			if !routeAcceptsAccessTokens(r) {
+				http.Error(w, "Personal access tokens cannot be used for this endpoint", http.StatusForbidden)
+				return
+			}
+
+			accessToken = token
+			userID = token.UserID
+		} else {
+			tokenClaims, err := validateToken(parts[1])
+			if err != nil {
+				logrus.WithError(err).Error("Invalid token")
+				returnGeneric401(w)
+				return
+			}
+
+			if tokenClaims.Purpose != "" {
+				logrus.Errorf("Rejected %s token used as a session", tokenClaims.Purpose)
+				returnGeneric401(w)
+				return
+			}
+
+			claims = tokenClaims
+			userID = tokenClaims.UserID
+		}
+
+		// look up the account so that disabled users and role changes take
+		// effect immediately instead of when the token expires
+		user, err := db.GetUserByID(userID)
 		if err != nil {
-			logrus.WithError(err).Error("Invalid token")
+			logrus.WithError(err).Error("Failed to load user for token")
+			returnGeneric401(w)
+			return
+		}
+
+		if user.Disabled {
+			logrus.Infof("Rejected token for disabled user %s", user.ID)
 			returnGeneric401(w)
 			return
 		}
 
+		// a forced password reset locks the account until the user resets it
+		if user.PasswordResetRequired {
+			logrus.Infof("Rejected token for user %s pending a password reset", user.ID)
+			returnGeneric401(w)
+			return
+		}
+
+		// tokens issued before a password or email change are revoked
+		if claims != nil && user.SessionsRevokedAt != nil && claims.IssuedAt < user.SessionsRevokedAt.Unix() {
+			logrus.Infof("Rejected revoked token for user %s", user.ID)
+			returnGeneric401(w)
+			return
+		}
+
+		// the session must not have been signed out
+		if claims != nil && claims.SessionID != "" {
+			if err := validateSession(claims.SessionID, user.ID); err != nil {
+				logrus.WithError(err).Infof("Rejected token for inactive session of user %s", user.ID)
+				returnGeneric401(w)
+				return
+			}
+		}
+
 		// add claims to request context
-		ctx := context.WithValue(r.Context(), "user_id", claims.UserID)
-		ctx = context.WithValue(ctx, "role", claims.Role)
+		ctx := context.WithValue(r.Context(), "user_id", user.ID)
+		ctx = context.WithValue(ctx, "role", user.EffectiveRole())
+		if accessToken != nil {
+			ctx = context.WithValue(ctx, "scopes", accessToken.Scopes)
+		}
+		if claims != nil && claims.SessionID != "" {
+			ctx = context.WithValue(ctx, "session_id", claims.SessionID)
+		}
 
 		// call the next handler with the enhanced context
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// a route handler that personal access tokens may call with the given scope
+type scopedHandler struct {
+	scope string
+	next  http.Handler
+}
+
+/**
+ * marks a route as usable with personal access tokens holding the given scope.
+ * JWT sessions are not restricted by scopes.
+ */
+func RequireScope(scope string, handler http.HandlerFunc) http.Handler {
+	return &scopedHandler{scope: scope, next: handler}
+}
+
+func (h *scopedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	scopes, isAccessToken := r.Context().Value("scopes").([]string)
+
+	if isAccessToken && !hasScope(scopes, h.scope) {
+		http.Error(w, "Token is missing the "+h.scope+" scope", http.StatusForbidden)
+		return
+	}
+
+	h.next.ServeHTTP(w, r)
+}
+
+/**
+ * personal access tokens are denied by default and only accepted on routes
+ * whose handler was registered through RequireScope
+ */
+func routeAcceptsAccessTokens(r *http.Request) bool {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return false
+	}
+
+	_, ok := route.GetHandler().(*scopedHandler)
+	return ok
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, granted := range scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * restricts access to users holding one of the given roles. Must be used after
+ * AuthMiddleware so the role is present in the request context.
+ */
+func RequireRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			role, err := GetUserRoleFromContext(r.Context())
+			if err != nil {
+				returnGeneric401(w)
+				return
+			}
+
+			for _, allowed := range roles {
+				if role == allowed {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		})
+	}
+}
+
 func returnGeneric401(w http.ResponseWriter) {
 	http.Error(w, "Unauthorized", http.StatusUnauthorized)
 }
@@ -143,3 +258,12 @@ func GetUserRoleFromContext(ctx context.Context) (string, error) {
 	}
 	return role, nil
 }
+
+/**
+ * extract the session ID from the request context. Returns an empty string
+ * for personal access tokens and tokens issued before sessions were tracked.
+ */
+func GetSessionIDFromContext(ctx context.Context) string {
+	sessionID, _ := ctx.Value("session_id").(string)
+	return sessionID
+}
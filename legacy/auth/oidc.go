@@ -0,0 +1,684 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"eurovision-api/db"
+	"eurovision-api/models"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	oidcStateTTL     = 10 * time.Minute
+	oidcHTTPTimeout  = 10 * time.Second
+	oidcJWKSCacheTTL = time.Hour
+
+	// ties a pending login to the browser that started it
+	OIDCLoginCookie = "oidc_login"
+)
+
+var (
+	ErrOIDCProviderNotFound = errors.New("unknown identity provider")
+	ErrOIDCInvalidState     = errors.New("invalid or expired login state")
+	ErrOIDCExchangeFailed   = errors.New("failed to exchange authorization code")
+	ErrOIDCInvalidIDToken   = errors.New("invalid id token")
+	ErrOIDCEmailUnverified  = errors.New("identity provider did not verify the email address")
+)
+
+var oidcHTTPClient = &http.Client{Timeout: oidcHTTPTimeout}
+
+/*
+oidcProvider holds the configuration for a single OpenID Connect provider.
+Providers are configured through the environment:
+
+	OIDC_PROVIDERS=google,mock
+	OIDC_GOOGLE_ISSUER=https://accounts.google.com
+	OIDC_GOOGLE_CLIENT_ID=...
+	OIDC_GOOGLE_CLIENT_SECRET=...
+	OIDC_GOOGLE_REDIRECT_URL=https://api.example.com/auth/oidc/google/callback
+	OIDC_GOOGLE_SCOPES=openid email profile   (optional)
+*/
+type oidcProvider struct {
+	name         string
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	scopes       []string
+
+	mu            sync.Mutex
+	discovery     *oidcDiscovery
+	keys          map[string]interface{}
+	keysFetchedAt time.Time
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	IDToken     string `json:"id_token"`
+	TokenType   string `json:"token_type"`
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// the verified identity returned by a provider
+type oidcIdentity struct {
+	Subject string
+	Email   string
+}
+
+/**
+ * reads the configured OIDC providers from the environment. Providers with
+ * incomplete configuration are skipped with a warning.
+ */
+func loadOIDCProviders() map[string]*oidcProvider {
+	providers := map[string]*oidcProvider{}
+
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		provider := &oidcProvider{
+			name:         name,
+			issuer:       strings.TrimSuffix(os.Getenv(prefix+"ISSUER"), "/"),
+			clientID:     os.Getenv(prefix + "CLIENT_ID"),
+			clientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			redirectURL:  os.Getenv(prefix + "REDIRECT_URL"),
+			scopes:       strings.Fields(os.Getenv(prefix + "SCOPES")),
+		}
+
+		if provider.issuer == "" || provider.clientID == "" || provider.redirectURL == "" {
+			logrus.Warnf("Skipping OIDC provider %s: ISSUER, CLIENT_ID and REDIRECT_URL are required", name)
+			continue
+		}
+
+		if len(provider.scopes) == 0 {
+			provider.scopes = []string{"openid", "email", "profile"}
+		}
+
+		providers[name] = provider
+		logrus.Infof("Configured OIDC provider %s (%s)", name, provider.issuer)
+	}
+
+	return providers
+}
+
+/**
+ * fetches and caches the provider's discovery document
+ */
+func (p *oidcProvider) getDiscovery() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var discovery oidcDiscovery
+	if err := getJSON(p.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, fmt.Errorf("error fetching discovery document for %s: %v", p.name, err)
+	}
+
+	if strings.TrimSuffix(discovery.Issuer, "/") != p.issuer {
+		return nil, fmt.Errorf("discovery issuer %s does not match configured issuer %s", discovery.Issuer, p.issuer)
+	}
+
+	p.discovery = &discovery
+	return p.discovery, nil
+}
+
+/**
+ * returns the provider's verification key with the given ID. The key set is
+ * refetched when it is stale or the key is unknown, which handles rotation.
+ */
+func (p *oidcProvider) getKey(kid string) (interface{}, error) {
+	discovery, err := p.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key := p.lookupKey(kid); key != nil && time.Since(p.keysFetchedAt) < oidcJWKSCacheTTL {
+		return key, nil
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := getJSON(discovery.JWKSURI, &jwks); err != nil {
+		return nil, fmt.Errorf("error fetching jwks for %s: %v", p.name, err)
+	}
+
+	keys := map[string]interface{}{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			logrus.WithError(err).Warnf("Ignoring unsupported key %s from %s", jwk.Kid, p.name)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+
+	p.keys = keys
+	p.keysFetchedAt = time.Now()
+
+	if key := p.lookupKey(kid); key != nil {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("no key %q published by %s", kid, p.name)
+}
+
+/**
+ * finds a cached key by ID. Tokens without a kid are accepted only when the
+ * provider publishes exactly one key.
+ */
+func (p *oidcProvider) lookupKey(kid string) interface{} {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key
+		}
+	}
+	return p.keys[kid]
+}
+
+/**
+ * converts a JWK into an RSA or ECDSA public key
+ */
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+	}
+}
+
+/**
+ * builds the authorization URL for the authorization code flow with PKCE
+ */
+func (p *oidcProvider) authorizationURL(state, nonce, codeVerifier string) (string, error) {
+	discovery, err := p.getDiscovery()
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(codeVerifier))
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.clientID)
+	params.Set("redirect_uri", p.redirectURL)
+	params.Set("scope", strings.Join(p.scopes, " "))
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	params.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+
+	return discovery.AuthorizationEndpoint + separator + params.Encode(), nil
+}
+
+/**
+ * exchanges the authorization code for tokens and returns the verified identity
+ */
+func (p *oidcProvider) exchange(code, codeVerifier, nonce string) (*oidcIdentity, error) {
+	discovery, err := p.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.redirectURL)
+	form.Set("client_id", p.clientID)
+	form.Set("code_verifier", codeVerifier)
+	if p.clientSecret != "" {
+		form.Set("client_secret", p.clientSecret)
+	}
+
+	resp, err := oidcHTTPClient.PostForm(discovery.TokenEndpoint, form)
+	if err != nil {
+		logrus.WithError(err).Errorf("Token request to %s failed", p.name)
+		return nil, ErrOIDCExchangeFailed
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		logrus.Errorf("Token endpoint for %s returned %d", p.name, resp.StatusCode)
+		return nil, ErrOIDCExchangeFailed
+	}
+
+	var tokens oidcTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		logrus.WithError(err).Errorf("Failed to decode token response from %s", p.name)
+		return nil, ErrOIDCExchangeFailed
+	}
+
+	if tokens.IDToken == "" {
+		logrus.Errorf("Token response from %s did not include an id token", p.name)
+		return nil, ErrOIDCExchangeFailed
+	}
+
+	return p.verifyIDToken(tokens.IDToken, nonce)
+}
+
+/**
+ * validates the id token signature, issuer, audience, expiry and nonce
+ */
+func (p *oidcProvider) verifyIDToken(idToken, nonce string) (*oidcIdentity, error) {
+	claims := jwt.MapClaims{}
+
+	_, err := jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+		default:
+			return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+		}
+		kid, _ := token.Header["kid"].(string)
+		return p.getKey(kid)
+	})
+	if err != nil {
+		logrus.WithError(err).Errorf("Invalid id token from %s", p.name)
+		return nil, ErrOIDCInvalidIDToken
+	}
+
+	if !claims.VerifyIssuer(p.issuer, true) {
+		return nil, ErrOIDCInvalidIDToken
+	}
+
+	if !claims.VerifyAudience(p.clientID, true) {
+		return nil, ErrOIDCInvalidIDToken
+	}
+
+	if claimNonce, _ := claims["nonce"].(string); claimNonce != nonce {
+		return nil, ErrOIDCInvalidIDToken
+	}
+
+	subject, _ := claims["sub"].(string)
+	email, _ := claims["email"].(string)
+	if subject == "" || email == "" {
+		return nil, ErrOIDCInvalidIDToken
+	}
+
+	// some providers send email_verified as a string
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		if !verified {
+			return nil, ErrOIDCEmailUnverified
+		}
+	case string:
+		if verified != "true" {
+			return nil, ErrOIDCEmailUnverified
+		}
+	default:
+		return nil, ErrOIDCEmailUnverified
+	}
+
+	return &oidcIdentity{
+		Subject: subject,
+		Email:   normalizeEmail(email),
+	}, nil
+}
+
+// pending authorization request, keyed by state. browserHash is the hash of
+// the login cookie set on the browser that started it.
+type oidcLoginState struct {
+	provider     string
+	nonce        string
+	codeVerifier string
+	browserHash  string
+	expiresAt    time.Time
+}
+
+/*
+oidcStateStore keeps pending logins in memory between the redirect to the
+provider and the callback. Entries are single use and expire after
+oidcStateTTL. Running several API instances requires sticky sessions.
+*/
+type oidcStateStore struct {
+	mu     sync.Mutex
+	states map[string]oidcLoginState
+}
+
+func newOIDCStateStore() *oidcStateStore {
+	return &oidcStateStore{states: map[string]oidcLoginState{}}
+}
+
+func (s *oidcStateStore) put(state string, value oidcLoginState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// drop expired entries so abandoned logins don't accumulate
+	now := time.Now()
+	for key, existing := range s.states {
+		if existing.expiresAt.Before(now) {
+			delete(s.states, key)
+		}
+	}
+
+	s.states[state] = value
+}
+
+func (s *oidcStateStore) take(state string) (oidcLoginState, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, ok := s.states[state]
+	delete(s.states, state)
+
+	if !ok || value.expiresAt.Before(time.Now()) {
+		return oidcLoginState{}, false
+	}
+
+	return value, true
+}
+
+/**
+ * generates a random URL-safe string with n bytes of entropy
+ */
+func randomURLSafeString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func getJSON(url string, target interface{}) error {
+	resp, err := oidcHTTPClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, url)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(target)
+}
+
+/**
+ * builds the login cookie for the provider's callback. It is scoped to the
+ * callback path and only marked Secure when the callback is served over https,
+ * so the local mock provider keeps working. A maxAge below zero clears it.
+ */
+func (p *oidcProvider) loginCookie(value string, maxAge int) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     OIDCLoginCookie,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		// the provider redirects back with a top level GET, which Lax allows
+		SameSite: http.SameSiteLaxMode,
+	}
+
+	if callback, err := url.Parse(p.redirectURL); err == nil {
+		if callback.Path != "" {
+			cookie.Path = callback.Path
+		}
+		cookie.Secure = callback.Scheme == "https"
+	}
+
+	return cookie
+}
+
+/**
+ * starts an OIDC login with the named provider. Returns the URL the user
+ * should be redirected to and a cookie to set on their browser, which must
+ * come back with the callback for the login to complete.
+ */
+func (s *Service) BeginOIDCLogin(providerName string) (string, *http.Cookie, error) {
+	provider, ok := s.oidcProviders[providerName]
+	if !ok {
+		return "", nil, ErrOIDCProviderNotFound
+	}
+
+	state, err := randomURLSafeString(32)
+	if err != nil {
+		return "", nil, err
+	}
+	nonce, err := randomURLSafeString(32)
+	if err != nil {
+		return "", nil, err
+	}
+	codeVerifier, err := randomURLSafeString(48)
+	if err != nil {
+		return "", nil, err
+	}
+	browserSecret, err := randomURLSafeString(32)
+	if err != nil {
+		return "", nil, err
+	}
+
+	authURL, err := provider.authorizationURL(state, nonce, codeVerifier)
+	if err != nil {
+		return "", nil, err
+	}
+
+	s.oidcStates.put(state, oidcLoginState{
+		provider:     providerName,
+		nonce:        nonce,
+		codeVerifier: codeVerifier,
+		browserHash:  hashAuthToken(browserSecret),
+		expiresAt:    time.Now().Add(oidcStateTTL),
+	})
+
+	return authURL, provider.loginCookie(browserSecret, int(oidcStateTTL.Seconds())), nil
+}
+
+/**
+ * returns a cookie that clears the provider's login cookie, or nil for an
+ * unknown provider
+ */
+func (s *Service) ClearOIDCLoginCookie(providerName string) *http.Cookie {
+	provider, ok := s.oidcProviders[providerName]
+	if !ok {
+		return nil
+	}
+	return provider.loginCookie("", -1)
+}
+
+/**
+ * completes an OIDC login. browserSecret is the login cookie sent with the
+ * callback, which must match the one set when the login began so a login
+ * started by someone else can't be completed in this browser. The provider
+ * identity is linked to an existing user by verified email, or a new
+ * confirmed user is created. Returns the API's normal JWT, or an mfa pending
+ * token if the user has 2FA enabled.
+ */
+func (s *Service) CompleteOIDCLogin(providerName, state, code, browserSecret string, client ClientInfo) (*LoginResult, error) {
+	user, result, err := s.completeOIDCLogin(providerName, state, code, browserSecret, client)
+	// failures before the identity is resolved can't be tied to an account
+	if user != nil {
+		recordLogin(loginMethodOIDC, "", user, client, result, err)
+	}
+	return result, err
+}
+
+func (s *Service) completeOIDCLogin(providerName, state, code, browserSecret string, client ClientInfo) (*models.User, *LoginResult, error) {
+	provider, ok := s.oidcProviders[providerName]
+	if !ok {
+		return nil, nil, ErrOIDCProviderNotFound
+	}
+
+	pending, ok := s.oidcStates.take(state)
+	if !ok || pending.provider != providerName {
+		return nil, nil, ErrOIDCInvalidState
+	}
+
+	if browserSecret == "" || subtle.ConstantTimeCompare([]byte(hashAuthToken(browserSecret)), []byte(pending.browserHash)) != 1 {
+		return nil, nil, ErrOIDCInvalidState
+	}
+
+	identity, err := provider.exchange(code, pending.codeVerifier, pending.nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user, err := s.findOrCreateOIDCUser(providerName, identity)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if user.Disabled {
+		return user, nil, ErrAccountDisabled
+	}
+
+	if user.PasswordResetRequired {
+		return user, nil, ErrPasswordResetRequired
+	}
+
+	result, err := s.completeLogin(user, client)
+	return user, result, err
+}
+
+/**
+ * resolves the local user for a provider identity, linking or creating the
+ * account when the identity is seen for the first time
+ */
+func (s *Service) findOrCreateOIDCUser(providerName string, identity *oidcIdentity) (*models.User, error) {
+	linked, err := db.GetIdentity(providerName, identity.Subject)
+	if err != nil {
+		return nil, err
+	}
+
+	if linked != nil {
+		return db.GetUserByID(linked.UserID)
+	}
+
+	user, err := db.GetUserByEmail(identity.Email)
+	if err != nil && err != db.ErrUserNotFound {
+		return nil, err
+	}
+
+	// the lookup ignores case, but never link to an account whose address
+	// differs by more than that
+	if user != nil && !strings.EqualFold(user.Email, identity.Email) {
+		return nil, fmt.Errorf("user %s matched email %s", user.ID, identity.Email)
+	}
+
+	if user == nil {
+		// no account with this email yet, the provider verified it so the
+		// new account is confirmed straight away
+		user = &models.User{
+			ID:        uuid.New().String(),
+			Email:     identity.Email,
+			Role:      models.RoleUser,
+			Confirmed: true,
+			CreatedAt: time.Now(),
+		}
+
+		if err := db.CreateUser(user); err != nil {
+			return nil, err
+		}
+
+		logrus.Infof("Created user %s from %s login", user.ID, providerName)
+	} else if !user.Confirmed {
+		// the provider verified ownership of the email
+		if err := db.ConfirmUserByID(user.ID); err != nil {
+			return nil, err
+		}
+		user.Confirmed = true
+	}
+
+	err = db.CreateIdentity(&models.UserIdentity{
+		ID:        uuid.New().String(),
+		UserID:    user.ID,
+		Provider:  providerName,
+		Subject:   identity.Subject,
+		Email:     identity.Email,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logrus.Infof("Linked %s identity to user %s", providerName, user.ID)
+
+	return user, nil
+}
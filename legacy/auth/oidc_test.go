@@ -0,0 +1,436 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"eurovision-api/db"
+	"eurovision-api/mailer"
+	"eurovision-api/models"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+)
+
+const (
+	mockOIDCClientID     = "eurovision-api"
+	mockOIDCClientSecret = "mock-secret"
+	mockOIDCRedirectURL  = "http://localhost:8080/auth/oidc/mock/callback"
+	mockOIDCKeyID        = "mock-key"
+)
+
+// an authorization the mock provider granted, redeemable once at the token
+// endpoint with the matching PKCE verifier
+type mockOIDCGrant struct {
+	challenge string
+	claims    jwt.MapClaims
+}
+
+/*
+mockOIDCProvider is an OpenID Connect provider served by httptest, with a
+discovery document, a JWKS holding one RSA key and a token endpoint that
+checks the client credentials, redirect URI and PKCE verifier.
+*/
+type mockOIDCProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu     sync.Mutex
+	grants map[string]mockOIDCGrant
+}
+
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &mockOIDCProvider{key: key, grants: map[string]mockOIDCGrant{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/jwks", p.jwks)
+	mux.HandleFunc("/token", p.token)
+
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+
+	return p
+}
+
+func (p *mockOIDCProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(oidcDiscovery{
+		Issuer:                p.server.URL,
+		AuthorizationEndpoint: p.server.URL + "/authorize",
+		TokenEndpoint:         p.server.URL + "/token",
+		JWKSURI:               p.server.URL + "/jwks",
+	})
+}
+
+func (p *mockOIDCProvider) jwks(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string][]jsonWebKey{
+		"keys": {{
+			Kty: "RSA",
+			Kid: mockOIDCKeyID,
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+		}},
+	})
+}
+
+func (p *mockOIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid_request", http.StatusBadRequest)
+		return
+	}
+
+	if r.PostForm.Get("grant_type") != "authorization_code" ||
+		r.PostForm.Get("client_id") != mockOIDCClientID ||
+		r.PostForm.Get("client_secret") != mockOIDCClientSecret ||
+		r.PostForm.Get("redirect_uri") != mockOIDCRedirectURL {
+		http.Error(w, "invalid_client", http.StatusUnauthorized)
+		return
+	}
+
+	p.mu.Lock()
+	grant, ok := p.grants[r.PostForm.Get("code")]
+	delete(p.grants, r.PostForm.Get("code"))
+	p.mu.Unlock()
+
+	if !ok || pkceChallenge(r.PostForm.Get("code_verifier")) != grant.challenge {
+		http.Error(w, "invalid_grant", http.StatusBadRequest)
+		return
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, grant.claims)
+	token.Header["kid"] = mockOIDCKeyID
+	idToken, err := token.SignedString(p.key)
+	if err != nil {
+		http.Error(w, "server_error", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(oidcTokenResponse{AccessToken: "mock-access-token", IDToken: idToken, TokenType: "Bearer"})
+}
+
+/**
+ * the provider's side of the redirect: checks the authorization request and
+ * grants a code for an id token with the claims. Claims the test leaves out
+ * are filled from the request. editRequest can tamper with the request before
+ * the provider sees it.
+ */
+func (p *mockOIDCProvider) authorize(t *testing.T, authURL string, claims jwt.MapClaims, editRequest func(url.Values)) (string, string) {
+	t.Helper()
+
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("invalid authorization url: %v", err)
+	}
+	query := parsed.Query()
+	if editRequest != nil {
+		editRequest(query)
+	}
+
+	if query.Get("response_type") != "code" || query.Get("code_challenge_method") != "S256" {
+		t.Fatalf("authorization request isn't a PKCE code flow: %s", authURL)
+	}
+	if query.Get("client_id") != mockOIDCClientID || query.Get("redirect_uri") != mockOIDCRedirectURL {
+		t.Fatalf("authorization request for the wrong client: %s", authURL)
+	}
+
+	defaults := jwt.MapClaims{
+		"iss":   p.server.URL,
+		"aud":   mockOIDCClientID,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"nonce": query.Get("nonce"),
+	}
+	for name, value := range defaults {
+		if _, ok := claims[name]; !ok {
+			claims[name] = value
+		}
+	}
+
+	code := uuid.New().String()
+	p.mu.Lock()
+	p.grants[code] = mockOIDCGrant{challenge: query.Get("code_challenge"), claims: claims}
+	p.mu.Unlock()
+
+	return query.Get("state"), code
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+/**
+ * builds a service whose only OIDC provider is the mock, named "mock"
+ */
+func (p *mockOIDCProvider) service() *Service {
+	return &Service{
+		mailer: mailer.NewMemoryMailer(),
+		oidcProviders: map[string]*oidcProvider{
+			"mock": {
+				name:         "mock",
+				issuer:       p.server.URL,
+				clientID:     mockOIDCClientID,
+				clientSecret: mockOIDCClientSecret,
+				redirectURL:  mockOIDCRedirectURL,
+				scopes:       []string{"openid", "email"},
+			},
+		},
+		oidcStates: newOIDCStateStore(),
+	}
+}
+
+func verifiedClaims(email string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"sub":            uuid.New().String(),
+		"email":          email,
+		"email_verified": true,
+	}
+}
+
+func TestBeginOIDCLogin(t *testing.T) {
+	s := newMockOIDCProvider(t).service()
+
+	if _, _, err := s.BeginOIDCLogin("unknown"); err != ErrOIDCProviderNotFound {
+		t.Errorf("unknown provider = %v, want %v", err, ErrOIDCProviderNotFound)
+	}
+
+	authURL, cookie, err := s.BeginOIDCLogin("mock")
+	if err != nil {
+		t.Fatalf("BeginOIDCLogin: %v", err)
+	}
+
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := parsed.Query()
+	for _, param := range []string{"state", "nonce", "code_challenge"} {
+		if query.Get(param) == "" {
+			t.Errorf("authorization url has no %s", param)
+		}
+	}
+	if query.Get("scope") != "openid email" {
+		t.Errorf("scope = %q", query.Get("scope"))
+	}
+
+	if cookie.Name != OIDCLoginCookie || cookie.Value == "" {
+		t.Fatalf("login cookie = %+v", cookie)
+	}
+	if !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode || cookie.Path != "/auth/oidc/mock/callback" {
+		t.Errorf("login cookie attributes = %+v", cookie)
+	}
+	// the mock's callback is plain http
+	if cookie.Secure {
+		t.Errorf("login cookie is Secure for an http callback")
+	}
+
+	if cleared := s.ClearOIDCLoginCookie("mock"); cleared == nil || cleared.MaxAge >= 0 {
+		t.Errorf("cleared cookie = %+v", cleared)
+	}
+}
+
+// what the browser brings back to the callback
+type oidcCallback struct {
+	state  string
+	code   string
+	cookie string
+}
+
+func TestCompleteOIDCLoginRejects(t *testing.T) {
+	mock := newMockOIDCProvider(t)
+
+	tests := []struct {
+		name string
+		// changes the id token claims the provider issues
+		claims func(jwt.MapClaims)
+		// tampers with the authorization request on its way to the provider
+		request func(url.Values)
+		// tampers with the callback on its way back
+		callback func(*oidcCallback)
+		err      error
+	}{
+		{name: "unknown state", callback: func(c *oidcCallback) { c.state = "forged" }, err: ErrOIDCInvalidState},
+		{name: "missing browser cookie", callback: func(c *oidcCallback) { c.cookie = "" }, err: ErrOIDCInvalidState},
+		{name: "cookie from another browser", callback: func(c *oidcCallback) { c.cookie = "other-browser" }, err: ErrOIDCInvalidState},
+		{name: "code never issued", callback: func(c *oidcCallback) { c.code = "forged" }, err: ErrOIDCExchangeFailed},
+		{
+			name:    "pkce verifier mismatch",
+			request: func(q url.Values) { q.Set("code_challenge", pkceChallenge("attacker verifier")) },
+			err:     ErrOIDCExchangeFailed,
+		},
+		{name: "nonce mismatch", request: func(q url.Values) { q.Set("nonce", "replayed") }, err: ErrOIDCInvalidIDToken},
+		{name: "email not verified", claims: func(c jwt.MapClaims) { c["email_verified"] = false }, err: ErrOIDCEmailUnverified},
+		{name: "email verified as string false", claims: func(c jwt.MapClaims) { c["email_verified"] = "false" }, err: ErrOIDCEmailUnverified},
+		{name: "email verification missing", claims: func(c jwt.MapClaims) { delete(c, "email_verified") }, err: ErrOIDCEmailUnverified},
+		{name: "email missing", claims: func(c jwt.MapClaims) { delete(c, "email") }, err: ErrOIDCInvalidIDToken},
+		{name: "wrong audience", claims: func(c jwt.MapClaims) { c["aud"] = "another-client" }, err: ErrOIDCInvalidIDToken},
+		{name: "wrong issuer", claims: func(c jwt.MapClaims) { c["iss"] = "https://evil.example" }, err: ErrOIDCInvalidIDToken},
+		{name: "expired", claims: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() }, err: ErrOIDCInvalidIDToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := mock.service()
+
+			authURL, cookie, err := s.BeginOIDCLogin("mock")
+			if err != nil {
+				t.Fatalf("BeginOIDCLogin: %v", err)
+			}
+
+			claims := verifiedClaims("fan@example.com")
+			if tt.claims != nil {
+				tt.claims(claims)
+			}
+			state, code := mock.authorize(t, authURL, claims, tt.request)
+
+			callback := oidcCallback{state: state, code: code, cookie: cookie.Value}
+			if tt.callback != nil {
+				tt.callback(&callback)
+			}
+
+			_, err = s.CompleteOIDCLogin("mock", callback.state, callback.code, callback.cookie, ClientInfo{})
+			if err != tt.err {
+				t.Errorf("CompleteOIDCLogin = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestCompleteOIDCLoginStateIsSingleUse(t *testing.T) {
+	mock := newMockOIDCProvider(t)
+	s := mock.service()
+
+	authURL, cookie, err := s.BeginOIDCLogin("mock")
+	if err != nil {
+		t.Fatalf("BeginOIDCLogin: %v", err)
+	}
+	claims := verifiedClaims("fan@example.com")
+	claims["email_verified"] = false
+	state, code := mock.authorize(t, authURL, claims, nil)
+
+	if _, err := s.CompleteOIDCLogin("mock", state, code, cookie.Value, ClientInfo{}); err != ErrOIDCEmailUnverified {
+		t.Fatalf("first callback = %v, want %v", err, ErrOIDCEmailUnverified)
+	}
+	if _, err := s.CompleteOIDCLogin("mock", state, code, cookie.Value, ClientInfo{}); err != ErrOIDCInvalidState {
+		t.Errorf("replayed callback = %v, want %v", err, ErrOIDCInvalidState)
+	}
+}
+
+/**
+ * runs a full login through the mock provider with a service that can issue
+ * sessions
+ */
+func completeMockOIDCLogin(t *testing.T, mock *mockOIDCProvider, claims jwt.MapClaims) *LoginResult {
+	t.Helper()
+
+	t.Setenv("JWT_SECRET", "oidc-test-secret")
+	tokens, err := NewTokenIssuerFromEnv()
+	if err != nil {
+		t.Fatalf("NewTokenIssuerFromEnv: %v", err)
+	}
+	s := mock.service()
+	s.tokens = tokens
+
+	authURL, cookie, err := s.BeginOIDCLogin("mock")
+	if err != nil {
+		t.Fatalf("BeginOIDCLogin: %v", err)
+	}
+	state, code := mock.authorize(t, authURL, claims, nil)
+
+	result, err := s.CompleteOIDCLogin("mock", state, code, cookie.Value, ClientInfo{})
+	if err != nil {
+		t.Fatalf("CompleteOIDCLogin: %v", err)
+	}
+	if result.Token == "" {
+		t.Fatalf("login returned no session token")
+	}
+	return result
+}
+
+func TestCompleteOIDCLoginLinksExistingUser(t *testing.T) {
+	requireES(t)
+	mock := newMockOIDCProvider(t)
+
+	// registered but never confirmed; the provider vouches for the address
+	user := &models.User{
+		ID:        uuid.New().String(),
+		Email:     "oidc-" + uuid.New().String() + "@example.com",
+		Role:      models.RoleUser,
+		CreatedAt: time.Now(),
+	}
+	if err := db.CreateUser(user); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	t.Cleanup(func() { db.DeleteUserCascade(user.ID) })
+
+	claims := verifiedClaims(strings.ToUpper(user.Email))
+	completeMockOIDCLogin(t, mock, claims)
+
+	linked, err := db.GetIdentity("mock", claims["sub"].(string))
+	if err != nil || linked == nil {
+		t.Fatalf("GetIdentity = %v, %v", linked, err)
+	}
+	if linked.UserID != user.ID {
+		t.Errorf("identity linked to %s, want the existing user %s", linked.UserID, user.ID)
+	}
+
+	current, err := db.GetUserByID(user.ID)
+	if err != nil {
+		t.Fatalf("GetUserByID: %v", err)
+	}
+	if !current.Confirmed {
+		t.Errorf("linked user isn't confirmed")
+	}
+}
+
+func TestCompleteOIDCLoginCreatesConfirmedUser(t *testing.T) {
+	requireES(t)
+	mock := newMockOIDCProvider(t)
+
+	email := "oidc-" + uuid.New().String() + "@example.com"
+	claims := verifiedClaims(email)
+	completeMockOIDCLogin(t, mock, claims)
+
+	user, err := db.GetUserByEmail(email)
+	if err != nil {
+		t.Fatalf("GetUserByEmail: %v", err)
+	}
+	t.Cleanup(func() { db.DeleteUserCascade(user.ID) })
+
+	if !user.Confirmed || user.PasswordHash != "" {
+		t.Errorf("created user confirmed %v with password %v, want confirmed and passwordless",
+			user.Confirmed, user.PasswordHash != "")
+	}
+
+	linked, err := db.GetIdentity("mock", claims["sub"].(string))
+	if err != nil || linked == nil || linked.UserID != user.ID {
+		t.Fatalf("GetIdentity = %v, %v, want a link to %s", linked, err, user.ID)
+	}
+
+	// the subject keeps resolving to the account even if the email changes
+	again := verifiedClaims("changed-" + email)
+	again["sub"] = claims["sub"]
+	completeMockOIDCLogin(t, mock, again)
+
+	if _, err := db.GetUserByEmail("changed-" + email); err != db.ErrUserNotFound {
+		t.Errorf("second login created another user: %v", err)
+	}
+}
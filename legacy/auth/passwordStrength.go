@@ -0,0 +1,613 @@
+package auth
+
+import (
+	"embed"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+//go:embed data
+var dataFS embed.FS
+
+// scores follow zxcvbn: 0 is guessable in under a thousand attempts and 4
+// needs more than ten billion
+const (
+	minPasswordScore = 3
+
+	bruteforceCardinality = 10
+	minSubmatchGuesses    = 50
+	minYearSpace          = 20
+)
+
+// where a dictionary match was found, used to pick the feedback message
+const (
+	dictionaryCommon     = "common_passwords"
+	dictionaryEurovision = "eurovision"
+	dictionaryUserInputs = "user_inputs"
+)
+
+var (
+	scoreThresholds = []float64{1e3, 1e6, 1e8, 1e10}
+
+	keyboardRows = []string{"1234567890", "qwertyuiop", "asdfghjkl", "zxcvbnm"}
+
+	leetSubstitutions = map[rune][]rune{
+		'4': {'a'}, '@': {'a'}, '8': {'b'}, '(': {'c'}, '3': {'e'},
+		'6': {'g'}, '1': {'i', 'l'}, '!': {'i'}, '|': {'i', 'l'},
+		'0': {'o'}, '$': {'s'}, '5': {'s'}, '7': {'t'}, '+': {'t'},
+		'2': {'z'},
+	}
+
+	rankedDictionaries = map[string]map[string]int{
+		dictionaryCommon:     loadRankedWords("data/common_passwords.txt"),
+		dictionaryEurovision: loadRankedWords("data/eurovision_words.txt"),
+	}
+)
+
+/*
+PasswordStrength is the estimated resistance of a password to guessing, with
+feedback to show the user when it is too weak.
+*/
+type PasswordStrength struct {
+	Score        int      `json:"score"`
+	GuessesLog10 float64  `json:"guesses_log10"`
+	Warning      string   `json:"warning,omitempty"`
+	Suggestions  []string `json:"suggestions,omitempty"`
+}
+
+// a part of the password recognised as a guessable pattern
+type passwordMatch struct {
+	pattern    string
+	start, end int
+	token      string
+	guesses    float64
+
+	dictionary string
+	rank       int
+	reversed   bool
+	leet       bool
+	uppercase  bool
+}
+
+/**
+ * reads a word list with one word per line, most common first
+ */
+func loadRankedWords(path string) map[string]int {
+	data, err := dataFS.ReadFile(path)
+	if err != nil {
+		panic("missing password word list " + path)
+	}
+
+	words := map[string]int{}
+	for _, line := range strings.Split(string(data), "\n") {
+		word := strings.TrimSpace(line)
+		if word == "" {
+			continue
+		}
+		if _, seen := words[word]; !seen {
+			words[word] = len(words) + 1
+		}
+	}
+	return words
+}
+
+/**
+ * builds a dictionary from account details like the email address, which an
+ * attacker targeting the account would try first
+ */
+func userInputDictionary(userInputs []string) map[string]int {
+	words := map[string]int{}
+	add := func(word string) {
+		word = strings.ToLower(word)
+		if len([]rune(word)) < 3 {
+			return
+		}
+		if _, seen := words[word]; !seen {
+			words[word] = len(words) + 1
+		}
+	}
+
+	for _, input := range userInputs {
+		local, domain, _ := strings.Cut(input, "@")
+		add(local)
+		for _, part := range strings.FieldsFunc(local, isNotAlphanumeric) {
+			add(part)
+		}
+		if domain != "" {
+			add(strings.Split(domain, ".")[0])
+		}
+	}
+	return words
+}
+
+func isNotAlphanumeric(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+/**
+ * estimates how many guesses an attacker needs for the password, zxcvbn
+ * style: the password is split into dictionary words, sequences, repeats,
+ * keyboard rows, years and bruteforced runs, and the cheapest split wins.
+ */
+func EstimatePasswordStrength(password string, userInputs []string) PasswordStrength {
+	runes := []rune(password)
+	if len(runes) == 0 {
+		return PasswordStrength{Score: 0, Warning: "Enter a password"}
+	}
+
+	matches := findPasswordMatches(runes, userInputDictionary(userInputs))
+	guesses, sequence := mostGuessableSequence(runes, matches)
+
+	strength := PasswordStrength{
+		Score:        scoreForGuesses(guesses),
+		GuessesLog10: math.Round(math.Log10(guesses)*100) / 100,
+	}
+	strength.Warning, strength.Suggestions = passwordFeedback(strength.Score, sequence)
+
+	return strength
+}
+
+func scoreForGuesses(guesses float64) int {
+	for score, threshold := range scoreThresholds {
+		if guesses < threshold {
+			return score
+		}
+	}
+	return len(scoreThresholds)
+}
+
+func findPasswordMatches(runes []rune, userWords map[string]int) []passwordMatch {
+	dictionaries := map[string]map[string]int{dictionaryUserInputs: userWords}
+	for name, words := range rankedDictionaries {
+		dictionaries[name] = words
+	}
+
+	var matches []passwordMatch
+	matches = append(matches, dictionaryMatches(runes, dictionaries)...)
+	matches = append(matches, sequenceMatches(runes)...)
+	matches = append(matches, repeatMatches(runes)...)
+	matches = append(matches, keyboardMatches(runes)...)
+	matches = append(matches, yearMatches(runes)...)
+	return matches
+}
+
+/**
+ * finds dictionary words, including reversed words and words written with
+ * l33t substitutions like p@ssw0rd
+ */
+func dictionaryMatches(runes []rune, dictionaries map[string]map[string]int) []passwordMatch {
+	lower := []rune(strings.ToLower(string(runes)))
+	var matches []passwordMatch
+
+	for i := 0; i < len(lower); i++ {
+		for j := i + 1; j <= len(lower); j++ {
+			token := string(runes[i:j])
+			candidate := lower[i:j]
+
+			for _, variant := range unleetVariants(candidate) {
+				leet := string(variant) != string(candidate)
+				word := string(variant)
+				reversedWord := reverseString(word)
+
+				for name, words := range dictionaries {
+					if rank, ok := words[word]; ok {
+						matches = append(matches, newDictionaryMatch(i, j, token, name, rank, false, leet))
+					}
+					if reversedWord != word {
+						if rank, ok := words[reversedWord]; ok {
+							matches = append(matches, newDictionaryMatch(i, j, token, name, rank, true, leet))
+						}
+					}
+				}
+			}
+		}
+	}
+	return matches
+}
+
+func newDictionaryMatch(start, end int, token, dictionary string, rank int, reversed, leet bool) passwordMatch {
+	match := passwordMatch{
+		pattern:    "dictionary",
+		start:      start,
+		end:        end,
+		token:      token,
+		dictionary: dictionary,
+		rank:       rank,
+		reversed:   reversed,
+		leet:       leet,
+		uppercase:  strings.ToLower(token) != token,
+	}
+
+	match.guesses = float64(rank) * uppercaseVariations(token)
+	if leet {
+		match.guesses *= 2
+	}
+	if reversed {
+		match.guesses *= 2
+	}
+	return match
+}
+
+/**
+ * counts the ways the word's capitalisation could have been chosen. All
+ * lowercase, all uppercase and a capitalised first letter are cheap to try.
+ */
+func uppercaseVariations(token string) float64 {
+	if strings.ToLower(token) == token {
+		return 1
+	}
+
+	runes := []rune(token)
+	rest := string(runes[1:])
+	if strings.ToUpper(token) == token || (unicode.IsUpper(runes[0]) && strings.ToLower(rest) == rest) {
+		return 2
+	}
+
+	upper, lower := 0, 0
+	for _, r := range runes {
+		if unicode.IsUpper(r) {
+			upper++
+		} else if unicode.IsLower(r) {
+			lower++
+		}
+	}
+
+	variations := 0.0
+	for i := 1; i <= min(upper, lower); i++ {
+		variations += binomial(upper+lower, i)
+	}
+	return math.Max(variations, 1)
+}
+
+func binomial(n, k int) float64 {
+	result := 1.0
+	for i := 1; i <= k; i++ {
+		result = result * float64(n-k+i) / float64(i)
+	}
+	return result
+}
+
+/**
+ * returns the word with l33t characters replaced by the letters they stand
+ * for. Characters with two readings produce one variant per reading.
+ */
+func unleetVariants(word []rune) [][]rune {
+	variants := [][]rune{make([]rune, 0, len(word))}
+	for _, r := range word {
+		letters, ok := leetSubstitutions[r]
+		if !ok {
+			letters = []rune{r}
+		}
+
+		var next [][]rune
+		for _, variant := range variants {
+			for _, letter := range letters {
+				next = append(next, append(append([]rune{}, variant...), letter))
+			}
+		}
+		// ambiguous characters can multiply quickly, the first readings are enough
+		if len(next) > 8 {
+			next = next[:8]
+		}
+		variants = next
+	}
+	return variants
+}
+
+func reverseString(s string) string {
+	runes := []rune(s)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}
+
+/**
+ * finds runs of at least three consecutive characters like abc or 9876
+ */
+func sequenceMatches(runes []rune) []passwordMatch {
+	var matches []passwordMatch
+
+	for i := 0; i < len(runes)-2; {
+		delta := runes[i+1] - runes[i]
+		if delta != 1 && delta != -1 {
+			i++
+			continue
+		}
+
+		j := i + 1
+		for j+1 < len(runes) && runes[j+1]-runes[j] == delta {
+			j++
+		}
+
+		if j-i >= 2 {
+			token := string(runes[i : j+1])
+			base := 26.0
+			switch {
+			case unicode.IsDigit(runes[i]):
+				base = 10
+			case runes[i] == 'a' || runes[i] == 'A' || runes[i] == '1' || runes[i] == '0':
+				base = 4
+			}
+			guesses := base * float64(j-i+1)
+			if delta < 0 {
+				guesses *= 2
+			}
+			matches = append(matches, passwordMatch{pattern: "sequence", start: i, end: j + 1, token: token, guesses: guesses})
+		}
+		i = j
+	}
+	return matches
+}
+
+/**
+ * finds the same character repeated three or more times
+ */
+func repeatMatches(runes []rune) []passwordMatch {
+	var matches []passwordMatch
+
+	for i := 0; i < len(runes); {
+		j := i + 1
+		for j < len(runes) && runes[j] == runes[i] {
+			j++
+		}
+		if j-i >= 3 {
+			matches = append(matches, passwordMatch{
+				pattern: "repeat",
+				start:   i,
+				end:     j,
+				token:   string(runes[i:j]),
+				guesses: float64(characterCardinality(runes[i]) * (j - i)),
+			})
+		}
+		i = j
+	}
+	return matches
+}
+
+func characterCardinality(r rune) int {
+	switch {
+	case unicode.IsDigit(r):
+		return 10
+	case unicode.IsLetter(r):
+		return 26
+	default:
+		return 33
+	}
+}
+
+/**
+ * finds four or more keys in a straight line on a qwerty keyboard, in either
+ * direction
+ */
+func keyboardMatches(runes []rune) []passwordMatch {
+	lower := strings.ToLower(string(runes))
+	lowerRunes := []rune(lower)
+	var matches []passwordMatch
+
+	for i := 0; i < len(lowerRunes); i++ {
+		for j := i + 4; j <= len(lowerRunes); j++ {
+			token := string(lowerRunes[i:j])
+			for _, row := range keyboardRows {
+				if strings.Contains(row, token) || strings.Contains(row, reverseString(token)) {
+					matches = append(matches, passwordMatch{
+						pattern: "keyboard",
+						start:   i,
+						end:     j,
+						token:   string(runes[i:j]),
+						guesses: float64(len(keyboardRows)*(j-i)) * 2 * uppercaseVariations(string(runes[i:j])),
+					})
+					break
+				}
+			}
+		}
+	}
+	return matches
+}
+
+/**
+ * finds four digit years between 1900 and 2099
+ */
+func yearMatches(runes []rune) []passwordMatch {
+	var matches []passwordMatch
+	currentYear := time.Now().Year()
+
+	for i := 0; i+4 <= len(runes); i++ {
+		token := string(runes[i : i+4])
+		year, err := strconv.Atoi(token)
+		if err != nil || year < 1900 || year > 2099 || strings.ContainsAny(token, "+-") {
+			continue
+		}
+
+		space := currentYear - year
+		if space < 0 {
+			space = -space
+		}
+		matches = append(matches, passwordMatch{
+			pattern: "year",
+			start:   i,
+			end:     i + 4,
+			token:   token,
+			guesses: float64(max(space, minYearSpace)),
+		})
+	}
+	return matches
+}
+
+/**
+ * picks the split of the password into matches and bruteforced runs that an
+ * attacker would need the fewest guesses for. Like zxcvbn, a split with more
+ * parts is penalised because the attacker must also guess how the parts fit
+ * together.
+ */
+func mostGuessableSequence(runes []rune, matches []passwordMatch) (float64, []passwordMatch) {
+	n := len(runes)
+
+	byEnd := make([][]passwordMatch, n+1)
+	for _, match := range matches {
+		byEnd[match.end] = append(byEnd[match.end], match)
+	}
+	for i := 0; i < n; i++ {
+		for j := i + 1; j <= n; j++ {
+			byEnd[j] = append(byEnd[j], passwordMatch{
+				pattern: "bruteforce",
+				start:   i,
+				end:     j,
+				token:   string(runes[i:j]),
+				guesses: math.Pow(bruteforceCardinality, float64(j-i)),
+			})
+		}
+	}
+
+	// best[j][k] is the lowest product of guesses covering runes[:j] with k parts
+	best := make([][]float64, n+1)
+	last := make([][]*passwordMatch, n+1)
+	for j := range best {
+		best[j] = make([]float64, n+1)
+		last[j] = make([]*passwordMatch, n+1)
+		for k := range best[j] {
+			best[j][k] = math.Inf(1)
+		}
+	}
+	best[0][0] = 1
+
+	for j := 1; j <= n; j++ {
+		for idx := range byEnd[j] {
+			match := &byEnd[j][idx]
+			guesses := match.guesses
+			if match.end-match.start < n {
+				guesses = math.Max(guesses, minSubmatchGuesses)
+			}
+			for k := 1; k <= j; k++ {
+				if candidate := best[match.start][k-1] * guesses; candidate < best[j][k] {
+					best[j][k] = candidate
+					last[j][k] = match
+				}
+			}
+		}
+	}
+
+	bestGuesses, bestCount := math.Inf(1), 0
+	for k := 1; k <= n; k++ {
+		if math.IsInf(best[n][k], 1) {
+			continue
+		}
+		total := factorial(k)*best[n][k] + math.Pow(10000, float64(k-1))
+		if total < bestGuesses {
+			bestGuesses, bestCount = total, k
+		}
+	}
+
+	sequence := make([]passwordMatch, bestCount)
+	for j, k := n, bestCount; k > 0; k-- {
+		sequence[k-1] = *last[j][k]
+		j = last[j][k].start
+	}
+
+	return bestGuesses, sequence
+}
+
+func factorial(n int) float64 {
+	result := 1.0
+	for i := 2; i <= n; i++ {
+		result *= float64(i)
+	}
+	return result
+}
+
+/**
+ * explains the weakest part of the password, based on the longest match that
+ * isn't bruteforced. Strong passwords get no feedback.
+ */
+func passwordFeedback(score int, sequence []passwordMatch) (string, []string) {
+	if score >= minPasswordScore {
+		return "", nil
+	}
+
+	suggestions := []string{"Add another word or two. Uncommon words are better."}
+
+	var longest *passwordMatch
+	for i := range sequence {
+		if sequence[i].pattern == "bruteforce" {
+			continue
+		}
+		if longest == nil || len(sequence[i].token) > len(longest.token) {
+			longest = &sequence[i]
+		}
+	}
+	if longest == nil {
+		return "", append(suggestions, "Use a longer password. Length helps more than symbols.")
+	}
+
+	warning := ""
+	switch longest.pattern {
+	case "dictionary":
+		switch longest.dictionary {
+		case dictionaryCommon:
+			if longest.rank <= 100 && !longest.leet && !longest.reversed && len(sequence) == 1 {
+				warning = "This is a top-100 common password"
+			} else {
+				warning = "This is similar to a commonly used password"
+			}
+		case dictionaryEurovision:
+			warning = "Eurovision songs, artists and places are easy to guess"
+		case dictionaryUserInputs:
+			warning = "Passwords based on your email address are easy to guess"
+		}
+		if longest.uppercase {
+			suggestions = append(suggestions, "Capitalization doesn't help very much")
+		}
+		if longest.reversed {
+			suggestions = append(suggestions, "Reversed words aren't much harder to guess")
+		}
+		if longest.leet {
+			suggestions = append(suggestions, "Predictable substitutions like '@' instead of 'a' don't help very much")
+		}
+	case "sequence":
+		warning = "Sequences like abc or 6543 are easy to guess"
+		suggestions = append(suggestions, "Avoid sequences")
+	case "repeat":
+		warning = "Repeats like \"aaa\" are easy to guess"
+		suggestions = append(suggestions, "Avoid repeated words and characters")
+	case "keyboard":
+		warning = "Straight rows of keys are easy to guess"
+		suggestions = append(suggestions, "Use a longer keyboard pattern with more turns")
+	case "year":
+		warning = "Recent years are easy to guess"
+		suggestions = append(suggestions, "Avoid years that are associated with you")
+	}
+
+	return warning, suggestions
+}
+
+// why validatePassword rejected a password
+const (
+	PasswordTooShort     = "too_short"
+	PasswordTooLong      = "too_long"
+	PasswordBreached     = "breached"
+	PasswordTooGuessable = "too_guessable"
+)
+
+/*
+PasswordRejectedError is returned when a new password doesn't meet the
+requirements. It wraps ErrWeakPassword and carries feedback for the user.
+Score is only set when the password was rejected by the strength estimate.
+*/
+type PasswordRejectedError struct {
+	Reason      string
+	Score       *int
+	Warning     string
+	Suggestions []string
+}
+
+func (e *PasswordRejectedError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrWeakPassword, e.Reason)
+}
+
+func (e *PasswordRejectedError) Unwrap() error {
+	return ErrWeakPassword
+}
@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestEstimatePasswordStrengthFlagsGuessablePatterns(t *testing.T) {
+	userInputs := []string{"jane.doe@example.com"}
+
+	tests := []struct {
+		password string
+		warning  string
+		hint     string
+	}{
+		{"password", "This is a top-100 common password", ""},
+		{"Password", "This is a top-100 common password", "Capitalization doesn't help very much"},
+		{"drowssap", "This is similar to a commonly used password", "Reversed words aren't much harder to guess"},
+		{"p@ssw0rd", "This is similar to a commonly used password", "Predictable substitutions like '@' instead of 'a' don't help very much"},
+		{"eurovision", "Eurovision songs, artists and places are easy to guess", ""},
+		{"loreen2023", "Eurovision songs, artists and places are easy to guess", ""},
+		{"jane.doe", "Passwords based on your email address are easy to guess", ""},
+		{"abcdefgh", "Sequences like abc or 6543 are easy to guess", "Avoid sequences"},
+		{"aaaaaaaa", "Repeats like \"aaa\" are easy to guess", "Avoid repeated words and characters"},
+		{"12345678", "Straight rows of keys are easy to guess", "Use a longer keyboard pattern with more turns"},
+		{"1987", "Recent years are easy to guess", "Avoid years that are associated with you"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.password, func(t *testing.T) {
+			strength := EstimatePasswordStrength(tt.password, userInputs)
+			if strength.Score >= minPasswordScore {
+				t.Fatalf("score = %d, want below %d", strength.Score, minPasswordScore)
+			}
+			if strength.Warning != tt.warning {
+				t.Errorf("warning = %q, want %q", strength.Warning, tt.warning)
+			}
+			if tt.hint != "" && !containsString(strength.Suggestions, tt.hint) {
+				t.Errorf("suggestions %q don't include %q", strength.Suggestions, tt.hint)
+			}
+		})
+	}
+}
+
+func TestEstimatePasswordStrengthAcceptsStrongPasswords(t *testing.T) {
+	for _, password := range []string{
+		"correct horse battery staple",
+		"Tr0ub4dor&3",
+		"kq8#Vz!p2Lw9",
+	} {
+		t.Run(password, func(t *testing.T) {
+			strength := EstimatePasswordStrength(password, nil)
+			if strength.Score < minPasswordScore {
+				t.Fatalf("score = %d, want at least %d", strength.Score, minPasswordScore)
+			}
+			if strength.Warning != "" || len(strength.Suggestions) != 0 {
+				t.Errorf("strong password got feedback %q %q", strength.Warning, strength.Suggestions)
+			}
+		})
+	}
+}
+
+func TestEstimatePasswordStrengthEmpty(t *testing.T) {
+	strength := EstimatePasswordStrength("", nil)
+	if strength.Score != 0 || strength.Warning != "Enter a password" {
+		t.Errorf("got %+v, want score 0 asking for a password", strength)
+	}
+}
+
+func TestValidatePasswordReasons(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		reason   string
+	}{
+		{"too short", "kq8#Vz!", PasswordTooShort},
+		{"too long", strings.Repeat("kq8#Vz!p", 10), PasswordTooLong},
+		{"breached", "nightcrawler", PasswordBreached},
+		{"based on the email", "Jane.Doe!", PasswordTooGuessable},
+		{"common with a capital", "Password", PasswordTooGuessable},
+		{"strong", "correct horse battery staple", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validatePassword(tt.password, "jane.doe@example.com")
+			if tt.reason == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			var rejected *PasswordRejectedError
+			if !errors.As(err, &rejected) {
+				t.Fatalf("error = %v, want a PasswordRejectedError", err)
+			}
+			if rejected.Reason != tt.reason {
+				t.Errorf("reason = %s, want %s", rejected.Reason, tt.reason)
+			}
+			if !errors.Is(err, ErrWeakPassword) {
+				t.Errorf("error doesn't wrap ErrWeakPassword")
+			}
+			if (rejected.Score != nil) != (tt.reason == PasswordTooGuessable) {
+				t.Errorf("score set = %v for reason %s", rejected.Score != nil, tt.reason)
+			}
+		})
+	}
+}
+
+func TestScoreForGuesses(t *testing.T) {
+	tests := []struct {
+		guesses float64
+		score   int
+	}{
+		{1, 0},
+		{999, 0},
+		{1e3, 1},
+		{1e6 - 1, 1},
+		{1e6, 2},
+		{1e8, 3},
+		{1e10 - 1, 3},
+		{1e10, 4},
+		{1e20, 4},
+	}
+
+	for _, tt := range tests {
+		if got := scoreForGuesses(tt.guesses); got != tt.score {
+			t.Errorf("scoreForGuesses(%g) = %d, want %d", tt.guesses, got, tt.score)
+		}
+	}
+}
+
+func TestUppercaseVariations(t *testing.T) {
+	tests := []struct {
+		token      string
+		variations float64
+	}{
+		{"douze", 1},
+		{"Douze", 2},
+		{"DOUZE", 2},
+		{"douzE", 5},
+		{"DoUze", 15},
+		{"1987", 1},
+	}
+
+	for _, tt := range tests {
+		if got := uppercaseVariations(tt.token); got != tt.variations {
+			t.Errorf("uppercaseVariations(%q) = %g, want %g", tt.token, got, tt.variations)
+		}
+	}
+}
+
+func TestReverseString(t *testing.T) {
+	tests := map[string]string{
+		"":      "",
+		"a":     "a",
+		"abc":   "cba",
+		"malmö": "ömlam",
+	}
+
+	for in, want := range tests {
+		if got := reverseString(in); got != want {
+			t.Errorf("reverseString(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func containsString(values []string, want string) bool {
+	for _, v := range values {
+		if v == want {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"errors"
+	"eurovision-api/db"
+	"eurovision-api/models"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// security event types
+const (
+	EventLoginSucceeded           = "login_succeeded"
+	EventLoginMFARequired         = "login_mfa_required"
+	EventLoginFailed              = "login_failed"
+	EventLoginBlocked             = "login_blocked"
+	EventAccountLocked            = "account_locked"
+	EventAccountUnlocked          = "account_unlocked"
+	EventRegistrationStarted      = "registration_started"
+	EventRegistrationCompleted    = "registration_completed"
+	EventPasswordResetRequested   = "password_reset_requested"
+	EventPasswordResetCompleted   = "password_reset_completed"
+	EventPasswordChanged          = "password_changed"
+	EventEmailChangeRequested     = "email_change_requested"
+	EventEmailChangeApproved      = "email_change_approved"
+	EventEmailChanged             = "email_changed"
+	EventMagicLinkRequested       = "magic_link_requested"
+	EventMFAEnabled               = "mfa_enabled"
+	EventMFADisabled              = "mfa_disabled"
+	EventRecoveryCodesRegenerated = "recovery_codes_regenerated"
+	EventSessionRevoked           = "session_revoked"
+	EventAllSessionsRevoked       = "all_sessions_revoked"
+	EventAccessTokenCreated       = "access_token_created"
+	EventAccessTokenRevoked       = "access_token_revoked"
+	EventDeletionRequested        = "account_deletion_requested"
+	EventDeletionCancelled        = "account_deletion_cancelled"
+
+	// admin actions are recorded as admin_<action>, e.g. admin_disable_user
+	EventAdminPrefix = "admin_"
+)
+
+// how the user proved who they are when logging in
+const (
+	loginMethodPassword  = "password"
+	loginMethodMFA       = "mfa"
+	loginMethodMagicLink = "magic_link"
+	loginMethodOIDC      = "oidc"
+)
+
+const defaultSecurityEventRetentionDays = 365
+
+/**
+ * appends an event to the security log. The actor defaults to the user the
+ * event is about, and the outcome is a failure when failure is set. Errors
+ * are logged rather than returned so a logging problem never blocks a login.
+ */
+func recordSecurityEvent(event models.SecurityEvent, client ClientInfo, failure error) {
+	event.ID = uuid.New().String()
+	event.Timestamp = time.Now()
+	event.IP = client.validIP()
+	event.UserAgent = client.UserAgent
+
+	if event.ActorID == "" {
+		event.ActorID = event.UserID
+	}
+
+	event.Outcome = models.SecurityOutcomeSuccess
+	if failure != nil {
+		event.Outcome = models.SecurityOutcomeFailure
+		event.Reason = failure.Error()
+	}
+
+	if err := db.CreateSecurityEvent(&event); err != nil {
+		logrus.WithError(err).Errorf("Failed to record security event %s", event.Event)
+	}
+}
+
+/**
+ * records an action an admin took, against the user it affected. targetUserID
+ * is empty for actions that don't concern a single user.
+ */
+func RecordAdminEvent(adminID, targetUserID, action string, client ClientInfo, details map[string]interface{}) {
+	recordSecurityEvent(models.SecurityEvent{
+		UserID:  targetUserID,
+		ActorID: adminID,
+		Event:   EventAdminPrefix + action,
+		Details: details,
+	}, client, nil)
+}
+
+/**
+ * records the outcome of a login step. user is nil when the account couldn't
+ * be identified, in which case the attempted email is kept instead.
+ */
+func recordLogin(method, email string, user *models.User, client ClientInfo, result *LoginResult, err error) {
+	event := models.SecurityEvent{
+		Email:   email,
+		Details: map[string]interface{}{"method": method},
+	}
+	if user != nil {
+		event.UserID = user.ID
+		event.Email = user.Email
+	}
+
+	var blocked *LoginBlockedError
+	switch {
+	case errors.As(err, &blocked):
+		event.Event = EventLoginBlocked
+	case err != nil:
+		event.Event = EventLoginFailed
+	case result != nil && result.MFAToken != "":
+		event.Event = EventLoginMFARequired
+	default:
+		event.Event = EventLoginSucceeded
+	}
+
+	recordSecurityEvent(event, client, err)
+}
+
+/**
+ * returns how long security events are kept, from SECURITY_EVENT_RETENTION_DAYS
+ */
+func securityEventRetention() time.Duration {
+	days, err := strconv.Atoi(os.Getenv("SECURITY_EVENT_RETENTION_DAYS"))
+	if err != nil || days <= 0 {
+		days = defaultSecurityEventRetentionDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// Cleanup job to delete security events past the retention period
+func purgeOldSecurityEvents() {
+	if err := db.DeleteSecurityEventsBefore(time.Now().Add(-securityEventRetention())); err != nil {
+		logrus.WithError(err).Error("Failed to purge old security events")
+	}
+}
+
+/**
+ * lists the security events concerning the user, newest first
+ */
+func (s *Service) ListSecurityEvents(userID string, from, size int) ([]models.SecurityEvent, int64, error) {
+	return db.SearchSecurityEvents(db.SecurityEventFilter{UserID: userID}, from, size)
+}
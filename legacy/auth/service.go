@@ -2,10 +2,10 @@ package auth
 
 import (
 	"eurovision-api/db"
+	"eurovision-api/mailer"
 	"eurovision-api/models"
 	"time"
 
-	"github.com/golang-jwt/jwt"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/bcrypt"
@@ -13,14 +13,29 @@ import (
 )
 
 type Service struct {
-	limiter   *rate.Limiter
-	jwtSecret []byte
+	limiter       *rate.Limiter
+	resendLimiter *rate.Limiter
+	tokens        *TokenIssuer
+	oidcProviders map[string]*oidcProvider
+	oidcStates    *oidcStateStore
+	mailer        mailer.Mailer
 }
 
-func NewService(jwtSecret string) *Service {
+func NewService(tokens *TokenIssuer, m mailer.Mailer) *Service {
+	if tokens == nil {
+		panic("token issuer cannot be nil")
+	}
+	if m == nil {
+		panic("mailer cannot be nil")
+	}
+
 	return &Service{
-		limiter:   rate.NewLimiter(rate.Every(time.Minute/10), 3),
-		jwtSecret: []byte(jwtSecret),
+		mailer:        m,
+		limiter:       rate.NewLimiter(rate.Every(time.Minute/10), 3),
+		resendLimiter: rate.NewLimiter(rate.Every(time.Minute/5), 2),
+		tokens:        tokens,
+		oidcProviders: loadOIDCProviders(),
+		oidcStates:    newOIDCStateStore(),
 	}
 }
 
@@ -28,12 +43,23 @@ func (s *Service) AllowRequest() bool {
 	return s.limiter.Allow()
 }
 
+/**
+ * rate limits verification resends separately, so they can't use up the
+ * budget for registration and login
+ */
+func (s *Service) AllowResendRequest() bool {
+	return s.resendLimiter.Allow()
+}
+
 /**
  * validates the email and checks if it already exists in the database. if not, a
  * confirmation token is generated and saved in the database. The token is
- * then sent to the user in an email.
+ * then sent to the user in an email, in their preferred locale when we have
+ * templates for it.
  */
-func (s *Service) InitiateRegistration(email string) error {
+func (s *Service) InitiateRegistration(email, locale string, client ClientInfo) error {
+	email = normalizeEmail(email)
+
 	if err := validateEmail(email); err != nil {
 		return ErrInvalidEmail
 	}
@@ -43,43 +69,118 @@ func (s *Service) InitiateRegistration(email string) error {
 		return err
 	}
 	if exists {
-		return ErrEmailExists
+		// registering again before confirming sends a fresh link instead
+		user, err := db.GetUserByEmail(email)
+		if err != nil {
+			return err
+		}
+		if !awaitingVerification(user) {
+			return ErrEmailExists
+		}
+		return s.reissueVerification(user)
 	}
 
-	token, expiry := generateConfirmationToken()
+	now := time.Now()
 
 	user := models.User{
-		ID:                uuid.New().String(),
-		Email:             email,
-		PasswordHash:      "", // Password will be set later
-		Confirmed:         false,
-		ConfirmationToken: token,
-		TokenExpiry:       expiry,
-		CreatedAt:         time.Now(),
+		ID:                 uuid.New().String(),
+		Email:              email,
+		PasswordHash:       "", // Password will be set later
+		Confirmed:          false,
+		Locale:             normalizeUserLocale(locale),
+		VerificationSentAt: &now,
+		CreatedAt:          now,
 	}
 
 	if err := db.CreateUser(&user); err != nil {
 		return err
 	}
 
-	return sendVerificationEmail(email, token)
+	recordSecurityEvent(models.SecurityEvent{UserID: user.ID, Event: EventRegistrationStarted}, client, nil)
+
+	token, err := issueAuthToken(user.ID, TokenPurposeVerifyEmail, verifyEmailTokenTTL)
+	if err != nil {
+		return err
+	}
+
+	return s.sendVerificationEmail(&user, token)
+}
+
+/**
+ * sends a fresh verification link to an account that has not completed
+ * registration. Unknown and already confirmed addresses are ignored so the
+ * response doesn't reveal whether an account exists.
+ */
+func (s *Service) ResendVerification(email string) error {
+	email = normalizeEmail(email)
+
+	if err := validateEmail(email); err != nil {
+		return ErrInvalidEmail
+	}
+
+	user, err := db.GetUserByEmail(email)
+	if err != nil {
+		logrus.Infof("Verification resend requested for non-existent email: %s", email)
+		return nil
+	}
+
+	if !awaitingVerification(user) {
+		return nil
+	}
+
+	return s.reissueVerification(user)
+}
+
+/**
+ * reports whether the user registered but never confirmed their email
+ */
+func awaitingVerification(user *models.User) bool {
+	return !user.Confirmed && user.PasswordHash == "" && !user.Disabled
+}
+
+/**
+ * replaces the user's verification token, invalidating the old link, and
+ * emails the new one. Does nothing if a link went out within the cooldown.
+ */
+func (s *Service) reissueVerification(user *models.User) error {
+	now := time.Now()
+	if user.VerificationSentAt != nil && now.Sub(*user.VerificationSentAt) < verificationResendCooldown {
+		return nil
+	}
+
+	token, err := issueAuthToken(user.ID, TokenPurposeVerifyEmail, verifyEmailTokenTTL)
+	if err != nil {
+		return err
+	}
+
+	if err := db.SetVerificationSentAt(user.ID, now); err != nil {
+		return err
+	}
+
+	return s.sendVerificationEmail(user, token)
 }
 
 /**
  * validates the token and sets the password for the user
  */
-func (s *Service) CompleteRegistration(token, password string) error {
-	if err := validatePassword(password); err != nil {
+func (s *Service) CompleteRegistration(token, password string, client ClientInfo) error {
+	// the token is only used up once the password is accepted
+	record, err := findAuthToken(token, TokenPurposeVerifyEmail)
+	if err != nil {
 		return err
 	}
 
-	user, err := db.GetUserByToken(token)
+	user, err := db.GetUserByID(record.UserID)
 	if err != nil {
 		return ErrInvalidToken
 	}
 
-	if user.TokenExpiry.Before(time.Now()) {
-		return ErrTokenExpired
+	if err := validatePassword(password, user.Email); err != nil {
+		return err
+	}
+
+	if err := redeemAuthToken(record); err != nil {
+		return err
 	}
 
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
@@ -87,13 +188,21 @@ func (s *Service) CompleteRegistration(token, password string) error {
 		return err
 	}
 
-	return db.CompleteRegistration(user.Email, string(hashedPassword))
+	if err := db.CompleteRegistration(user.Email, string(hashedPassword)); err != nil {
+		return err
+	}
+
+	recordSecurityEvent(models.SecurityEvent{UserID: user.ID, Event: EventRegistrationCompleted}, client, nil)
+
+	return nil
 }
 
 /**
  * generates a new token and sends a password reset email
  */
-func (s *Service) InitiatePasswordReset(email string) error {
+func (s *Service) InitiatePasswordReset(email string, client ClientInfo) error {
+	email = normalizeEmail(email)
+
 	if err := validateEmail(email); err != nil {
 		return ErrInvalidEmail
 	}
@@ -101,33 +210,73 @@ func (s *Service) InitiatePasswordReset(email string) error {
 	user, err := db.GetUserByEmail(email)
 	if err != nil {
 		logrus.Infof("Password reset requested for non-existent email: %s", email)
+		recordSecurityEvent(models.SecurityEvent{Email: email, Event: EventPasswordResetRequested}, client, ErrUserNotFound)
 		return nil // Don't reveal if email exists
 	}
 
-	token, expiry := generateConfirmationToken()
+	token, err := issueAuthToken(user.ID, TokenPurposeResetPassword, resetPasswordTokenTTL)
+	if err != nil {
+		return err
+	}
+
+	recordSecurityEvent(models.SecurityEvent{UserID: user.ID, Event: EventPasswordResetRequested}, client, nil)
+
+	return s.sendPasswordResetEmail(user, token)
+}
+
+/**
+ * invalidates the user's current password and emails them a reset link. Used
+ * by admins when an account is suspected to be compromised, so every JWT,
+ * session and personal access token the user holds is revoked as well.
+ */
+func (s *Service) ForcePasswordReset(userID string) error {
+	user, err := db.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if err := db.RequirePasswordReset(user.ID, now); err != nil {
+		return err
+	}
+
+	if err := db.RevokeUserSessions(user.ID, "", now); err != nil {
+		return err
+	}
+
+	if err := db.DeleteUserAccessTokens(user.ID); err != nil {
+		return err
+	}
 
-	if err := db.SetResetToken(user.Email, token, expiry); err != nil {
+	token, err := issueAuthToken(user.ID, TokenPurposeResetPassword, resetPasswordTokenTTL)
+	if err != nil {
 		return err
 	}
 
-	return sendPasswordResetEmail(email, token)
+	return s.sendPasswordResetEmail(user, token)
 }
 
 /**
  * validates the reset token and sets the new password
  */
-func (s *Service) CompletePasswordReset(token, newPassword string) error {
-	if err := validatePassword(newPassword); err != nil {
+func (s *Service) CompletePasswordReset(token, newPassword string, client ClientInfo) error {
+	// the token is only used up once the password is accepted
+	record, err := findAuthToken(token, TokenPurposeResetPassword)
+	if err != nil {
 		return err
 	}
 
-	user, err := db.GetUserByToken(token)
+	user, err := db.GetUserByID(record.UserID)
 	if err != nil {
 		return ErrInvalidToken
 	}
 
-	if user.TokenExpiry.Before(time.Now()) {
-		return ErrTokenExpired
+	if err := validatePassword(newPassword, user.Email); err != nil {
+		return err
+	}
+
+	if err := redeemAuthToken(record); err != nil {
+		return err
 	}
 
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
@@ -135,33 +284,81 @@ func (s *Service) CompletePasswordReset(token, newPassword string) error {
 		return err
 	}
 
-	return db.UpdatePassword(user.Email, string(hashedPassword))
+	if err := db.UpdatePassword(user.Email, string(hashedPassword)); err != nil {
+		return err
+	}
+
+	if err := db.RevokeUserSessions(user.ID, "", time.Now()); err != nil {
+		return err
+	}
+
+	if err := db.DeleteUserAccessTokens(user.ID); err != nil {
+		return err
+	}
+
+	recordSecurityEvent(models.SecurityEvent{UserID: user.ID, Event: EventPasswordResetCompleted}, client, nil)
+
+	return nil
+}
+
+/**
+ * checks the user's password. Returns the JWT, or an mfa pending token when
+ * the account has two-factor authentication enabled.
+ */
+func (s *Service) AuthenticateUser(email, password string, client ClientInfo) (*LoginResult, error) {
+	email = normalizeEmail(email)
+
+	user, result, err := s.authenticatePassword(email, password, client)
+	recordLogin(loginMethodPassword, email, user, client, result, err)
+	return result, err
 }
 
-func (s *Service) AuthenticateUser(email, password string) (string, error) {
+/**
+ * does the work of AuthenticateUser, also returning the user once the email
+ * has been matched so the attempt can be recorded against them
+ */
+func (s *Service) authenticatePassword(email, password string, client ClientInfo) (*models.User, *LoginResult, error) {
 	user, err := db.GetUserByEmail(email)
 	if err != nil {
-		return "", ErrInvalidCredentials
+		return nil, nil, ErrInvalidCredentials
 	}
 
 	if !user.Confirmed {
-		return "", ErrUnconfirmedEmail
+		return user, nil, ErrUnconfirmedEmail
 	}
 
 	if user.PasswordHash == "" {
-		return "", ErrRegistrationIncomplete
+		return user, nil, ErrRegistrationIncomplete
+	}
+
+	if err := checkLoginAllowed(user, time.Now()); err != nil {
+		return user, nil, err
 	}
 
 	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
-		return "", ErrInvalidCredentials
+		return user, nil, s.recordFailedLogin(user, ErrInvalidCredentials, client)
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"email":   user.Email,
-		"user_id": user.ID,
-		"role":    "user",
-		"exp":     time.Now().Add(24 * time.Hour).Unix(),
-	})
+	if user.Disabled {
+		return user, nil, ErrAccountDisabled
+	}
+
+	if user.PasswordResetRequired {
+		return user, nil, ErrPasswordResetRequired
+	}
 
-	return token.SignedString(s.jwtSecret)
+	// accounts with 2FA keep their counter until the code is verified
+	if !user.TOTPEnabled {
+		clearFailedLogins(user)
+	}
+
+	result, err := s.completeLogin(user, client)
+	return user, result, err
+}
+
+/**
+ * returns the public signing keys for /.well-known/jwks.json
+ */
+func (s *Service) JWKS() *JSONWebKeySet {
+	return s.tokens.JWKS()
 }
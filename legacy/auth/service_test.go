@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"eurovision-api/db"
+	"eurovision-api/mailer"
+	"eurovision-api/models"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+/**
+ * connects to the Elasticsearch at ELASTICSEARCH_URL, skipping the test when
+ * it isn't set
+ */
+func requireES(t *testing.T) {
+	t.Helper()
+
+	if os.Getenv("ELASTICSEARCH_URL") == "" {
+		t.Skip("ELASTICSEARCH_URL is not set")
+	}
+	if err := db.InitES(); err != nil {
+		t.Fatalf("InitES: %v", err)
+	}
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	tests := map[string]string{
+		"alice@example.com":     "alice@example.com",
+		"Alice@Example.COM":     "alice@example.com",
+		"  alice@example.com\n": "alice@example.com",
+	}
+
+	for in, want := range tests {
+		if got := normalizeEmail(in); got != want {
+			t.Errorf("normalizeEmail(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestInitiateRegistrationRefusesCaseVariants(t *testing.T) {
+	requireES(t)
+
+	email := "owner-" + uuid.New().String() + "@example.com"
+	owner := &models.User{
+		ID:        uuid.New().String(),
+		Email:     email,
+		Role:      models.RoleUser,
+		Confirmed: true,
+		CreatedAt: time.Now(),
+	}
+	if err := db.CreateUser(owner); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	t.Cleanup(func() { db.DeleteUserCascade(owner.ID) })
+
+	memory := mailer.NewMemoryMailer()
+	s := &Service{mailer: memory}
+
+	for _, variant := range []string{"Owner-" + email[len("owner-"):], " " + email + " "} {
+		if err := s.InitiateRegistration(variant, "en", ClientInfo{}); err != ErrEmailExists {
+			t.Errorf("InitiateRegistration(%q) = %v, want %v", variant, err, ErrEmailExists)
+		}
+	}
+
+	if sent := memory.Messages(); len(sent) != 0 {
+		t.Errorf("sent %d emails for refused registrations", len(sent))
+	}
+
+	user, err := db.GetUserByEmail(email)
+	if err != nil {
+		t.Fatalf("GetUserByEmail: %v", err)
+	}
+	if user.ID != owner.ID {
+		t.Errorf("email resolves to %s, want the original account %s", user.ID, owner.ID)
+	}
+}
@@ -0,0 +1,224 @@
+package auth
+
+import (
+	"errors"
+	"eurovision-api/db"
+	"eurovision-api/models"
+	"eurovision-api/utils"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// how often a session's last seen time is written
+	sessionTouchInterval = time.Minute
+
+	// expired sessions are kept this long so users can still see them
+	expiredSessionRetention = 7 * 24 * time.Hour
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+/*
+ClientInfo describes the client a user signs in from. It is recorded on the
+session and in security events so users can recognise their devices.
+*/
+type ClientInfo struct {
+	IP        string
+	UserAgent string
+}
+
+/**
+ * returns the client's IP, or an empty string if it isn't a valid address
+ */
+func (c ClientInfo) validIP() string {
+	if net.ParseIP(c.IP) == nil {
+		return ""
+	}
+	return c.IP
+}
+
+/**
+ * starts a session for the user and signs a JWT bound to it. The location of
+ * the client's IP is looked up in the background.
+ */
+func (s *Service) startSession(user *models.User, client ClientInfo) (string, error) {
+	now := time.Now()
+
+	ip := client.validIP()
+
+	session := models.Session{
+		ID:         uuid.New().String(),
+		UserID:     user.ID,
+		Device:     describeDevice(client.UserAgent),
+		UserAgent:  client.UserAgent,
+		IP:         ip,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(s.tokens.ttl),
+	}
+
+	if err := db.CreateSession(&session); err != nil {
+		return "", err
+	}
+
+	if ip != "" {
+		go locateSession(session.ID, ip)
+	}
+
+	return s.tokens.IssueSession(user, session.ID)
+}
+
+func locateSession(sessionID, ip string) {
+	location, err := utils.FetchIPLocation(ip)
+	if err != nil {
+		logrus.WithError(err).Warnf("Failed to locate session %s", sessionID)
+		return
+	}
+
+	if err := db.SetSessionLocation(sessionID, location); err != nil {
+		logrus.WithError(err).Errorf("Failed to store location of session %s", sessionID)
+	}
+}
+
+/**
+ * checks that the session a JWT belongs to is still active and records that
+ * it was used, at most once a minute
+ */
+func validateSession(sessionID, userID string) error {
+	session, err := db.GetSession(sessionID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if session.UserID != userID || !session.IsActive(now) {
+		return ErrSessionNotFound
+	}
+
+	if now.Sub(session.LastSeenAt) >= sessionTouchInterval {
+		go func() {
+			if err := db.TouchSession(session.ID, now); err != nil {
+				logrus.WithError(err).Errorf("Failed to update last seen of session %s", session.ID)
+			}
+		}()
+	}
+
+	return nil
+}
+
+/**
+ * lists the user's active sessions
+ */
+func (s *Service) ListSessions(userID string) ([]models.Session, error) {
+	return db.GetActiveSessionsByUserID(userID, time.Now())
+}
+
+/**
+ * signs out one of the user's sessions
+ */
+func (s *Service) RevokeSession(userID, sessionID string, client ClientInfo) error {
+	revoked, err := db.RevokeSession(userID, sessionID, time.Now())
+	if err != nil {
+		return err
+	}
+	if !revoked {
+		return ErrSessionNotFound
+	}
+
+	recordSecurityEvent(models.SecurityEvent{
+		UserID:  userID,
+		Event:   EventSessionRevoked,
+		Details: map[string]interface{}{"session_id": sessionID},
+	}, client, nil)
+
+	return nil
+}
+
+/**
+ * signs out all of the user's sessions except keepSessionID, if given. When
+ * nothing is kept, tokens issued before sessions were tracked are revoked too.
+ */
+func (s *Service) RevokeAllSessions(userID, keepSessionID string, client ClientInfo) error {
+	now := time.Now()
+
+	if err := db.RevokeUserSessions(userID, keepSessionID, now); err != nil {
+		return err
+	}
+
+	if keepSessionID == "" {
+		if err := db.RevokeUserTokens(userID, now); err != nil {
+			return err
+		}
+	}
+
+	recordSecurityEvent(models.SecurityEvent{
+		UserID:  userID,
+		Event:   EventAllSessionsRevoked,
+		Details: map[string]interface{}{"kept_current": keepSessionID != ""},
+	}, client, nil)
+
+	return nil
+}
+
+/**
+ * builds a short description such as "Firefox on Windows" from a user agent
+ */
+func describeDevice(userAgent string) string {
+	browser := ""
+	switch {
+	case strings.Contains(userAgent, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(userAgent, "OPR/"):
+		browser = "Opera"
+	case strings.Contains(userAgent, "Firefox/"):
+		browser = "Firefox"
+	case strings.Contains(userAgent, "Chrome/"), strings.Contains(userAgent, "CriOS/"):
+		browser = "Chrome"
+	case strings.Contains(userAgent, "Safari/"):
+		browser = "Safari"
+	}
+
+	platform := ""
+	switch {
+	case strings.Contains(userAgent, "iPhone"):
+		platform = "iOS"
+	case strings.Contains(userAgent, "iPad"):
+		platform = "iPadOS"
+	case strings.Contains(userAgent, "Android"):
+		platform = "Android"
+	case strings.Contains(userAgent, "Windows"):
+		platform = "Windows"
+	case strings.Contains(userAgent, "Mac OS X"):
+		platform = "macOS"
+	case strings.Contains(userAgent, "CrOS"):
+		platform = "ChromeOS"
+	case strings.Contains(userAgent, "Linux"):
+		platform = "Linux"
+	}
+
+	switch {
+	case browser != "" && platform != "":
+		return browser + " on " + platform
+	case browser != "":
+		return browser
+	case platform != "":
+		return platform
+	case userAgent != "":
+		// API clients such as curl or scripts
+		return strings.SplitN(userAgent, "/", 2)[0]
+	default:
+		return "Unknown device"
+	}
+}
+
+// Cleanup job to delete sessions that expired over a week ago
+func purgeExpiredSessions() {
+	if err := db.DeleteExpiredSessions(time.Now().Add(-expiredSessionRetention)); err != nil {
+		logrus.WithError(err).Error("Failed to purge expired sessions")
+	}
+}
@@ -0,0 +1,404 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"eurovision-api/models"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+const defaultSessionTTL = 24 * time.Hour
+
+var (
+	ErrUnknownSigningKey = errors.New("token signed with an unknown key")
+	ErrUnexpectedAlg     = errors.New("unexpected signing method")
+)
+
+/*
+TokenIssuer signs and verifies every JWT the API hands out. It signs with one
+key and verifies with any of its keys, which lets a key be rotated out while
+tokens it signed are still live. Every token carries the signing key's id in
+its kid header. Public keys of the asymmetric keys are published as a JWKS so
+other services can verify tokens without sharing a secret.
+*/
+type TokenIssuer struct {
+	signing  *tokenKey
+	keys     map[string]*tokenKey
+	ttl      time.Duration
+	issuer   string
+	audience string
+}
+
+type tokenKey struct {
+	id        string
+	method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+/*
+JSONWebKey is the public half of an asymmetric signing key, as published in
+the JWKS (RFC 7517)
+*/
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+}
+
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+/**
+ * builds the issuer from the environment:
+ *
+ * JWT_ALGORITHM is HS256 (default), RS256 or EdDSA. HS256 signs with
+ * JWT_SECRET, the others with the PEM private key in JWT_PRIVATE_KEY_FILE.
+ * JWT_KEY_ID overrides the kid, which defaults to the RFC 7638 thumbprint for
+ * asymmetric keys. Retired keys that should still verify are listed in
+ * JWT_VERIFICATION_KEY_FILES (PEM public keys) and JWT_PREVIOUS_SECRETS,
+ * both comma separated. When signing asymmetrically, JWT_SECRET is still
+ * accepted for verification so existing sessions survive the switch.
+ *
+ * JWT_TTL sets the session lifetime (default 24h), JWT_ISSUER and
+ * JWT_AUDIENCE set the iss and aud claims, which are then also required.
+ */
+func NewTokenIssuerFromEnv() (*TokenIssuer, error) {
+	issuer := &TokenIssuer{
+		keys:     map[string]*tokenKey{},
+		ttl:      defaultSessionTTL,
+		issuer:   os.Getenv("JWT_ISSUER"),
+		audience: os.Getenv("JWT_AUDIENCE"),
+	}
+
+	if ttl := os.Getenv("JWT_TTL"); ttl != "" {
+		parsed, err := time.ParseDuration(ttl)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid JWT_TTL: %s", ttl)
+		}
+		issuer.ttl = parsed
+	}
+
+	secret := os.Getenv("JWT_SECRET")
+
+	switch alg := os.Getenv("JWT_ALGORITHM"); alg {
+	case "", "HS256":
+		if secret == "" {
+			return nil, errors.New("JWT_SECRET is required for HS256")
+		}
+		issuer.signing = newHMACKey(secret)
+	case "RS256", "EdDSA":
+		key, err := loadPrivateKey(os.Getenv("JWT_PRIVATE_KEY_FILE"), alg)
+		if err != nil {
+			return nil, err
+		}
+		issuer.signing = key
+		if secret != "" {
+			issuer.addKey(newHMACKey(secret))
+		}
+	default:
+		return nil, fmt.Errorf("unsupported JWT_ALGORITHM: %s", alg)
+	}
+
+	if kid := os.Getenv("JWT_KEY_ID"); kid != "" {
+		issuer.signing.id = kid
+	}
+	issuer.addKey(issuer.signing)
+
+	for _, secret := range splitList(os.Getenv("JWT_PREVIOUS_SECRETS")) {
+		issuer.addKey(newHMACKey(secret))
+	}
+
+	for _, path := range splitList(os.Getenv("JWT_VERIFICATION_KEY_FILES")) {
+		key, err := loadPublicKey(path)
+		if err != nil {
+			return nil, err
+		}
+		issuer.addKey(key)
+	}
+
+	return issuer, nil
+}
+
+func (i *TokenIssuer) addKey(key *tokenKey) {
+	i.keys[key.id] = key
+}
+
+/**
+ * signs a token for the user's session, valid for the configured TTL
+ */
+func (i *TokenIssuer) IssueSession(user *models.User, sessionID string) (string, error) {
+	return i.Issue(&Claims{
+		UserID:    user.ID,
+		Email:     user.Email,
+		Role:      user.EffectiveRole(),
+		SessionID: sessionID,
+	}, i.ttl)
+}
+
+/**
+ * signs the claims with the current signing key, filling in the standard
+ * claims
+ */
+func (i *TokenIssuer) Issue(claims *Claims, ttl time.Duration) (string, error) {
+	now := time.Now()
+
+	claims.IssuedAt = now.Unix()
+	claims.ExpiresAt = now.Add(ttl).Unix()
+	claims.Issuer = i.issuer
+	claims.Audience = i.audience
+
+	token := jwt.NewWithClaims(i.signing.method, claims)
+	token.Header["kid"] = i.signing.id
+
+	return token.SignedString(i.signing.signKey)
+}
+
+/**
+ * verifies the token's signature with the key named by its kid, and its
+ * expiry, issuer and audience. Tokens without a kid predate key ids and are
+ * checked against the HMAC keys.
+ */
+func (i *TokenIssuer) Parse(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+
+		key, ok := i.keys[kid]
+		if !ok && kid == "" {
+			key, ok = i.legacyKey(tokenString)
+		}
+		if !ok {
+			return nil, ErrUnknownSigningKey
+		}
+
+		if token.Method.Alg() != key.method.Alg() {
+			return nil, ErrUnexpectedAlg
+		}
+		return key.verifyKey, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+
+	if i.issuer != "" && !claims.VerifyIssuer(i.issuer, true) {
+		return nil, errors.New("invalid token issuer")
+	}
+
+	if i.audience != "" && !claims.VerifyAudience(i.audience, true) {
+		return nil, errors.New("invalid token audience")
+	}
+
+	return claims, nil
+}
+
+/**
+ * finds the HMAC key that signed a token issued before tokens carried a kid
+ */
+func (i *TokenIssuer) legacyKey(tokenString string) (*tokenKey, bool) {
+	parts := strings.Split(tokenString, ".")
+	if len(parts) != 3 {
+		return nil, false
+	}
+
+	for _, key := range i.keys {
+		if key.method != jwt.SigningMethodHS256 {
+			continue
+		}
+		if key.method.Verify(parts[0]+"."+parts[1], parts[2], key.verifyKey) == nil {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+/**
+ * returns the public keys of all asymmetric keys. HMAC secrets are never
+ * published.
+ */
+func (i *TokenIssuer) JWKS() *JSONWebKeySet {
+	set := &JSONWebKeySet{Keys: []JSONWebKey{}}
+
+	for _, key := range i.keys {
+		if jwk, ok := publicJWK(key); ok {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+
+	return set
+}
+
+func publicJWK(key *tokenKey) (JSONWebKey, bool) {
+	switch pub := key.verifyKey.(type) {
+	case *rsa.PublicKey:
+		return JSONWebKey{
+			KeyType:   "RSA",
+			KeyID:     key.id,
+			Use:       "sig",
+			Algorithm: key.method.Alg(),
+			N:         base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}, true
+	case ed25519.PublicKey:
+		return JSONWebKey{
+			KeyType:   "OKP",
+			KeyID:     key.id,
+			Use:       "sig",
+			Algorithm: key.method.Alg(),
+			Curve:     "Ed25519",
+			X:         base64.RawURLEncoding.EncodeToString(pub),
+		}, true
+	}
+	return JSONWebKey{}, false
+}
+
+/**
+ * computes the RFC 7638 thumbprint of the key's public JWK, used as the
+ * default kid
+ */
+func thumbprint(jwk JSONWebKey) string {
+	var members interface{}
+	switch jwk.KeyType {
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.E, jwk.KeyType, jwk.N}
+	default:
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Curve, jwk.KeyType, jwk.X}
+	}
+
+	encoded, _ := json.Marshal(members)
+	sum := sha256.Sum256(encoded)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+/**
+ * wraps an HMAC secret. Its kid is derived from a hash of the secret so that
+ * rotated secrets get distinct ids without having to name them.
+ */
+func newHMACKey(secret string) *tokenKey {
+	sum := sha256.Sum256([]byte("kid:" + secret))
+
+	return &tokenKey{
+		id:        "hs-" + hex.EncodeToString(sum[:8]),
+		method:    jwt.SigningMethodHS256,
+		signKey:   []byte(secret),
+		verifyKey: []byte(secret),
+	}
+}
+
+func loadPrivateKey(path, alg string) (*tokenKey, error) {
+	if path == "" {
+		return nil, fmt.Errorf("JWT_PRIVATE_KEY_FILE is required for %s", alg)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading JWT private key: %v", err)
+	}
+
+	var key *tokenKey
+	switch alg {
+	case "RS256":
+		private, err := jwt.ParseRSAPrivateKeyFromPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing JWT private key: %v", err)
+		}
+		key = &tokenKey{method: jwt.SigningMethodRS256, signKey: private, verifyKey: &private.PublicKey}
+	default:
+		private, err := jwt.ParseEdPrivateKeyFromPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing JWT private key: %v", err)
+		}
+		public := private.(crypto.Signer).Public()
+		key = &tokenKey{method: jwt.SigningMethodEdDSA, signKey: private, verifyKey: public}
+	}
+
+	jwk, _ := publicJWK(key)
+	key.id = thumbprint(jwk)
+
+	return key, nil
+}
+
+/**
+ * loads a PEM encoded RSA or Ed25519 public key that is still accepted for
+ * verification
+ */
+func loadPublicKey(path string) (*tokenKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading JWT verification key: %v", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in JWT verification key %s", path)
+	}
+
+	var public interface{}
+	if block.Type == "RSA PUBLIC KEY" {
+		public, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	} else {
+		public, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing JWT verification key %s: %v", path, err)
+	}
+
+	var key *tokenKey
+	switch public := public.(type) {
+	case *rsa.PublicKey:
+		key = &tokenKey{method: jwt.SigningMethodRS256, verifyKey: public}
+	case ed25519.PublicKey:
+		key = &tokenKey{method: jwt.SigningMethodEdDSA, verifyKey: public}
+	default:
+		return nil, fmt.Errorf("unsupported JWT verification key type in %s", path)
+	}
+
+	jwk, _ := publicJWK(key)
+	key.id = thumbprint(jwk)
+
+	return key, nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
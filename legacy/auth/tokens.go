@@ -0,0 +1,158 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"eurovision-api/db"
+	"eurovision-api/models"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// what an emailed token may be used for. A token is only accepted by the
+// flow it was issued for.
+const (
+	TokenPurposeVerifyEmail    = "verify_email"
+	TokenPurposeResetPassword  = "reset_password"
+	TokenPurposeChangeEmail    = "change_email"
+	TokenPurposeCancelDeletion = "cancel_deletion"
+	TokenPurposeUnlockAccount  = "unlock_account"
+	TokenPurposeMagicLogin     = "magic_login"
+
+	// confirm an account change made by a user with no password or 2FA
+	TokenPurposeApproveEmailChange = "approve_email_change"
+	TokenPurposeConfirmDeletion    = "confirm_deletion"
+)
+
+const (
+	verifyEmailTokenTTL   = 24 * time.Hour
+	resetPasswordTokenTTL = 2 * time.Hour
+	changeEmailTokenTTL   = 24 * time.Hour
+	magicLoginTokenTTL    = 15 * time.Minute
+	confirmChangeTokenTTL = time.Hour
+
+	// expired tokens are kept this long before the cleanup job deletes them
+	expiredTokenRetention = 24 * time.Hour
+)
+
+/**
+ * hashes an emailed token for storage. The tokens carry 256 bits of
+ * randomness, so a fast hash is sufficient.
+ */
+func hashAuthToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+/**
+ * creates a single-use token for the user and returns the plaintext to put
+ * in the email. Outstanding tokens for the same purpose are invalidated so
+ * only the latest link works.
+ */
+func issueAuthToken(userID, purpose string, ttl time.Duration) (string, error) {
+	return issueEmailAuthToken(userID, purpose, "", ttl)
+}
+
+/**
+ * issues a token like issueAuthToken that only works for the given address,
+ * so a link can't confirm a different email than the one it was sent for
+ */
+func issueEmailAuthToken(userID, purpose, email string, ttl time.Duration) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	if err := db.DeleteAuthTokens(userID, purpose); err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	record := models.AuthToken{
+		TokenHash: hashAuthToken(token),
+		UserID:    userID,
+		Purpose:   purpose,
+		Email:     email,
+		ExpiresAt: now.Add(ttl),
+		CreatedAt: now,
+	}
+
+	if err := db.CreateAuthToken(&record); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+/**
+ * checks the token was issued for the purpose and marks it used. Returns
+ * ErrInvalidToken for unknown, reused or wrong-purpose tokens and
+ * ErrTokenExpired for expired ones.
+ */
+func consumeAuthToken(token, purpose string) (*models.AuthToken, error) {
+	record, err := findAuthToken(token, purpose)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := redeemAuthToken(record); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+/**
+ * checks the token like consumeAuthToken without using it up, for flows that
+ * validate more input before redeeming the token
+ */
+func findAuthToken(token, purpose string) (*models.AuthToken, error) {
+	if token == "" {
+		return nil, ErrInvalidToken
+	}
+
+	record, err := db.GetAuthToken(hashAuthToken(token))
+	if err != nil {
+		if err == db.ErrAuthTokenNotFound {
+			return nil, ErrInvalidToken
+		}
+		return nil, err
+	}
+
+	if record.Purpose != purpose || record.UsedAt != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if record.ExpiresAt.Before(time.Now()) {
+		return nil, ErrTokenExpired
+	}
+
+	return record, nil
+}
+
+/**
+ * marks a token returned by findAuthToken as used. Fails with ErrInvalidToken
+ * if a concurrent request used it first.
+ */
+func redeemAuthToken(record *models.AuthToken) error {
+	consumed, err := db.MarkAuthTokenUsed(record, time.Now())
+	if err != nil {
+		return err
+	}
+	if !consumed {
+		return ErrInvalidToken
+	}
+
+	return nil
+}
+
+// Cleanup job to delete expired emailed tokens
+func purgeExpiredAuthTokens() {
+	if err := db.DeleteExpiredAuthTokens(time.Now().Add(-expiredTokenRetention)); err != nil {
+		logrus.WithError(err).Error("Failed to purge expired auth tokens")
+	}
+}
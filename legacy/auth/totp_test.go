@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+// the SHA-1 seed from RFC 4226 appendix D and RFC 6238 appendix B
+var rfcSecret = []byte("12345678901234567890")
+
+func TestHOTPMatchesRFC4226Vectors(t *testing.T) {
+	want := []string{
+		"755224", "287082", "359152", "969429", "338314",
+		"254676", "287922", "162583", "399871", "520489",
+	}
+
+	for counter, code := range want {
+		if got := hotp(rfcSecret, uint64(counter)); got != code {
+			t.Errorf("hotp(counter %d) = %s, want %s", counter, got, code)
+		}
+	}
+}
+
+func TestValidateTOTPMatchesRFC6238Vectors(t *testing.T) {
+	secret := totpEncoding.EncodeToString(rfcSecret)
+
+	// RFC 6238 lists 8 digit codes, the last 6 are the 6 digit code
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		step, ok := validateTOTP(secret, tt.code, time.Unix(tt.unix, 0))
+		if !ok {
+			t.Errorf("code %s rejected at %d", tt.code, tt.unix)
+			continue
+		}
+		if want := tt.unix / totpPeriod; step != want {
+			t.Errorf("code %s at %d matched step %d, want %d", tt.code, tt.unix, step, want)
+		}
+	}
+}
+
+func TestValidateTOTPAllowsOneStepOfSkew(t *testing.T) {
+	secret := totpEncoding.EncodeToString(rfcSecret)
+
+	// the code for step 37037036, valid from 1111111080 to 1111111109
+	const code, step = "081804", int64(37037036)
+	start := time.Unix(step*totpPeriod, 0)
+
+	tests := []struct {
+		name  string
+		now   time.Time
+		valid bool
+	}{
+		{"two steps early", start.Add(-2 * totpPeriod * time.Second), false},
+		{"one step early", start.Add(-totpPeriod * time.Second), true},
+		{"current step", start, true},
+		{"one step late", start.Add(totpPeriod * time.Second), true},
+		{"last second of one step late", start.Add(2*totpPeriod*time.Second - time.Second), true},
+		{"two steps late", start.Add(2 * totpPeriod * time.Second), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matched, ok := validateTOTP(secret, code, tt.now)
+			if ok != tt.valid {
+				t.Fatalf("valid = %v, want %v", ok, tt.valid)
+			}
+			// the matched step is the code's own, which replay protection keys on
+			if ok && matched != step {
+				t.Errorf("matched step %d, want %d", matched, step)
+			}
+		})
+	}
+}
+
+func TestValidateTOTPRejectsMalformedInput(t *testing.T) {
+	secret := totpEncoding.EncodeToString(rfcSecret)
+	now := time.Unix(59, 0)
+
+	tests := []struct {
+		name   string
+		secret string
+		code   string
+		valid  bool
+	}{
+		{"surrounding whitespace", secret, " 287082 ", true},
+		{"lowercase secret", "gezdgnbvgy3tqojqgezdgnbvgy3tqojq", "287082", true},
+		{"wrong code", secret, "287083", false},
+		{"too short", secret, "28708", false},
+		{"too long", secret, "2870820", false},
+		{"empty", secret, "", false},
+		{"invalid secret", "not base32!", "287082", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := validateTOTP(tt.secret, tt.code, now); ok != tt.valid {
+				t.Errorf("valid = %v, want %v", ok, tt.valid)
+			}
+		})
+	}
+}
+
+func TestHashRecoveryCodeNormalizes(t *testing.T) {
+	want := hashRecoveryCode("abcd-efgh")
+
+	for _, code := range []string{"ABCD-EFGH", " abcd-efgh ", "abcd - efgh"} {
+		if got := hashRecoveryCode(code); got != want {
+			t.Errorf("hashRecoveryCode(%q) differs from the canonical code", code)
+		}
+	}
+}
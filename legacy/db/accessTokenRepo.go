@@ -0,0 +1,200 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"eurovision-api/models"
+	"fmt"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+/**
+ * creates the personal access tokens index with proper mappings if it doesn't exist.
+ */
+func createAccessTokensIndex() error {
+
+	mapping := `{
+		"mappings": {
+			"properties": {
+				"id": {
+					"type": "keyword"
+				},
+				"user_id": {
+					"type": "keyword"
+				},
+				"name": {
+					"type": "keyword"
+				},
+				"token_hash": {
+					"type": "keyword"
+				},
+				"token_prefix": {
+					"type": "keyword"
+				},
+				"scopes": {
+					"type": "keyword"
+				},
+				"expires_at": {
+					"type": "date"
+				},
+				"last_used_at": {
+					"type": "date"
+				},
+				"created_at": {
+					"type": "date"
+				}
+			}
+		}
+	}`
+
+	return createIndex(accessTokensIndex, mapping)
+}
+
+/**
+ * stores a new personal access token
+ */
+func CreateAccessToken(token *models.PersonalAccessToken) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, err := esClient.Index().
+		Index(accessTokensIndex).
+		Id(token.ID).
+		BodyJson(token).
+		Refresh("true").
+		Do(ctx)
+
+	if err != nil {
+		return fmt.Errorf("error creating access token: %v", err)
+	}
+
+	return nil
+}
+
+/**
+ * gets a personal access token by the hash of its value
+ */
+func GetAccessTokenByHash(tokenHash string) (*models.PersonalAccessToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	result, err := esClient.Search().
+		Index(accessTokensIndex).
+		Query(elastic.NewTermQuery("token_hash", tokenHash)).
+		Size(1).
+		Do(ctx)
+
+	if err != nil {
+		return nil, fmt.Errorf("error getting access token: %v", err)
+	}
+
+	if result.TotalHits() == 0 {
+		return nil, fmt.Errorf("access token not found")
+	}
+
+	var token models.PersonalAccessToken
+	if err := json.Unmarshal(result.Hits.Hits[0].Source, &token); err != nil {
+		return nil, fmt.Errorf("error unmarshaling access token: %v", err)
+	}
+
+	return &token, nil
+}
+
+/**
+ * gets all personal access tokens belonging to the user, newest first
+ */
+func GetAccessTokensByUserID(userID string) ([]models.PersonalAccessToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	result, err := esClient.Search().
+		Index(accessTokensIndex).
+		Query(elastic.NewTermQuery("user_id", userID)).
+		Sort("created_at", false).
+		Size(100).
+		Do(ctx)
+
+	if err != nil {
+		return nil, fmt.Errorf("error getting access tokens: %v", err)
+	}
+
+	tokens := []models.PersonalAccessToken{}
+	for _, hit := range result.Hits.Hits {
+		var token models.PersonalAccessToken
+		if err := json.Unmarshal(hit.Source, &token); err != nil {
+			return nil, fmt.Errorf("error unmarshaling access token: %v", err)
+		}
+		tokens = append(tokens, token)
+	}
+
+	return tokens, nil
+}
+
+/**
+ * deletes the user's personal access token. Returns false if the user has no
+ * token with that ID.
+ */
+func DeleteAccessToken(userID, tokenID string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	query := elastic.NewBoolQuery().
+		Filter(
+			elastic.NewTermQuery("id", tokenID),
+			elastic.NewTermQuery("user_id", userID),
+		)
+
+	result, err := esClient.DeleteByQuery().
+		Index(accessTokensIndex).
+		Query(query).
+		Refresh("true").
+		Do(ctx)
+
+	if err != nil {
+		return false, fmt.Errorf("error deleting access token: %v", err)
+	}
+
+	return result.Deleted > 0, nil
+}
+
+/**
+ * deletes all of the user's personal access tokens
+ */
+func DeleteUserAccessTokens(userID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, err := esClient.DeleteByQuery().
+		Index(accessTokensIndex).
+		Query(elastic.NewTermQuery("user_id", userID)).
+		Refresh("true").
+		Do(ctx)
+
+	if err != nil {
+		return fmt.Errorf("error deleting access tokens: %v", err)
+	}
+
+	return nil
+}
+
+/**
+ * records when the token was last used
+ */
+func TouchAccessToken(tokenID string, usedAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, err := esClient.Update().
+		Index(accessTokensIndex).
+		Id(tokenID).
+		Doc(map[string]interface{}{"last_used_at": usedAt}).
+		Do(ctx)
+
+	if err != nil {
+		return fmt.Errorf("error updating access token: %v", err)
+	}
+
+	return nil
+}
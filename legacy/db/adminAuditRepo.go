@@ -0,0 +1,108 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"eurovision-api/models"
+	"fmt"
+
+	"github.com/olivere/elastic/v7"
+)
+
+/**
+ * creates the admin audit log index with proper mappings if it doesn't exist.
+ */
+func createAdminAuditIndex() error {
+
+	mapping := `{
+		"mappings": {
+			"properties": {
+				"id": {
+					"type": "keyword"
+				},
+				"admin_id": {
+					"type": "keyword"
+				},
+				"action": {
+					"type": "keyword"
+				},
+				"target_user_id": {
+					"type": "keyword"
+				},
+				"details": {
+					"type": "object",
+					"enabled": false
+				},
+				"timestamp": {
+					"type": "date"
+				}
+			}
+		}
+	}`
+
+	return createIndex(adminAuditIndex, mapping)
+}
+
+/**
+ * appends an entry to the admin audit log
+ */
+func CreateAdminAuditEntry(entry *models.AdminAuditEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, err := esClient.Index().
+		Index(adminAuditIndex).
+		Id(entry.ID).
+		OpType("create").
+		BodyJson(entry).
+		Refresh("true").
+		Do(ctx)
+
+	if err != nil {
+		return fmt.Errorf("error creating admin audit entry: %v", err)
+	}
+
+	return nil
+}
+
+/**
+ * gets admin audit entries, newest first. Empty filters are ignored.
+ */
+func GetAdminAuditEntries(adminID, targetUserID, action string, from, size int) ([]models.AdminAuditEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	query := elastic.NewBoolQuery()
+	if adminID != "" {
+		query.Filter(elastic.NewTermQuery("admin_id", adminID))
+	}
+	if targetUserID != "" {
+		query.Filter(elastic.NewTermQuery("target_user_id", targetUserID))
+	}
+	if action != "" {
+		query.Filter(elastic.NewTermQuery("action", action))
+	}
+
+	result, err := esClient.Search().
+		Index(adminAuditIndex).
+		Query(query).
+		Sort("timestamp", false).
+		From(from).
+		Size(size).
+		Do(ctx)
+
+	if err != nil {
+		return nil, fmt.Errorf("error getting admin audit entries: %v", err)
+	}
+
+	entries := []models.AdminAuditEntry{}
+	for _, hit := range result.Hits.Hits {
+		var entry models.AdminAuditEntry
+		if err := json.Unmarshal(hit.Source, &entry); err != nil {
+			return nil, fmt.Errorf("error unmarshaling admin audit entry: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
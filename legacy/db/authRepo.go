@@ -5,11 +5,22 @@ import (
 	"encoding/json"
 	"eurovision-api/models"
 	"fmt"
+	"io"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/olivere/elastic/v7"
 )
 
+// account statuses accepted by SearchUsers
+const (
+	UserStatusConfirmed   = "confirmed"
+	UserStatusUnconfirmed = "unconfirmed"
+	UserStatusDisabled    = "disabled"
+	UserStatusLocked      = "locked"
+)
+
 /**
  * creates the users index with proper mappings if it doesn't exist.
  */
@@ -27,13 +38,66 @@ func createUsersIndex() error {
 				"password_hash": {
 					"type": "keyword"
 				},
+				"role": {
+					"type": "keyword"
+				},
+				"locale": {
+					"type": "keyword"
+				},
 				"confirmed": {
 					"type": "boolean"
 				},
-				"confirmation_token": {
+				"disabled": {
+					"type": "boolean"
+				},
+				"disabled_at": {
+					"type": "date"
+				},
+				"password_reset_required": {
+					"type": "boolean"
+				},
+				"ranking_quota": {
+					"type": "long"
+				},
+				"totp_enabled": {
+					"type": "boolean"
+				},
+				"totp_secret": {
+					"type": "keyword",
+					"index": false
+				},
+				"totp_pending_secret": {
+					"type": "keyword",
+					"index": false
+				},
+				"totp_last_used_step": {
+					"type": "long"
+				},
+				"recovery_code_hashes": {
 					"type": "keyword"
 				},
-				"token_expiry": {
+				"failed_login_attempts": {
+					"type": "integer"
+				},
+				"last_failed_login_at": {
+					"type": "date"
+				},
+				"locked_until": {
+					"type": "date"
+				},
+				"sessions_revoked_at": {
+					"type": "date"
+				},
+				"pending_email": {
+					"type": "keyword"
+				},
+				"deletion_requested_at": {
+					"type": "date"
+				},
+				"deletion_scheduled_for": {
+					"type": "date"
+				},
+				"verification_sent_at": {
 					"type": "date"
 				},
 				"created_at": {
@@ -56,7 +120,6 @@ func CompleteRegistration(email, passwordHash string) error {
 	script := elastic.NewScript(`
 		ctx._source.password_hash = params.password_hash;
 		ctx._source.confirmed = true;
-		ctx._source.confirmation_token = null;
 	`).Param("password_hash", passwordHash)
 
 	query := elastic.NewTermQuery("email", email)
@@ -79,41 +142,17 @@ func CompleteRegistration(email, passwordHash string) error {
 }
 
 /**
- * updates the user's reset token and expiry
+ * records when the latest verification email was sent to the user
  */
-func SetResetToken(email, token string, expiry time.Time) error {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-
-	script := elastic.NewScript(`
-		ctx._source.confirmation_token = params.token;
-		ctx._source.token_expiry = params.expiry;
-	`).Params(map[string]interface{}{
-		"token":  token,
-		"expiry": expiry,
-	})
-
-	query := elastic.NewTermQuery("email", email)
-
-	result, err := esClient.UpdateByQuery(usersIndex).
-		Query(query).
-		Script(script).
-		Refresh("true").
-		Do(ctx)
-
-	if err != nil {
-		return fmt.Errorf("error setting reset token: %v", err)
-	}
-
-	if result.Updated == 0 {
-		return fmt.Errorf("user not found with email: %s", email)
-	}
+func SetVerificationSentAt(userID string, sentAt time.Time) error {
+	script := elastic.NewScript("ctx._source.verification_sent_at = params.sent_at").
+		Param("sent_at", sentAt)
 
-	return nil
+	return updateUserByID(userID, script)
 }
 
 /**
- * updates the user's password and removes the reset token
+ * updates the user's password and signs out all existing sessions
  */
 func UpdatePassword(email, passwordHash string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
@@ -121,8 +160,12 @@ func UpdatePassword(email, passwordHash string) error {
 
 	script := elastic.NewScript(`
 		ctx._source.password_hash = params.password_hash;
-		ctx._source.confirmation_token = null;
-	`).Param("password_hash", passwordHash)
+		ctx._source.password_reset_required = false;
+		ctx._source.sessions_revoked_at = params.revoked_at;
+	`).Params(map[string]interface{}{
+		"password_hash": passwordHash,
+		"revoked_at":    time.Now(),
+	})
 
 	query := elastic.NewTermQuery("email", email)
 
@@ -144,14 +187,14 @@ func UpdatePassword(email, passwordHash string) error {
 }
 
 /**
- * updates the user's confirmed status and removes the confirmation token.
+ * updates the user's confirmed status.
  * Returns an error if the user is not found or the operation fails.
  */
 func ConfirmUser(email string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
-	script := elastic.NewScript("ctx._source.confirmed = true; ctx._source.confirmation_token = null")
+	script := elastic.NewScript("ctx._source.confirmed = true")
 	query := elastic.NewTermQuery("email", email)
 
 	result, err := esClient.UpdateByQuery(usersIndex).
@@ -172,18 +215,24 @@ func ConfirmUser(email string) error {
 }
 
 /**
- * removes all unconfirmed users created before the cutoff time.
- * Returns an error if the operation fails.
+ * removes all unconfirmed users whose latest verification email was sent
+ * before the cutoff time, so resending the verification email extends the
+ * account's life. Accounts from before verification_sent_at was recorded
+ * go by their creation time. Returns an error if the operation fails.
  */
 func DeleteUnconfirmedUsers(cutoff time.Time) error {
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
 	boolQuery := elastic.NewBoolQuery().
-		Must(
-			elastic.NewTermQuery("confirmed", false),
-			elastic.NewRangeQuery("created_at").Lt(cutoff),
-		)
+		Must(elastic.NewTermQuery("confirmed", false)).
+		Should(
+			elastic.NewRangeQuery("verification_sent_at").Lt(cutoff),
+			elastic.NewBoolQuery().
+				MustNot(elastic.NewExistsQuery("verification_sent_at")).
+				Must(elastic.NewRangeQuery("created_at").Lt(cutoff)),
+		).
+		MinimumNumberShouldMatch(1)
 
 	_, err := esClient.DeleteByQuery().
 		Index(usersIndex).
@@ -199,13 +248,14 @@ func DeleteUnconfirmedUsers(cutoff time.Time) error {
 }
 
 /**
- * checks if an email is already registered in the users index
+ * checks if an email is already registered in the users index, ignoring
+ * case like GetUserByEmail
  */
 func EmailExists(email string) (bool, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
-	query := elastic.NewTermQuery("email", email)
+	query := elastic.NewTermQuery("email", strings.ToLower(email)).CaseInsensitive(true)
 	count, err := esClient.Count(usersIndex).Query(query).Do(ctx)
 	if err != nil {
 		return false, fmt.Errorf("error checking email: %v", err)
@@ -235,16 +285,19 @@ func CreateUser(user *models.User) error {
 }
 
 /**
- * gets a user by their confirmation token
+ * gets a user by their email address, ignoring case. Accounts created before
+ * emails were stored lowercase may differ only in case, in which case the
+ * oldest one is returned. Returns ErrUserNotFound if there is no such user.
  */
-func GetUserByToken(token string) (*models.User, error) {
+func GetUserByEmail(email string) (*models.User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
-	query := elastic.NewTermQuery("confirmation_token", token)
+	query := elastic.NewTermQuery("email", strings.ToLower(email)).CaseInsensitive(true)
 	result, err := esClient.Search().
 		Index(usersIndex).
 		Query(query).
+		Sort("created_at", true).
 		Size(1).
 		Do(ctx)
 
@@ -253,7 +306,7 @@ func GetUserByToken(token string) (*models.User, error) {
 	}
 
 	if result.TotalHits() == 0 {
-		return nil, fmt.Errorf("user not found")
+		return nil, ErrUserNotFound
 	}
 
 	var user models.User
@@ -266,13 +319,76 @@ func GetUserByToken(token string) (*models.User, error) {
 }
 
 /**
- * gets a user by their email address.
+ * lowercases the email of every user stored with capitals. Addresses shared
+ * by several accounts that differ only in case are left alone and returned,
+ * lowercased, for an admin to resolve.
  */
-func GetUserByEmail(email string) (*models.User, error) {
+func NormalizeUserEmails() (int, []string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*timeout)
+	defer cancel()
+
+	scroll := esClient.Scroll(usersIndex).
+		FetchSourceContext(elastic.NewFetchSourceContext(true).Include("id", "email")).
+		Size(scrollPageSize).
+		KeepAlive(scrollKeepAlive)
+	defer scroll.Clear(context.Background())
+
+	// every user id by lowercased email, remembering which need updating
+	usersByEmail := map[string][]string{}
+	mixedCase := map[string]bool{}
+	for {
+		result, err := scroll.Do(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, nil, fmt.Errorf("error scrolling users: %v", err)
+		}
+
+		for _, hit := range result.Hits.Hits {
+			var user models.User
+			if err := json.Unmarshal(hit.Source, &user); err != nil {
+				return 0, nil, fmt.Errorf("error unmarshaling user: %v", err)
+			}
+
+			email := strings.ToLower(user.Email)
+			usersByEmail[email] = append(usersByEmail[email], user.ID)
+			if email != user.Email {
+				mixedCase[user.ID] = true
+			}
+		}
+	}
+
+	normalized := 0
+	conflicts := []string{}
+	for email, userIDs := range usersByEmail {
+		if len(userIDs) > 1 {
+			conflicts = append(conflicts, email)
+			continue
+		}
+		if !mixedCase[userIDs[0]] {
+			continue
+		}
+
+		script := elastic.NewScript("ctx._source.email = params.email").Param("email", email)
+		if err := updateUserByID(userIDs[0], script); err != nil {
+			return normalized, nil, fmt.Errorf("error normalizing email: %v", err)
+		}
+		normalized++
+	}
+
+	sort.Strings(conflicts)
+	return normalized, conflicts, nil
+}
+
+/**
+ * gets a user by their ID.
+ */
+func GetUserByID(userID string) (*models.User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
-	query := elastic.NewTermQuery("email", email)
+	query := elastic.NewTermQuery("id", userID)
 	result, err := esClient.Search().
 		Index(usersIndex).
 		Query(query).
@@ -284,7 +400,7 @@ func GetUserByEmail(email string) (*models.User, error) {
 	}
 
 	if result.TotalHits() == 0 {
-		return nil, fmt.Errorf("user not found")
+		return nil, ErrUserNotFound
 	}
 
 	var user models.User
@@ -295,3 +411,510 @@ func GetUserByEmail(email string) (*models.User, error) {
 
 	return &user, nil
 }
+
+/**
+ * searches users by email prefix and account status. status may be one of
+ * "confirmed", "unconfirmed", "disabled" or "locked"; an empty value matches
+ * all users.
+ * Returns the page of users and the total number of matches.
+ */
+func SearchUsers(emailPrefix, status string, from, size int) ([]models.User, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	query := elastic.NewBoolQuery()
+
+	if emailPrefix != "" {
+		query.Must(elastic.NewPrefixQuery("email", strings.ToLower(emailPrefix)).CaseInsensitive(true))
+	}
+
+	switch status {
+	case "":
+	case UserStatusConfirmed:
+		query.Must(elastic.NewTermQuery("confirmed", true))
+		query.MustNot(elastic.NewTermQuery("disabled", true))
+	case UserStatusUnconfirmed:
+		query.Must(elastic.NewTermQuery("confirmed", false))
+	case UserStatusDisabled:
+		query.Must(elastic.NewTermQuery("disabled", true))
+	case UserStatusLocked:
+		query.Must(elastic.NewRangeQuery("locked_until").Gt(time.Now()))
+	default:
+		return nil, 0, fmt.Errorf("unknown user status: %s", status)
+	}
+
+	result, err := esClient.Search().
+		Index(usersIndex).
+		Query(query).
+		Sort("created_at", false).
+		From(from).
+		Size(size).
+		Do(ctx)
+
+	if err != nil {
+		return nil, 0, fmt.Errorf("error searching users: %v", err)
+	}
+
+	users := []models.User{}
+	for _, hit := range result.Hits.Hits {
+		var user models.User
+		if err := json.Unmarshal(hit.Source, &user); err != nil {
+			return nil, 0, fmt.Errorf("error unmarshaling user: %v", err)
+		}
+		users = append(users, user)
+	}
+
+	return users, result.TotalHits(), nil
+}
+
+/**
+ * applies the given painless script to the user with the provided ID.
+ * Returns ErrUserNotFound if no user was updated.
+ */
+func updateUserByID(userID string, script *elastic.Script) error {
+	updated, err := conditionalUpdateUserByID(userID, script)
+	if err != nil {
+		return err
+	}
+
+	if !updated {
+		return ErrUserNotFound
+	}
+
+	return nil
+}
+
+/**
+ * applies a painless script that may set ctx.op = 'noop' to the user with the
+ * provided ID. Returns whether the user was actually modified, which lets
+ * callers make check-and-set changes atomically.
+ */
+func conditionalUpdateUserByID(userID string, script *elastic.Script) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	result, err := esClient.UpdateByQuery(usersIndex).
+		Query(elastic.NewTermQuery("id", userID)).
+		Script(script).
+		Refresh("true").
+		Do(ctx)
+
+	if err != nil {
+		return false, fmt.Errorf("error updating user: %v", err)
+	}
+
+	return result.Updated > 0, nil
+}
+
+/**
+ * marks the user's email as confirmed
+ */
+func ConfirmUserByID(userID string) error {
+	return updateUserByID(userID, elastic.NewScript("ctx._source.confirmed = true"))
+}
+
+/**
+ * enables or disables the user's account
+ */
+func SetUserDisabled(userID string, disabled bool) error {
+	var disabledAt interface{}
+	if disabled {
+		disabledAt = time.Now()
+	}
+
+	script := elastic.NewScript(`
+		ctx._source.disabled = params.disabled;
+		ctx._source.disabled_at = params.disabled_at;
+	`).Params(map[string]interface{}{
+		"disabled":    disabled,
+		"disabled_at": disabledAt,
+	})
+
+	return updateUserByID(userID, script)
+}
+
+/**
+ * flags the user as requiring a password reset before they can log in again,
+ * revoking every token issued to them before revokedAt
+ */
+func RequirePasswordReset(userID string, revokedAt time.Time) error {
+	script := elastic.NewScript(`
+		ctx._source.password_reset_required = true;
+		ctx._source.sessions_revoked_at = params.revoked_at;
+	`).Param("revoked_at", revokedAt)
+
+	return updateUserByID(userID, script)
+}
+
+/**
+ * sets a per-user ranking quota. A nil quota removes the override so the
+ * global MAX_USER_RANKINGS limit applies again.
+ */
+func SetRankingQuota(userID string, quota *int64) error {
+	var value interface{}
+	if quota != nil {
+		value = *quota
+	}
+
+	script := elastic.NewScript("ctx._source.ranking_quota = params.quota").
+		Param("quota", value)
+
+	return updateUserByID(userID, script)
+}
+
+/**
+ * deletes the user along with their rankings, ranking revisions, votes,
+ * linked identities, personal access tokens, profile, follows in either
+ * direction, reactions, comments and queued or sent emails. Reactions the
+ * user added are taken off the counts of other users' rankings, and their
+ * comments on other users' rankings are emptied but kept so replies stay
+ * threaded.
+ */
+func DeleteUserCascade(userID string) error {
+	// emails are keyed by address, so they go while the user can still be read
+	user, err := GetUserByID(userID)
+	if err != nil && err != ErrUserNotFound {
+		return fmt.Errorf("error getting user: %v", err)
+	}
+	if user != nil {
+		if err := DeleteOutboundEmailsTo(user.Email, user.PendingEmail); err != nil {
+			return fmt.Errorf("error deleting user emails: %v", err)
+		}
+	}
+
+	if err := DeleteByFieldValue(RankingsIndex, "user_id", userID); err != nil {
+		return fmt.Errorf("error deleting user rankings: %v", err)
+	}
+
+	if err := DeleteByFieldValue(revisionsIndex, "user_id", userID); err != nil {
+		return fmt.Errorf("error deleting user ranking revisions: %v", err)
+	}
+
+	if err := DeleteByFieldValue(VotesIndex, "user_id", userID); err != nil {
+		return fmt.Errorf("error deleting user votes: %v", err)
+	}
+
+	if err := DeleteByFieldValue(identitiesIndex, "user_id", userID); err != nil {
+		return fmt.Errorf("error deleting user identities: %v", err)
+	}
+
+	if err := DeleteByFieldValue(accessTokensIndex, "user_id", userID); err != nil {
+		return fmt.Errorf("error deleting user access tokens: %v", err)
+	}
+
+	if err := DeleteByFieldValue(authTokensIndex, "user_id", userID); err != nil {
+		return fmt.Errorf("error deleting user auth tokens: %v", err)
+	}
+
+	if err := DeleteByFieldValue(sessionsIndex, "user_id", userID); err != nil {
+		return fmt.Errorf("error deleting user sessions: %v", err)
+	}
+
+	if err := DeleteByFieldValue(profilesIndex, "user_id", userID); err != nil {
+		return fmt.Errorf("error deleting user profile: %v", err)
+	}
+
+	if err := DeleteByFieldValue(handlesIndex, "user_id", userID); err != nil {
+		return fmt.Errorf("error deleting user handle: %v", err)
+	}
+
+	if err := deleteCommentsForUser(userID); err != nil {
+		return fmt.Errorf("error deleting user comments: %v", err)
+	}
+
+	if err := deleteReactionsForUser(userID); err != nil {
+		return fmt.Errorf("error deleting user reactions: %v", err)
+	}
+
+	if err := DeleteByFieldValue(FollowsIndex, "follower_id", userID); err != nil {
+		return fmt.Errorf("error deleting user follows: %v", err)
+	}
+
+	if err := DeleteByFieldValue(FollowsIndex, "followee_id", userID); err != nil {
+		return fmt.Errorf("error deleting user followers: %v", err)
+	}
+
+	if err := DeleteByFieldValue(usersIndex, "id", userID); err != nil {
+		return fmt.Errorf("error deleting user: %v", err)
+	}
+
+	return nil
+}
+
+/**
+ * stores a TOTP secret that is awaiting verification during enrollment
+ */
+func SetPendingTOTPSecret(userID, secret string) error {
+	script := elastic.NewScript("ctx._source.totp_pending_secret = params.secret").
+		Param("secret", secret)
+
+	return updateUserByID(userID, script)
+}
+
+/**
+ * promotes the pending TOTP secret to the active one, enables 2FA and stores
+ * the hashed recovery codes
+ */
+func EnableTOTP(userID string, recoveryCodeHashes []string) error {
+	script := elastic.NewScript(`
+		ctx._source.totp_secret = ctx._source.totp_pending_secret;
+		ctx._source.totp_pending_secret = null;
+		ctx._source.totp_enabled = true;
+		ctx._source.recovery_code_hashes = params.hashes;
+	`).Param("hashes", recoveryCodeHashes)
+
+	return updateUserByID(userID, script)
+}
+
+/**
+ * turns off 2FA and removes the secret and recovery codes
+ */
+func DisableTOTP(userID string) error {
+	script := elastic.NewScript(`
+		ctx._source.totp_enabled = false;
+		ctx._source.totp_secret = null;
+		ctx._source.totp_pending_secret = null;
+		ctx._source.recovery_code_hashes = null;
+	`)
+
+	return updateUserByID(userID, script)
+}
+
+/**
+ * replaces the user's recovery codes with a new set of hashes
+ */
+func ReplaceRecoveryCodes(userID string, recoveryCodeHashes []string) error {
+	script := elastic.NewScript("ctx._source.recovery_code_hashes = params.hashes").
+		Param("hashes", recoveryCodeHashes)
+
+	return updateUserByID(userID, script)
+}
+
+/**
+ * removes the recovery code hash from the user if present. Returns false if
+ * the code was unknown or has already been used.
+ */
+func ConsumeRecoveryCode(userID, codeHash string) (bool, error) {
+	script := elastic.NewScript(`
+		def hashes = ctx._source.recovery_code_hashes;
+		if (hashes != null && hashes.contains(params.hash)) {
+			hashes.remove(hashes.indexOf(params.hash));
+		} else {
+			ctx.op = 'noop';
+		}
+	`).Param("hash", codeHash)
+
+	return conditionalUpdateUserByID(userID, script)
+}
+
+/**
+ * records the TOTP time step as used. Returns false if the same or a later
+ * step was already used, which prevents a code from being replayed.
+ */
+func MarkTOTPStepUsed(userID string, step int64) (bool, error) {
+	script := elastic.NewScript(`
+		def last = ctx._source.totp_last_used_step;
+		if (last == null || params.step > last) {
+			ctx._source.totp_last_used_step = params.step;
+		} else {
+			ctx.op = 'noop';
+		}
+	`).Param("step", step)
+
+	return conditionalUpdateUserByID(userID, script)
+}
+
+/**
+ * schedules the user's account for deletion
+ */
+func ScheduleUserDeletion(userID string, requestedAt, scheduledFor time.Time) error {
+	script := elastic.NewScript(`
+		ctx._source.deletion_requested_at = params.requested_at;
+		ctx._source.deletion_scheduled_for = params.scheduled_for;
+	`).Params(map[string]interface{}{
+		"requested_at":  requestedAt,
+		"scheduled_for": scheduledFor,
+	})
+
+	return updateUserByID(userID, script)
+}
+
+/**
+ * clears the user's scheduled deletion. Returns false if no deletion was
+ * pending.
+ */
+func CancelUserDeletion(userID string) (bool, error) {
+	script := elastic.NewScript(`
+		if (ctx._source.deletion_scheduled_for == null) {
+			ctx.op = 'noop';
+		} else {
+			ctx._source.deletion_requested_at = null;
+			ctx._source.deletion_scheduled_for = null;
+		}
+	`)
+
+	return conditionalUpdateUserByID(userID, script)
+}
+
+/**
+ * gets the IDs of users whose deletion grace period ended before the cutoff
+ */
+func GetUserIDsDueForDeletion(cutoff time.Time) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	result, err := esClient.Search().
+		Index(usersIndex).
+		Query(elastic.NewRangeQuery("deletion_scheduled_for").Lte(cutoff)).
+		FetchSourceContext(elastic.NewFetchSourceContext(true).Include("id")).
+		Size(1000).
+		Do(ctx)
+
+	if err != nil {
+		return nil, fmt.Errorf("error getting users due for deletion: %v", err)
+	}
+
+	ids := []string{}
+	for _, hit := range result.Hits.Hits {
+		var user models.User
+		if err := json.Unmarshal(hit.Source, &user); err != nil {
+			return nil, fmt.Errorf("error unmarshaling user: %v", err)
+		}
+		ids = append(ids, user.ID)
+	}
+
+	return ids, nil
+}
+
+/**
+ * sets a new password for a signed in user and revokes tokens issued before
+ * revokedAt
+ */
+func ChangePassword(userID, passwordHash string, revokedAt time.Time) error {
+	script := elastic.NewScript(`
+		ctx._source.password_hash = params.password_hash;
+		ctx._source.password_reset_required = false;
+		ctx._source.sessions_revoked_at = params.revoked_at;
+	`).Params(map[string]interface{}{
+		"password_hash": passwordHash,
+		"revoked_at":    revokedAt,
+	})
+
+	return updateUserByID(userID, script)
+}
+
+/**
+ * stores an email change that is waiting for the new address to be confirmed
+ */
+func SetPendingEmailChange(userID, newEmail string) error {
+	script := elastic.NewScript("ctx._source.pending_email = params.email").
+		Param("email", newEmail)
+
+	return updateUserByID(userID, script)
+}
+
+/**
+ * replaces the user's email with the confirmed pending address, clears the
+ * pending change and revokes tokens issued before revokedAt
+ */
+func CompleteEmailChange(userID, newEmail string, revokedAt time.Time) error {
+	script := elastic.NewScript(`
+		ctx._source.email = params.email;
+		ctx._source.pending_email = null;
+		ctx._source.sessions_revoked_at = params.revoked_at;
+	`).Params(map[string]interface{}{
+		"email":      newEmail,
+		"revoked_at": revokedAt,
+	})
+
+	return updateUserByID(userID, script)
+}
+
+/**
+ * revokes every token issued to the user before revokedAt
+ */
+func RevokeUserTokens(userID string, revokedAt time.Time) error {
+	script := elastic.NewScript("ctx._source.sessions_revoked_at = params.revoked_at").
+		Param("revoked_at", revokedAt)
+
+	return updateUserByID(userID, script)
+}
+
+/**
+ * increments the user's failed login counter
+ */
+func RecordFailedLogin(userID string, failedAt time.Time) error {
+	script := elastic.NewScript(`
+		def attempts = ctx._source.failed_login_attempts;
+		ctx._source.failed_login_attempts = (attempts == null ? 0 : attempts) + 1;
+		ctx._source.last_failed_login_at = params.failed_at;
+	`).Param("failed_at", failedAt)
+
+	return updateUserByID(userID, script)
+}
+
+/**
+ * locks the user's account until the given time
+ */
+func LockUser(userID string, until time.Time) error {
+	script := elastic.NewScript("ctx._source.locked_until = params.until").
+		Param("until", until)
+
+	return updateUserByID(userID, script)
+}
+
+/**
+ * clears the failed login counter and any lock on the user's account
+ */
+func ResetFailedLogins(userID string) error {
+	script := elastic.NewScript(`
+		ctx._source.failed_login_attempts = 0;
+		ctx._source.last_failed_login_at = null;
+		ctx._source.locked_until = null;
+	`)
+
+	return updateUserByID(userID, script)
+}
+
+// plaintext token fields users carried before tokens moved to their own index
+var legacyUserTokenFields = []string{
+	"confirmation_token",
+	"token_expiry",
+	"email_change_token",
+	"email_change_expiry",
+	"deletion_cancel_token",
+	"unlock_token",
+}
+
+/**
+ * strips the legacy plaintext token fields from every user that still has
+ * them. Links sent before the migration stop working and have to be
+ * requested again.
+ */
+func removeLegacyUserTokens() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 6*timeout)
+	defer cancel()
+
+	query := elastic.NewBoolQuery().MinimumNumberShouldMatch(1)
+	for _, field := range legacyUserTokenFields {
+		query.Should(elastic.NewExistsQuery(field))
+	}
+
+	script := elastic.NewScript(`
+		for (field in params.fields) {
+			ctx._source.remove(field);
+		}
+	`).Param("fields", legacyUserTokenFields)
+
+	_, err := esClient.UpdateByQuery(usersIndex).
+		Query(query).
+		Script(script).
+		Refresh("true").
+		Do(ctx)
+
+	if err != nil {
+		return fmt.Errorf("error removing legacy user tokens: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,139 @@
+package db
+
+import (
+	"eurovision-api/models"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+/**
+ * connects to the Elasticsearch at ELASTICSEARCH_URL, skipping the test when
+ * it isn't set
+ */
+func requireES(t testing.TB) {
+	t.Helper()
+
+	if os.Getenv("ELASTICSEARCH_URL") == "" {
+		t.Skip("ELASTICSEARCH_URL is not set")
+	}
+	if err := InitES(); err != nil {
+		t.Fatalf("InitES: %v", err)
+	}
+}
+
+func TestMarkTOTPStepUsedRejectsReplays(t *testing.T) {
+	requireES(t)
+
+	user := &models.User{
+		ID:        uuid.New().String(),
+		Email:     "totp-" + uuid.New().String() + "@example.com",
+		Role:      models.RoleUser,
+		CreatedAt: time.Now(),
+	}
+	if err := CreateUser(user); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	t.Cleanup(func() { DeleteByFieldValue(usersIndex, "id", user.ID) })
+
+	steps := []struct {
+		step  int64
+		fresh bool
+	}{
+		{100, true},
+		{100, false}, // the same code again
+		{99, false},  // an older code still inside the skew window
+		{101, true},
+		{100, false},
+	}
+
+	for _, tt := range steps {
+		fresh, err := MarkTOTPStepUsed(user.ID, tt.step)
+		if err != nil {
+			t.Fatalf("MarkTOTPStepUsed(%d): %v", tt.step, err)
+		}
+		if fresh != tt.fresh {
+			t.Errorf("MarkTOTPStepUsed(%d) = %v, want %v", tt.step, fresh, tt.fresh)
+		}
+	}
+}
+
+func TestEmailLookupsIgnoreCase(t *testing.T) {
+	requireES(t)
+
+	email := "case-" + uuid.New().String() + "@example.com"
+	user := &models.User{ID: uuid.New().String(), Email: email, Role: models.RoleUser, CreatedAt: time.Now()}
+	if err := CreateUser(user); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	t.Cleanup(func() { DeleteByFieldValue(usersIndex, "id", user.ID) })
+
+	for _, variant := range []string{email, strings.ToUpper(email), "Case-" + email[len("case-"):]} {
+		exists, err := EmailExists(variant)
+		if err != nil {
+			t.Fatalf("EmailExists(%s): %v", variant, err)
+		}
+		if !exists {
+			t.Errorf("EmailExists(%s) = false", variant)
+		}
+
+		found, err := GetUserByEmail(variant)
+		if err != nil {
+			t.Fatalf("GetUserByEmail(%s): %v", variant, err)
+		}
+		if found.ID != user.ID {
+			t.Errorf("GetUserByEmail(%s) = %s, want %s", variant, found.ID, user.ID)
+		}
+	}
+}
+
+func TestNormalizeUserEmails(t *testing.T) {
+	requireES(t)
+
+	suffix := uuid.New().String() + "@example.com"
+	users := []*models.User{
+		{ID: uuid.New().String(), Email: "Mixed-" + suffix},
+		{ID: uuid.New().String(), Email: "twin-" + suffix},
+		{ID: uuid.New().String(), Email: "Twin-" + suffix},
+	}
+	for _, user := range users {
+		user.Role = models.RoleUser
+		user.CreatedAt = time.Now()
+		if err := CreateUser(user); err != nil {
+			t.Fatalf("CreateUser: %v", err)
+		}
+		id := user.ID
+		t.Cleanup(func() { DeleteByFieldValue(usersIndex, "id", id) })
+	}
+
+	normalized, conflicts, err := NormalizeUserEmails()
+	if err != nil {
+		t.Fatalf("NormalizeUserEmails: %v", err)
+	}
+	if normalized < 1 {
+		t.Errorf("normalized %d users, want at least 1", normalized)
+	}
+
+	mixed, err := GetUserByID(users[0].ID)
+	if err != nil {
+		t.Fatalf("GetUserByID: %v", err)
+	}
+	if mixed.Email != "mixed-"+suffix {
+		t.Errorf("email = %s, want it lowercased", mixed.Email)
+	}
+
+	if !slices.Contains(conflicts, "twin-"+suffix) {
+		t.Errorf("conflicts %v don't include the case variants", conflicts)
+	}
+	twin, err := GetUserByID(users[2].ID)
+	if err != nil {
+		t.Fatalf("GetUserByID: %v", err)
+	}
+	if twin.Email != users[2].Email {
+		t.Errorf("conflicting email was changed to %s", twin.Email)
+	}
+}
@@ -0,0 +1,179 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"eurovision-api/models"
+	"fmt"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+var ErrAuthTokenNotFound = errors.New("token not found")
+
+/**
+ * creates the auth tokens index with proper mappings if it doesn't exist.
+ */
+func createAuthTokensIndex() error {
+
+	mapping := `{
+		"mappings": {
+			"properties": {
+				"token_hash": {
+					"type": "keyword"
+				},
+				"user_id": {
+					"type": "keyword"
+				},
+				"purpose": {
+					"type": "keyword"
+				},
+				"email": {
+					"type": "keyword"
+				},
+				"expires_at": {
+					"type": "date"
+				},
+				"used_at": {
+					"type": "date"
+				},
+				"created_at": {
+					"type": "date"
+				}
+			}
+		}
+	}`
+
+	return createIndex(authTokensIndex, mapping)
+}
+
+/**
+ * stores a new token, keyed by its hash
+ */
+func CreateAuthToken(token *models.AuthToken) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, err := esClient.Index().
+		Index(authTokensIndex).
+		Id(token.TokenHash).
+		OpType("create").
+		BodyJson(token).
+		Refresh("true").
+		Do(ctx)
+
+	if err != nil {
+		return fmt.Errorf("error creating auth token: %v", err)
+	}
+
+	return nil
+}
+
+/**
+ * gets a token by its hash, including its sequence number for
+ * MarkAuthTokenUsed
+ */
+func GetAuthToken(tokenHash string) (*models.AuthToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	result, err := esClient.Get().
+		Index(authTokensIndex).
+		Id(tokenHash).
+		Do(ctx)
+
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return nil, ErrAuthTokenNotFound
+		}
+		return nil, fmt.Errorf("error getting auth token: %v", err)
+	}
+
+	var token models.AuthToken
+	if err := json.Unmarshal(result.Source, &token); err != nil {
+		return nil, fmt.Errorf("error unmarshaling auth token: %v", err)
+	}
+	if result.SeqNo != nil && result.PrimaryTerm != nil {
+		token.SeqNo = *result.SeqNo
+		token.PrimaryTerm = *result.PrimaryTerm
+	}
+
+	return &token, nil
+}
+
+/**
+ * marks the token as used, provided it hasn't changed since it was read.
+ * Returns false when a concurrent request consumed it first.
+ */
+func MarkAuthTokenUsed(token *models.AuthToken, usedAt time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	token.UsedAt = &usedAt
+
+	_, err := esClient.Index().
+		Index(authTokensIndex).
+		Id(token.TokenHash).
+		IfSeqNo(token.SeqNo).
+		IfPrimaryTerm(token.PrimaryTerm).
+		BodyJson(token).
+		Refresh("true").
+		Do(ctx)
+
+	if err != nil {
+		if elastic.IsConflict(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("error consuming auth token: %v", err)
+	}
+
+	return true, nil
+}
+
+/**
+ * deletes the user's tokens for the given purpose, invalidating any links
+ * already sent
+ */
+func DeleteAuthTokens(userID, purpose string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	query := elastic.NewBoolQuery().Filter(
+		elastic.NewTermQuery("user_id", userID),
+		elastic.NewTermQuery("purpose", purpose),
+	)
+
+	_, err := esClient.DeleteByQuery().
+		Index(authTokensIndex).
+		Query(query).
+		Refresh("true").
+		Do(ctx)
+
+	if err != nil {
+		return fmt.Errorf("error deleting auth tokens: %v", err)
+	}
+
+	return nil
+}
+
+/**
+ * deletes tokens that expired before the cutoff, used or not
+ */
+func DeleteExpiredAuthTokens(cutoff time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, err := esClient.DeleteByQuery().
+		Index(authTokensIndex).
+		Query(elastic.NewRangeQuery("expires_at").Lt(cutoff)).
+		Refresh("true").
+		Do(ctx)
+
+	if err != nil {
+		return fmt.Errorf("error deleting expired auth tokens: %v", err)
+	}
+
+	return nil
+}
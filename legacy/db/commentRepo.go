@@ -0,0 +1,514 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"eurovision-api/models"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// how often a report count update is retried when another write got there first
+const commentReportRetries = 10
+
+// moderation queue filters
+const (
+	ModerationQueueReported = "reported"
+	ModerationQueueHidden   = "hidden"
+)
+
+var (
+	ErrCommentNotFound = errors.New("comment not found")
+	ErrAlreadyReported = errors.New("comment already reported")
+)
+
+/**
+ * creates the comments index with proper mappings if it doesn't exist.
+ */
+func createCommentsIndex() error {
+
+	mapping := `{
+		"mappings": {
+			"properties": {
+				"id": {
+					"type": "keyword"
+				},
+				"ranking_id": {
+					"type": "keyword"
+				},
+				"ranking_owner_id": {
+					"type": "keyword"
+				},
+				"thread_id": {
+					"type": "keyword"
+				},
+				"parent_id": {
+					"type": "keyword"
+				},
+				"depth": {
+					"type": "integer"
+				},
+				"user_id": {
+					"type": "keyword"
+				},
+				"body": {
+					"type": "text"
+				},
+				"created_at": {
+					"type": "date"
+				},
+				"edited_at": {
+					"type": "date"
+				},
+				"deleted": {
+					"type": "boolean"
+				},
+				"hidden": {
+					"type": "boolean"
+				},
+				"hidden_by": {
+					"type": "keyword"
+				},
+				"hidden_at": {
+					"type": "date"
+				},
+				"hidden_reason": {
+					"type": "text"
+				},
+				"report_count": {
+					"type": "integer"
+				},
+				"last_reported_at": {
+					"type": "date"
+				}
+			}
+		}
+	}`
+
+	return createIndex(commentsIndex, mapping)
+}
+
+/**
+ * creates the comment reports index with proper mappings if it doesn't exist.
+ */
+func createCommentReportsIndex() error {
+
+	mapping := `{
+		"mappings": {
+			"properties": {
+				"comment_id": {
+					"type": "keyword"
+				},
+				"ranking_id": {
+					"type": "keyword"
+				},
+				"ranking_owner_id": {
+					"type": "keyword"
+				},
+				"user_id": {
+					"type": "keyword"
+				},
+				"reason": {
+					"type": "text"
+				},
+				"created_at": {
+					"type": "date"
+				}
+			}
+		}
+	}`
+
+	return createIndex(commentReportsIndex, mapping)
+}
+
+/**
+ * stores a new comment
+ */
+func CreateComment(comment *models.Comment) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, err := esClient.Index().
+		Index(commentsIndex).
+		Id(comment.ID).
+		OpType("create").
+		BodyJson(comment).
+		Refresh("true").
+		Do(ctx)
+
+	if err != nil {
+		return fmt.Errorf("error creating comment: %v", err)
+	}
+
+	return nil
+}
+
+/**
+ * gets a comment by its ID
+ */
+func GetCommentByID(commentID string) (*models.Comment, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	result, err := esClient.Get().
+		Index(commentsIndex).
+		Id(commentID).
+		Do(ctx)
+
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return nil, ErrCommentNotFound
+		}
+		return nil, fmt.Errorf("error getting comment: %v", err)
+	}
+
+	var comment models.Comment
+	if err := json.Unmarshal(result.Source, &comment); err != nil {
+		return nil, fmt.Errorf("error unmarshaling comment: %v", err)
+	}
+
+	return &comment, nil
+}
+
+/**
+ * replaces the comment's body and records when it was edited
+ */
+func UpdateCommentBody(commentID, body string, editedAt time.Time) error {
+	return updateComment(commentID, map[string]interface{}{
+		"body":      body,
+		"edited_at": editedAt,
+	})
+}
+
+/**
+ * removes the comment's body and marks it deleted. The comment stays in place
+ * so replies to it keep their thread.
+ */
+func DeleteComment(commentID string) error {
+	return updateComment(commentID, map[string]interface{}{
+		"body":    "",
+		"deleted": true,
+	})
+}
+
+/**
+ * hides the comment from everyone but moderators
+ */
+func HideComment(commentID, moderatorID, reason string) error {
+	return updateComment(commentID, map[string]interface{}{
+		"hidden":        true,
+		"hidden_by":     moderatorID,
+		"hidden_at":     time.Now(),
+		"hidden_reason": reason,
+	})
+}
+
+/**
+ * makes a hidden or reported comment visible again and clears its reports,
+ * so it leaves the moderation queue and can be reported afresh
+ */
+func RestoreComment(commentID string) error {
+	if err := DeleteByFieldValue(commentReportsIndex, "comment_id", commentID); err != nil {
+		return fmt.Errorf("error clearing comment reports: %v", err)
+	}
+
+	return updateComment(commentID, map[string]interface{}{
+		"hidden":           false,
+		"hidden_by":        nil,
+		"hidden_at":        nil,
+		"hidden_reason":    nil,
+		"report_count":     0,
+		"last_reported_at": nil,
+	})
+}
+
+func updateComment(commentID string, fields map[string]interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, err := esClient.Update().
+		Index(commentsIndex).
+		Id(commentID).
+		Doc(fields).
+		Refresh("true").
+		Do(ctx)
+
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return ErrCommentNotFound
+		}
+		return fmt.Errorf("error updating comment: %v", err)
+	}
+
+	return nil
+}
+
+/**
+ * gets a page of the ranking's top level comments, oldest first
+ */
+func GetCommentThreads(rankingID string, from, size int) ([]models.Comment, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	query := elastic.NewBoolQuery().
+		Filter(
+			elastic.NewTermQuery("ranking_id", rankingID),
+			elastic.NewTermQuery("depth", 0),
+		)
+
+	result, err := esClient.Search().
+		Index(commentsIndex).
+		Query(query).
+		Sort("created_at", true).
+		From(from).
+		Size(size).
+		TrackTotalHits(true).
+		Do(ctx)
+
+	if err != nil {
+		return nil, 0, fmt.Errorf("error getting comments: %v", err)
+	}
+
+	comments := []models.Comment{}
+	for _, hit := range result.Hits.Hits {
+		var comment models.Comment
+		if err := json.Unmarshal(hit.Source, &comment); err != nil {
+			return nil, 0, fmt.Errorf("error unmarshaling comment: %v", err)
+		}
+		comments = append(comments, comment)
+	}
+
+	return comments, result.TotalHits(), nil
+}
+
+/**
+ * gets every reply in the given threads, oldest first
+ */
+func GetCommentReplies(threadIDs []string) ([]models.Comment, error) {
+	replies := []models.Comment{}
+	if len(threadIDs) == 0 {
+		return replies, nil
+	}
+
+	ids := make([]interface{}, 0, len(threadIDs))
+	for _, id := range threadIDs {
+		ids = append(ids, id)
+	}
+
+	query := elastic.NewBoolQuery().
+		Filter(elastic.NewTermsQuery("thread_id", ids...)).
+		MustNot(elastic.NewTermQuery("depth", 0))
+
+	sources, err := searchAll(commentsIndex, query)
+	if err != nil {
+		return nil, fmt.Errorf("error getting comment replies: %v", err)
+	}
+
+	for _, source := range sources {
+		var comment models.Comment
+		if err := json.Unmarshal(source, &comment); err != nil {
+			return nil, fmt.Errorf("error unmarshaling comment: %v", err)
+		}
+		replies = append(replies, comment)
+	}
+
+	sort.Slice(replies, func(i, j int) bool {
+		return replies[i].CreatedAt.Before(replies[j].CreatedAt)
+	})
+
+	return replies, nil
+}
+
+/**
+ * gets every comment the user wrote
+ */
+func GetCommentsByUserID(userID string) ([]models.Comment, error) {
+	sources, err := searchAllByFieldValue(commentsIndex, "user_id", userID)
+	if err != nil {
+		return nil, err
+	}
+
+	comments := []models.Comment{}
+	for _, source := range sources {
+		var comment models.Comment
+		if err := json.Unmarshal(source, &comment); err != nil {
+			return nil, fmt.Errorf("error unmarshaling comment: %v", err)
+		}
+		comments = append(comments, comment)
+	}
+
+	return comments, nil
+}
+
+/**
+ * records a report and bumps the comment's report count. Returns
+ * ErrAlreadyReported if the user reported the comment before.
+ */
+func ReportComment(report *models.CommentReport) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, err := esClient.Index().
+		Index(commentReportsIndex).
+		Id(report.CommentID + ":" + report.UserID).
+		OpType("create").
+		BodyJson(report).
+		Refresh("true").
+		Do(ctx)
+
+	if err != nil {
+		if elastic.IsConflict(err) {
+			return ErrAlreadyReported
+		}
+		return fmt.Errorf("error reporting comment: %v", err)
+	}
+
+	script := elastic.NewScript(`
+		ctx._source.report_count = (ctx._source.report_count == null ? 0 : ctx._source.report_count) + 1;
+		ctx._source.last_reported_at = params.reported_at;
+	`).Param("reported_at", report.CreatedAt)
+
+	_, err = esClient.Update().
+		Index(commentsIndex).
+		Id(report.CommentID).
+		Script(script).
+		RetryOnConflict(commentReportRetries).
+		Refresh("true").
+		Do(ctx)
+
+	if err != nil {
+		return fmt.Errorf("error counting comment report: %v", err)
+	}
+
+	return nil
+}
+
+/**
+ * gets the reports on the given comments, keyed by comment id
+ */
+func GetCommentReports(commentIDs []string) (map[string][]models.CommentReport, error) {
+	reports := map[string][]models.CommentReport{}
+	if len(commentIDs) == 0 {
+		return reports, nil
+	}
+
+	ids := make([]interface{}, 0, len(commentIDs))
+	for _, id := range commentIDs {
+		ids = append(ids, id)
+	}
+
+	sources, err := searchAll(commentReportsIndex, elastic.NewTermsQuery("comment_id", ids...))
+	if err != nil {
+		return nil, fmt.Errorf("error getting comment reports: %v", err)
+	}
+
+	for _, source := range sources {
+		var report models.CommentReport
+		if err := json.Unmarshal(source, &report); err != nil {
+			return nil, fmt.Errorf("error unmarshaling comment report: %v", err)
+		}
+		reports[report.CommentID] = append(reports[report.CommentID], report)
+	}
+
+	return reports, nil
+}
+
+/**
+ * gets a page of the moderation queue. The reported queue holds visible
+ * comments with open reports, most recently reported first. The hidden queue
+ * holds hidden comments, most recently hidden first.
+ */
+func GetModerationQueue(queue string, from, size int) ([]models.Comment, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	query := elastic.NewBoolQuery().
+		MustNot(elastic.NewTermQuery("deleted", true))
+	sortField := "hidden_at"
+
+	switch queue {
+	case ModerationQueueReported:
+		query.Filter(elastic.NewRangeQuery("report_count").Gt(0)).
+			MustNot(elastic.NewTermQuery("hidden", true))
+		sortField = "last_reported_at"
+	case ModerationQueueHidden:
+		query.Filter(elastic.NewTermQuery("hidden", true))
+	default:
+		return nil, 0, fmt.Errorf("unknown moderation queue: %s", queue)
+	}
+
+	result, err := esClient.Search().
+		Index(commentsIndex).
+		Query(query).
+		Sort(sortField, false).
+		From(from).
+		Size(size).
+		TrackTotalHits(true).
+		Do(ctx)
+
+	if err != nil {
+		return nil, 0, fmt.Errorf("error getting moderation queue: %v", err)
+	}
+
+	comments := []models.Comment{}
+	for _, hit := range result.Hits.Hits {
+		var comment models.Comment
+		if err := json.Unmarshal(hit.Source, &comment); err != nil {
+			return nil, 0, fmt.Errorf("error unmarshaling comment: %v", err)
+		}
+		comments = append(comments, comment)
+	}
+
+	return comments, result.TotalHits(), nil
+}
+
+/**
+ * deletes a ranking's comments and the reports on them
+ */
+func DeleteCommentsForRanking(rankingID string) error {
+	if err := DeleteByFieldValue(commentsIndex, "ranking_id", rankingID); err != nil {
+		return err
+	}
+
+	return DeleteByFieldValue(commentReportsIndex, "ranking_id", rankingID)
+}
+
+/**
+ * removes the user from comments: their own comments are emptied and
+ * unlinked from them but stay in their threads, their reports are deleted,
+ * and comments on their rankings are deleted outright
+ */
+func deleteCommentsForUser(userID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 6*timeout)
+	defer cancel()
+
+	script := elastic.NewScript(`
+		ctx._source.body = "";
+		ctx._source.deleted = true;
+		ctx._source.remove("user_id");
+	`)
+
+	_, err := esClient.UpdateByQuery(commentsIndex).
+		Query(elastic.NewTermQuery("user_id", userID)).
+		Script(script).
+		Refresh("true").
+		Do(ctx)
+
+	if err != nil {
+		return fmt.Errorf("error removing user comments: %v", err)
+	}
+
+	if err := DeleteByFieldValue(commentReportsIndex, "user_id", userID); err != nil {
+		return err
+	}
+
+	if err := DeleteByFieldValue(commentsIndex, "ranking_owner_id", userID); err != nil {
+		return err
+	}
+
+	return DeleteByFieldValue(commentReportsIndex, "ranking_owner_id", userID)
+}
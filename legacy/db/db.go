@@ -2,7 +2,10 @@ package db
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"sync"
 	"time"
@@ -12,14 +15,34 @@ import (
 )
 
 const (
-	usersIndex    = "users"
-	RankingsIndex = "user_rankings"
-	timeout       = 5 * time.Second
+	usersIndex          = "users"
+	RankingsIndex       = "user_rankings"
+	revisionsIndex      = "ranking_revisions"
+	VotesIndex          = "eurovision_votes"
+	adminAuditIndex     = "admin_audit_log"
+	identitiesIndex     = "user_identities"
+	accessTokensIndex   = "personal_access_tokens"
+	emailOutboxIndex    = "email_outbox"
+	authTokensIndex     = "auth_tokens"
+	sessionsIndex       = "sessions"
+	profilesIndex       = "profiles"
+	handlesIndex        = "user_handles"
+	securityEventsIndex = "security_events"
+	FollowsIndex        = "follows"
+	reactionsIndex      = "ranking_reactions"
+	reactionCountsIndex = "ranking_reaction_counts"
+	commentsIndex       = "ranking_comments"
+	commentReportsIndex = "comment_reports"
+	scrollPageSize      = 500
+	scrollKeepAlive     = "1m"
+	timeout             = 5 * time.Second
 )
 
 var (
 	esClient *elastic.Client
 	once     sync.Once
+
+	ErrUserNotFound = errors.New("user not found")
 )
 
 /**
@@ -37,8 +60,33 @@ func InitES() error {
 			return
 		}
 		esClient = client
-		initErr = createUsersIndex()
-		initErr = createRankingsIndex()
+
+		for _, create := range []func() error{
+			createUsersIndex,
+			createRankingsIndex,
+			createRevisionsIndex,
+			createVotesIndex,
+			createAdminAuditIndex,
+			createIdentitiesIndex,
+			createAccessTokensIndex,
+			createEmailOutboxIndex,
+			createAuthTokensIndex,
+			createSessionsIndex,
+			createProfilesIndex,
+			createHandlesIndex,
+			createSecurityEventsIndex,
+			createFollowsIndex,
+			createReactionsIndex,
+			createReactionCountsIndex,
+			createCommentsIndex,
+			createCommentReportsIndex,
+		} {
+			if initErr = create(); initErr != nil {
+				return
+			}
+		}
+
+		initErr = removeLegacyUserTokens()
 	})
 	return initErr
 }
@@ -155,3 +203,46 @@ func CountByFieldValue(indexName, fieldName, value string) (int64, error) {
 
 	return result, nil
 }
+
+/*
+returns the source of every document in the index where the field value matches
+the provided value, scrolling through all pages of results.
+*/
+func searchAllByFieldValue(indexName, fieldName, value string) ([]json.RawMessage, error) {
+	sources, err := searchAll(indexName, elastic.NewTermQuery(fieldName, value))
+	if err != nil {
+		return nil, fmt.Errorf("error scrolling %s docs with %s = %s: %v", indexName, fieldName, value, err)
+	}
+
+	return sources, nil
+}
+
+/*
+returns the source of every document in the index matching the query,
+scrolling through all pages of results. Results are in no particular order.
+*/
+func searchAll(indexName string, query elastic.Query) ([]json.RawMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 6*timeout)
+	defer cancel()
+
+	scroll := esClient.Scroll(indexName).
+		Query(query).
+		Size(scrollPageSize).
+		KeepAlive(scrollKeepAlive)
+	defer scroll.Clear(context.Background())
+
+	var sources []json.RawMessage
+	for {
+		result, err := scroll.Do(ctx)
+		if err == io.EOF {
+			return sources, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, hit := range result.Hits.Hits {
+			sources = append(sources, hit.Source)
+		}
+	}
+}
@@ -0,0 +1,358 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"eurovision-api/models"
+	"fmt"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+var ErrOutboundEmailNotFound = errors.New("email not found")
+
+/**
+ * creates the email outbox index with proper mappings if it doesn't exist.
+ * Message bodies are stored but not indexed.
+ */
+func createEmailOutboxIndex() error {
+
+	mapping := `{
+		"mappings": {
+			"properties": {
+				"id": {
+					"type": "keyword"
+				},
+				"to": {
+					"type": "keyword"
+				},
+				"subject": {
+					"type": "text"
+				},
+				"text": {
+					"type": "text",
+					"index": false
+				},
+				"html": {
+					"type": "text",
+					"index": false
+				},
+				"status": {
+					"type": "keyword"
+				},
+				"attempts": {
+					"type": "integer"
+				},
+				"next_attempt_at": {
+					"type": "date"
+				},
+				"lease_expires_at": {
+					"type": "date"
+				},
+				"last_error": {
+					"type": "text"
+				},
+				"created_at": {
+					"type": "date"
+				},
+				"updated_at": {
+					"type": "date"
+				},
+				"sent_at": {
+					"type": "date"
+				}
+			}
+		}
+	}`
+
+	return createIndex(emailOutboxIndex, mapping)
+}
+
+/**
+ * adds a new message to the outbox
+ */
+func CreateOutboundEmail(email *models.OutboundEmail) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, err := esClient.Index().
+		Index(emailOutboxIndex).
+		Id(email.ID).
+		OpType("create").
+		BodyJson(email).
+		Refresh("true").
+		Do(ctx)
+
+	if err != nil {
+		return fmt.Errorf("error queueing email: %v", err)
+	}
+
+	return nil
+}
+
+/**
+ * gets an outbox message by id, including its sequence number for a later
+ * conditional save
+ */
+func GetOutboundEmailByID(id string) (*models.OutboundEmail, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	result, err := esClient.Get().
+		Index(emailOutboxIndex).
+		Id(id).
+		Do(ctx)
+
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return nil, ErrOutboundEmailNotFound
+		}
+		return nil, fmt.Errorf("error getting email: %v", err)
+	}
+
+	var email models.OutboundEmail
+	if err := json.Unmarshal(result.Source, &email); err != nil {
+		return nil, fmt.Errorf("error unmarshaling email: %v", err)
+	}
+	if result.SeqNo != nil && result.PrimaryTerm != nil {
+		email.SeqNo = *result.SeqNo
+		email.PrimaryTerm = *result.PrimaryTerm
+	}
+
+	return &email, nil
+}
+
+/**
+ * gets messages that are ready to be attempted: pending messages whose next
+ * attempt is due, and messages whose sending lease ran out because a worker
+ * stopped mid-delivery. Oldest first.
+ */
+func GetDueOutboundEmails(now time.Time, limit int) ([]models.OutboundEmail, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	query := elastic.NewBoolQuery().
+		Should(
+			elastic.NewBoolQuery().Filter(
+				elastic.NewTermQuery("status", models.EmailStatusPending),
+				elastic.NewRangeQuery("next_attempt_at").Lte(now),
+			),
+			elastic.NewBoolQuery().Filter(
+				elastic.NewTermQuery("status", models.EmailStatusSending),
+				elastic.NewRangeQuery("lease_expires_at").Lte(now),
+			),
+		).
+		MinimumNumberShouldMatch(1)
+
+	result, err := esClient.Search().
+		Index(emailOutboxIndex).
+		Query(query).
+		Sort("next_attempt_at", true).
+		Size(limit).
+		SeqNoAndPrimaryTerm(true).
+		Do(ctx)
+
+	if err != nil {
+		return nil, fmt.Errorf("error getting due emails: %v", err)
+	}
+
+	return outboundEmailsFromHits(result.Hits.Hits)
+}
+
+/**
+ * saves the message only if nobody else has changed it since it was read.
+ * Returns false when another worker got there first. On success the
+ * message's sequence number is updated for the next save.
+ */
+func SaveOutboundEmail(email *models.OutboundEmail) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	result, err := esClient.Index().
+		Index(emailOutboxIndex).
+		Id(email.ID).
+		IfSeqNo(email.SeqNo).
+		IfPrimaryTerm(email.PrimaryTerm).
+		BodyJson(email).
+		Refresh("true").
+		Do(ctx)
+
+	if err != nil {
+		if elastic.IsConflict(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("error saving email: %v", err)
+	}
+
+	email.SeqNo = result.SeqNo
+	email.PrimaryTerm = result.PrimaryTerm
+
+	return true, nil
+}
+
+/**
+ * searches the outbox by status and recipient, newest first. Empty filters
+ * are ignored. Returns the matching messages and the total number of hits.
+ */
+func SearchOutboundEmails(status, to string, from, size int) ([]models.OutboundEmail, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	query := elastic.NewBoolQuery()
+	if status != "" {
+		query.Filter(elastic.NewTermQuery("status", status))
+	}
+	if to != "" {
+		query.Filter(elastic.NewTermQuery("to", to))
+	}
+
+	result, err := esClient.Search().
+		Index(emailOutboxIndex).
+		Query(query).
+		Sort("created_at", false).
+		From(from).
+		Size(size).
+		TrackTotalHits(true).
+		Do(ctx)
+
+	if err != nil {
+		return nil, 0, fmt.Errorf("error searching emails: %v", err)
+	}
+
+	emails, err := outboundEmailsFromHits(result.Hits.Hits)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return emails, result.TotalHits(), nil
+}
+
+/**
+ * deletes delivered messages sent before the cutoff. They hold one-time
+ * links, so there is no reason to keep them around.
+ */
+func DeleteSentOutboundEmails(before time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	query := elastic.NewBoolQuery().Filter(
+		elastic.NewTermQuery("status", models.EmailStatusSent),
+		elastic.NewRangeQuery("sent_at").Lt(before),
+	)
+
+	_, err := esClient.DeleteByQuery().
+		Index(emailOutboxIndex).
+		Query(query).
+		Refresh("true").
+		Do(ctx)
+
+	if err != nil {
+		return fmt.Errorf("error deleting sent emails: %v", err)
+	}
+
+	return nil
+}
+
+/**
+ * empties the bodies of messages that died before the cutoff, so the links in
+ * them aren't kept once nobody will retry them
+ */
+func ClearDeadOutboundEmailBodies(before time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	query := elastic.NewBoolQuery().
+		Filter(
+			elastic.NewTermQuery("status", models.EmailStatusDead),
+			elastic.NewRangeQuery("updated_at").Lt(before),
+		)
+
+	_, err := esClient.UpdateByQuery(emailOutboxIndex).
+		Query(query).
+		Script(elastic.NewScript(`
+			ctx._source.remove("text");
+			ctx._source.remove("html");
+		`)).
+		ProceedOnVersionConflict().
+		Refresh("true").
+		Do(ctx)
+
+	if err != nil {
+		return fmt.Errorf("error clearing dead email bodies: %v", err)
+	}
+
+	return nil
+}
+
+/**
+ * deletes messages that died before the cutoff
+ */
+func DeleteDeadOutboundEmails(before time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	query := elastic.NewBoolQuery().Filter(
+		elastic.NewTermQuery("status", models.EmailStatusDead),
+		elastic.NewRangeQuery("updated_at").Lt(before),
+	)
+
+	_, err := esClient.DeleteByQuery().
+		Index(emailOutboxIndex).
+		Query(query).
+		Refresh("true").
+		Do(ctx)
+
+	if err != nil {
+		return fmt.Errorf("error deleting dead emails: %v", err)
+	}
+
+	return nil
+}
+
+/**
+ * deletes every message addressed to any of the given addresses
+ */
+func DeleteOutboundEmailsTo(addresses ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	recipients := []interface{}{}
+	for _, address := range addresses {
+		if address != "" {
+			recipients = append(recipients, address)
+		}
+	}
+	if len(recipients) == 0 {
+		return nil
+	}
+
+	_, err := esClient.DeleteByQuery().
+		Index(emailOutboxIndex).
+		Query(elastic.NewTermsQuery("to", recipients...)).
+		Refresh("true").
+		Do(ctx)
+
+	if err != nil {
+		return fmt.Errorf("error deleting emails: %v", err)
+	}
+
+	return nil
+}
+
+func outboundEmailsFromHits(hits []*elastic.SearchHit) ([]models.OutboundEmail, error) {
+	emails := []models.OutboundEmail{}
+	for _, hit := range hits {
+		var email models.OutboundEmail
+		if err := json.Unmarshal(hit.Source, &email); err != nil {
+			return nil, fmt.Errorf("error unmarshaling email: %v", err)
+		}
+		if hit.SeqNo != nil && hit.PrimaryTerm != nil {
+			email.SeqNo = *hit.SeqNo
+			email.PrimaryTerm = *hit.PrimaryTerm
+		}
+		emails = append(emails, email)
+	}
+	return emails, nil
+}
@@ -0,0 +1,195 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"eurovision-api/models"
+	"fmt"
+
+	"github.com/olivere/elastic/v7"
+)
+
+var (
+	ErrNotFollowing     = errors.New("not following this user")
+	ErrAlreadyFollowing = errors.New("already following this user")
+)
+
+/**
+ * creates the follows index with proper mappings if it doesn't exist.
+ */
+func createFollowsIndex() error {
+
+	mapping := `{
+		"mappings": {
+			"properties": {
+				"follower_id": {
+					"type": "keyword"
+				},
+				"followee_id": {
+					"type": "keyword"
+				},
+				"created_at": {
+					"type": "date"
+				}
+			}
+		}
+	}`
+
+	return createIndex(FollowsIndex, mapping)
+}
+
+func followID(followerID, followeeID string) string {
+	return followerID + ":" + followeeID
+}
+
+/**
+ * records that the follower follows the followee. Returns ErrAlreadyFollowing
+ * if they already do.
+ */
+func CreateFollow(follow *models.Follow) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, err := esClient.Index().
+		Index(FollowsIndex).
+		Id(followID(follow.FollowerID, follow.FolloweeID)).
+		OpType("create").
+		BodyJson(follow).
+		Refresh("true").
+		Do(ctx)
+
+	if err != nil {
+		if elastic.IsConflict(err) {
+			return ErrAlreadyFollowing
+		}
+		return fmt.Errorf("error creating follow: %v", err)
+	}
+
+	return nil
+}
+
+/**
+ * removes a follow. Returns ErrNotFollowing if there was none.
+ */
+func DeleteFollow(followerID, followeeID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, err := esClient.Delete().
+		Index(FollowsIndex).
+		Id(followID(followerID, followeeID)).
+		Refresh("true").
+		Do(ctx)
+
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return ErrNotFollowing
+		}
+		return fmt.Errorf("error deleting follow: %v", err)
+	}
+
+	return nil
+}
+
+/**
+ * gets the users the user follows, most recently followed first
+ */
+func GetFollowing(userID string, from, size int) ([]models.Follow, int64, error) {
+	return searchFollows("follower_id", userID, from, size)
+}
+
+/**
+ * gets the user's followers, most recent first
+ */
+func GetFollowers(userID string, from, size int) ([]models.Follow, int64, error) {
+	return searchFollows("followee_id", userID, from, size)
+}
+
+func searchFollows(field, userID string, from, size int) ([]models.Follow, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	result, err := esClient.Search().
+		Index(FollowsIndex).
+		Query(elastic.NewTermQuery(field, userID)).
+		Sort("created_at", false).
+		From(from).
+		Size(size).
+		TrackTotalHits(true).
+		Do(ctx)
+
+	if err != nil {
+		return nil, 0, fmt.Errorf("error getting follows: %v", err)
+	}
+
+	follows, err := unmarshalFollows(result.Hits.Hits)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return follows, result.TotalHits(), nil
+}
+
+/**
+ * gets the ids of every user the user follows
+ */
+func GetAllFolloweeIDs(userID string) ([]string, error) {
+	follows, err := GetAllFollowing(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(follows))
+	for _, follow := range follows {
+		ids = append(ids, follow.FolloweeID)
+	}
+
+	return ids, nil
+}
+
+/**
+ * gets every follow made by the user, without the page limit applied by
+ * GetFollowing
+ */
+func GetAllFollowing(userID string) ([]models.Follow, error) {
+	return getAllFollows("follower_id", userID)
+}
+
+/**
+ * gets every follow of the user, without the page limit applied by
+ * GetFollowers
+ */
+func GetAllFollowers(userID string) ([]models.Follow, error) {
+	return getAllFollows("followee_id", userID)
+}
+
+func getAllFollows(field, userID string) ([]models.Follow, error) {
+	sources, err := searchAllByFieldValue(FollowsIndex, field, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	follows := []models.Follow{}
+	for _, source := range sources {
+		var follow models.Follow
+		if err := json.Unmarshal(source, &follow); err != nil {
+			return nil, fmt.Errorf("error unmarshaling follow: %v", err)
+		}
+		follows = append(follows, follow)
+	}
+
+	return follows, nil
+}
+
+func unmarshalFollows(hits []*elastic.SearchHit) ([]models.Follow, error) {
+	follows := []models.Follow{}
+	for _, hit := range hits {
+		var follow models.Follow
+		if err := json.Unmarshal(hit.Source, &follow); err != nil {
+			return nil, fmt.Errorf("error unmarshaling follow: %v", err)
+		}
+		follows = append(follows, follow)
+	}
+	return follows, nil
+}
@@ -0,0 +1,123 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"eurovision-api/models"
+	"fmt"
+
+	"github.com/olivere/elastic/v7"
+)
+
+/**
+ * creates the user identities index with proper mappings if it doesn't exist.
+ */
+func createIdentitiesIndex() error {
+
+	mapping := `{
+		"mappings": {
+			"properties": {
+				"id": {
+					"type": "keyword"
+				},
+				"user_id": {
+					"type": "keyword"
+				},
+				"provider": {
+					"type": "keyword"
+				},
+				"subject": {
+					"type": "keyword"
+				},
+				"email": {
+					"type": "keyword"
+				},
+				"created_at": {
+					"type": "date"
+				}
+			}
+		}
+	}`
+
+	return createIndex(identitiesIndex, mapping)
+}
+
+/**
+ * links an external identity to a user. The document ID is derived from the
+ * provider and subject so the same identity can never be linked twice.
+ */
+func CreateIdentity(identity *models.UserIdentity) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, err := esClient.Index().
+		Index(identitiesIndex).
+		Id(identity.Provider + ":" + identity.Subject).
+		OpType("create").
+		BodyJson(identity).
+		Refresh("true").
+		Do(ctx)
+
+	if err != nil {
+		return fmt.Errorf("error creating identity: %v", err)
+	}
+
+	return nil
+}
+
+/**
+ * gets the identity for the given provider and subject, or nil if the
+ * identity has not been linked to a user yet
+ */
+func GetIdentity(provider, subject string) (*models.UserIdentity, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	query := elastic.NewBoolQuery().
+		Filter(
+			elastic.NewTermQuery("provider", provider),
+			elastic.NewTermQuery("subject", subject),
+		)
+
+	result, err := esClient.Search().
+		Index(identitiesIndex).
+		Query(query).
+		Size(1).
+		Do(ctx)
+
+	if err != nil {
+		return nil, fmt.Errorf("error getting identity: %v", err)
+	}
+
+	if result.TotalHits() == 0 {
+		return nil, nil
+	}
+
+	var identity models.UserIdentity
+	if err := json.Unmarshal(result.Hits.Hits[0].Source, &identity); err != nil {
+		return nil, fmt.Errorf("error unmarshaling identity: %v", err)
+	}
+
+	return &identity, nil
+}
+
+/**
+ * gets every identity linked to the user
+ */
+func GetIdentitiesByUserID(userID string) ([]models.UserIdentity, error) {
+	sources, err := searchAllByFieldValue(identitiesIndex, "user_id", userID)
+	if err != nil {
+		return nil, err
+	}
+
+	identities := []models.UserIdentity{}
+	for _, source := range sources {
+		var identity models.UserIdentity
+		if err := json.Unmarshal(source, &identity); err != nil {
+			return nil, fmt.Errorf("error unmarshaling identity: %v", err)
+		}
+		identities = append(identities, identity)
+	}
+
+	return identities, nil
+}
@@ -0,0 +1,272 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"eurovision-api/models"
+	"fmt"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+var (
+	ErrProfileNotFound = errors.New("profile not found")
+	ErrHandleTaken     = errors.New("handle is already taken")
+)
+
+/**
+ * creates the profiles index with proper mappings if it doesn't exist.
+ */
+func createProfilesIndex() error {
+
+	mapping := `{
+		"mappings": {
+			"properties": {
+				"user_id": {
+					"type": "keyword"
+				},
+				"handle": {
+					"type": "keyword"
+				},
+				"display_name": {
+					"type": "text"
+				},
+				"bio": {
+					"type": "text"
+				},
+				"country": {
+					"type": "keyword"
+				},
+				"avatar_url": {
+					"type": "keyword",
+					"index": false
+				},
+				"created_at": {
+					"type": "date"
+				},
+				"updated_at": {
+					"type": "date"
+				}
+			}
+		}
+	}`
+
+	return createIndex(profilesIndex, mapping)
+}
+
+/**
+ * creates the handle reservations index with proper mappings if it doesn't exist.
+ */
+func createHandlesIndex() error {
+
+	mapping := `{
+		"mappings": {
+			"properties": {
+				"handle": {
+					"type": "keyword"
+				},
+				"user_id": {
+					"type": "keyword"
+				},
+				"created_at": {
+					"type": "date"
+				}
+			}
+		}
+	}`
+
+	return createIndex(handlesIndex, mapping)
+}
+
+/**
+ * gets the user's profile
+ */
+func GetProfile(userID string) (*models.Profile, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	result, err := esClient.Get().
+		Index(profilesIndex).
+		Id(userID).
+		Do(ctx)
+
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return nil, ErrProfileNotFound
+		}
+		return nil, fmt.Errorf("error getting profile: %v", err)
+	}
+
+	var profile models.Profile
+	if err := json.Unmarshal(result.Source, &profile); err != nil {
+		return nil, fmt.Errorf("error unmarshaling profile: %v", err)
+	}
+
+	return &profile, nil
+}
+
+/**
+ * gets the profile with the given handle
+ */
+func GetProfileByHandle(handle string) (*models.Profile, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	result, err := esClient.Search().
+		Index(profilesIndex).
+		Query(elastic.NewTermQuery("handle", handle)).
+		Size(1).
+		Do(ctx)
+
+	if err != nil {
+		return nil, fmt.Errorf("error getting profile: %v", err)
+	}
+
+	if result.TotalHits() == 0 {
+		return nil, ErrProfileNotFound
+	}
+
+	var profile models.Profile
+	if err := json.Unmarshal(result.Hits.Hits[0].Source, &profile); err != nil {
+		return nil, fmt.Errorf("error unmarshaling profile: %v", err)
+	}
+
+	return &profile, nil
+}
+
+/**
+ * gets the profiles of the given users, keyed by user id. Users without a
+ * profile are left out.
+ */
+func GetProfilesByUserIDs(userIDs []string) (map[string]models.Profile, error) {
+	profiles := map[string]models.Profile{}
+	if len(userIDs) == 0 {
+		return profiles, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	request := esClient.MultiGet()
+	for _, userID := range userIDs {
+		request.Add(elastic.NewMultiGetItem().Index(profilesIndex).Id(userID))
+	}
+
+	result, err := request.Do(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting profiles: %v", err)
+	}
+
+	for _, doc := range result.Docs {
+		if !doc.Found {
+			continue
+		}
+		var profile models.Profile
+		if err := json.Unmarshal(doc.Source, &profile); err != nil {
+			return nil, fmt.Errorf("error unmarshaling profile: %v", err)
+		}
+		profiles[profile.UserID] = profile
+	}
+
+	return profiles, nil
+}
+
+/**
+ * creates or replaces the user's profile
+ */
+func SaveProfile(profile *models.Profile) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, err := esClient.Index().
+		Index(profilesIndex).
+		Id(profile.UserID).
+		BodyJson(profile).
+		Refresh("true").
+		Do(ctx)
+
+	if err != nil {
+		return fmt.Errorf("error saving profile: %v", err)
+	}
+
+	return nil
+}
+
+/**
+ * claims the handle for the user. Returns ErrHandleTaken if another user
+ * holds it. Reserving a handle the user already holds succeeds.
+ */
+func ReserveHandle(handle, userID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	reservation := models.HandleReservation{
+		Handle:    handle,
+		UserID:    userID,
+		CreatedAt: time.Now(),
+	}
+
+	_, err := esClient.Index().
+		Index(handlesIndex).
+		Id(handle).
+		OpType("create").
+		BodyJson(reservation).
+		Refresh("true").
+		Do(ctx)
+
+	if err == nil {
+		return nil
+	}
+
+	if !elastic.IsConflict(err) {
+		return fmt.Errorf("error reserving handle: %v", err)
+	}
+
+	result, err := esClient.Get().
+		Index(handlesIndex).
+		Id(handle).
+		Do(ctx)
+
+	if err != nil {
+		return fmt.Errorf("error getting handle reservation: %v", err)
+	}
+
+	var existing models.HandleReservation
+	if err := json.Unmarshal(result.Source, &existing); err != nil {
+		return fmt.Errorf("error unmarshaling handle reservation: %v", err)
+	}
+
+	if existing.UserID != userID {
+		return ErrHandleTaken
+	}
+
+	return nil
+}
+
+/**
+ * frees the handle if the user holds it
+ */
+func ReleaseHandle(handle, userID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	query := elastic.NewBoolQuery().
+		Filter(
+			elastic.NewTermQuery("handle", handle),
+			elastic.NewTermQuery("user_id", userID),
+		)
+
+	_, err := esClient.DeleteByQuery().
+		Index(handlesIndex).
+		Query(query).
+		Refresh("true").
+		Do(ctx)
+
+	if err != nil {
+		return fmt.Errorf("error releasing handle: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,239 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"eurovision-api/models"
+	"eurovision-api/utils"
+	"fmt"
+	"io"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// most countries that take part in a single contest, with room to spare
+const maxCountryBuckets = 100
+
+/*
+RankingPositionFilter selects public rankings by where entries placed. Country,
+when set, is the entry the position bounds apply to. Last matches entries
+ranked last. Empty fields are ignored.
+*/
+type RankingPositionFilter struct {
+	Year        *int
+	Country     string
+	PositionGte *int
+	PositionLte *int
+	Last        bool
+}
+
+/*
+CountryPositionCount is how many rankings placed a country within a
+RankingPositionFilter.
+*/
+type CountryPositionCount struct {
+	Country  string `json:"country"`
+	Rankings int64  `json:"rankings"`
+}
+
+/**
+ * builds the conditions on a single position entry
+ */
+func (f RankingPositionFilter) positionQuery() *elastic.BoolQuery {
+	query := elastic.NewBoolQuery()
+
+	if f.Country != "" {
+		query.Filter(elastic.NewTermQuery("positions.country", f.Country))
+	}
+
+	if f.PositionGte != nil || f.PositionLte != nil {
+		position := elastic.NewRangeQuery("positions.position")
+		if f.PositionGte != nil {
+			position.Gte(*f.PositionGte)
+		}
+		if f.PositionLte != nil {
+			position.Lte(*f.PositionLte)
+		}
+		query.Filter(position)
+	}
+
+	if f.Last {
+		query.Filter(elastic.NewTermQuery("positions.from_bottom", 1))
+	}
+
+	return query
+}
+
+/**
+ * builds the conditions on the ranking itself
+ */
+func (f RankingPositionFilter) rankingQuery() *elastic.BoolQuery {
+	query := elastic.NewBoolQuery().
+		Filter(
+			elastic.NewTermQuery("public", true),
+			elastic.NewExistsQuery("country_positions"),
+		)
+
+	if f.Year != nil {
+		query.Filter(elastic.NewTermQuery("year", *f.Year))
+	}
+
+	return query
+}
+
+/**
+ * gets public rankings with an entry matching the filter, newest first
+ */
+func SearchRankingsByPosition(filter RankingPositionFilter, from, size int) ([]models.UserRanking, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	query := filter.rankingQuery().
+		Filter(elastic.NewNestedQuery("positions", filter.positionQuery()))
+
+	result, err := esClient.Search().
+		Index(RankingsIndex).
+		Query(query).
+		Sort("updated_at", false).
+		From(from).
+		Size(size).
+		TrackTotalHits(true).
+		Do(ctx)
+
+	if err != nil {
+		return nil, 0, fmt.Errorf("error searching rankings by position: %v", err)
+	}
+
+	rankings := []models.UserRanking{}
+	for _, hit := range result.Hits.Hits {
+		var ranking models.UserRanking
+		if err := json.Unmarshal(hit.Source, &ranking); err != nil {
+			return nil, 0, fmt.Errorf("error unmarshaling ranking: %v", err)
+		}
+		rankings = append(rankings, ranking)
+	}
+
+	return rankings, result.TotalHits(), nil
+}
+
+/**
+ * counts, for each country, the public rankings that placed it within the
+ * filter. Sorted by count, highest first.
+ */
+func CountRankingsByCountryPosition(filter RankingPositionFilter) ([]CountryPositionCount, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	aggregation := elastic.NewNestedAggregation().
+		Path("positions").
+		SubAggregation("matching", elastic.NewFilterAggregation().
+			Filter(filter.positionQuery()).
+			SubAggregation("countries", elastic.NewTermsAggregation().
+				Field("positions.country").
+				Size(maxCountryBuckets).
+				SubAggregation("rankings", elastic.NewReverseNestedAggregation())))
+
+	result, err := esClient.Search().
+		Index(RankingsIndex).
+		Query(filter.rankingQuery()).
+		Size(0).
+		Aggregation("positions", aggregation).
+		Do(ctx)
+
+	if err != nil {
+		return nil, fmt.Errorf("error counting rankings by position: %v", err)
+	}
+
+	counts := []CountryPositionCount{}
+
+	positions, found := result.Aggregations.Nested("positions")
+	if !found {
+		return counts, nil
+	}
+	matching, found := positions.Aggregations.Filter("matching")
+	if !found {
+		return counts, nil
+	}
+	countries, found := matching.Aggregations.Terms("countries")
+	if !found {
+		return counts, nil
+	}
+
+	for _, bucket := range countries.Buckets {
+		country, ok := bucket.Key.(string)
+		if !ok {
+			continue
+		}
+		rankings := bucket.DocCount
+		if reverse, found := bucket.Aggregations.ReverseNested("rankings"); found {
+			rankings = reverse.DocCount
+		}
+		counts = append(counts, CountryPositionCount{Country: country, Rankings: rankings})
+	}
+
+	return counts, nil
+}
+
+/**
+ * calls fn with every ranking in the index, scrolling through them in pages
+ * so they are never all held in memory
+ */
+func ForEachRanking(fn func(ranking *models.UserRanking) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*timeout)
+	defer cancel()
+
+	scroll := esClient.Scroll(RankingsIndex).
+		Size(scrollPageSize).
+		KeepAlive(scrollKeepAlive)
+	defer scroll.Clear(context.Background())
+
+	for {
+		result, err := scroll.Do(ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error scrolling rankings: %v", err)
+		}
+
+		for _, hit := range result.Hits.Hits {
+			var ranking models.UserRanking
+			if err := json.Unmarshal(hit.Source, &ranking); err != nil {
+				return fmt.Errorf("error unmarshaling ranking: %v", err)
+			}
+			if err := fn(&ranking); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+/**
+ * replaces the ranking's decoded positions and position vector without
+ * touching anything else
+ */
+func UpdateRankingPositions(ranking *models.UserRanking) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	script := elastic.NewScript(`
+		ctx._source.positions = params.positions;
+		ctx._source.country_positions = params.country_positions;
+		ctx._source.position_vector = params.position_vector;
+	`).Params(map[string]interface{}{
+		"positions":         ranking.Positions,
+		"country_positions": ranking.CountryPositions,
+		"position_vector":   utils.RankingPositionVector(ranking.Positions),
+	})
+
+	_, err := esClient.UpdateByQuery(RankingsIndex).
+		Query(elastic.NewTermQuery("ranking_id", ranking.RankingID)).
+		Script(script).
+		Do(ctx)
+
+	if err != nil {
+		return fmt.Errorf("error updating ranking positions: %v", err)
+	}
+
+	return nil
+}
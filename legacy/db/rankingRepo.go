@@ -4,13 +4,75 @@ import (
 	"context"
 	"encoding/json"
 	"eurovision-api/models"
+	"eurovision-api/utils"
 	"fmt"
 
 	"github.com/olivere/elastic/v7"
 )
 
+// mappings for the decoded positions, which are added to rankings indices
+// created before positions were indexed. position_vector is only read by
+// similarity scripts, so it isn't indexed for kNN search.
+var rankingPositionsMapping = fmt.Sprintf(`{
+	"dynamic_templates": [
+		{
+			"country_positions": {
+				"path_match": "country_positions.*",
+				"mapping": {
+					"type": "integer"
+				}
+			}
+		}
+	],
+	"properties": {
+		"positions": {
+			"type": "nested",
+			"properties": {
+				"country": {
+					"type": "keyword"
+				},
+				"position": {
+					"type": "integer"
+				},
+				"from_bottom": {
+					"type": "integer"
+				}
+			}
+		},
+		"country_positions": {
+			"type": "object"
+		},
+		"position_vector": {
+			"type": "dense_vector",
+			"dims": %d,
+			"index": false
+		}
+	}
+}`, utils.RankingVectorDims)
+
+/*
+rankingDocument is a ranking as stored in the index, with the position vector
+that similarity searches score. The vector is derived from the positions on
+every write and never returned by the API.
+*/
+type rankingDocument struct {
+	*models.UserRanking
+	PositionVector []float32 `json:"position_vector"`
+}
+
 /**
- * creates the rankings index with proper mappings if it doesn't exist.
+ * wraps the ranking with the position vector built from its positions
+ */
+func newRankingDocument(ranking *models.UserRanking) rankingDocument {
+	return rankingDocument{
+		UserRanking:    ranking,
+		PositionVector: utils.RankingPositionVector(ranking.Positions),
+	}
+}
+
+/**
+ * creates the rankings index with proper mappings if it doesn't exist, and
+ * makes sure the decoded position fields are mapped on older indices.
  */
 func createRankingsIndex() error {
 
@@ -43,12 +105,37 @@ func createRankingsIndex() error {
 				},
                 "created_at": {
                     "type": "date"
+                },
+                "updated_at": {
+                    "type": "date"
+                },
+                "comments_locked": {
+                    "type": "boolean"
+                },
+                "reaction_total": {
+                    "type": "long"
                 }
             }
         }
     }`
 
-	return createIndex(RankingsIndex, mapping)
+	if err := createIndex(RankingsIndex, mapping); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, err := esClient.PutMapping().
+		Index(RankingsIndex).
+		BodyString(rankingPositionsMapping).
+		Do(ctx)
+
+	if err != nil {
+		return fmt.Errorf("error updating rankings mapping: %v", err)
+	}
+
+	return nil
 }
 
 /**
@@ -60,7 +147,8 @@ func CreateRanking(ranking *models.UserRanking) error {
 
 	_, err := esClient.Index().
 		Index(RankingsIndex).
-		BodyJson(ranking).
+		Id(ranking.RankingID).
+		BodyJson(newRankingDocument(ranking)).
 		Refresh("true").
 		Do(ctx)
 
@@ -106,6 +194,104 @@ func GetRankingsByUserID(userID string) ([]models.UserRanking, error) {
 	return rankings, nil
 }
 
+/**
+ * gets the user's public rankings, newest first
+ */
+func GetPublicRankingsByUserID(userID string) ([]models.UserRanking, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	query := elastic.NewBoolQuery().
+		Filter(
+			elastic.NewTermQuery("user_id", userID),
+			elastic.NewTermQuery("public", true),
+		)
+
+	result, err := esClient.Search().
+		Index(RankingsIndex).
+		Query(query).
+		Sort("created_at", false).
+		Size(100).
+		Do(ctx)
+
+	if err != nil {
+		return nil, fmt.Errorf("error getting public rankings: %v", err)
+	}
+
+	rankings := []models.UserRanking{}
+	for _, hit := range result.Hits.Hits {
+		var ranking models.UserRanking
+		if err := json.Unmarshal(hit.Source, &ranking); err != nil {
+			return nil, fmt.Errorf("error unmarshaling ranking: %v", err)
+		}
+		rankings = append(rankings, ranking)
+	}
+
+	return rankings, nil
+}
+
+/**
+ * gets a page of public rankings by the given users, most recently created
+ * or updated first. Pass the sort values of the last ranking of the previous
+ * page as searchAfter to get the next page. Also returns the sort values of
+ * the last ranking on this page, or nil when there are no more.
+ */
+func GetFeedRankings(userIDs []string, searchAfter []interface{}, size int) ([]models.UserRanking, []interface{}, error) {
+	rankings := []models.UserRanking{}
+	if len(userIDs) == 0 {
+		return rankings, nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	ids := make([]interface{}, 0, len(userIDs))
+	for _, userID := range userIDs {
+		ids = append(ids, userID)
+	}
+
+	query := elastic.NewBoolQuery().
+		Filter(
+			elastic.NewTermsQuery("user_id", ids...),
+			elastic.NewTermQuery("public", true),
+		)
+
+	search := esClient.Search().
+		Index(RankingsIndex).
+		Query(query).
+		SortBy(
+			elastic.NewFieldSort("updated_at").Desc().UnmappedType("date"),
+			elastic.NewFieldSort("ranking_id").Desc(),
+		).
+		Size(size)
+
+	if len(searchAfter) > 0 {
+		search = search.SearchAfter(searchAfter...)
+	}
+
+	result, err := search.Do(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting feed rankings: %v", err)
+	}
+
+	var lastSort []interface{}
+	for _, hit := range result.Hits.Hits {
+		var ranking models.UserRanking
+		if err := json.Unmarshal(hit.Source, &ranking); err != nil {
+			return nil, nil, fmt.Errorf("error unmarshaling ranking: %v", err)
+		}
+		rankings = append(rankings, ranking)
+		lastSort = hit.Sort
+	}
+
+	// a short page means the feed has been read to the end
+	if len(rankings) < size {
+		lastSort = nil
+	}
+
+	return rankings, lastSort, nil
+}
+
 /**
  * gets a ranking by its ID
  */
@@ -138,16 +324,36 @@ func GetRankingByID(rankingID string) (*models.UserRanking, error) {
 }
 
 /**
- * updates an existing ranking in the user_rankings index
+ * updates an existing ranking in the user_rankings index. Each field of the
+ * ranking replaces the stored one outright, rather than being merged into it
+ * the way a partial document update would merge country_positions. Fields the
+ * model doesn't carry, like reaction_total, are left alone. Rankings created
+ * before documents were keyed by ranking_id have generated document IDs, so
+ * the ranking is matched on its ranking_id field.
  */
 func UpdateRanking(ranking *models.UserRanking) error {
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
-	_, err := esClient.Update().
-		Index(RankingsIndex).
-		Id(ranking.RankingID).
-		Doc(ranking).
+	data, err := json.Marshal(newRankingDocument(ranking))
+	if err != nil {
+		return fmt.Errorf("error encoding ranking: %v", err)
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return fmt.Errorf("error encoding ranking: %v", err)
+	}
+
+	script := elastic.NewScript(`
+		for (entry in params.fields.entrySet()) {
+			ctx._source[entry.getKey()] = entry.getValue();
+		}
+	`).Param("fields", fields)
+
+	result, err := esClient.UpdateByQuery(RankingsIndex).
+		Query(elastic.NewTermQuery("ranking_id", ranking.RankingID)).
+		Script(script).
 		Refresh("true").
 		Do(ctx)
 
@@ -155,5 +361,164 @@ func UpdateRanking(ranking *models.UserRanking) error {
 		return fmt.Errorf("error updating ranking: %v", err)
 	}
 
+	if result.Updated == 0 {
+		return fmt.Errorf("ranking not found")
+	}
+
+	return nil
+}
+
+/**
+ * locks or unlocks comments on the ranking
+ */
+func SetCommentsLocked(rankingID string, locked bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	script := elastic.NewScript("ctx._source.comments_locked = params.locked").
+		Param("locked", locked)
+
+	result, err := esClient.UpdateByQuery(RankingsIndex).
+		Query(elastic.NewTermQuery("ranking_id", rankingID)).
+		Script(script).
+		Refresh("true").
+		Do(ctx)
+
+	if err != nil {
+		return fmt.Errorf("error locking ranking comments: %v", err)
+	}
+
+	if result.Updated == 0 {
+		return fmt.Errorf("ranking not found")
+	}
+
+	return nil
+}
+
+/**
+ * creates the ranking revisions index with proper mappings if it doesn't exist.
+ */
+func createRevisionsIndex() error {
+
+	mapping := `{
+		"mappings": {
+			"properties": {
+				"revision_id": {
+					"type": "keyword"
+				},
+				"ranking_id": {
+					"type": "keyword"
+				},
+				"user_id": {
+					"type": "keyword"
+				},
+				"name": {
+					"type": "text"
+				},
+				"description": {
+					"type": "text"
+				},
+				"year": {
+					"type": "integer"
+				},
+				"ranking": {
+					"type": "keyword"
+				},
+				"public": {
+					"type": "boolean"
+				},
+				"group_ids": {
+					"type": "keyword"
+				},
+				"revised_at": {
+					"type": "date"
+				}
+			}
+		}
+	}`
+
+	return createIndex(revisionsIndex, mapping)
+}
+
+/**
+ * stores a snapshot of a ranking before it is updated
+ */
+func CreateRankingRevision(revision *models.RankingRevision) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, err := esClient.Index().
+		Index(revisionsIndex).
+		Id(revision.RevisionID).
+		BodyJson(revision).
+		Refresh("true").
+		Do(ctx)
+
+	if err != nil {
+		return fmt.Errorf("error creating ranking revision: %v", err)
+	}
+
 	return nil
 }
+
+/**
+ * gets every revision of every ranking owned by the user
+ */
+func GetRankingRevisionsByUserID(userID string) ([]models.RankingRevision, error) {
+	sources, err := searchAllByFieldValue(revisionsIndex, "user_id", userID)
+	if err != nil {
+		return nil, err
+	}
+
+	revisions := []models.RankingRevision{}
+	for _, source := range sources {
+		var revision models.RankingRevision
+		if err := json.Unmarshal(source, &revision); err != nil {
+			return nil, fmt.Errorf("error unmarshaling ranking revision: %v", err)
+		}
+		revisions = append(revisions, revision)
+	}
+
+	return revisions, nil
+}
+
+/**
+ * gets every ranking owned by the user, without the page limit applied by
+ * GetRankingsByUserID
+ */
+func GetAllRankingsByUserID(userID string) ([]models.UserRanking, error) {
+	sources, err := searchAllByFieldValue(RankingsIndex, "user_id", userID)
+	if err != nil {
+		return nil, err
+	}
+
+	rankings := []models.UserRanking{}
+	for _, source := range sources {
+		var ranking models.UserRanking
+		if err := json.Unmarshal(source, &ranking); err != nil {
+			return nil, fmt.Errorf("error unmarshaling ranking: %v", err)
+		}
+		rankings = append(rankings, ranking)
+	}
+
+	return rankings, nil
+}
+
+/**
+ * deletes a ranking, its revision history, reactions and comments
+ */
+func DeleteRanking(rankingID string) error {
+	if err := DeleteByFieldValue(RankingsIndex, "ranking_id", rankingID); err != nil {
+		return err
+	}
+
+	if err := DeleteByFieldValue(revisionsIndex, "ranking_id", rankingID); err != nil {
+		return err
+	}
+
+	if err := DeleteReactionsForRanking(rankingID); err != nil {
+		return err
+	}
+
+	return DeleteCommentsForRanking(rankingID)
+}
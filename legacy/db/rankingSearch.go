@@ -0,0 +1,157 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"eurovision-api/models"
+	"fmt"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// orders for public ranking search
+const (
+	RankingSortRelevance = "relevance"
+	RankingSortRecent    = "recent"
+	RankingSortPopular   = "popular"
+)
+
+/*
+RankingSearch describes a search of public rankings. An empty Query matches
+every public ranking. Years, when set, limits results to those years, and
+YearFrom and YearTo bound the year inclusively.
+*/
+type RankingSearch struct {
+	Query       string
+	Years       []int
+	YearFrom    *int
+	YearTo      *int
+	Sort        string
+	SearchAfter []interface{}
+	Size        int
+}
+
+/*
+RankingSearchHit is a public ranking found by a search, with the matching
+fragments of its name and description wrapped in <em> tags.
+*/
+type RankingSearchHit struct {
+	Ranking       models.UserRanking
+	ReactionTotal int64
+	Highlights    map[string][]string
+	Sort          []interface{}
+}
+
+/**
+ * returns the number of sort values a search_after cursor holds for the order
+ */
+func RankingSortValueCount(sort string) int {
+	if sort == RankingSortPopular {
+		return 3
+	}
+	return 2
+}
+
+/**
+ * full text searches the name and description of public rankings. Returns
+ * one page of hits; pass the Sort of the last hit as SearchAfter to get the
+ * next one.
+ */
+func SearchPublicRankings(search RankingSearch) ([]RankingSearchHit, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	query := elastic.NewBoolQuery().
+		Filter(elastic.NewTermQuery("public", true))
+
+	if search.Query != "" {
+		query.Must(
+			elastic.NewMultiMatchQuery(search.Query, "name^2", "description").
+				Type("best_fields").
+				Fuzziness("AUTO"),
+		)
+	}
+
+	if len(search.Years) > 0 {
+		years := make([]interface{}, 0, len(search.Years))
+		for _, year := range search.Years {
+			years = append(years, year)
+		}
+		query.Filter(elastic.NewTermsQuery("year", years...))
+	}
+
+	if search.YearFrom != nil || search.YearTo != nil {
+		year := elastic.NewRangeQuery("year")
+		if search.YearFrom != nil {
+			year.Gte(*search.YearFrom)
+		}
+		if search.YearTo != nil {
+			year.Lte(*search.YearTo)
+		}
+		query.Filter(year)
+	}
+
+	// ranking_id breaks ties so search_after never skips or repeats a ranking
+	var sorters []elastic.Sorter
+	switch search.Sort {
+	case RankingSortRelevance:
+		sorters = []elastic.Sorter{elastic.NewScoreSort()}
+	case RankingSortRecent:
+		sorters = []elastic.Sorter{elastic.NewFieldSort("updated_at").Desc().UnmappedType("date")}
+	case RankingSortPopular:
+		sorters = []elastic.Sorter{
+			elastic.NewFieldSort("reaction_total").Desc().Missing(0).UnmappedType("long"),
+			elastic.NewFieldSort("updated_at").Desc().UnmappedType("date"),
+		}
+	default:
+		return nil, fmt.Errorf("unknown ranking sort: %s", search.Sort)
+	}
+	sorters = append(sorters, elastic.NewFieldSort("ranking_id").Desc())
+
+	highlight := elastic.NewHighlight().
+		Fields(
+			elastic.NewHighlighterField("name").NumOfFragments(0),
+			elastic.NewHighlighterField("description").FragmentSize(150).NumOfFragments(3),
+		)
+
+	request := esClient.Search().
+		Index(RankingsIndex).
+		Query(query).
+		SortBy(sorters...).
+		Highlight(highlight).
+		Size(search.Size)
+
+	if len(search.SearchAfter) > 0 {
+		request = request.SearchAfter(search.SearchAfter...)
+	}
+
+	result, err := request.Do(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error searching rankings: %v", err)
+	}
+
+	hits := []RankingSearchHit{}
+	for _, hit := range result.Hits.Hits {
+		var source struct {
+			models.UserRanking
+			ReactionTotal int64 `json:"reaction_total"`
+		}
+		if err := json.Unmarshal(hit.Source, &source); err != nil {
+			return nil, fmt.Errorf("error unmarshaling ranking: %v", err)
+		}
+
+		highlights := map[string][]string(hit.Highlight)
+		if highlights == nil {
+			highlights = map[string][]string{}
+		}
+
+		hits = append(hits, RankingSearchHit{
+			Ranking:       source.UserRanking,
+			ReactionTotal: source.ReactionTotal,
+			Highlights:    highlights,
+			Sort:          hit.Sort,
+		})
+	}
+
+	return hits, nil
+}
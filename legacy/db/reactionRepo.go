@@ -0,0 +1,457 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"eurovision-api/models"
+	"fmt"
+	"io"
+
+	"github.com/olivere/elastic/v7"
+	"github.com/sirupsen/logrus"
+)
+
+// how often a counter update is retried when another write got there first
+const reactionCountRetries = 10
+
+var (
+	ErrReactionExists   = errors.New("reaction already added")
+	ErrReactionNotFound = errors.New("reaction not found")
+)
+
+/**
+ * creates the reactions index with proper mappings if it doesn't exist.
+ */
+func createReactionsIndex() error {
+
+	mapping := `{
+		"mappings": {
+			"properties": {
+				"ranking_id": {
+					"type": "keyword"
+				},
+				"ranking_owner_id": {
+					"type": "keyword"
+				},
+				"user_id": {
+					"type": "keyword"
+				},
+				"kind": {
+					"type": "keyword"
+				},
+				"created_at": {
+					"type": "date"
+				}
+			}
+		}
+	}`
+
+	return createIndex(reactionsIndex, mapping)
+}
+
+/**
+ * creates the reaction counts index with proper mappings if it doesn't exist.
+ */
+func createReactionCountsIndex() error {
+
+	mapping := `{
+		"mappings": {
+			"properties": {
+				"ranking_id": {
+					"type": "keyword"
+				},
+				"ranking_owner_id": {
+					"type": "keyword"
+				},
+				"counts": {
+					"type": "object"
+				}
+			}
+		}
+	}`
+
+	return createIndex(reactionCountsIndex, mapping)
+}
+
+func reactionID(rankingID, userID, kind string) string {
+	return rankingID + ":" + userID + ":" + kind
+}
+
+/**
+ * adds the reaction and increments the ranking's count for its kind. Returns
+ * ErrReactionExists if the user already reacted with that kind. The reaction
+ * document is only created once, so concurrent requests can't count it twice.
+ */
+func AddReaction(reaction *models.Reaction) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, err := esClient.Index().
+		Index(reactionsIndex).
+		Id(reactionID(reaction.RankingID, reaction.UserID, reaction.Kind)).
+		OpType("create").
+		BodyJson(reaction).
+		Refresh("true").
+		Do(ctx)
+
+	if err != nil {
+		if elastic.IsConflict(err) {
+			return ErrReactionExists
+		}
+		return fmt.Errorf("error adding reaction: %v", err)
+	}
+
+	if err := updateReactionCount(reaction.RankingID, reaction.RankingOwnerID, reaction.Kind, 1); err != nil {
+		// undo the reaction so it isn't left uncounted
+		if _, deleteErr := esClient.Delete().
+			Index(reactionsIndex).
+			Id(reactionID(reaction.RankingID, reaction.UserID, reaction.Kind)).
+			Refresh("true").
+			Do(context.Background()); deleteErr != nil {
+			logrus.WithError(deleteErr).Error("Failed to remove uncounted reaction")
+		}
+		return err
+	}
+
+	updateRankingReactionTotal(reaction.RankingID, 1)
+
+	return nil
+}
+
+/**
+ * removes the reaction and decrements the ranking's count for its kind.
+ * Returns ErrReactionNotFound if the user hadn't reacted with that kind.
+ */
+func RemoveReaction(rankingID, userID, kind string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	id := reactionID(rankingID, userID, kind)
+
+	result, err := esClient.Get().
+		Index(reactionsIndex).
+		Id(id).
+		Do(ctx)
+
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return ErrReactionNotFound
+		}
+		return fmt.Errorf("error getting reaction: %v", err)
+	}
+
+	var reaction models.Reaction
+	if err := json.Unmarshal(result.Source, &reaction); err != nil {
+		return fmt.Errorf("error unmarshaling reaction: %v", err)
+	}
+
+	// only the request that actually deletes the document decrements the count
+	_, err = esClient.Delete().
+		Index(reactionsIndex).
+		Id(id).
+		Refresh("true").
+		Do(ctx)
+
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return ErrReactionNotFound
+		}
+		return fmt.Errorf("error removing reaction: %v", err)
+	}
+
+	if err := updateReactionCount(rankingID, reaction.RankingOwnerID, kind, -1); err != nil {
+		return err
+	}
+
+	updateRankingReactionTotal(rankingID, -1)
+
+	return nil
+}
+
+/**
+ * atomically adds delta to the count for the kind, creating the counts
+ * document on first use. Kinds that drop to zero are removed. A removal can
+ * be counted before the add it undoes, so a count may briefly go negative;
+ * it is never clamped here, otherwise the two updates wouldn't cancel out.
+ */
+func updateReactionCount(rankingID, ownerID, kind string, delta int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	script := elastic.NewScript(`
+		if (ctx._source.counts == null) {
+			ctx._source.counts = [:];
+		}
+		long count = ctx._source.counts.getOrDefault(params.kind, 0) + params.delta;
+		if (count == 0) {
+			ctx._source.counts.remove(params.kind);
+		} else {
+			ctx._source.counts[params.kind] = count;
+		}
+	`).Params(map[string]interface{}{
+		"kind":  kind,
+		"delta": delta,
+	})
+
+	_, err := esClient.Update().
+		Index(reactionCountsIndex).
+		Id(rankingID).
+		Script(script).
+		ScriptedUpsert(true).
+		Upsert(models.ReactionCounts{
+			RankingID:      rankingID,
+			RankingOwnerID: ownerID,
+			Counts:         map[string]int64{},
+		}).
+		RetryOnConflict(reactionCountRetries).
+		Refresh("true").
+		Do(ctx)
+
+	if err != nil {
+		return fmt.Errorf("error updating reaction count: %v", err)
+	}
+
+	return nil
+}
+
+/**
+ * keeps the ranking's total reaction count, used to sort search results by
+ * popularity, in step with the counts document. It only affects ordering,
+ * so a failure is logged rather than failing the reaction.
+ */
+func updateRankingReactionTotal(rankingID string, delta int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	documentID, err := rankingDocumentID(ctx, rankingID)
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to update reaction total of ranking %s", rankingID)
+		return
+	}
+
+	// the ranking may have been deleted since the reaction was added
+	if documentID == "" {
+		return
+	}
+
+	script := elastic.NewScript(`
+		ctx._source.reaction_total = (ctx._source.reaction_total == null ? 0 : ctx._source.reaction_total) + params.delta;
+	`).Param("delta", delta)
+
+	_, err = esClient.Update().
+		Index(RankingsIndex).
+		Id(documentID).
+		Script(script).
+		RetryOnConflict(reactionCountRetries).
+		Do(ctx)
+
+	if err != nil && !elastic.IsNotFound(err) {
+		logrus.WithError(err).Errorf("Failed to update reaction total of ranking %s", rankingID)
+	}
+}
+
+/**
+ * finds the document ID of the ranking, which differs from its ranking_id for
+ * rankings created before documents were keyed by it. Returns an empty ID if
+ * the ranking doesn't exist.
+ */
+func rankingDocumentID(ctx context.Context, rankingID string) (string, error) {
+	result, err := esClient.Search().
+		Index(RankingsIndex).
+		Query(elastic.NewTermQuery("ranking_id", rankingID)).
+		FetchSource(false).
+		Size(1).
+		Do(ctx)
+
+	if err != nil {
+		return "", fmt.Errorf("error getting ranking: %v", err)
+	}
+
+	if len(result.Hits.Hits) == 0 {
+		return "", nil
+	}
+
+	return result.Hits.Hits[0].Id, nil
+}
+
+/**
+ * sets every reacted-to ranking's reaction_total from its counts document,
+ * for rankings whose total was never kept or has drifted. Returns the number
+ * of rankings updated.
+ */
+func BackfillReactionTotals() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*timeout)
+	defer cancel()
+
+	scroll := esClient.Scroll(reactionCountsIndex).
+		Size(scrollPageSize).
+		KeepAlive(scrollKeepAlive)
+	defer scroll.Clear(context.Background())
+
+	updated := 0
+	for {
+		result, err := scroll.Do(ctx)
+		if err == io.EOF {
+			return updated, nil
+		}
+		if err != nil {
+			return updated, fmt.Errorf("error scrolling reaction counts: %v", err)
+		}
+
+		for _, hit := range result.Hits.Hits {
+			var counts models.ReactionCounts
+			if err := json.Unmarshal(hit.Source, &counts); err != nil {
+				return updated, fmt.Errorf("error unmarshaling reaction counts: %v", err)
+			}
+
+			// counts briefly below zero are left out, as in GetReactionCounts
+			var total int64
+			for _, count := range counts.Counts {
+				if count > 0 {
+					total += count
+				}
+			}
+
+			response, err := esClient.UpdateByQuery(RankingsIndex).
+				Query(elastic.NewTermQuery("ranking_id", counts.RankingID)).
+				Script(elastic.NewScript("ctx._source.reaction_total = params.total").Param("total", total)).
+				Do(ctx)
+
+			if err != nil {
+				return updated, fmt.Errorf("error setting reaction total: %v", err)
+			}
+			updated += int(response.Updated)
+		}
+	}
+}
+
+/**
+ * gets the ranking's reaction counts by kind. Kinds nobody used are left out,
+ * as are counts that are briefly negative while a removal settles.
+ */
+func GetReactionCounts(rankingID string) (map[string]int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	result, err := esClient.Get().
+		Index(reactionCountsIndex).
+		Id(rankingID).
+		Do(ctx)
+
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return map[string]int64{}, nil
+		}
+		return nil, fmt.Errorf("error getting reaction counts: %v", err)
+	}
+
+	var counts models.ReactionCounts
+	if err := json.Unmarshal(result.Source, &counts); err != nil {
+		return nil, fmt.Errorf("error unmarshaling reaction counts: %v", err)
+	}
+
+	positive := map[string]int64{}
+	for kind, count := range counts.Counts {
+		if count > 0 {
+			positive[kind] = count
+		}
+	}
+
+	return positive, nil
+}
+
+/**
+ * gets the kinds the user reacted to the ranking with
+ */
+func GetUserReactionKinds(rankingID, userID string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	query := elastic.NewBoolQuery().
+		Filter(
+			elastic.NewTermQuery("ranking_id", rankingID),
+			elastic.NewTermQuery("user_id", userID),
+		)
+
+	result, err := esClient.Search().
+		Index(reactionsIndex).
+		Query(query).
+		Size(len(models.ReactionKinds)).
+		Do(ctx)
+
+	if err != nil {
+		return nil, fmt.Errorf("error getting reactions: %v", err)
+	}
+
+	kinds := []string{}
+	for _, hit := range result.Hits.Hits {
+		var reaction models.Reaction
+		if err := json.Unmarshal(hit.Source, &reaction); err != nil {
+			return nil, fmt.Errorf("error unmarshaling reaction: %v", err)
+		}
+		kinds = append(kinds, reaction.Kind)
+	}
+
+	return kinds, nil
+}
+
+/**
+ * gets every reaction the user added
+ */
+func GetReactionsByUserID(userID string) ([]models.Reaction, error) {
+	sources, err := searchAllByFieldValue(reactionsIndex, "user_id", userID)
+	if err != nil {
+		return nil, err
+	}
+
+	reactions := []models.Reaction{}
+	for _, source := range sources {
+		var reaction models.Reaction
+		if err := json.Unmarshal(source, &reaction); err != nil {
+			return nil, fmt.Errorf("error unmarshaling reaction: %v", err)
+		}
+		reactions = append(reactions, reaction)
+	}
+
+	return reactions, nil
+}
+
+/**
+ * deletes a ranking's reactions and counts
+ */
+func DeleteReactionsForRanking(rankingID string) error {
+	if err := DeleteByFieldValue(reactionsIndex, "ranking_id", rankingID); err != nil {
+		return err
+	}
+
+	return DeleteByFieldValue(reactionCountsIndex, "ranking_id", rankingID)
+}
+
+/**
+ * deletes everything about reactions tied to the user: the reactions they
+ * added, which are taken off the counts of other users' rankings, and the
+ * reactions and counts on their own rankings
+ */
+func deleteReactionsForUser(userID string) error {
+	reactions, err := GetReactionsByUserID(userID)
+	if err != nil {
+		return err
+	}
+
+	for _, reaction := range reactions {
+		if reaction.RankingOwnerID == userID {
+			continue
+		}
+		err := RemoveReaction(reaction.RankingID, reaction.UserID, reaction.Kind)
+		if err != nil && err != ErrReactionNotFound {
+			return err
+		}
+	}
+
+	if err := DeleteByFieldValue(reactionsIndex, "ranking_owner_id", userID); err != nil {
+		return err
+	}
+
+	return DeleteByFieldValue(reactionCountsIndex, "ranking_owner_id", userID)
+}
@@ -0,0 +1,174 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"eurovision-api/models"
+	"fmt"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+/*
+SecurityEventFilter narrows a security event search. Empty fields are ignored.
+*/
+type SecurityEventFilter struct {
+	UserID  string
+	ActorID string
+	Email   string
+	Event   string
+	Outcome string
+	IP      string
+	Since   *time.Time
+	Until   *time.Time
+}
+
+/**
+ * creates the security events index with proper mappings if it doesn't exist.
+ */
+func createSecurityEventsIndex() error {
+
+	mapping := `{
+		"mappings": {
+			"properties": {
+				"id": {
+					"type": "keyword"
+				},
+				"user_id": {
+					"type": "keyword"
+				},
+				"actor_id": {
+					"type": "keyword"
+				},
+				"email": {
+					"type": "keyword"
+				},
+				"event": {
+					"type": "keyword"
+				},
+				"outcome": {
+					"type": "keyword"
+				},
+				"reason": {
+					"type": "keyword"
+				},
+				"ip": {
+					"type": "ip"
+				},
+				"user_agent": {
+					"type": "keyword",
+					"index": false
+				},
+				"details": {
+					"type": "object",
+					"enabled": false
+				},
+				"timestamp": {
+					"type": "date"
+				}
+			}
+		}
+	}`
+
+	return createIndex(securityEventsIndex, mapping)
+}
+
+/**
+ * appends an event to the security log. Unlike the admin audit log the write
+ * doesn't wait for a refresh, since it sits on the login path.
+ */
+func CreateSecurityEvent(event *models.SecurityEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, err := esClient.Index().
+		Index(securityEventsIndex).
+		Id(event.ID).
+		OpType("create").
+		BodyJson(event).
+		Do(ctx)
+
+	if err != nil {
+		return fmt.Errorf("error creating security event: %v", err)
+	}
+
+	return nil
+}
+
+/**
+ * searches security events, newest first
+ */
+func SearchSecurityEvents(filter SecurityEventFilter, from, size int) ([]models.SecurityEvent, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	query := elastic.NewBoolQuery()
+	terms := map[string]string{
+		"user_id":  filter.UserID,
+		"actor_id": filter.ActorID,
+		"email":    filter.Email,
+		"event":    filter.Event,
+		"outcome":  filter.Outcome,
+		"ip":       filter.IP,
+	}
+	for field, value := range terms {
+		if value != "" {
+			query.Filter(elastic.NewTermQuery(field, value))
+		}
+	}
+	if filter.Since != nil || filter.Until != nil {
+		timestamp := elastic.NewRangeQuery("timestamp")
+		if filter.Since != nil {
+			timestamp.Gte(*filter.Since)
+		}
+		if filter.Until != nil {
+			timestamp.Lt(*filter.Until)
+		}
+		query.Filter(timestamp)
+	}
+
+	result, err := esClient.Search().
+		Index(securityEventsIndex).
+		Query(query).
+		Sort("timestamp", false).
+		From(from).
+		Size(size).
+		TrackTotalHits(true).
+		Do(ctx)
+
+	if err != nil {
+		return nil, 0, fmt.Errorf("error searching security events: %v", err)
+	}
+
+	events := []models.SecurityEvent{}
+	for _, hit := range result.Hits.Hits {
+		var event models.SecurityEvent
+		if err := json.Unmarshal(hit.Source, &event); err != nil {
+			return nil, 0, fmt.Errorf("error unmarshaling security event: %v", err)
+		}
+		events = append(events, event)
+	}
+
+	return events, result.TotalHits(), nil
+}
+
+/**
+ * deletes security events older than the cutoff
+ */
+func DeleteSecurityEventsBefore(cutoff time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 6*timeout)
+	defer cancel()
+
+	_, err := esClient.DeleteByQuery().
+		Index(securityEventsIndex).
+		Query(elastic.NewRangeQuery("timestamp").Lt(cutoff)).
+		Refresh("true").
+		Do(ctx)
+
+	if err != nil {
+		return fmt.Errorf("error deleting old security events: %v", err)
+	}
+
+	return nil
+}
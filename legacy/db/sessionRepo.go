@@ -0,0 +1,272 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"eurovision-api/models"
+	"fmt"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+/**
+ * creates the sessions index with proper mappings if it doesn't exist.
+ */
+func createSessionsIndex() error {
+
+	mapping := `{
+		"mappings": {
+			"properties": {
+				"id": {
+					"type": "keyword"
+				},
+				"user_id": {
+					"type": "keyword"
+				},
+				"device": {
+					"type": "keyword"
+				},
+				"user_agent": {
+					"type": "text"
+				},
+				"ip": {
+					"type": "ip"
+				},
+				"location": {
+					"properties": {
+						"city": {
+							"type": "keyword"
+						},
+						"region": {
+							"type": "keyword"
+						},
+						"country_name": {
+							"type": "keyword"
+						}
+					}
+				},
+				"created_at": {
+					"type": "date"
+				},
+				"last_seen_at": {
+					"type": "date"
+				},
+				"expires_at": {
+					"type": "date"
+				},
+				"revoked_at": {
+					"type": "date"
+				}
+			}
+		}
+	}`
+
+	return createIndex(sessionsIndex, mapping)
+}
+
+/**
+ * stores a new session
+ */
+func CreateSession(session *models.Session) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, err := esClient.Index().
+		Index(sessionsIndex).
+		Id(session.ID).
+		OpType("create").
+		BodyJson(session).
+		Refresh("true").
+		Do(ctx)
+
+	if err != nil {
+		return fmt.Errorf("error creating session: %v", err)
+	}
+
+	return nil
+}
+
+/**
+ * gets a session by id
+ */
+func GetSession(sessionID string) (*models.Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	result, err := esClient.Get().
+		Index(sessionsIndex).
+		Id(sessionID).
+		Do(ctx)
+
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return nil, ErrSessionNotFound
+		}
+		return nil, fmt.Errorf("error getting session: %v", err)
+	}
+
+	var session models.Session
+	if err := json.Unmarshal(result.Source, &session); err != nil {
+		return nil, fmt.Errorf("error unmarshaling session: %v", err)
+	}
+
+	return &session, nil
+}
+
+/**
+ * gets the user's sessions that are neither revoked nor expired, most
+ * recently used first
+ */
+func GetActiveSessionsByUserID(userID string, now time.Time) ([]models.Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	query := elastic.NewBoolQuery().
+		Filter(
+			elastic.NewTermQuery("user_id", userID),
+			elastic.NewRangeQuery("expires_at").Gt(now),
+		).
+		MustNot(elastic.NewExistsQuery("revoked_at"))
+
+	result, err := esClient.Search().
+		Index(sessionsIndex).
+		Query(query).
+		Sort("last_seen_at", false).
+		Size(1000).
+		Do(ctx)
+
+	if err != nil {
+		return nil, fmt.Errorf("error getting sessions: %v", err)
+	}
+
+	sessions := []models.Session{}
+	for _, hit := range result.Hits.Hits {
+		var session models.Session
+		if err := json.Unmarshal(hit.Source, &session); err != nil {
+			return nil, fmt.Errorf("error unmarshaling session: %v", err)
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, nil
+}
+
+/**
+ * revokes one of the user's active sessions. Returns false if the user has no
+ * such active session.
+ */
+func RevokeSession(userID, sessionID string, revokedAt time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	query := elastic.NewBoolQuery().
+		Filter(
+			elastic.NewTermQuery("id", sessionID),
+			elastic.NewTermQuery("user_id", userID),
+		).
+		MustNot(elastic.NewExistsQuery("revoked_at"))
+
+	result, err := esClient.UpdateByQuery(sessionsIndex).
+		Query(query).
+		Script(elastic.NewScript("ctx._source.revoked_at = params.revoked_at").Param("revoked_at", revokedAt)).
+		Refresh("true").
+		Do(ctx)
+
+	if err != nil {
+		return false, fmt.Errorf("error revoking session: %v", err)
+	}
+
+	return result.Updated > 0, nil
+}
+
+/**
+ * revokes all of the user's sessions, except the one with exceptSessionID
+ * when it is not empty
+ */
+func RevokeUserSessions(userID, exceptSessionID string, revokedAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	query := elastic.NewBoolQuery().
+		Filter(elastic.NewTermQuery("user_id", userID)).
+		MustNot(elastic.NewExistsQuery("revoked_at"))
+	if exceptSessionID != "" {
+		query.MustNot(elastic.NewTermQuery("id", exceptSessionID))
+	}
+
+	_, err := esClient.UpdateByQuery(sessionsIndex).
+		Query(query).
+		Script(elastic.NewScript("ctx._source.revoked_at = params.revoked_at").Param("revoked_at", revokedAt)).
+		Refresh("true").
+		Do(ctx)
+
+	if err != nil {
+		return fmt.Errorf("error revoking sessions: %v", err)
+	}
+
+	return nil
+}
+
+/**
+ * records that the session was just used
+ */
+func TouchSession(sessionID string, seenAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, err := esClient.Update().
+		Index(sessionsIndex).
+		Id(sessionID).
+		Doc(map[string]interface{}{"last_seen_at": seenAt}).
+		Do(ctx)
+
+	if err != nil {
+		return fmt.Errorf("error updating session last seen: %v", err)
+	}
+
+	return nil
+}
+
+/**
+ * stores the approximate location of the session's IP address
+ */
+func SetSessionLocation(sessionID string, location models.IPLocation) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, err := esClient.Update().
+		Index(sessionsIndex).
+		Id(sessionID).
+		Doc(map[string]interface{}{"location": location}).
+		Do(ctx)
+
+	if err != nil {
+		return fmt.Errorf("error updating session location: %v", err)
+	}
+
+	return nil
+}
+
+/**
+ * deletes sessions that expired before the cutoff
+ */
+func DeleteExpiredSessions(cutoff time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, err := esClient.DeleteByQuery().
+		Index(sessionsIndex).
+		Query(elastic.NewRangeQuery("expires_at").Lt(cutoff)).
+		Refresh("true").
+		Do(ctx)
+
+	if err != nil {
+		return fmt.Errorf("error deleting expired sessions: %v", err)
+	}
+
+	return nil
+}
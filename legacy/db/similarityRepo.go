@@ -0,0 +1,110 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"eurovision-api/models"
+	"eurovision-api/utils"
+	"fmt"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// scores each candidate by the footrule distance between its position
+// vector and the target's, with entries either ranking leaves out tied last
+const footruleScoreScript = `1.0 / (1.0 + l1norm(params.vector, 'position_vector'))`
+
+var ErrNoDecodedRanking = errors.New("no ranking with decoded positions for this year")
+
+/**
+ * gets up to limit public rankings from the same year whose decoded
+ * positions are closest to the ranking's by footrule distance, closest
+ * first. The ranking itself and, when set, rankings by excludeUserID are
+ * left out. Scoring runs against the position vectors stored on write, so
+ * only the year's public rankings are scanned and nothing is loaded into the
+ * API. Returns nothing when the ranking has no position vector.
+ */
+func FindSimilarRankings(ranking *models.UserRanking, excludeUserID string, limit int) ([]models.UserRanking, error) {
+	vector := utils.RankingPositionVector(ranking.Positions)
+	if vector == nil {
+		return []models.UserRanking{}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	candidates := elastic.NewBoolQuery().
+		Filter(
+			elastic.NewTermQuery("public", true),
+			elastic.NewTermQuery("year", ranking.Year),
+			elastic.NewExistsQuery("position_vector"),
+		).
+		MustNot(elastic.NewTermQuery("ranking_id", ranking.RankingID))
+
+	if excludeUserID != "" {
+		candidates.MustNot(elastic.NewTermQuery("user_id", excludeUserID))
+	}
+
+	script := elastic.NewScript(footruleScoreScript).Param("vector", vector)
+
+	result, err := esClient.Search().
+		Index(RankingsIndex).
+		Query(elastic.NewScriptScoreQuery(candidates, script)).
+		FetchSourceContext(elastic.NewFetchSourceContext(true).Exclude("position_vector")).
+		Size(limit).
+		Do(ctx)
+
+	if err != nil {
+		return nil, fmt.Errorf("error finding similar rankings: %v", err)
+	}
+
+	rankings := []models.UserRanking{}
+	for _, hit := range result.Hits.Hits {
+		var similar models.UserRanking
+		if err := json.Unmarshal(hit.Source, &similar); err != nil {
+			return nil, fmt.Errorf("error unmarshaling ranking: %v", err)
+		}
+		rankings = append(rankings, similar)
+	}
+
+	return rankings, nil
+}
+
+/**
+ * gets the user's most recently changed ranking from the year that has
+ * decoded positions. Returns ErrNoDecodedRanking if there is none.
+ */
+func GetLatestDecodedRanking(userID string, year int) (*models.UserRanking, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	query := elastic.NewBoolQuery().
+		Filter(
+			elastic.NewTermQuery("user_id", userID),
+			elastic.NewTermQuery("year", year),
+			elastic.NewExistsQuery("country_positions"),
+		)
+
+	result, err := esClient.Search().
+		Index(RankingsIndex).
+		Query(query).
+		SortBy(elastic.NewFieldSort("updated_at").Desc().UnmappedType("date")).
+		Size(1).
+		Do(ctx)
+
+	if err != nil {
+		return nil, fmt.Errorf("error getting latest ranking: %v", err)
+	}
+
+	if result.TotalHits() == 0 {
+		return nil, ErrNoDecodedRanking
+	}
+
+	var ranking models.UserRanking
+	if err := json.Unmarshal(result.Hits.Hits[0].Source, &ranking); err != nil {
+		return nil, fmt.Errorf("error unmarshaling ranking: %v", err)
+	}
+
+	return &ranking, nil
+}
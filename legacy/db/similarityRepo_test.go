@@ -0,0 +1,184 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"eurovision-api/models"
+	"eurovision-api/utils"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/olivere/elastic/v7"
+)
+
+const (
+	// countries in the codes file the similarity tests decode with
+	similarityTestCountries = 40
+
+	// candidates the handlers ask for on a default similar rankings request
+	similarBenchmarkCandidates = 100
+)
+
+/**
+ * configures ranking codes for similarityTestCountries countries, named C00
+ * upwards with entry codes c00. upwards
+ */
+func useSimilarityTestCodes(t testing.TB) []string {
+	t.Helper()
+
+	codes := map[string]string{}
+	countries := make([]string, 0, similarityTestCountries)
+	for i := 0; i < similarityTestCountries; i++ {
+		country := fmt.Sprintf("C%02d", i)
+		codes[fmt.Sprintf("c%02d.", i)] = country
+		countries = append(countries, country)
+	}
+
+	data, err := json.Marshal(codes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "codes.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("RANKING_CODES_FILE", path)
+	if err := utils.InitRankingCodec(); err != nil {
+		t.Fatalf("InitRankingCodec: %v", err)
+	}
+
+	return countries
+}
+
+/**
+ * builds a public ranking for the year listing the countries best first
+ */
+func similarityTestRanking(userID string, year int, countries []string) *models.UserRanking {
+	positions := make([]models.RankingPosition, 0, len(countries))
+	for i, country := range countries {
+		positions = append(positions, models.RankingPosition{
+			Country:    country,
+			Position:   i + 1,
+			FromBottom: len(countries) - i,
+		})
+	}
+
+	ranking := &models.UserRanking{
+		UserID:    userID,
+		RankingID: uuid.New().String(),
+		Name:      "Similarity test",
+		Year:      year,
+		Public:    true,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	ranking.SetPositions(positions)
+	return ranking
+}
+
+/**
+ * indexes the rankings in bulk, removing them when the test ends
+ */
+func seedRankings(t testing.TB, userID string, rankings []*models.UserRanking) {
+	t.Helper()
+	t.Cleanup(func() { DeleteByFieldValue(RankingsIndex, "user_id", userID) })
+
+	for start := 0; start < len(rankings); start += scrollPageSize {
+		bulk := esClient.Bulk().Index(RankingsIndex).Refresh("true")
+		for _, ranking := range rankings[start:min(start+scrollPageSize, len(rankings))] {
+			bulk.Add(elastic.NewBulkIndexRequest().Id(ranking.RankingID).Doc(newRankingDocument(ranking)))
+		}
+
+		result, err := bulk.Do(context.Background())
+		if err != nil {
+			t.Fatalf("bulk indexing rankings: %v", err)
+		}
+		if result.Errors {
+			t.Fatalf("bulk indexing rankings: %+v", result.Failed()[0].Error)
+		}
+	}
+}
+
+func TestFindSimilarRankingsOrdersByFootrule(t *testing.T) {
+	requireES(t)
+	countries := useSimilarityTestCodes(t)
+
+	userID := "similarity-" + uuid.New().String()
+	year := 3000 + rand.Intn(1000000)
+	swapped := func(i, j int) []string {
+		order := append([]string{}, countries[:10]...)
+		order[i], order[j] = order[j], order[i]
+		return order
+	}
+
+	target := similarityTestRanking(userID, year, countries[:10])
+	near := similarityTestRanking(userID, year, swapped(0, 1))
+	far := similarityTestRanking(userID, year, swapped(0, 9))
+	// lists the same top nine but leaves the last entry out
+	partial := similarityTestRanking(userID, year, countries[:9])
+	// a different set of entries entirely
+	disjoint := similarityTestRanking(userID, year, countries[20:30])
+	private := similarityTestRanking(userID, year, countries[:10])
+	private.Public = false
+
+	seedRankings(t, userID, []*models.UserRanking{target, near, far, partial, disjoint, private})
+
+	similar, err := FindSimilarRankings(target, "", 10)
+	if err != nil {
+		t.Fatalf("FindSimilarRankings: %v", err)
+	}
+
+	// near and far are 2 and 18 apart, partial 31 (the left out entry is
+	// tied last at 41) and disjoint 710
+	want := []string{near.RankingID, far.RankingID, partial.RankingID, disjoint.RankingID}
+	var got []string
+	for _, ranking := range similar {
+		got = append(got, ranking.RankingID)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("similar = %v, want %v", got, want)
+	}
+
+	excluded, err := FindSimilarRankings(target, userID, 10)
+	if err != nil {
+		t.Fatalf("FindSimilarRankings: %v", err)
+	}
+	if len(excluded) != 0 {
+		t.Errorf("found %d rankings by the excluded user", len(excluded))
+	}
+}
+
+/**
+ * scores a year of 20,000 public rankings, each a shuffled selection of 26
+ * of the 40 countries. Needs ELASTICSEARCH_URL.
+ */
+func BenchmarkFindSimilarRankings(b *testing.B) {
+	requireES(b)
+	countries := useSimilarityTestCodes(b)
+
+	const rankings = 20000
+	userID := "similarity-" + uuid.New().String()
+	year := 3000 + rand.Intn(1000000)
+	random := rand.New(rand.NewSource(1))
+
+	seeded := make([]*models.UserRanking, 0, rankings)
+	for i := 0; i < rankings; i++ {
+		order := append([]string{}, countries...)
+		random.Shuffle(len(order), func(i, j int) { order[i], order[j] = order[j], order[i] })
+		seeded = append(seeded, similarityTestRanking(userID, year, order[:26]))
+	}
+	seedRankings(b, userID, seeded)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := FindSimilarRankings(seeded[i%rankings], "", similarBenchmarkCandidates); err != nil {
+			b.Fatalf("FindSimilarRankings: %v", err)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// percentiles reported for each country's positions
+var positionPercentiles = []float64{10, 25, 50, 75, 90}
+
+// placements at or above this position count as top 10
+const topTenPosition = 10
+
+/*
+CountryPositionStats describes how the public rankings of a year placed one
+country. Controversy is the standard deviation of its positions divided by
+the standard deviation a uniformly random placement would have over the
+average ranking length: near 0 when rankers agree, around 1 when positions
+are as spread as chance and above 1 when rankers are split.
+*/
+type CountryPositionStats struct {
+	Country         string             `json:"country"`
+	Rankings        int64              `json:"rankings"`
+	AveragePosition float64            `json:"average_position"`
+	Percentiles     map[string]float64 `json:"percentiles"`
+	TopTenShare     float64            `json:"top_ten_share"`
+	Variance        float64            `json:"variance"`
+	StdDeviation    float64            `json:"std_deviation"`
+	Controversy     float64            `json:"controversy"`
+	Histogram       []PositionCount    `json:"histogram,omitempty"`
+}
+
+type PositionCount struct {
+	Position int   `json:"position"`
+	Rankings int64 `json:"rankings"`
+}
+
+/**
+ * public rankings from the year that were decoded into positions
+ */
+func yearStatsQuery(year int) elastic.Query {
+	return elastic.NewBoolQuery().
+		Filter(
+			elastic.NewTermQuery("public", true),
+			elastic.NewTermQuery("year", year),
+			elastic.NewExistsQuery("country_positions"),
+		)
+}
+
+/**
+ * the statistics sub aggregations to run over the nested position entries of
+ * one country
+ */
+func positionStatsAggregations() map[string]elastic.Aggregation {
+	return map[string]elastic.Aggregation{
+		"stats": elastic.NewExtendedStatsAggregation().Field("positions.position"),
+		"percentiles": elastic.NewPercentilesAggregation().
+			Field("positions.position").
+			Percentiles(positionPercentiles...),
+		"top_ten": elastic.NewFilterAggregation().
+			Filter(elastic.NewRangeQuery("positions.position").Lte(topTenPosition)),
+		"entries": elastic.NewAvgAggregation().
+			Script(elastic.NewScript("doc['positions.position'].value + doc['positions.from_bottom'].value - 1")),
+	}
+}
+
+/**
+ * reads the statistics requested by positionStatsAggregations
+ */
+func positionStatsFrom(country string, rankings int64, aggregations elastic.Aggregations) CountryPositionStats {
+	stats := CountryPositionStats{
+		Country:     country,
+		Rankings:    rankings,
+		Percentiles: map[string]float64{},
+	}
+
+	if rankings == 0 {
+		return stats
+	}
+
+	if extended, found := aggregations.ExtendedStats("stats"); found {
+		if extended.Avg != nil {
+			stats.AveragePosition = *extended.Avg
+		}
+		if extended.Variance != nil {
+			stats.Variance = *extended.Variance
+		}
+		if extended.StdDeviation != nil {
+			stats.StdDeviation = *extended.StdDeviation
+		}
+	}
+
+	if percentiles, found := aggregations.Percentiles("percentiles"); found {
+		for _, percentile := range positionPercentiles {
+			key := strconv.FormatFloat(percentile, 'f', 1, 64)
+			if value, ok := percentiles.Values[key]; ok {
+				stats.Percentiles["p"+strconv.FormatFloat(percentile, 'f', -1, 64)] = value
+			}
+		}
+	}
+
+	if topTen, found := aggregations.Filter("top_ten"); found {
+		stats.TopTenShare = float64(topTen.DocCount) / float64(rankings)
+	}
+
+	// a random position among n entries has a variance of (n^2 - 1) / 12
+	if entries, found := aggregations.Avg("entries"); found && entries.Value != nil {
+		n := *entries.Value
+		if uniform := math.Sqrt((n*n - 1) / 12); uniform > 0 {
+			stats.Controversy = stats.StdDeviation / uniform
+		}
+	}
+
+	return stats
+}
+
+/**
+ * gets how the year's public rankings placed the country, with a histogram
+ * of its positions
+ */
+func GetCountryPositionStats(year int, country string) (*CountryPositionStats, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	countryEntries := elastic.NewFilterAggregation().
+		Filter(elastic.NewTermQuery("positions.country", country))
+	for name, aggregation := range positionStatsAggregations() {
+		countryEntries.SubAggregation(name, aggregation)
+	}
+	countryEntries.SubAggregation("histogram", elastic.NewHistogramAggregation().
+		Field("positions.position").
+		Interval(1).
+		MinDocCount(0))
+
+	result, err := esClient.Search().
+		Index(RankingsIndex).
+		Query(yearStatsQuery(year)).
+		Size(0).
+		Aggregation("positions", elastic.NewNestedAggregation().
+			Path("positions").
+			SubAggregation("country", countryEntries)).
+		Do(ctx)
+
+	if err != nil {
+		return nil, fmt.Errorf("error getting country stats: %v", err)
+	}
+
+	positions, found := result.Aggregations.Nested("positions")
+	if !found {
+		return &CountryPositionStats{Country: country, Percentiles: map[string]float64{}}, nil
+	}
+	entries, found := positions.Aggregations.Filter("country")
+	if !found {
+		return &CountryPositionStats{Country: country, Percentiles: map[string]float64{}}, nil
+	}
+
+	stats := positionStatsFrom(country, entries.DocCount, entries.Aggregations)
+
+	if histogram, found := entries.Aggregations.Histogram("histogram"); found {
+		for _, bucket := range histogram.Buckets {
+			stats.Histogram = append(stats.Histogram, PositionCount{
+				Position: int(bucket.Key),
+				Rankings: bucket.DocCount,
+			})
+		}
+	}
+
+	return &stats, nil
+}
+
+/**
+ * gets the statistics of every country placed by the year's public rankings,
+ * most controversial first. Countries in fewer than minRankings rankings are
+ * left out.
+ */
+func GetYearPositionStats(year int, minRankings int64) ([]CountryPositionStats, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	countries := elastic.NewTermsAggregation().
+		Field("positions.country").
+		Size(maxCountryBuckets).
+		MinDocCount(int(minRankings))
+	for name, aggregation := range positionStatsAggregations() {
+		countries.SubAggregation(name, aggregation)
+	}
+
+	result, err := esClient.Search().
+		Index(RankingsIndex).
+		Query(yearStatsQuery(year)).
+		Size(0).
+		Aggregation("positions", elastic.NewNestedAggregation().
+			Path("positions").
+			SubAggregation("countries", countries)).
+		Do(ctx)
+
+	if err != nil {
+		return nil, fmt.Errorf("error getting year stats: %v", err)
+	}
+
+	table := []CountryPositionStats{}
+
+	positions, found := result.Aggregations.Nested("positions")
+	if !found {
+		return table, nil
+	}
+	buckets, found := positions.Aggregations.Terms("countries")
+	if !found {
+		return table, nil
+	}
+
+	for _, bucket := range buckets.Buckets {
+		country, ok := bucket.Key.(string)
+		if !ok {
+			continue
+		}
+		table = append(table, positionStatsFrom(country, bucket.DocCount, bucket.Aggregations))
+	}
+
+	sort.SliceStable(table, func(i, j int) bool {
+		return table[i].Controversy > table[j].Controversy
+	})
+
+	return table, nil
+}
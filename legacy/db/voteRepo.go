@@ -0,0 +1,80 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"eurovision-api/models"
+	"fmt"
+)
+
+/**
+ * creates the votes index if it doesn't exist and makes sure user_id is
+ * mapped as a keyword, including on indices created before votes were
+ * attributed to users.
+ */
+func createVotesIndex() error {
+
+	mapping := `{
+		"mappings": {
+			"properties": {
+				"user_id": {
+					"type": "keyword"
+				},
+				"vote_string": {
+					"type": "keyword"
+				},
+				"ip": {
+					"type": "keyword"
+				},
+				"country": {
+					"type": "keyword"
+				},
+				"year": {
+					"type": "integer"
+				},
+				"timestamp": {
+					"type": "date"
+				}
+			}
+		}
+	}`
+
+	if err := createIndex(VotesIndex, mapping); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, err := esClient.PutMapping().
+		Index(VotesIndex).
+		BodyString(`{"properties": {"user_id": {"type": "keyword"}}}`).
+		Do(ctx)
+
+	if err != nil {
+		return fmt.Errorf("error updating votes mapping: %v", err)
+	}
+
+	return nil
+}
+
+/**
+ * gets every vote cast by the user
+ */
+func GetVotesByUserID(userID string) ([]models.Vote, error) {
+	sources, err := searchAllByFieldValue(VotesIndex, "user_id", userID)
+	if err != nil {
+		return nil, err
+	}
+
+	votes := []models.Vote{}
+	for _, source := range sources {
+		var vote models.Vote
+		if err := json.Unmarshal(source, &vote); err != nil {
+			return nil, fmt.Errorf("error unmarshaling vote: %v", err)
+		}
+		votes = append(votes, vote)
+	}
+
+	return votes, nil
+}
@@ -0,0 +1,422 @@
+package handlers
+
+import (
+	"encoding/json"
+	"eurovision-api/auth"
+	"eurovision-api/models"
+	"eurovision-api/utils"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+type AccountHandler struct {
+	authService *auth.Service
+}
+
+func NewAccountHandler(authService *auth.Service) *AccountHandler {
+	if authService == nil {
+		panic("auth service cannot be nil")
+	}
+	return &AccountHandler{
+		authService: authService,
+	}
+}
+
+// Request/Response structs
+type VerifyTOTPRequest struct {
+	Code string `json:"code"`
+}
+
+type DisableTOTPRequest struct {
+	Password     string `json:"password"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type DeleteAccountRequest struct {
+	Password     string `json:"password"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type ChangeEmailRequest struct {
+	Password     string `json:"password"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+	NewEmail     string `json:"new_email"`
+}
+
+type CreateAccessTokenRequest struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expires_in_days"`
+}
+
+type AccessTokenResponse struct {
+	ID          string     `json:"id"`
+	Name        string     `json:"name"`
+	TokenPrefix string     `json:"token_prefix"`
+	Scopes      []string   `json:"scopes"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt  *time.Time `json:"last_used_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	// only set in the response to the create request
+	Token string `json:"token,omitempty"`
+}
+
+/**
+ * starts two-factor enrollment, returning the secret and otpauth URI to
+ * show as a QR code
+ */
+func (h *AccountHandler) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	enrollment, err := h.authService.BeginTOTPEnrollment(userID)
+	if err != nil {
+		switch err {
+		case auth.ErrMFAAlreadyEnabled:
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			logrus.WithError(err).Error("Failed to begin totp enrollment")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(enrollment)
+}
+
+/**
+ * confirms enrollment with a code from the authenticator app and returns
+ * the recovery codes
+ */
+func (h *AccountHandler) VerifyTOTP(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	req, valid := utils.DecodeRequestBody[VerifyTOTPRequest](w, r)
+	if !valid {
+		return
+	}
+
+	codes, err := h.authService.VerifyTOTPEnrollment(userID, req.Code, clientInfo(r))
+	if err != nil {
+		writeMFAError(w, err, "Failed to verify totp enrollment")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+/**
+ * turns off two-factor authentication
+ */
+func (h *AccountHandler) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	req, valid := utils.DecodeRequestBody[DisableTOTPRequest](w, r)
+	if !valid {
+		return
+	}
+
+	err = h.authService.DisableTOTP(userID, req.Password, req.Code, req.RecoveryCode, clientInfo(r))
+	if err != nil {
+		writeMFAError(w, err, "Failed to disable totp")
+		return
+	}
+
+	writeMessage(w, "Two-factor authentication disabled")
+}
+
+/**
+ * replaces the recovery codes, invalidating the previous set
+ */
+func (h *AccountHandler) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	req, valid := utils.DecodeRequestBody[VerifyTOTPRequest](w, r)
+	if !valid {
+		return
+	}
+
+	codes, err := h.authService.RegenerateRecoveryCodes(userID, req.Code, clientInfo(r))
+	if err != nil {
+		writeMFAError(w, err, "Failed to regenerate recovery codes")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+func writeMFAError(w http.ResponseWriter, err error, logMessage string) {
+	switch err {
+	case auth.ErrInvalidMFACode, auth.ErrInvalidCredentials:
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	case auth.ErrMFAAlreadyEnabled:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case auth.ErrMFANotEnabled, auth.ErrMFANotEnrolling:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		logrus.WithError(err).Error(logMessage)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+/**
+ * schedules the authenticated user's account for deletion after the grace
+ * period. A cancellation link is emailed to the user. Accounts with neither a
+ * password nor 2FA are emailed a confirmation link instead.
+ */
+func (h *AccountHandler) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	req, valid := utils.DecodeRequestBody[DeleteAccountRequest](w, r)
+	if !valid {
+		return
+	}
+
+	scheduledFor, err := h.authService.RequestAccountDeletion(userID, auth.Reauthentication{
+		Password:     req.Password,
+		Code:         req.Code,
+		RecoveryCode: req.RecoveryCode,
+	}, clientInfo(r))
+	if err != nil {
+		switch err {
+		case auth.ErrInvalidCredentials, auth.ErrInvalidMFACode:
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+		default:
+			logrus.WithError(err).Error("Failed to request account deletion")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if scheduledFor.IsZero() {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Check your email for a link to confirm the deletion.",
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":       "Your account is scheduled for deletion. Check your email for a link to cancel.",
+		"scheduled_for": scheduledFor,
+	})
+}
+
+/**
+ * changes the authenticated user's password. Other sessions are signed out
+ * and a new session is started for this client.
+ */
+func (h *AccountHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	req, valid := utils.DecodeRequestBody[ChangePasswordRequest](w, r)
+	if !valid {
+		return
+	}
+
+	token, err := h.authService.ChangePassword(userID, req.CurrentPassword, req.NewPassword, clientInfo(r))
+	if err != nil {
+		if writePasswordRejected(w, err) {
+			return
+		}
+		switch err {
+		case auth.ErrInvalidCredentials:
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+		case auth.ErrRegistrationIncomplete:
+			http.Error(w, "account has no password, use the password reset flow to set one", http.StatusBadRequest)
+		default:
+			logrus.WithError(err).Error("Failed to change password")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(LoginResponse{Token: token})
+}
+
+/**
+ * starts an email change by sending a confirmation link to the new address
+ */
+func (h *AccountHandler) ChangeEmail(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	req, valid := utils.DecodeRequestBody[ChangeEmailRequest](w, r)
+	if !valid {
+		return
+	}
+
+	awaitingApproval, err := h.authService.RequestEmailChange(userID, auth.Reauthentication{
+		Password:     req.Password,
+		Code:         req.Code,
+		RecoveryCode: req.RecoveryCode,
+	}, req.NewEmail, clientInfo(r))
+	if err != nil {
+		switch err {
+		case auth.ErrInvalidCredentials, auth.ErrInvalidMFACode:
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+		case auth.ErrInvalidEmail, auth.ErrEmailExists, auth.ErrSameEmail:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			logrus.WithError(err).Error("Failed to request email change")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if awaitingApproval {
+		writeMessage(w, "Check your current email address for a link to approve the change.")
+		return
+	}
+
+	writeMessage(w, "Check your new email address for a confirmation link.")
+}
+
+/**
+ * strips the token hash before the token is returned to its owner
+ */
+func newAccessTokenResponse(token *models.PersonalAccessToken) AccessTokenResponse {
+	return AccessTokenResponse{
+		ID:          token.ID,
+		Name:        token.Name,
+		TokenPrefix: token.TokenPrefix,
+		Scopes:      token.Scopes,
+		ExpiresAt:   token.ExpiresAt,
+		LastUsedAt:  token.LastUsedAt,
+		CreatedAt:   token.CreatedAt,
+	}
+}
+
+/**
+ * creates a personal access token. The token value is only returned here.
+ */
+func (h *AccountHandler) CreateAccessToken(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	req, valid := utils.DecodeRequestBody[CreateAccessTokenRequest](w, r)
+	if !valid {
+		return
+	}
+
+	plaintext, token, err := h.authService.CreateAccessToken(userID, req.Name, req.Scopes, req.ExpiresInDays, clientInfo(r))
+	if err != nil {
+		switch err {
+		case auth.ErrInvalidTokenName, auth.ErrInvalidScopes, auth.ErrInvalidTokenExpiry:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			logrus.WithError(err).Error("Failed to create access token")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	response := newAccessTokenResponse(token)
+	response.Token = plaintext
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+/**
+ * lists the authenticated user's personal access tokens
+ */
+func (h *AccountHandler) ListAccessTokens(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	tokens, err := h.authService.ListAccessTokens(userID)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to list access tokens")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := []AccessTokenResponse{}
+	for i := range tokens {
+		response = append(response, newAccessTokenResponse(&tokens[i]))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+/**
+ * revokes one of the authenticated user's personal access tokens
+ */
+func (h *AccountHandler) RevokeAccessToken(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	err = h.authService.RevokeAccessToken(userID, mux.Vars(r)["tokenID"], clientInfo(r))
+	if err != nil {
+		switch err {
+		case auth.ErrAccessTokenUnknown:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		default:
+			logrus.WithError(err).Error("Failed to revoke access token")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	writeMessage(w, "Access token revoked")
+}
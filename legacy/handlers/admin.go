@@ -0,0 +1,474 @@
+package handlers
+
+import (
+	"encoding/json"
+	"eurovision-api/auth"
+	"eurovision-api/db"
+	"eurovision-api/models"
+	"eurovision-api/utils"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultAdminPageSize = 25
+	maxAdminPageSize     = 100
+)
+
+// actions recorded in the admin audit log
+const (
+	auditActionSearchUsers        = "search_users"
+	auditActionViewUser           = "view_user"
+	auditActionViewUserRankings   = "view_user_rankings"
+	auditActionConfirmUser        = "confirm_user"
+	auditActionDisableUser        = "disable_user"
+	auditActionEnableUser         = "enable_user"
+	auditActionForcePasswordReset = "force_password_reset"
+	auditActionDeleteUser         = "delete_user"
+	auditActionSetRankingQuota    = "set_ranking_quota"
+	auditActionUnlockUser         = "unlock_user"
+	auditActionNormalizeEmails    = "normalize_emails"
+)
+
+type AdminHandler struct {
+	authService *auth.Service
+}
+
+func NewAdminHandler(authService *auth.Service) *AdminHandler {
+	if authService == nil {
+		panic("auth service cannot be nil")
+	}
+	return &AdminHandler{
+		authService: authService,
+	}
+}
+
+// Request/Response structs
+type AdminUserResponse struct {
+	ID                    string     `json:"id"`
+	Email                 string     `json:"email"`
+	Role                  string     `json:"role"`
+	Confirmed             bool       `json:"confirmed"`
+	Disabled              bool       `json:"disabled"`
+	DisabledAt            *time.Time `json:"disabled_at,omitempty"`
+	PasswordResetRequired bool       `json:"password_reset_required"`
+	RankingQuota          *int64     `json:"ranking_quota"`
+	FailedLoginAttempts   int        `json:"failed_login_attempts"`
+	LastFailedLoginAt     *time.Time `json:"last_failed_login_at,omitempty"`
+	Locked                bool       `json:"locked"`
+	LockedUntil           *time.Time `json:"locked_until,omitempty"`
+	CreatedAt             time.Time  `json:"created_at"`
+}
+
+type AdminUserSearchResponse struct {
+	Total int64               `json:"total"`
+	Users []AdminUserResponse `json:"users"`
+}
+
+type NormalizeEmailsResponse struct {
+	Normalized int `json:"normalized"`
+	// lowercased addresses held by more than one account, left unchanged
+	Conflicts []string `json:"conflicts"`
+}
+
+type SetRankingQuotaRequest struct {
+	// a null quota removes the override and restores the global limit
+	Quota *int64 `json:"quota"`
+}
+
+/**
+ * strips secrets from the user before it is returned to an admin
+ */
+func newAdminUserResponse(user *models.User) AdminUserResponse {
+	return AdminUserResponse{
+		ID:                    user.ID,
+		Email:                 user.Email,
+		Role:                  user.EffectiveRole(),
+		Confirmed:             user.Confirmed,
+		Disabled:              user.Disabled,
+		DisabledAt:            user.DisabledAt,
+		PasswordResetRequired: user.PasswordResetRequired,
+		RankingQuota:          user.RankingQuota,
+		FailedLoginAttempts:   user.FailedLoginAttempts,
+		LastFailedLoginAt:     user.LastFailedLoginAt,
+		Locked:                user.IsLocked(time.Now()),
+		LockedUntil:           user.LockedUntil,
+		CreatedAt:             user.CreatedAt,
+	}
+}
+
+/**
+ * searches users by email prefix and/or status
+ */
+func (h *AdminHandler) SearchUsers(w http.ResponseWriter, r *http.Request) {
+	email := r.URL.Query().Get("email")
+	status := r.URL.Query().Get("status")
+
+	switch status {
+	case "", db.UserStatusConfirmed, db.UserStatusUnconfirmed, db.UserStatusDisabled, db.UserStatusLocked:
+	default:
+		http.Error(w, "status must be one of confirmed, unconfirmed, disabled or locked", http.StatusBadRequest)
+		return
+	}
+
+	from, size := getPagination(r)
+
+	users, total, err := db.SearchUsers(email, status, from, size)
+	if err != nil {
+		logrus.Error("Error searching users: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := AdminUserSearchResponse{Total: total, Users: []AdminUserResponse{}}
+	for i := range users {
+		response.Users = append(response.Users, newAdminUserResponse(&users[i]))
+	}
+
+	h.audit(r, auditActionSearchUsers, "", map[string]interface{}{
+		"email":  email,
+		"status": status,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+/**
+ * retrieves a single user by ID
+ */
+func (h *AdminHandler) GetUser(w http.ResponseWriter, r *http.Request) {
+	user := getTargetUser(w, r)
+	if user == nil {
+		return
+	}
+
+	h.audit(r, auditActionViewUser, user.ID, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newAdminUserResponse(user))
+}
+
+/**
+ * retrieves all rankings owned by a user, public or not
+ */
+func (h *AdminHandler) GetUserRankings(w http.ResponseWriter, r *http.Request) {
+	user := getTargetUser(w, r)
+	if user == nil {
+		return
+	}
+
+	rankings, err := db.GetRankingsByUserID(user.ID)
+	if err != nil {
+		logrus.Error("Error fetching rankings: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if rankings == nil {
+		rankings = []models.UserRanking{}
+	}
+
+	h.audit(r, auditActionViewUserRankings, user.ID, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rankings)
+}
+
+/**
+ * manually confirms a user's email address
+ */
+func (h *AdminHandler) ConfirmUser(w http.ResponseWriter, r *http.Request) {
+	user := getTargetUser(w, r)
+	if user == nil {
+		return
+	}
+
+	if err := db.ConfirmUserByID(user.ID); err != nil {
+		logrus.Error("Error confirming user: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	h.audit(r, auditActionConfirmUser, user.ID, nil)
+
+	writeMessage(w, "User confirmed")
+}
+
+/**
+ * disables a user's account. Existing tokens stop working immediately.
+ */
+func (h *AdminHandler) DisableUser(w http.ResponseWriter, r *http.Request) {
+	h.setUserDisabled(w, r, true)
+}
+
+/**
+ * re-enables a previously disabled account
+ */
+func (h *AdminHandler) EnableUser(w http.ResponseWriter, r *http.Request) {
+	h.setUserDisabled(w, r, false)
+}
+
+func (h *AdminHandler) setUserDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	user := getTargetUser(w, r)
+	if user == nil {
+		return
+	}
+
+	adminID, _ := auth.GetUserIDFromContext(r.Context())
+	if disabled && user.ID == adminID {
+		http.Error(w, "Admins cannot disable their own account", http.StatusBadRequest)
+		return
+	}
+
+	if err := db.SetUserDisabled(user.ID, disabled); err != nil {
+		logrus.Error("Error updating user: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if disabled {
+		h.audit(r, auditActionDisableUser, user.ID, nil)
+		writeMessage(w, "User disabled")
+		return
+	}
+
+	h.audit(r, auditActionEnableUser, user.ID, nil)
+	writeMessage(w, "User enabled")
+}
+
+/**
+ * invalidates the user's password, signs them out everywhere and sends them
+ * a reset email
+ */
+func (h *AdminHandler) ForcePasswordReset(w http.ResponseWriter, r *http.Request) {
+	user := getTargetUser(w, r)
+	if user == nil {
+		return
+	}
+
+	if err := h.authService.ForcePasswordReset(user.ID); err != nil {
+		logrus.WithError(err).Error("Failed to force password reset")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	h.audit(r, auditActionForcePasswordReset, user.ID, map[string]interface{}{
+		"sessions_revoked":      true,
+		"access_tokens_revoked": true,
+	})
+
+	writeMessage(w, "Password reset email sent")
+}
+
+/**
+ * clears a login lockout and the user's failed attempt counter
+ */
+func (h *AdminHandler) UnlockUser(w http.ResponseWriter, r *http.Request) {
+	user := getTargetUser(w, r)
+	if user == nil {
+		return
+	}
+
+	if err := h.authService.AdminUnlockAccount(user.ID); err != nil {
+		logrus.WithError(err).Error("Failed to unlock user")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	h.audit(r, auditActionUnlockUser, user.ID, map[string]interface{}{
+		"failed_login_attempts": user.FailedLoginAttempts,
+	})
+
+	writeMessage(w, "User unlocked")
+}
+
+/**
+ * deletes a user and all of their rankings
+ */
+func (h *AdminHandler) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	user := getTargetUser(w, r)
+	if user == nil {
+		return
+	}
+
+	adminID, _ := auth.GetUserIDFromContext(r.Context())
+	if user.ID == adminID {
+		http.Error(w, "Admins cannot delete their own account", http.StatusBadRequest)
+		return
+	}
+
+	if err := db.DeleteUserCascade(user.ID); err != nil {
+		logrus.Error("Error deleting user: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	h.audit(r, auditActionDeleteUser, user.ID, map[string]interface{}{
+		"email": user.Email,
+	})
+
+	writeMessage(w, "User deleted")
+}
+
+/**
+ * overrides the maximum number of rankings the user may have
+ */
+func (h *AdminHandler) SetRankingQuota(w http.ResponseWriter, r *http.Request) {
+	user := getTargetUser(w, r)
+	if user == nil {
+		return
+	}
+
+	req, valid := utils.DecodeRequestBody[SetRankingQuotaRequest](w, r)
+	if !valid {
+		return
+	}
+
+	if req.Quota != nil && *req.Quota < 0 {
+		http.Error(w, "quota cannot be negative", http.StatusBadRequest)
+		return
+	}
+
+	if err := db.SetRankingQuota(user.ID, req.Quota); err != nil {
+		logrus.Error("Error setting ranking quota: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	h.audit(r, auditActionSetRankingQuota, user.ID, map[string]interface{}{
+		"previous_quota": user.RankingQuota,
+		"quota":          req.Quota,
+	})
+
+	writeMessage(w, "Ranking quota updated")
+}
+
+/**
+ * lowercases the emails of accounts created before addresses were stored
+ * lowercase. Accounts whose addresses differ only in case are reported as
+ * conflicts instead, for an admin to merge or delete.
+ */
+func (h *AdminHandler) NormalizeEmails(w http.ResponseWriter, r *http.Request) {
+	normalized, conflicts, err := db.NormalizeUserEmails()
+	if err != nil {
+		logrus.WithError(err).Error("Failed to normalize user emails")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	h.audit(r, auditActionNormalizeEmails, "", map[string]interface{}{
+		"normalized": normalized,
+		"conflicts":  conflicts,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(NormalizeEmailsResponse{Normalized: normalized, Conflicts: conflicts})
+}
+
+/**
+ * lists admin audit log entries, optionally filtered by admin, target user or action
+ */
+func (h *AdminHandler) GetAuditLog(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	from, size := getPagination(r)
+
+	entries, err := db.GetAdminAuditEntries(
+		query.Get("admin_id"),
+		query.Get("target_user_id"),
+		query.Get("action"),
+		from,
+		size,
+	)
+	if err != nil {
+		logrus.Error("Error fetching audit log: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+/**
+ * records an admin action in the audit log, and in the security log of the
+ * user it affected. Failures are logged but do not fail the request since the
+ * action itself has already been applied.
+ */
+func (h *AdminHandler) audit(r *http.Request, action, targetUserID string, details map[string]interface{}) {
+	adminID, _ := auth.GetUserIDFromContext(r.Context())
+
+	entry := models.AdminAuditEntry{
+		ID:           uuid.New().String(),
+		AdminID:      adminID,
+		Action:       action,
+		TargetUserID: targetUserID,
+		Details:      details,
+		Timestamp:    time.Now(),
+	}
+
+	if err := db.CreateAdminAuditEntry(&entry); err != nil {
+		logrus.WithError(err).Errorf("Failed to write admin audit entry for %s", action)
+	}
+
+	auth.RecordAdminEvent(adminID, targetUserID, action, clientInfo(r), details)
+}
+
+/**
+ * loads the user referenced by the userID path variable, writing a 404 if
+ * they do not exist
+ */
+func getTargetUser(w http.ResponseWriter, r *http.Request) *models.User {
+	userID := mux.Vars(r)["userID"]
+
+	if userID == "" {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return nil
+	}
+
+	user, err := db.GetUserByID(userID)
+	if err != nil {
+		if err == db.ErrUserNotFound {
+			http.Error(w, "User not found", http.StatusNotFound)
+		} else {
+			logrus.Error("Error fetching user: ", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return nil
+	}
+
+	return user
+}
+
+/**
+ * reads the from/size pagination query parameters, applying defaults and limits
+ */
+func getPagination(r *http.Request) (int, int) {
+	from, err := strconv.Atoi(r.URL.Query().Get("from"))
+	if err != nil || from < 0 {
+		from = 0
+	}
+
+	size, err := strconv.Atoi(r.URL.Query().Get("size"))
+	if err != nil || size <= 0 {
+		size = defaultAdminPageSize
+	}
+	if size > maxAdminPageSize {
+		size = maxAdminPageSize
+	}
+
+	return from, size
+}
+
+func writeMessage(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": message,
+	})
+}
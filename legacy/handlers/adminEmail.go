@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"encoding/json"
+	"eurovision-api/db"
+	"eurovision-api/mailer"
+	"eurovision-api/models"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+const auditActionRetryEmail = "retry_email"
+
+// Request/Response structs
+type AdminEmailResponse struct {
+	ID            string     `json:"id"`
+	To            string     `json:"to"`
+	Subject       string     `json:"subject"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	LastError     string     `json:"last_error,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	SentAt        *time.Time `json:"sent_at,omitempty"`
+}
+
+type AdminEmailSearchResponse struct {
+	Total  int64                `json:"total"`
+	Emails []AdminEmailResponse `json:"emails"`
+}
+
+/**
+ * leaves out the message body, which holds one-time links meant only for
+ * the recipient
+ */
+func newAdminEmailResponse(email *models.OutboundEmail) AdminEmailResponse {
+	return AdminEmailResponse{
+		ID:            email.ID,
+		To:            email.To,
+		Subject:       email.Subject,
+		Status:        email.Status,
+		Attempts:      email.Attempts,
+		NextAttemptAt: email.NextAttemptAt,
+		LastError:     email.LastError,
+		CreatedAt:     email.CreatedAt,
+		SentAt:        email.SentAt,
+	}
+}
+
+/**
+ * lists outbox messages by status and/or recipient
+ */
+func (h *AdminHandler) SearchEmails(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	to := r.URL.Query().Get("to")
+
+	switch status {
+	case "", models.EmailStatusPending, models.EmailStatusSending, models.EmailStatusSent, models.EmailStatusDead:
+	default:
+		http.Error(w, "status must be one of pending, sending, sent or dead", http.StatusBadRequest)
+		return
+	}
+
+	from, size := getPagination(r)
+
+	emails, total, err := db.SearchOutboundEmails(status, to, from, size)
+	if err != nil {
+		logrus.Error("Error searching emails: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := AdminEmailSearchResponse{Total: total, Emails: []AdminEmailResponse{}}
+	for i := range emails {
+		response.Emails = append(response.Emails, newAdminEmailResponse(&emails[i]))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+/**
+ * requeues a dead message for another round of delivery attempts
+ */
+func (h *AdminHandler) RetryEmail(w http.ResponseWriter, r *http.Request) {
+	emailID := mux.Vars(r)["emailID"]
+
+	email, err := mailer.RetryDeadEmail(emailID)
+	if err != nil {
+		switch err {
+		case db.ErrOutboundEmailNotFound:
+			http.Error(w, "Email not found", http.StatusNotFound)
+		case mailer.ErrEmailNotDead, mailer.ErrEmailBodyCleared:
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			logrus.WithError(err).Error("Failed to retry email")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	h.audit(r, auditActionRetryEmail, "", map[string]interface{}{
+		"email_id": email.ID,
+		"to":       email.To,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newAdminEmailResponse(email))
+}
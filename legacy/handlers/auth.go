@@ -2,9 +2,16 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"eurovision-api/auth"
+	"eurovision-api/utils"
+	"math"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
 
+	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 )
 
@@ -23,6 +30,11 @@ func NewAuthHandler(authService *auth.Service) *AuthHandler {
 
 // Request/Response structs
 type InitiateRegistrationRequest struct {
+	Email  string `json:"email"`
+	Locale string `json:"locale"`
+}
+
+type ResendVerificationRequest struct {
 	Email string `json:"email"`
 }
 
@@ -37,6 +49,30 @@ type LoginRequest struct {
 }
 
 type LoginResponse struct {
+	Token       string `json:"token,omitempty"`
+	MFARequired bool   `json:"mfa_required,omitempty"`
+	MFAToken    string `json:"mfa_token,omitempty"`
+}
+
+type PasswordRejectedResponse struct {
+	Error       string   `json:"error"`
+	Reason      string   `json:"reason"`
+	Score       *int     `json:"score,omitempty"`
+	Warning     string   `json:"warning,omitempty"`
+	Suggestions []string `json:"suggestions,omitempty"`
+}
+
+type CompleteMFALoginRequest struct {
+	MFAToken     string `json:"mfa_token"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type MagicLinkRequest struct {
+	Email string `json:"email"`
+}
+
+type CompleteMagicLinkRequest struct {
 	Token string `json:"token"`
 }
 
@@ -64,7 +100,13 @@ func (h *AuthHandler) InitiateRegistration(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err := h.authService.InitiateRegistration(req.Email)
+	// emails go out in the requested locale, or the browser's language
+	locale := req.Locale
+	if locale == "" {
+		locale = r.Header.Get("Accept-Language")
+	}
+
+	err := h.authService.InitiateRegistration(req.Email, locale, clientInfo(r))
 	if err != nil {
 		switch err {
 		case auth.ErrEmailExists:
@@ -84,6 +126,39 @@ func (h *AuthHandler) InitiateRegistration(w http.ResponseWriter, r *http.Reques
 	})
 }
 
+/**
+ * sends a new verification email for a registration that was never completed
+ */
+func (h *AuthHandler) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	if !h.authService.AllowResendRequest() {
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	var req ResendVerificationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	err := h.authService.ResendVerification(req.Email)
+	if err != nil {
+		switch err {
+		case auth.ErrInvalidEmail:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			logrus.WithError(err).Error("Failed to resend verification email")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "If this email is awaiting verification, a new link has been sent.",
+	})
+}
+
 /**
  * handles the second step of registration, setting user pw
  */
@@ -99,15 +174,16 @@ func (h *AuthHandler) CompleteRegistration(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err := h.authService.CompleteRegistration(req.Token, req.Password)
+	err := h.authService.CompleteRegistration(req.Token, req.Password, clientInfo(r))
 	if err != nil {
+		if writePasswordRejected(w, err) {
+			return
+		}
 		switch err {
 		case auth.ErrInvalidToken:
 			http.Error(w, err.Error(), http.StatusBadRequest)
 		case auth.ErrTokenExpired:
 			http.Error(w, err.Error(), http.StatusBadRequest)
-		case auth.ErrWeakPassword:
-			http.Error(w, err.Error(), http.StatusBadRequest)
 		default:
 			logrus.WithError(err).Error("Failed to complete registration")
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -133,8 +209,11 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token, err := h.authService.AuthenticateUser(req.Email, req.Password)
+	result, err := h.authService.AuthenticateUser(req.Email, req.Password, clientInfo(r))
 	if err != nil {
+		if writeLoginBlocked(w, err) {
+			return
+		}
 		switch err {
 		case auth.ErrInvalidCredentials:
 			http.Error(w, err.Error(), http.StatusUnauthorized)
@@ -142,6 +221,10 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), http.StatusForbidden)
 		case auth.ErrRegistrationIncomplete:
 			http.Error(w, err.Error(), http.StatusForbidden)
+		case auth.ErrAccountDisabled:
+			http.Error(w, err.Error(), http.StatusForbidden)
+		case auth.ErrPasswordResetRequired:
+			http.Error(w, err.Error(), http.StatusForbidden)
 		default:
 			logrus.WithError(err).Error("Failed to authenticate user")
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -149,9 +232,183 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	response := LoginResponse{Token: token}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	json.NewEncoder(w).Encode(newLoginResponse(result))
+}
+
+/**
+ * handles the second login step for accounts with two-factor authentication,
+ * exchanging the mfa token and a TOTP or recovery code for the JWT
+ */
+func (h *AuthHandler) CompleteMFALogin(w http.ResponseWriter, r *http.Request) {
+	if !h.authService.AllowRequest() {
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	var req CompleteMFALoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	token, err := h.authService.CompleteMFALogin(req.MFAToken, req.Code, req.RecoveryCode, clientInfo(r))
+	if err != nil {
+		if writeLoginBlocked(w, err) {
+			return
+		}
+		switch err {
+		case auth.ErrInvalidMFAToken:
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+		case auth.ErrInvalidMFACode:
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+		case auth.ErrMFANotEnabled:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case auth.ErrAccountDisabled:
+			http.Error(w, err.Error(), http.StatusForbidden)
+		default:
+			logrus.WithError(err).Error("Failed to complete mfa login")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(LoginResponse{Token: token})
+}
+
+/**
+ * emails a one-time login link to the address
+ */
+func (h *AuthHandler) RequestMagicLink(w http.ResponseWriter, r *http.Request) {
+	if !h.authService.AllowRequest() {
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	var req MagicLinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	err := h.authService.RequestMagicLink(req.Email, clientInfo(r))
+	if err != nil {
+		switch err {
+		case auth.ErrInvalidEmail:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		default:
+			// don't reveal if email exists or not
+			logrus.WithError(err).Error("Failed to send magic link")
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "If your email exists in our system, you will receive a login link.",
+	})
+}
+
+/**
+ * exchanges the token from a magic link email for the JWT, or an mfa token
+ * when the account has two-factor authentication enabled
+ */
+func (h *AuthHandler) CompleteMagicLinkLogin(w http.ResponseWriter, r *http.Request) {
+	if !h.authService.AllowRequest() {
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	var req CompleteMagicLinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.authService.CompleteMagicLinkLogin(req.Token, clientInfo(r))
+	if err != nil {
+		switch err {
+		case auth.ErrInvalidToken:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case auth.ErrTokenExpired:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case auth.ErrAccountDisabled:
+			http.Error(w, err.Error(), http.StatusForbidden)
+		case auth.ErrPasswordResetRequired:
+			http.Error(w, err.Error(), http.StatusForbidden)
+		default:
+			logrus.WithError(err).Error("Failed to complete magic link login")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newLoginResponse(result))
+}
+
+/**
+ * writes the response for a login refused because of earlier failed attempts,
+ * telling the client when to retry. Returns false for any other error.
+ */
+func writeLoginBlocked(w http.ResponseWriter, err error) bool {
+	var blocked *auth.LoginBlockedError
+	if !errors.As(err, &blocked) {
+		return false
+	}
+
+	retryAfter := int(math.Ceil(blocked.RetryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+
+	if errors.Is(err, auth.ErrAccountLocked) {
+		http.Error(w, auth.ErrAccountLocked.Error(), http.StatusLocked)
+	} else {
+		http.Error(w, auth.ErrLoginThrottled.Error(), http.StatusTooManyRequests)
+	}
+
+	return true
+}
+
+/**
+ * writes a 400 explaining why a new password was rejected, so the client can
+ * show the feedback next to the password field. Returns false for any other
+ * error.
+ */
+func writePasswordRejected(w http.ResponseWriter, err error) bool {
+	var rejected *auth.PasswordRejectedError
+	if !errors.As(err, &rejected) {
+		return false
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(PasswordRejectedResponse{
+		Error:       auth.ErrWeakPassword.Error(),
+		Reason:      rejected.Reason,
+		Score:       rejected.Score,
+		Warning:     rejected.Warning,
+		Suggestions: rejected.Suggestions,
+	})
+
+	return true
+}
+
+/**
+ * describes the client making the request, recorded on new sessions
+ */
+func clientInfo(r *http.Request) auth.ClientInfo {
+	return auth.ClientInfo{
+		IP:        utils.ClientIP(r),
+		UserAgent: r.UserAgent(),
+	}
+}
+
+func newLoginResponse(result *auth.LoginResult) LoginResponse {
+	if result.MFAToken != "" {
+		return LoginResponse{MFARequired: true, MFAToken: result.MFAToken}
+	}
+	return LoginResponse{Token: result.Token}
 }
 
 /**
@@ -169,7 +426,7 @@ func (h *AuthHandler) InitiatePasswordReset(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	err := h.authService.InitiatePasswordReset(req.Email)
+	err := h.authService.InitiatePasswordReset(req.Email, clientInfo(r))
 	if err != nil {
 		// don't reveal if email exists or not
 		logrus.WithError(err).Error("Failed to initiate password reset")
@@ -201,15 +458,16 @@ func (h *AuthHandler) CompletePasswordReset(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	err := h.authService.CompletePasswordReset(req.Token, req.NewPassword)
+	err := h.authService.CompletePasswordReset(req.Token, req.NewPassword, clientInfo(r))
 	if err != nil {
+		if writePasswordRejected(w, err) {
+			return
+		}
 		switch err {
 		case auth.ErrInvalidToken:
 			http.Error(w, err.Error(), http.StatusBadRequest)
 		case auth.ErrTokenExpired:
 			http.Error(w, err.Error(), http.StatusBadRequest)
-		case auth.ErrWeakPassword:
-			http.Error(w, err.Error(), http.StatusBadRequest)
 		default:
 			logrus.WithError(err).Error("Failed to complete password reset")
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -222,3 +480,296 @@ func (h *AuthHandler) CompletePasswordReset(w http.ResponseWriter, r *http.Reque
 		"message": "Password has been reset successfully. You can now log in with your new password.",
 	})
 }
+
+/**
+ * starts an OpenID Connect login by redirecting to the provider
+ */
+func (h *AuthHandler) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if !h.authService.AllowRequest() {
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	authURL, cookie, err := h.authService.BeginOIDCLogin(mux.Vars(r)["provider"])
+	if err != nil {
+		switch err {
+		case auth.ErrOIDCProviderNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		default:
+			logrus.WithError(err).Error("Failed to start OIDC login")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	http.SetCookie(w, cookie)
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+/**
+ * handles the provider's redirect back to the API. Responds like Login, or
+ * forwards the token to OIDC_SUCCESS_REDIRECT_URL in the URL fragment when set.
+ */
+func (h *AuthHandler) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	if providerError := query.Get("error"); providerError != "" {
+		logrus.Infof("OIDC provider returned error: %s", providerError)
+		http.Error(w, "Login was not completed: "+providerError, http.StatusBadRequest)
+		return
+	}
+
+	provider := mux.Vars(r)["provider"]
+
+	// the login cookie is single use like the state it belongs to
+	var browserSecret string
+	if cookie, err := r.Cookie(auth.OIDCLoginCookie); err == nil {
+		browserSecret = cookie.Value
+	}
+	if clear := h.authService.ClearOIDCLoginCookie(provider); clear != nil {
+		http.SetCookie(w, clear)
+	}
+
+	result, err := h.authService.CompleteOIDCLogin(
+		provider,
+		query.Get("state"),
+		query.Get("code"),
+		browserSecret,
+		clientInfo(r),
+	)
+	if err != nil {
+		switch err {
+		case auth.ErrOIDCProviderNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case auth.ErrOIDCInvalidState,
+			auth.ErrOIDCExchangeFailed,
+			auth.ErrOIDCInvalidIDToken,
+			auth.ErrOIDCEmailUnverified:
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+		case auth.ErrAccountDisabled:
+			http.Error(w, err.Error(), http.StatusForbidden)
+		case auth.ErrPasswordResetRequired:
+			http.Error(w, err.Error(), http.StatusForbidden)
+		default:
+			logrus.WithError(err).Error("Failed to complete OIDC login")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if redirectURL := os.Getenv("OIDC_SUCCESS_REDIRECT_URL"); redirectURL != "" {
+		fragment := "#token=" + url.QueryEscape(result.Token)
+		if result.MFAToken != "" {
+			fragment = "#mfa_token=" + url.QueryEscape(result.MFAToken)
+		}
+		http.Redirect(w, r, redirectURL+fragment, http.StatusFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newLoginResponse(result))
+}
+
+type CancelAccountDeletionRequest struct {
+	Token string `json:"token"`
+}
+
+type ConfirmEmailChangeRequest struct {
+	Token string `json:"token"`
+}
+
+type ApproveEmailChangeRequest struct {
+	Token string `json:"token"`
+}
+
+type ConfirmAccountDeletionRequest struct {
+	Token string `json:"token"`
+}
+
+type UnlockAccountRequest struct {
+	Token string `json:"token"`
+}
+
+/**
+ * cancels a pending account deletion using the token from the deletion email
+ */
+func (h *AuthHandler) CancelAccountDeletion(w http.ResponseWriter, r *http.Request) {
+	if !h.authService.AllowRequest() {
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	var req CancelAccountDeletionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	err := h.authService.CancelAccountDeletion(req.Token, clientInfo(r))
+	if err != nil {
+		switch err {
+		case auth.ErrInvalidToken, auth.ErrTokenExpired:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			logrus.WithError(err).Error("Failed to cancel account deletion")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Account deletion cancelled.",
+	})
+}
+
+/**
+ * confirms an email change using the token sent to the new address
+ */
+func (h *AuthHandler) ConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	if !h.authService.AllowRequest() {
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	var req ConfirmEmailChangeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	err := h.authService.ConfirmEmailChange(req.Token, clientInfo(r))
+	if err != nil {
+		switch err {
+		case auth.ErrInvalidToken:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case auth.ErrTokenExpired:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case auth.ErrEmailExists:
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			logrus.WithError(err).Error("Failed to confirm email change")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Your email address has been changed. Please log in again.",
+	})
+}
+
+/**
+ * unlocks an account locked after failed logins, using the token from the
+ * lockout email
+ */
+func (h *AuthHandler) UnlockAccount(w http.ResponseWriter, r *http.Request) {
+	if !h.authService.AllowRequest() {
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	var req UnlockAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	err := h.authService.UnlockAccount(req.Token, clientInfo(r))
+	if err != nil {
+		switch err {
+		case auth.ErrInvalidToken, auth.ErrTokenExpired:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			logrus.WithError(err).Error("Failed to unlock account")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Your account has been unlocked. You can now log in.",
+	})
+}
+
+/**
+ * publishes the public keys used to sign the API's JWTs as a JSON Web Key Set
+ */
+func (h *AuthHandler) JWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(h.authService.JWKS())
+}
+
+/**
+ * approves an email change using the token sent to the current address of an
+ * account without a password or 2FA. The new address then gets its
+ * confirmation link.
+ */
+func (h *AuthHandler) ApproveEmailChange(w http.ResponseWriter, r *http.Request) {
+	if !h.authService.AllowRequest() {
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	var req ApproveEmailChangeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	err := h.authService.ApproveEmailChange(req.Token, clientInfo(r))
+	if err != nil {
+		switch err {
+		case auth.ErrInvalidToken, auth.ErrTokenExpired:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			logrus.WithError(err).Error("Failed to approve email change")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Check your new email address for a confirmation link.",
+	})
+}
+
+/**
+ * schedules an account deletion using the token emailed to an account without
+ * a password or 2FA
+ */
+func (h *AuthHandler) ConfirmAccountDeletion(w http.ResponseWriter, r *http.Request) {
+	if !h.authService.AllowRequest() {
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	var req ConfirmAccountDeletionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	scheduledFor, err := h.authService.ConfirmAccountDeletion(req.Token, clientInfo(r))
+	if err != nil {
+		switch err {
+		case auth.ErrInvalidToken, auth.ErrTokenExpired:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			logrus.WithError(err).Error("Failed to confirm account deletion")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":       "Your account is scheduled for deletion. Check your email for a link to cancel.",
+		"scheduled_for": scheduledFor,
+	})
+}
@@ -0,0 +1,504 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"eurovision-api/auth"
+	"eurovision-api/db"
+	"eurovision-api/models"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	maxCommentLen          = 2000
+	maxReportReasonLen     = 500
+	maxCommentDepth        = 5
+	defaultCommentEditMins = 15
+
+	// placeholders shown in place of removed comments
+	deletedCommentBody = "[deleted]"
+	hiddenCommentBody  = "[hidden by a moderator]"
+
+	commentsLockedMessage = "Comments are locked on this ranking"
+)
+
+type CommentHandler struct {
+}
+
+func NewCommentHandler() *CommentHandler {
+	return &CommentHandler{}
+}
+
+// Request/Response structs
+type CreateCommentRequest struct {
+	Body     string `json:"body"`
+	ParentID string `json:"parent_id"`
+}
+
+type EditCommentRequest struct {
+	Body string `json:"body"`
+}
+
+type ReportCommentRequest struct {
+	Reason string `json:"reason"`
+}
+
+type CommentAuthor struct {
+	UserID      string `json:"user_id"`
+	Handle      string `json:"handle,omitempty"`
+	DisplayName string `json:"display_name,omitempty"`
+}
+
+type CommentResponse struct {
+	ID        string            `json:"id"`
+	ParentID  string            `json:"parent_id,omitempty"`
+	Depth     int               `json:"depth"`
+	Author    *CommentAuthor    `json:"author,omitempty"`
+	Body      string            `json:"body"`
+	CreatedAt time.Time         `json:"created_at"`
+	EditedAt  *time.Time        `json:"edited_at,omitempty"`
+	Deleted   bool              `json:"deleted"`
+	Hidden    bool              `json:"hidden"`
+	Replies   []CommentResponse `json:"replies"`
+}
+
+type CommentListResponse struct {
+	Total          int64             `json:"total"`
+	CommentsLocked bool              `json:"comments_locked"`
+	Comments       []CommentResponse `json:"comments"`
+}
+
+/**
+ * returns how long after posting a comment can be edited, from
+ * COMMENT_EDIT_WINDOW_MINUTES
+ */
+func commentEditWindow() time.Duration {
+	minutes, err := strconv.Atoi(os.Getenv("COMMENT_EDIT_WINDOW_MINUTES"))
+	if err != nil || minutes < 0 {
+		minutes = defaultCommentEditMins
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+/**
+ * trims the body and checks its length
+ */
+func validateCommentBody(body string) (string, error) {
+	body = strings.TrimSpace(body)
+	if body == "" {
+		return "", errors.New("body is required")
+	}
+	if utf8.RuneCountInString(body) > maxCommentLen {
+		return "", errors.New("body is too long")
+	}
+	return body, nil
+}
+
+/**
+ * lists a page of the ranking's comment threads, oldest first, each with all
+ * of its replies nested beneath it
+ */
+func (h *CommentHandler) ListComments(w http.ResponseWriter, r *http.Request) {
+	ranking := getAuthorizedRanking(w, r, mux.Vars(r)["rankingID"], true)
+	if ranking == nil {
+		return
+	}
+
+	from, size := getPagination(r)
+
+	threads, total, err := db.GetCommentThreads(ranking.RankingID, from, size)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to list comments")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	threadIDs := make([]string, 0, len(threads))
+	for _, thread := range threads {
+		threadIDs = append(threadIDs, thread.ID)
+	}
+
+	replies, err := db.GetCommentReplies(threadIDs)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to list comment replies")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	comments, err := buildCommentTree(append(threads, replies...))
+	if err != nil {
+		logrus.WithError(err).Error("Failed to get comment authors")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(CommentListResponse{
+		Total:          total,
+		CommentsLocked: ranking.CommentsLocked,
+		Comments:       comments,
+	})
+}
+
+/**
+ * nests the comments under their parents. Top level comments keep their
+ * order and replies are expected oldest first.
+ */
+func buildCommentTree(comments []models.Comment) ([]CommentResponse, error) {
+	authorIDs := []string{}
+	for _, comment := range comments {
+		if comment.UserID != "" {
+			authorIDs = append(authorIDs, comment.UserID)
+		}
+	}
+
+	profiles, err := db.GetProfilesByUserIDs(authorIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	children := map[string][]*models.Comment{}
+	roots := []*models.Comment{}
+	for i := range comments {
+		comment := &comments[i]
+		if comment.ParentID == "" {
+			roots = append(roots, comment)
+		} else {
+			children[comment.ParentID] = append(children[comment.ParentID], comment)
+		}
+	}
+
+	var build func(comment *models.Comment) CommentResponse
+	build = func(comment *models.Comment) CommentResponse {
+		response := newCommentResponse(comment, profiles)
+		for _, child := range children[comment.ID] {
+			response.Replies = append(response.Replies, build(child))
+		}
+		return response
+	}
+
+	tree := []CommentResponse{}
+	for _, root := range roots {
+		tree = append(tree, build(root))
+	}
+
+	return tree, nil
+}
+
+/**
+ * shapes a comment for readers. Deleted and hidden comments keep their place
+ * in the thread with a placeholder body.
+ */
+func newCommentResponse(comment *models.Comment, profiles map[string]models.Profile) CommentResponse {
+	response := CommentResponse{
+		ID:        comment.ID,
+		ParentID:  comment.ParentID,
+		Depth:     comment.Depth,
+		Body:      comment.Body,
+		CreatedAt: comment.CreatedAt,
+		EditedAt:  comment.EditedAt,
+		Deleted:   comment.Deleted,
+		Hidden:    comment.Hidden,
+		Replies:   []CommentResponse{},
+	}
+
+	switch {
+	case comment.Deleted:
+		response.Body = deletedCommentBody
+	case comment.Hidden:
+		response.Body = hiddenCommentBody
+	}
+
+	if comment.UserID != "" && !comment.Deleted {
+		profile := profiles[comment.UserID]
+		response.Author = &CommentAuthor{
+			UserID:      comment.UserID,
+			Handle:      profile.Handle,
+			DisplayName: profile.DisplayName,
+		}
+	}
+
+	return response
+}
+
+/**
+ * adds a comment to a ranking the caller can read, or a reply when
+ * parent_id is set
+ */
+func (h *CommentHandler) CreateComment(w http.ResponseWriter, r *http.Request) {
+	ranking := getAuthorizedRanking(w, r, mux.Vars(r)["rankingID"], true)
+	if ranking == nil {
+		return
+	}
+
+	if ranking.CommentsLocked {
+		http.Error(w, commentsLockedMessage, http.StatusForbidden)
+		return
+	}
+
+	var req CreateCommentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	body, err := validateCommentBody(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	userID, _ := auth.GetUserIDFromContext(r.Context())
+
+	comment := models.Comment{
+		ID:             uuid.New().String(),
+		RankingID:      ranking.RankingID,
+		RankingOwnerID: ranking.UserID,
+		UserID:         userID,
+		Body:           body,
+		CreatedAt:      time.Now(),
+	}
+	comment.ThreadID = comment.ID
+
+	if req.ParentID != "" {
+		parent, err := db.GetCommentByID(req.ParentID)
+		if err != nil && err != db.ErrCommentNotFound {
+			logrus.WithError(err).Error("Failed to get parent comment")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if err == db.ErrCommentNotFound || parent.RankingID != ranking.RankingID {
+			http.Error(w, "parent_id is not a comment on this ranking", http.StatusBadRequest)
+			return
+		}
+		if parent.Depth+1 > maxCommentDepth {
+			http.Error(w, fmt.Sprintf("Replies can only be nested %d deep", maxCommentDepth), http.StatusBadRequest)
+			return
+		}
+
+		comment.ParentID = parent.ID
+		comment.ThreadID = parent.ThreadID
+		comment.Depth = parent.Depth + 1
+	}
+
+	if err := db.CreateComment(&comment); err != nil {
+		logrus.WithError(err).Error("Failed to create comment")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response, err := buildCommentTree([]models.Comment{comment})
+	if err != nil {
+		logrus.WithError(err).Error("Failed to get comment author")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response[0])
+}
+
+/**
+ * loads the comment from the {commentID} path variable along with its
+ * ranking, writing an error if either is missing or the caller can't read
+ * the ranking
+ */
+func getReadableComment(w http.ResponseWriter, r *http.Request) (*models.Comment, *models.UserRanking) {
+	comment, err := db.GetCommentByID(mux.Vars(r)["commentID"])
+	if err != nil {
+		if err == db.ErrCommentNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return nil, nil
+		}
+		logrus.WithError(err).Error("Failed to get comment")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil, nil
+	}
+
+	ranking := getAuthorizedRanking(w, r, comment.RankingID, true)
+	if ranking == nil {
+		return nil, nil
+	}
+
+	if comment.Deleted {
+		http.Error(w, db.ErrCommentNotFound.Error(), http.StatusNotFound)
+		return nil, nil
+	}
+
+	return comment, ranking
+}
+
+/**
+ * edits the caller's own comment within the edit window
+ */
+func (h *CommentHandler) EditComment(w http.ResponseWriter, r *http.Request) {
+	comment, ranking := getReadableComment(w, r)
+	if comment == nil {
+		return
+	}
+
+	userID, _ := auth.GetUserIDFromContext(r.Context())
+	if comment.UserID != userID {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if ranking.CommentsLocked {
+		http.Error(w, commentsLockedMessage, http.StatusForbidden)
+		return
+	}
+
+	window := commentEditWindow()
+	if time.Since(comment.CreatedAt) > window {
+		http.Error(w, fmt.Sprintf("Comments can only be edited for %d minutes", int(window.Minutes())), http.StatusForbidden)
+		return
+	}
+
+	var req EditCommentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	body, err := validateCommentBody(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	editedAt := time.Now()
+	if err := db.UpdateCommentBody(comment.ID, body, editedAt); err != nil {
+		logrus.WithError(err).Error("Failed to edit comment")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	comment.Body = body
+	comment.EditedAt = &editedAt
+
+	response, err := buildCommentTree([]models.Comment{*comment})
+	if err != nil {
+		logrus.WithError(err).Error("Failed to get comment author")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response[0])
+}
+
+/**
+ * deletes a comment. Authors can delete their own comments and ranking
+ * owners can delete any comment on their ranking.
+ */
+func (h *CommentHandler) DeleteComment(w http.ResponseWriter, r *http.Request) {
+	comment, ranking := getReadableComment(w, r)
+	if comment == nil {
+		return
+	}
+
+	userID, _ := auth.GetUserIDFromContext(r.Context())
+	if comment.UserID != userID && ranking.UserID != userID {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := db.DeleteComment(comment.ID); err != nil {
+		logrus.WithError(err).Error("Failed to delete comment")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeMessage(w, "Comment deleted")
+}
+
+/**
+ * reports a comment to the moderators. Each user can report a comment once.
+ */
+func (h *CommentHandler) ReportComment(w http.ResponseWriter, r *http.Request) {
+	comment, _ := getReadableComment(w, r)
+	if comment == nil {
+		return
+	}
+
+	userID, _ := auth.GetUserIDFromContext(r.Context())
+	if comment.UserID == userID {
+		http.Error(w, "You can't report your own comment", http.StatusBadRequest)
+		return
+	}
+
+	var req ReportCommentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	req.Reason = strings.TrimSpace(req.Reason)
+	if utf8.RuneCountInString(req.Reason) > maxReportReasonLen {
+		http.Error(w, "reason is too long", http.StatusBadRequest)
+		return
+	}
+
+	err := db.ReportComment(&models.CommentReport{
+		CommentID:      comment.ID,
+		RankingID:      comment.RankingID,
+		RankingOwnerID: comment.RankingOwnerID,
+		UserID:         userID,
+		Reason:         req.Reason,
+		CreatedAt:      time.Now(),
+	})
+
+	switch err {
+	case nil:
+		writeMessage(w, "Comment reported")
+	case db.ErrAlreadyReported:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		logrus.WithError(err).Error("Failed to report comment")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+/**
+ * stops new comments and edits on the caller's own ranking
+ */
+func (h *CommentHandler) LockComments(w http.ResponseWriter, r *http.Request) {
+	setCommentsLocked(w, r, true)
+}
+
+/**
+ * allows comments on the caller's own ranking again
+ */
+func (h *CommentHandler) UnlockComments(w http.ResponseWriter, r *http.Request) {
+	setCommentsLocked(w, r, false)
+}
+
+func setCommentsLocked(w http.ResponseWriter, r *http.Request, locked bool) {
+	ranking := getAuthorizedRanking(w, r, mux.Vars(r)["rankingID"], false)
+	if ranking == nil {
+		return
+	}
+
+	if err := db.SetCommentsLocked(ranking.RankingID, locked); err != nil {
+		logrus.WithError(err).Error("Failed to lock comments")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if locked {
+		writeMessage(w, "Comments locked")
+	} else {
+		writeMessage(w, "Comments unlocked")
+	}
+}
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+/**
+ * encodes the sort values of the last item on a page as an opaque cursor.
+ * Paging with search_after from these values stays stable when new items are
+ * added to the top of the results.
+ */
+func encodeCursor(sortValues []interface{}) (string, error) {
+	data, err := json.Marshal(sortValues)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+/**
+ * decodes a cursor made by encodeCursor, checking it holds the expected number
+ * of sort values. An empty cursor decodes to nil, meaning the first page.
+ */
+func decodeCursor(cursor string, sortValueCount int) ([]interface{}, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+
+	// keep numbers as json.Number so timestamps and scores round trip exactly
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var sortValues []interface{}
+	if err := decoder.Decode(&sortValues); err != nil || len(sortValues) != sortValueCount {
+		return nil, errInvalidCursor
+	}
+
+	return sortValues, nil
+}
@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"eurovision-api/auth"
+	"eurovision-api/db"
+	"eurovision-api/models"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// the user's account data, without password hashes, tokens or 2FA secrets
+type ExportedUser struct {
+	ID                   string     `json:"id"`
+	Email                string     `json:"email"`
+	Role                 string     `json:"role"`
+	Locale               string     `json:"locale,omitempty"`
+	Confirmed            bool       `json:"confirmed"`
+	TwoFactorEnabled     bool       `json:"two_factor_enabled"`
+	CreatedAt            time.Time  `json:"created_at"`
+	DeletionScheduledFor *time.Time `json:"deletion_scheduled_for,omitempty"`
+}
+
+type AccountExport struct {
+	ExportedAt       time.Time                `json:"exported_at"`
+	User             ExportedUser             `json:"user"`
+	Profile          *models.Profile          `json:"profile,omitempty"`
+	Identities       []models.UserIdentity    `json:"identities"`
+	Rankings         []models.UserRanking     `json:"rankings"`
+	RankingRevisions []models.RankingRevision `json:"ranking_revisions"`
+	Votes            []models.Vote            `json:"votes"`
+	Following        []models.Follow          `json:"following"`
+	Followers        []models.Follow          `json:"followers"`
+	Reactions        []models.Reaction        `json:"reactions"`
+	Comments         []models.Comment         `json:"comments"`
+}
+
+/**
+ * gathers everything stored about the user
+ */
+func buildAccountExport(userID string) (*AccountExport, error) {
+	user, err := db.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	// users who never saved a profile have none to export
+	profile, err := db.GetProfile(userID)
+	if err != nil && err != db.ErrProfileNotFound {
+		return nil, err
+	}
+
+	identities, err := db.GetIdentitiesByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	rankings, err := db.GetAllRankingsByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	revisions, err := db.GetRankingRevisionsByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	votes, err := db.GetVotesByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	following, err := db.GetAllFollowing(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	followers, err := db.GetAllFollowers(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	reactions, err := db.GetReactionsByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	comments, err := db.GetCommentsByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AccountExport{
+		ExportedAt: time.Now(),
+		User: ExportedUser{
+			ID:                   user.ID,
+			Email:                user.Email,
+			Role:                 user.EffectiveRole(),
+			Locale:               user.Locale,
+			Confirmed:            user.Confirmed,
+			TwoFactorEnabled:     user.TOTPEnabled,
+			CreatedAt:            user.CreatedAt,
+			DeletionScheduledFor: user.DeletionScheduledFor,
+		},
+		Profile:          profile,
+		Identities:       identities,
+		Rankings:         rankings,
+		RankingRevisions: revisions,
+		Votes:            votes,
+		Following:        following,
+		Followers:        followers,
+		Reactions:        reactions,
+		Comments:         comments,
+	}, nil
+}
+
+/**
+ * exports the authenticated user's data. Responds with a ZIP archive holding
+ * one JSON file per data set, or a single JSON document with ?format=json.
+ */
+func (h *AccountHandler) ExportData(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "zip" && format != "json" {
+		http.Error(w, "format must be zip or json", http.StatusBadRequest)
+		return
+	}
+
+	export, err := buildAccountExport(userID)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to build account export")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	filename := fmt.Sprintf("eurovision-ranker-export-%s", export.ExportedAt.Format("20060102"))
+
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.json"`, filename))
+		json.NewEncoder(w).Encode(export)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.zip"`, filename))
+
+	if err := writeExportZip(w, export); err != nil {
+		// headers are already sent, so the best we can do is log
+		logrus.WithError(err).Error("Failed to write account export archive")
+	}
+}
+
+func writeExportZip(w http.ResponseWriter, export *AccountExport) error {
+	archive := zip.NewWriter(w)
+
+	files := []struct {
+		name string
+		data interface{}
+	}{
+		{"user.json", export.User},
+		{"profile.json", export.Profile},
+		{"identities.json", export.Identities},
+		{"rankings.json", export.Rankings},
+		{"ranking_revisions.json", export.RankingRevisions},
+		{"votes.json", export.Votes},
+		{"following.json", export.Following},
+		{"followers.json", export.Followers},
+		{"reactions.json", export.Reactions},
+		{"comments.json", export.Comments},
+	}
+
+	for _, file := range files {
+		writer, err := archive.CreateHeader(&zip.FileHeader{
+			Name:     file.name,
+			Method:   zip.Deflate,
+			Modified: export.ExportedAt,
+		})
+		if err != nil {
+			return err
+		}
+
+		encoder := json.NewEncoder(writer)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(file.data); err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
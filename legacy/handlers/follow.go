@@ -0,0 +1,332 @@
+package handlers
+
+import (
+	"encoding/json"
+	"eurovision-api/auth"
+	"eurovision-api/db"
+	"eurovision-api/models"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// keeps the feed query's list of followed users bounded
+	maxFollowing = 5000
+
+	defaultFeedPageSize = 20
+	maxFeedPageSize     = 50
+
+	feedItemCreated = "ranking_created"
+	feedItemUpdated = "ranking_updated"
+)
+
+type FollowHandler struct {
+}
+
+func NewFollowHandler() *FollowHandler {
+	return &FollowHandler{}
+}
+
+// Request/Response structs
+type FollowUserResponse struct {
+	UserID      string    `json:"user_id"`
+	Handle      string    `json:"handle,omitempty"`
+	DisplayName string    `json:"display_name,omitempty"`
+	AvatarURL   string    `json:"avatar_url,omitempty"`
+	FollowedAt  time.Time `json:"followed_at"`
+}
+
+type FollowListResponse struct {
+	Total int64                `json:"total"`
+	Users []FollowUserResponse `json:"users"`
+}
+
+type FeedAuthor struct {
+	UserID      string `json:"user_id"`
+	Handle      string `json:"handle,omitempty"`
+	DisplayName string `json:"display_name,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+}
+
+type FeedItem struct {
+	Type      string             `json:"type"`
+	Timestamp time.Time          `json:"timestamp"`
+	Author    FeedAuthor         `json:"author"`
+	Ranking   models.UserRanking `json:"ranking"`
+}
+
+type FeedResponse struct {
+	Items      []FeedItem `json:"items"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+}
+
+/**
+ * follows the user with the {handle} path variable
+ */
+func (h *FollowHandler) Follow(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	profile := getActiveProfile(w, r)
+	if profile == nil {
+		return
+	}
+
+	if profile.UserID == userID {
+		http.Error(w, "You can't follow yourself", http.StatusBadRequest)
+		return
+	}
+
+	count, err := db.CountByFieldValue(db.FollowsIndex, "follower_id", userID)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if count >= maxFollowing {
+		http.Error(w, "Maximum number of followed users reached: "+strconv.Itoa(maxFollowing), http.StatusBadRequest)
+		return
+	}
+
+	err = db.CreateFollow(&models.Follow{
+		FollowerID: userID,
+		FolloweeID: profile.UserID,
+		CreatedAt:  time.Now(),
+	})
+
+	// following someone twice is not an error
+	if err != nil && err != db.ErrAlreadyFollowing {
+		logrus.WithError(err).Error("Failed to follow user")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeMessage(w, "Following "+profile.Handle)
+}
+
+/**
+ * stops following the user with the {handle} path variable
+ */
+func (h *FollowHandler) Unfollow(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	profile := getActiveProfile(w, r)
+	if profile == nil {
+		return
+	}
+
+	switch err := db.DeleteFollow(userID, profile.UserID); err {
+	case nil:
+		writeMessage(w, "Unfollowed "+profile.Handle)
+	case db.ErrNotFollowing:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		logrus.WithError(err).Error("Failed to unfollow user")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+/**
+ * lists the users the authenticated user follows
+ */
+func (h *FollowHandler) GetMyFollowing(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	writeFollowList(w, r, userID, db.GetFollowing, func(f models.Follow) string { return f.FolloweeID })
+}
+
+/**
+ * lists the authenticated user's followers
+ */
+func (h *FollowHandler) GetMyFollowers(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	writeFollowList(w, r, userID, db.GetFollowers, func(f models.Follow) string { return f.FollowerID })
+}
+
+/**
+ * lists the users followed by the user with the {handle} path variable
+ */
+func (h *FollowHandler) GetFollowing(w http.ResponseWriter, r *http.Request) {
+	profile := getActiveProfile(w, r)
+	if profile == nil {
+		return
+	}
+
+	writeFollowList(w, r, profile.UserID, db.GetFollowing, func(f models.Follow) string { return f.FolloweeID })
+}
+
+/**
+ * lists the followers of the user with the {handle} path variable
+ */
+func (h *FollowHandler) GetFollowers(w http.ResponseWriter, r *http.Request) {
+	profile := getActiveProfile(w, r)
+	if profile == nil {
+		return
+	}
+
+	writeFollowList(w, r, profile.UserID, db.GetFollowers, func(f models.Follow) string { return f.FollowerID })
+}
+
+/**
+ * writes a page of follows, described by the profile of the user on the
+ * other side of each follow
+ */
+func writeFollowList(
+	w http.ResponseWriter,
+	r *http.Request,
+	userID string,
+	list func(userID string, from, size int) ([]models.Follow, int64, error),
+	otherUser func(models.Follow) string,
+) {
+	from, size := getPagination(r)
+
+	follows, total, err := list(userID, from, size)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to list follows")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	userIDs := make([]string, 0, len(follows))
+	for _, follow := range follows {
+		userIDs = append(userIDs, otherUser(follow))
+	}
+
+	profiles, err := db.GetProfilesByUserIDs(userIDs)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to get profiles")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := FollowListResponse{Total: total, Users: []FollowUserResponse{}}
+	for _, follow := range follows {
+		id := otherUser(follow)
+		profile := profiles[id]
+		response.Users = append(response.Users, FollowUserResponse{
+			UserID:      id,
+			Handle:      profile.Handle,
+			DisplayName: profile.DisplayName,
+			AvatarURL:   profile.AvatarURL,
+			FollowedAt:  follow.CreatedAt,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+/**
+ * returns public rankings created or updated by the users the authenticated
+ * user follows, newest first. Each ranking appears once, at the time of its
+ * latest change. Pass next_cursor back as ?cursor= to get the next page.
+ */
+func (h *FollowHandler) GetFeed(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	size, err := strconv.Atoi(r.URL.Query().Get("size"))
+	if err != nil || size <= 0 {
+		size = defaultFeedPageSize
+	}
+	if size > maxFeedPageSize {
+		size = maxFeedPageSize
+	}
+
+	searchAfter, err := decodeCursor(r.URL.Query().Get("cursor"), 2)
+	if err != nil {
+		http.Error(w, "Invalid cursor", http.StatusBadRequest)
+		return
+	}
+
+	followeeIDs, err := db.GetAllFolloweeIDs(userID)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to get followed users")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	rankings, lastSort, err := db.GetFeedRankings(followeeIDs, searchAfter, size)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to get feed")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	authorIDs := []string{}
+	for _, ranking := range rankings {
+		authorIDs = append(authorIDs, ranking.UserID)
+	}
+
+	profiles, err := db.GetProfilesByUserIDs(authorIDs)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to get profiles")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := FeedResponse{Items: []FeedItem{}}
+	for _, ranking := range rankings {
+		profile := profiles[ranking.UserID]
+		response.Items = append(response.Items, newFeedItem(ranking, FeedAuthor{
+			UserID:      ranking.UserID,
+			Handle:      profile.Handle,
+			DisplayName: profile.DisplayName,
+			AvatarURL:   profile.AvatarURL,
+		}))
+	}
+
+	if lastSort != nil {
+		response.NextCursor, err = encodeCursor(lastSort)
+		if err != nil {
+			logrus.WithError(err).Error("Failed to encode feed cursor")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+/**
+ * a ranking that was never changed after being created is reported as a
+ * creation. Rankings saved before updated_at was set on create fall back to
+ * their creation time.
+ */
+func newFeedItem(ranking models.UserRanking, author FeedAuthor) FeedItem {
+	item := FeedItem{
+		Type:      feedItemUpdated,
+		Timestamp: ranking.UpdatedAt,
+		Author:    author,
+		Ranking:   ranking,
+	}
+
+	if !ranking.UpdatedAt.After(ranking.CreatedAt) {
+		item.Type = feedItemCreated
+		item.Timestamp = ranking.CreatedAt
+	}
+
+	return item
+}
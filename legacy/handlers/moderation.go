@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"encoding/json"
+	"eurovision-api/auth"
+	"eurovision-api/db"
+	"eurovision-api/models"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// moderation actions recorded in the admin audit log
+const (
+	auditActionViewModerationQueue = "view_moderation_queue"
+	auditActionHideComment         = "hide_comment"
+	auditActionRestoreComment      = "restore_comment"
+)
+
+// Request/Response structs
+type HideCommentRequest struct {
+	Reason string `json:"reason"`
+}
+
+type ModerationQueueItem struct {
+	Comment models.Comment         `json:"comment"`
+	Reports []models.CommentReport `json:"reports"`
+}
+
+type ModerationQueueResponse struct {
+	Total    int64                 `json:"total"`
+	Comments []ModerationQueueItem `json:"comments"`
+}
+
+/**
+ * lists reported comments awaiting review, or hidden comments with
+ * ?status=hidden, along with their reports
+ */
+func (h *AdminHandler) GetModerationQueue(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = db.ModerationQueueReported
+	}
+	if status != db.ModerationQueueReported && status != db.ModerationQueueHidden {
+		http.Error(w, "status must be reported or hidden", http.StatusBadRequest)
+		return
+	}
+
+	from, size := getPagination(r)
+
+	comments, total, err := db.GetModerationQueue(status, from, size)
+	if err != nil {
+		logrus.Error("Error getting moderation queue: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	commentIDs := make([]string, 0, len(comments))
+	for _, comment := range comments {
+		commentIDs = append(commentIDs, comment.ID)
+	}
+
+	reports, err := db.GetCommentReports(commentIDs)
+	if err != nil {
+		logrus.Error("Error getting comment reports: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	h.audit(r, auditActionViewModerationQueue, "", map[string]interface{}{
+		"status": status,
+	})
+
+	response := ModerationQueueResponse{Total: total, Comments: []ModerationQueueItem{}}
+	for _, comment := range comments {
+		commentReports := reports[comment.ID]
+		if commentReports == nil {
+			commentReports = []models.CommentReport{}
+		}
+		response.Comments = append(response.Comments, ModerationQueueItem{
+			Comment: comment,
+			Reports: commentReports,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+/**
+ * hides a comment from everyone but moderators
+ */
+func (h *AdminHandler) HideComment(w http.ResponseWriter, r *http.Request) {
+	comment := getModeratedComment(w, r)
+	if comment == nil {
+		return
+	}
+
+	var req HideCommentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	req.Reason = strings.TrimSpace(req.Reason)
+	if utf8.RuneCountInString(req.Reason) > maxReportReasonLen {
+		http.Error(w, "reason is too long", http.StatusBadRequest)
+		return
+	}
+
+	moderatorID, _ := auth.GetUserIDFromContext(r.Context())
+
+	if err := db.HideComment(comment.ID, moderatorID, req.Reason); err != nil {
+		logrus.Error("Error hiding comment: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	h.audit(r, auditActionHideComment, comment.UserID, map[string]interface{}{
+		"comment_id": comment.ID,
+		"ranking_id": comment.RankingID,
+		"reason":     req.Reason,
+	})
+
+	writeMessage(w, "Comment hidden")
+}
+
+/**
+ * makes a hidden comment visible again, or dismisses the reports on a
+ * visible one
+ */
+func (h *AdminHandler) RestoreComment(w http.ResponseWriter, r *http.Request) {
+	comment := getModeratedComment(w, r)
+	if comment == nil {
+		return
+	}
+
+	if err := db.RestoreComment(comment.ID); err != nil {
+		logrus.Error("Error restoring comment: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	h.audit(r, auditActionRestoreComment, comment.UserID, map[string]interface{}{
+		"comment_id": comment.ID,
+		"ranking_id": comment.RankingID,
+	})
+
+	writeMessage(w, "Comment restored")
+}
+
+/**
+ * loads the comment referenced by the commentID path variable, writing a 404
+ * if it does not exist or was deleted by its author
+ */
+func getModeratedComment(w http.ResponseWriter, r *http.Request) *models.Comment {
+	comment, err := db.GetCommentByID(mux.Vars(r)["commentID"])
+	if err != nil {
+		if err == db.ErrCommentNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return nil
+		}
+		logrus.Error("Error getting comment: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil
+	}
+
+	if comment.Deleted {
+		http.Error(w, db.ErrCommentNotFound.Error(), http.StatusNotFound)
+		return nil
+	}
+
+	return comment
+}
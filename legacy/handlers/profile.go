@@ -0,0 +1,324 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"eurovision-api/auth"
+	"eurovision-api/db"
+	"eurovision-api/models"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	maxDisplayNameLen = 50
+	maxBioLen         = 500
+	maxAvatarURLLen   = 2048
+)
+
+var (
+	handlePattern  = regexp.MustCompile(`^[a-z0-9_]{3,30}$`)
+	countryPattern = regexp.MustCompile(`^[A-Z]{2}$`)
+
+	// handles that could be mistaken for the site itself
+	reservedHandles = map[string]bool{
+		"admin": true, "administrator": true, "api": true, "auth": true,
+		"eurovision": true, "help": true, "me": true, "moderator": true,
+		"root": true, "settings": true, "support": true, "system": true,
+		"users": true,
+	}
+)
+
+type ProfileHandler struct {
+}
+
+func NewProfileHandler() *ProfileHandler {
+	return &ProfileHandler{}
+}
+
+// Request/Response structs
+
+// fields left out of the request are unchanged, empty strings clear them
+type UpdateProfileRequest struct {
+	Handle      *string `json:"handle"`
+	DisplayName *string `json:"display_name"`
+	Bio         *string `json:"bio"`
+	Country     *string `json:"country"`
+	AvatarURL   *string `json:"avatar_url"`
+}
+
+type PublicProfileResponse struct {
+	Handle         string               `json:"handle"`
+	DisplayName    string               `json:"display_name"`
+	Bio            string               `json:"bio"`
+	Country        string               `json:"country,omitempty"`
+	AvatarURL      string               `json:"avatar_url,omitempty"`
+	UserID         string               `json:"user_id"`
+	CreatedAt      time.Time            `json:"created_at"`
+	FollowerCount  int64                `json:"follower_count"`
+	FollowingCount int64                `json:"following_count"`
+	Rankings       []models.UserRanking `json:"rankings"`
+}
+
+/**
+ * lowercases and trims the fields that are stored in canonical form
+ */
+func (req *UpdateProfileRequest) normalize() {
+	trim := func(value *string) {
+		if value != nil {
+			*value = strings.TrimSpace(*value)
+		}
+	}
+
+	trim(req.Handle)
+	trim(req.DisplayName)
+	trim(req.Bio)
+	trim(req.Country)
+	trim(req.AvatarURL)
+
+	if req.Handle != nil {
+		*req.Handle = strings.ToLower(*req.Handle)
+	}
+	if req.Country != nil {
+		*req.Country = strings.ToUpper(*req.Country)
+	}
+}
+
+/**
+ * checks the changed fields. Expects the request to be normalized.
+ */
+func (req UpdateProfileRequest) validate() error {
+	if req.Handle != nil {
+		if !handlePattern.MatchString(*req.Handle) {
+			return errors.New("handle must be 3 to 30 characters of letters, digits and underscores")
+		}
+		if reservedHandles[*req.Handle] {
+			return errors.New("handle is reserved")
+		}
+	}
+
+	if req.DisplayName != nil {
+		if utf8.RuneCountInString(*req.DisplayName) > maxDisplayNameLen {
+			return errors.New("display_name is too long")
+		}
+		if strings.IndexFunc(*req.DisplayName, unicode.IsControl) >= 0 {
+			return errors.New("display_name contains invalid characters")
+		}
+	}
+
+	if req.Bio != nil && utf8.RuneCountInString(*req.Bio) > maxBioLen {
+		return errors.New("bio is too long")
+	}
+
+	if req.Country != nil && *req.Country != "" && !countryPattern.MatchString(*req.Country) {
+		return errors.New("country must be an ISO 3166-1 alpha-2 code")
+	}
+
+	if req.AvatarURL != nil && *req.AvatarURL != "" {
+		if len(*req.AvatarURL) > maxAvatarURLLen {
+			return errors.New("avatar_url is too long")
+		}
+		parsed, err := url.Parse(*req.AvatarURL)
+		if err != nil || parsed.Scheme != "https" || parsed.Host == "" {
+			return errors.New("avatar_url must be an https URL")
+		}
+	}
+
+	return nil
+}
+
+/**
+ * returns the authenticated user's profile. Users who never saved one get an
+ * empty profile.
+ */
+func (h *ProfileHandler) GetMyProfile(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	profile, err := db.GetProfile(userID)
+	if err != nil {
+		if err != db.ErrProfileNotFound {
+			logrus.WithError(err).Error("Failed to get profile")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		profile = &models.Profile{UserID: userID}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(profile)
+}
+
+/**
+ * updates the authenticated user's profile, creating it on first use. A new
+ * handle is reserved before the profile is saved and the old one is released
+ * afterwards.
+ */
+func (h *ProfileHandler) UpdateMyProfile(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req UpdateProfileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.normalize()
+
+	if err := req.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+
+	profile, err := db.GetProfile(userID)
+	if err != nil {
+		if err != db.ErrProfileNotFound {
+			logrus.WithError(err).Error("Failed to get profile")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		profile = &models.Profile{UserID: userID, CreatedAt: now}
+	}
+
+	previousHandle := profile.Handle
+
+	if req.Handle != nil && *req.Handle != previousHandle {
+		if err := db.ReserveHandle(*req.Handle, userID); err != nil {
+			if err == db.ErrHandleTaken {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			logrus.WithError(err).Error("Failed to reserve handle")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		profile.Handle = *req.Handle
+	}
+	if req.DisplayName != nil {
+		profile.DisplayName = *req.DisplayName
+	}
+	if req.Bio != nil {
+		profile.Bio = *req.Bio
+	}
+	if req.Country != nil {
+		profile.Country = *req.Country
+	}
+	if req.AvatarURL != nil {
+		profile.AvatarURL = *req.AvatarURL
+	}
+	profile.UpdatedAt = now
+
+	if err := db.SaveProfile(profile); err != nil {
+		if profile.Handle != previousHandle {
+			releaseHandle(profile.Handle, userID)
+		}
+		logrus.WithError(err).Error("Failed to save profile")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if previousHandle != "" && profile.Handle != previousHandle {
+		releaseHandle(previousHandle, userID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(profile)
+}
+
+func releaseHandle(handle, userID string) {
+	if err := db.ReleaseHandle(handle, userID); err != nil {
+		logrus.WithError(err).Errorf("Failed to release handle %s", handle)
+	}
+}
+
+/**
+ * returns the profile with the given handle, follower counts and the user's
+ * public rankings. Disabled accounts are reported as not found.
+ */
+func (h *ProfileHandler) GetPublicProfile(w http.ResponseWriter, r *http.Request) {
+	profile := getActiveProfile(w, r)
+	if profile == nil {
+		return
+	}
+
+	followers, err := db.CountByFieldValue(db.FollowsIndex, "followee_id", profile.UserID)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	following, err := db.CountByFieldValue(db.FollowsIndex, "follower_id", profile.UserID)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	rankings, err := db.GetPublicRankingsByUserID(profile.UserID)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to get public rankings")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PublicProfileResponse{
+		Handle:         profile.Handle,
+		DisplayName:    profile.DisplayName,
+		Bio:            profile.Bio,
+		Country:        profile.Country,
+		AvatarURL:      profile.AvatarURL,
+		UserID:         profile.UserID,
+		CreatedAt:      profile.CreatedAt,
+		FollowerCount:  followers,
+		FollowingCount: following,
+		Rankings:       rankings,
+	})
+}
+
+/**
+ * looks up the profile for the {handle} path variable. Responds with 404 and
+ * returns nil when there is none or its owner's account is disabled.
+ */
+func getActiveProfile(w http.ResponseWriter, r *http.Request) *models.Profile {
+	handle := strings.ToLower(mux.Vars(r)["handle"])
+
+	profile, err := db.GetProfileByHandle(handle)
+	if err != nil {
+		if err == db.ErrProfileNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return nil
+		}
+		logrus.WithError(err).Error("Failed to get profile")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil
+	}
+
+	user, err := db.GetUserByID(profile.UserID)
+	if err != nil && err != db.ErrUserNotFound {
+		logrus.WithError(err).Error("Failed to get profile owner")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil
+	}
+	if err == db.ErrUserNotFound || user.Disabled {
+		http.Error(w, db.ErrProfileNotFound.Error(), http.StatusNotFound)
+		return nil
+	}
+
+	return profile
+}
@@ -12,6 +12,7 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 )
@@ -22,6 +23,14 @@ var maxRankings int64
 type RankingHandler struct {
 }
 
+// a ranking along with its reaction counts by kind and the kinds the caller
+// reacted with
+type RankingResponse struct {
+	models.UserRanking
+	ReactionCounts map[string]int64 `json:"reaction_counts"`
+	MyReactions    []string         `json:"my_reactions"`
+}
+
 func NewRankingHandler() *RankingHandler {
 	return &RankingHandler{}
 }
@@ -55,11 +64,13 @@ func (h *RankingHandler) CreateRanking(w http.ResponseWriter, r *http.Request) {
 
 	count, nil := db.CountByFieldValue(db.RankingsIndex, "user_id", userID)
 
-	if count >= maxRankings {
-		logrus.Infof("User %s has reached the maximum number of rankings, %d", userID, maxRankings)
+	limit := rankingLimitForUser(userID)
+
+	if count >= limit {
+		logrus.Infof("User %s has reached the maximum number of rankings, %d", userID, limit)
 		http.Error(
 			w,
-			fmt.Sprintf("Maximum number of rankings already reached: %d", maxRankings),
+			fmt.Sprintf("Maximum number of rankings already reached: %d", limit),
 			http.StatusBadRequest,
 		)
 		return
@@ -72,6 +83,9 @@ func (h *RankingHandler) CreateRanking(w http.ResponseWriter, r *http.Request) {
 	}
 
 	ranking.CreatedAt = time.Now()
+	ranking.UpdatedAt = ranking.CreatedAt
+	ranking.CommentsLocked = false
+	decodeRankingPositions(&ranking)
 	ranking.UserID = userID
 	ranking.RankingID = GenerateShortID()
 
@@ -86,6 +100,24 @@ func (h *RankingHandler) CreateRanking(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusCreated)
 }
 
+/**
+ * returns the maximum number of rankings the user may have. An admin-assigned
+ * quota on the user takes precedence over MAX_USER_RANKINGS.
+ */
+func rankingLimitForUser(userID string) int64 {
+	user, err := db.GetUserByID(userID)
+	if err != nil {
+		logrus.Error("Error fetching user for ranking quota: ", err)
+		return maxRankings
+	}
+
+	if user.RankingQuota != nil {
+		return *user.RankingQuota
+	}
+
+	return maxRankings
+}
+
 func (h *RankingHandler) DeleteRanking(w http.ResponseWriter, r *http.Request) {
 
 	// get rankingID from URL path variables
@@ -104,7 +136,7 @@ func (h *RankingHandler) DeleteRanking(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := db.DeleteByFieldValue(db.RankingsIndex, "ranking_id", rankingID)
+	err := db.DeleteRanking(rankingID)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -138,8 +170,19 @@ func (h *RankingHandler) GetRanking(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	counts, mine, err := getReactionSummary(r, rankingID)
+	if err != nil {
+		logrus.Error("Error fetching ranking reactions: ", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(ranking)
+	json.NewEncoder(w).Encode(RankingResponse{
+		UserRanking:    *ranking,
+		ReactionCounts: counts,
+		MyReactions:    mine,
+	})
 }
 
 /**
@@ -159,11 +202,33 @@ func (h *RankingHandler) UpdateRanking(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// preserve the original UserID and CreatedAt
+	// keep the previous version so users can export their ranking history
+	revision := models.RankingRevision{
+		RevisionID:  uuid.New().String(),
+		RankingID:   existingRanking.RankingID,
+		UserID:      existingRanking.UserID,
+		Name:        existingRanking.Name,
+		Description: existingRanking.Description,
+		Year:        existingRanking.Year,
+		Ranking:     existingRanking.Ranking,
+		Public:      existingRanking.Public,
+		GroupIDs:    existingRanking.GroupIDs,
+		RevisedAt:   time.Now(),
+	}
+
+	if err := db.CreateRankingRevision(&revision); err != nil {
+		logrus.Error("Error creating ranking revision: ", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// preserve the original UserID, CreatedAt and comment lock
 	ranking.RankingID = existingRanking.RankingID
 	ranking.UserID = existingRanking.UserID
 	ranking.CreatedAt = existingRanking.CreatedAt
+	ranking.CommentsLocked = existingRanking.CommentsLocked
 	ranking.UpdatedAt = time.Now()
+	decodeRankingPositions(&ranking)
 
 	err := db.UpdateRanking(&ranking)
 
@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"encoding/json"
+	"eurovision-api/models"
+	"eurovision-api/utils"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// how many entries are listed as the largest disagreements
+const maxDisagreements = 5
+
+// Request/Response structs
+type ComparedRanking struct {
+	RankingID string `json:"ranking_id"`
+	UserID    string `json:"user_id"`
+	Name      string `json:"name"`
+	Year      int    `json:"year"`
+}
+
+type EntryDelta struct {
+	Country   string `json:"country"`
+	PositionA int    `json:"position_a"`
+	PositionB int    `json:"position_b"`
+	Delta     int    `json:"delta"`
+}
+
+type CompareRankingsResponse struct {
+	A                    ComparedRanking          `json:"a"`
+	B                    ComparedRanking          `json:"b"`
+	Agreement            utils.RankingAgreement   `json:"agreement"`
+	Entries              []EntryDelta             `json:"entries"`
+	OnlyInA              []models.RankingPosition `json:"only_in_a"`
+	OnlyInB              []models.RankingPosition `json:"only_in_b"`
+	LargestDisagreements []EntryDelta             `json:"largest_disagreements"`
+}
+
+/**
+ * compares two decoded rankings ?a= and ?b= the user can read. Each entry
+ * in both gets its position in each and the delta, b minus a, so a positive
+ * delta means b placed the entry lower. ?format=text returns a plain text
+ * table instead of JSON.
+ */
+func (h *RankingHandler) CompareRankings(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	format := query.Get("format")
+	if format != "" && format != "json" && format != "text" {
+		http.Error(w, "format must be json or text", http.StatusBadRequest)
+		return
+	}
+
+	if query.Get("a") == "" || query.Get("b") == "" {
+		http.Error(w, "a and b ranking ids are required", http.StatusBadRequest)
+		return
+	}
+
+	a := getAuthorizedRanking(w, r, query.Get("a"), true)
+	if a == nil || !requireDecodedRanking(w, a) {
+		return
+	}
+
+	b := getAuthorizedRanking(w, r, query.Get("b"), true)
+	if b == nil || !requireDecodedRanking(w, b) {
+		return
+	}
+
+	response := compareRankings(a, b)
+
+	if format == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writeComparisonTable(w, response)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+/**
+ * builds the comparison of two decoded rankings. Entries are in a's order.
+ */
+func compareRankings(a, b *models.UserRanking) CompareRankingsResponse {
+	response := CompareRankingsResponse{
+		A:                    comparedRanking(a),
+		B:                    comparedRanking(b),
+		Agreement:            utils.CompareRankingPositions(a.Positions, b.Positions),
+		Entries:              []EntryDelta{},
+		OnlyInA:              []models.RankingPosition{},
+		OnlyInB:              []models.RankingPosition{},
+		LargestDisagreements: []EntryDelta{},
+	}
+
+	positionsB := map[string]int{}
+	for _, position := range b.Positions {
+		positionsB[position.Country] = position.Position
+	}
+
+	inA := map[string]bool{}
+	for _, position := range a.Positions {
+		inA[position.Country] = true
+
+		positionB, ok := positionsB[position.Country]
+		if !ok {
+			response.OnlyInA = append(response.OnlyInA, position)
+			continue
+		}
+
+		response.Entries = append(response.Entries, EntryDelta{
+			Country:   position.Country,
+			PositionA: position.Position,
+			PositionB: positionB,
+			Delta:     positionB - position.Position,
+		})
+	}
+
+	for _, position := range b.Positions {
+		if !inA[position.Country] {
+			response.OnlyInB = append(response.OnlyInB, position)
+		}
+	}
+
+	// the entries that moved furthest, keeping a's order on ties
+	for _, entry := range response.Entries {
+		if entry.Delta != 0 {
+			response.LargestDisagreements = append(response.LargestDisagreements, entry)
+		}
+	}
+	sort.SliceStable(response.LargestDisagreements, func(i, j int) bool {
+		return abs(response.LargestDisagreements[i].Delta) > abs(response.LargestDisagreements[j].Delta)
+	})
+	if len(response.LargestDisagreements) > maxDisagreements {
+		response.LargestDisagreements = response.LargestDisagreements[:maxDisagreements]
+	}
+
+	return response
+}
+
+func comparedRanking(ranking *models.UserRanking) ComparedRanking {
+	return ComparedRanking{
+		RankingID: ranking.RankingID,
+		UserID:    ranking.UserID,
+		Name:      ranking.Name,
+		Year:      ranking.Year,
+	}
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+/**
+ * writes the comparison as an aligned plain text table followed by the
+ * entries only in one ranking, the largest disagreements and the agreement
+ */
+func writeComparisonTable(w http.ResponseWriter, comparison CompareRankingsResponse) {
+	fmt.Fprintf(w, "A: %s (%s, %d)\n", comparison.A.Name, comparison.A.RankingID, comparison.A.Year)
+	fmt.Fprintf(w, "B: %s (%s, %d)\n\n", comparison.B.Name, comparison.B.RankingID, comparison.B.Year)
+
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(table, "COUNTRY\tA\tB\tDELTA\t")
+	for _, entry := range comparison.Entries {
+		fmt.Fprintf(table, "%s\t%d\t%d\t%+d\t\n", entry.Country, entry.PositionA, entry.PositionB, entry.Delta)
+	}
+	table.Flush()
+
+	if len(comparison.OnlyInA) > 0 {
+		fmt.Fprintf(w, "\nonly in A: %s\n", formatPositions(comparison.OnlyInA))
+	}
+	if len(comparison.OnlyInB) > 0 {
+		fmt.Fprintf(w, "\nonly in B: %s\n", formatPositions(comparison.OnlyInB))
+	}
+
+	if len(comparison.LargestDisagreements) > 0 {
+		disagreements := make([]string, 0, len(comparison.LargestDisagreements))
+		for _, entry := range comparison.LargestDisagreements {
+			disagreements = append(disagreements, fmt.Sprintf("%s %+d", entry.Country, entry.Delta))
+		}
+		fmt.Fprintf(w, "\nlargest disagreements: %s\n", strings.Join(disagreements, ", "))
+	}
+
+	agreement := comparison.Agreement
+	fmt.Fprintf(w, "\ncommon %d (overlap %.2f), kendall tau %.3f, footrule %d (similarity %.3f)\n",
+		agreement.Common, agreement.Overlap, agreement.KendallTau,
+		agreement.FootruleDistance, agreement.FootruleSimilarity)
+}
+
+/**
+ * lists positions as "SE 4, NO 12"
+ */
+func formatPositions(positions []models.RankingPosition) string {
+	formatted := make([]string, 0, len(positions))
+	for _, position := range positions {
+		formatted = append(formatted, fmt.Sprintf("%s %d", position.Country, position.Position))
+	}
+	return strings.Join(formatted, ", ")
+}
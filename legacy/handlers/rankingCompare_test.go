@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"math"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"eurovision-api/models"
+)
+
+/**
+ * builds a decoded ranking listing the countries best first
+ */
+func testRanking(id string, countries ...string) *models.UserRanking {
+	positions := make([]models.RankingPosition, 0, len(countries))
+	for i, country := range countries {
+		positions = append(positions, models.RankingPosition{
+			Country:    country,
+			Position:   i + 1,
+			FromBottom: len(countries) - i,
+		})
+	}
+
+	ranking := &models.UserRanking{RankingID: id, UserID: "user-" + id, Name: "Ranking " + id, Year: 2024}
+	ranking.SetPositions(positions)
+	return ranking
+}
+
+func TestCompareRankings(t *testing.T) {
+	tests := []struct {
+		name          string
+		a, b          *models.UserRanking
+		entries       []EntryDelta
+		onlyInA       []string
+		onlyInB       []string
+		disagreements []EntryDelta
+	}{
+		{
+			name: "identical",
+			a:    testRanking("a", "SE", "NO", "CH"),
+			b:    testRanking("b", "SE", "NO", "CH"),
+			entries: []EntryDelta{
+				{"SE", 1, 1, 0}, {"NO", 2, 2, 0}, {"CH", 3, 3, 0},
+			},
+			disagreements: []EntryDelta{},
+		},
+		{
+			name: "partial overlap",
+			a:    testRanking("a", "SE", "NO", "CH", "FR"),
+			b:    testRanking("b", "CH", "SE", "IT", "NO"),
+			entries: []EntryDelta{
+				{"SE", 1, 2, 1}, {"NO", 2, 4, 2}, {"CH", 3, 1, -2},
+			},
+			onlyInA: []string{"FR"},
+			onlyInB: []string{"IT"},
+			disagreements: []EntryDelta{
+				{"NO", 2, 4, 2}, {"CH", 3, 1, -2}, {"SE", 1, 2, 1},
+			},
+		},
+		{
+			name:          "disjoint",
+			a:             testRanking("a", "SE", "NO"),
+			b:             testRanking("b", "IT", "FR"),
+			entries:       []EntryDelta{},
+			onlyInA:       []string{"SE", "NO"},
+			onlyInB:       []string{"IT", "FR"},
+			disagreements: []EntryDelta{},
+		},
+		{
+			name: "reversed keeps the five largest",
+			a:    testRanking("a", "SE", "NO", "CH", "FR", "IT", "UA", "AT"),
+			b:    testRanking("b", "AT", "UA", "IT", "FR", "CH", "NO", "SE"),
+			entries: []EntryDelta{
+				{"SE", 1, 7, 6}, {"NO", 2, 6, 4}, {"CH", 3, 5, 2}, {"FR", 4, 4, 0},
+				{"IT", 5, 3, -2}, {"UA", 6, 2, -4}, {"AT", 7, 1, -6},
+			},
+			disagreements: []EntryDelta{
+				{"SE", 1, 7, 6}, {"AT", 7, 1, -6}, {"NO", 2, 6, 4}, {"UA", 6, 2, -4}, {"CH", 3, 5, 2},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := compareRankings(tt.a, tt.b)
+
+			if response.A.RankingID != tt.a.RankingID || response.B.RankingID != tt.b.RankingID {
+				t.Errorf("compared %s and %s, want %s and %s",
+					response.A.RankingID, response.B.RankingID, tt.a.RankingID, tt.b.RankingID)
+			}
+			if !reflect.DeepEqual(response.Entries, tt.entries) {
+				t.Errorf("entries = %v, want %v", response.Entries, tt.entries)
+			}
+			if got := positionCountries(response.OnlyInA); !reflect.DeepEqual(got, tt.onlyInA) {
+				t.Errorf("only in a = %v, want %v", got, tt.onlyInA)
+			}
+			if got := positionCountries(response.OnlyInB); !reflect.DeepEqual(got, tt.onlyInB) {
+				t.Errorf("only in b = %v, want %v", got, tt.onlyInB)
+			}
+			if !reflect.DeepEqual(response.LargestDisagreements, tt.disagreements) {
+				t.Errorf("largest disagreements = %v, want %v", response.LargestDisagreements, tt.disagreements)
+			}
+		})
+	}
+}
+
+func TestCompareRankingsAgreement(t *testing.T) {
+	a := testRanking("a", "SE", "NO", "CH", "FR")
+	b := testRanking("b", "CH", "SE", "IT", "NO")
+
+	agreement := compareRankings(a, b).Agreement
+	if agreement.Common != 3 {
+		t.Errorf("common = %d, want 3", agreement.Common)
+	}
+	if math.Abs(agreement.Overlap-0.6) > 1e-9 {
+		t.Errorf("overlap = %v, want 0.6", agreement.Overlap)
+	}
+	if math.Abs(agreement.KendallTau+1.0/3) > 1e-9 {
+		t.Errorf("kendall tau = %v, want -1/3", agreement.KendallTau)
+	}
+	if agreement.FootruleDistance != 4 {
+		t.Errorf("footrule distance = %d, want 4", agreement.FootruleDistance)
+	}
+}
+
+func TestWriteComparisonTable(t *testing.T) {
+	a := testRanking("a", "SE", "NO", "CH", "FR")
+	b := testRanking("b", "CH", "SE", "IT", "NO")
+
+	recorder := httptest.NewRecorder()
+	writeComparisonTable(recorder, compareRankings(a, b))
+	text := recorder.Body.String()
+
+	for _, want := range []string{
+		"A: Ranking a (a, 2024)",
+		"B: Ranking b (b, 2024)",
+		"COUNTRY  A  B  DELTA",
+		"     NO  2  4     +2",
+		"     CH  3  1     -2",
+		"only in A: FR 4",
+		"only in B: IT 3",
+		"largest disagreements: NO +2, CH -2, SE +1",
+		"common 3 (overlap 0.60), kendall tau -0.333, footrule 4",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("table is missing %q:\n%s", want, text)
+		}
+	}
+}
+
+func positionCountries(positions []models.RankingPosition) []string {
+	var countries []string
+	for _, position := range positions {
+		countries = append(countries, position.Country)
+	}
+	return countries
+}
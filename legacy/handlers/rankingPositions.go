@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"encoding/json"
+	"eurovision-api/db"
+	"eurovision-api/models"
+	"eurovision-api/utils"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const auditActionReindexPositions = "reindex_ranking_positions"
+
+// Request/Response structs
+type PositionSearchResponse struct {
+	Total    int64                `json:"total"`
+	Rankings []models.UserRanking `json:"rankings"`
+}
+
+type PositionCountResponse struct {
+	Countries []db.CountryPositionCount `json:"countries"`
+}
+
+type ReindexPositionsResponse struct {
+	Rankings  int `json:"rankings"`
+	Decoded   int `json:"decoded"`
+	Undecoded int `json:"undecoded"`
+}
+
+/**
+ * fills in the ranking's decoded positions. Rankings that can't be decoded,
+ * for instance because they list an entry missing from the ranking codes, are
+ * still saved, just without positions.
+ */
+func decodeRankingPositions(ranking *models.UserRanking) bool {
+	positions, err := utils.DecodeRankingPositions(ranking.Ranking)
+	if err != nil && err != utils.ErrRankingCodesNotConfigured {
+		logrus.Warnf("Could not decode ranking %s: %v", ranking.RankingID, err)
+	}
+
+	ranking.SetPositions(positions)
+	return len(positions) > 0
+}
+
+/**
+ * reads the position filter from the query string: year, country,
+ * position_gte, position_lte and last=true
+ */
+func parsePositionFilter(r *http.Request) (db.RankingPositionFilter, string) {
+	params := r.URL.Query()
+
+	filter := db.RankingPositionFilter{
+		Country: strings.ToUpper(strings.TrimSpace(params.Get("country"))),
+		Last:    params.Get("last") == "true",
+	}
+
+	for _, bound := range []struct {
+		param  string
+		target **int
+	}{
+		{"year", &filter.Year},
+		{"position_gte", &filter.PositionGte},
+		{"position_lte", &filter.PositionLte},
+	} {
+		value := params.Get(bound.param)
+		if value == "" {
+			continue
+		}
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 1 {
+			return filter, bound.param + " must be a positive number"
+		}
+		*bound.target = &number
+	}
+
+	return filter, ""
+}
+
+/**
+ * lists public rankings with an entry matching the position filter, e.g.
+ * ?year=2024&country=SE&position_lte=3 for rankings with Sweden in the top 3
+ */
+func (h *RankingHandler) SearchByPosition(w http.ResponseWriter, r *http.Request) {
+	filter, problem := parsePositionFilter(r)
+	if problem != "" {
+		http.Error(w, problem, http.StatusBadRequest)
+		return
+	}
+
+	from, size := getPagination(r)
+
+	rankings, total, err := db.SearchRankingsByPosition(filter, from, size)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to search rankings by position")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PositionSearchResponse{Total: total, Rankings: rankings})
+}
+
+/**
+ * counts per country how many public rankings placed it within the position
+ * filter, e.g. ?last=true for how often each country is ranked last
+ */
+func (h *RankingHandler) CountByPosition(w http.ResponseWriter, r *http.Request) {
+	filter, problem := parsePositionFilter(r)
+	if problem != "" {
+		http.Error(w, problem, http.StatusBadRequest)
+		return
+	}
+
+	counts, err := db.CountRankingsByCountryPosition(filter)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to count rankings by position")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PositionCountResponse{Countries: counts})
+}
+
+/**
+ * decodes the positions of every stored ranking again and rebuilds their
+ * position vectors, for use after the ranking codes change
+ */
+func (h *AdminHandler) ReindexRankingPositions(w http.ResponseWriter, r *http.Request) {
+	if !utils.RankingCodecConfigured() {
+		http.Error(w, utils.ErrRankingCodesNotConfigured.Error(), http.StatusConflict)
+		return
+	}
+
+	var response ReindexPositionsResponse
+
+	err := db.ForEachRanking(func(ranking *models.UserRanking) error {
+		response.Rankings++
+		if decodeRankingPositions(ranking) {
+			response.Decoded++
+		} else {
+			response.Undecoded++
+		}
+		return db.UpdateRankingPositions(ranking)
+	})
+
+	if err != nil {
+		logrus.Error("Error reindexing ranking positions: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	h.audit(r, auditActionReindexPositions, "", map[string]interface{}{
+		"rankings":  response.Rankings,
+		"decoded":   response.Decoded,
+		"undecoded": response.Undecoded,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
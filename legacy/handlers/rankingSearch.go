@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"encoding/json"
+	"eurovision-api/db"
+	"eurovision-api/models"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	maxSearchQueryLen     = 200
+	defaultSearchPageSize = 20
+	maxSearchPageSize     = 50
+)
+
+// Request/Response structs
+type RankingSearchItem struct {
+	Ranking       models.UserRanking  `json:"ranking"`
+	Author        FeedAuthor          `json:"author"`
+	ReactionTotal int64               `json:"reaction_total"`
+	Highlights    map[string][]string `json:"highlights"`
+}
+
+type RankingSearchResponse struct {
+	Items      []RankingSearchItem `json:"items"`
+	NextCursor string              `json:"next_cursor,omitempty"`
+}
+
+/**
+ * full text searches public rankings by name and description. Supports
+ * ?year=2023,2024, ?year_from= and ?year_to= filters, ?sort=relevance, recent
+ * or popular, and cursor pagination through next_cursor.
+ */
+func (h *RankingHandler) SearchRankings(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	search := db.RankingSearch{
+		Query: strings.TrimSpace(params.Get("q")),
+		Sort:  params.Get("sort"),
+	}
+
+	if utf8.RuneCountInString(search.Query) > maxSearchQueryLen {
+		http.Error(w, "q is too long", http.StatusBadRequest)
+		return
+	}
+
+	// relevance only means something when there is a query to match
+	if search.Sort == "" {
+		search.Sort = db.RankingSortRecent
+		if search.Query != "" {
+			search.Sort = db.RankingSortRelevance
+		}
+	}
+
+	switch search.Sort {
+	case db.RankingSortRelevance, db.RankingSortRecent, db.RankingSortPopular:
+	default:
+		http.Error(w, "sort must be relevance, recent or popular", http.StatusBadRequest)
+		return
+	}
+
+	if years := params.Get("year"); years != "" {
+		for _, value := range strings.Split(years, ",") {
+			year, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				http.Error(w, "year must be a comma separated list of years", http.StatusBadRequest)
+				return
+			}
+			search.Years = append(search.Years, year)
+		}
+	}
+
+	for _, bound := range []struct {
+		param  string
+		target **int
+	}{
+		{"year_from", &search.YearFrom},
+		{"year_to", &search.YearTo},
+	} {
+		value := params.Get(bound.param)
+		if value == "" {
+			continue
+		}
+		year, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, bound.param+" must be a year", http.StatusBadRequest)
+			return
+		}
+		*bound.target = &year
+	}
+
+	search.Size = defaultSearchPageSize
+	if size, err := strconv.Atoi(params.Get("size")); err == nil && size > 0 {
+		search.Size = size
+	}
+	if search.Size > maxSearchPageSize {
+		search.Size = maxSearchPageSize
+	}
+
+	searchAfter, err := decodeCursor(params.Get("cursor"), db.RankingSortValueCount(search.Sort))
+	if err != nil {
+		http.Error(w, "Invalid cursor", http.StatusBadRequest)
+		return
+	}
+	search.SearchAfter = searchAfter
+
+	hits, err := db.SearchPublicRankings(search)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to search rankings")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	authorIDs := make([]string, 0, len(hits))
+	for _, hit := range hits {
+		authorIDs = append(authorIDs, hit.Ranking.UserID)
+	}
+
+	profiles, err := db.GetProfilesByUserIDs(authorIDs)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to get profiles")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := RankingSearchResponse{Items: []RankingSearchItem{}}
+	for _, hit := range hits {
+		profile := profiles[hit.Ranking.UserID]
+		response.Items = append(response.Items, RankingSearchItem{
+			Ranking: hit.Ranking,
+			Author: FeedAuthor{
+				UserID:      hit.Ranking.UserID,
+				Handle:      profile.Handle,
+				DisplayName: profile.DisplayName,
+				AvatarURL:   profile.AvatarURL,
+			},
+			ReactionTotal: hit.ReactionTotal,
+			Highlights:    hit.Highlights,
+		})
+	}
+
+	// a full page may have more after it
+	if len(hits) == search.Size {
+		response.NextCursor, err = encodeCursor(hits[len(hits)-1].Sort)
+		if err != nil {
+			logrus.WithError(err).Error("Failed to encode search cursor")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
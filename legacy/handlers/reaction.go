@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"encoding/json"
+	"eurovision-api/auth"
+	"eurovision-api/db"
+	"eurovision-api/models"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+const auditActionReindexReactionTotals = "reindex_reaction_totals"
+
+// Request/Response structs
+type ReactionCountResponse struct {
+	Kind    string `json:"kind"`
+	Emoji   string `json:"emoji"`
+	Count   int64  `json:"count"`
+	Reacted bool   `json:"reacted"`
+}
+
+type ReactionsResponse struct {
+	RankingID string                  `json:"ranking_id"`
+	Reactions []ReactionCountResponse `json:"reactions"`
+}
+
+type ReindexReactionTotalsResponse struct {
+	Rankings int `json:"rankings"`
+}
+
+/**
+ * lists the count of every reaction kind on the ranking and whether the
+ * caller used it
+ */
+func (h *RankingHandler) GetReactions(w http.ResponseWriter, r *http.Request) {
+	ranking := getAuthorizedRanking(w, r, mux.Vars(r)["rankingID"], true)
+	if ranking == nil {
+		return
+	}
+
+	writeReactions(w, r, ranking.RankingID)
+}
+
+/**
+ * adds one of the fixed reactions to a ranking the caller can read. Adding a
+ * reaction twice is not an error.
+ */
+func (h *RankingHandler) AddReaction(w http.ResponseWriter, r *http.Request) {
+	kind := mux.Vars(r)["kind"]
+	if _, ok := models.ReactionEmoji[kind]; !ok {
+		http.Error(w, "Unknown reaction", http.StatusBadRequest)
+		return
+	}
+
+	ranking := getAuthorizedRanking(w, r, mux.Vars(r)["rankingID"], true)
+	if ranking == nil {
+		return
+	}
+
+	userID, _ := auth.GetUserIDFromContext(r.Context())
+
+	err := db.AddReaction(&models.Reaction{
+		RankingID:      ranking.RankingID,
+		RankingOwnerID: ranking.UserID,
+		UserID:         userID,
+		Kind:           kind,
+		CreatedAt:      time.Now(),
+	})
+
+	if err != nil && err != db.ErrReactionExists {
+		logrus.WithError(err).Error("Failed to add reaction")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeReactions(w, r, ranking.RankingID)
+}
+
+/**
+ * removes one of the caller's reactions from a ranking
+ */
+func (h *RankingHandler) RemoveReaction(w http.ResponseWriter, r *http.Request) {
+	kind := mux.Vars(r)["kind"]
+	if _, ok := models.ReactionEmoji[kind]; !ok {
+		http.Error(w, "Unknown reaction", http.StatusBadRequest)
+		return
+	}
+
+	ranking := getAuthorizedRanking(w, r, mux.Vars(r)["rankingID"], true)
+	if ranking == nil {
+		return
+	}
+
+	userID, _ := auth.GetUserIDFromContext(r.Context())
+
+	switch err := db.RemoveReaction(ranking.RankingID, userID, kind); err {
+	case nil:
+		writeReactions(w, r, ranking.RankingID)
+	case db.ErrReactionNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		logrus.WithError(err).Error("Failed to remove reaction")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+/**
+ * gets the ranking's reaction counts and the kinds the caller reacted with
+ */
+func getReactionSummary(r *http.Request, rankingID string) (map[string]int64, []string, error) {
+	counts, err := db.GetReactionCounts(rankingID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	userID, _ := auth.GetUserIDFromContext(r.Context())
+
+	mine, err := db.GetUserReactionKinds(rankingID, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return counts, mine, nil
+}
+
+func writeReactions(w http.ResponseWriter, r *http.Request, rankingID string) {
+	counts, mine, err := getReactionSummary(r, rankingID)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to get reactions")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	reacted := map[string]bool{}
+	for _, kind := range mine {
+		reacted[kind] = true
+	}
+
+	response := ReactionsResponse{RankingID: rankingID, Reactions: []ReactionCountResponse{}}
+	for _, kind := range models.ReactionKinds {
+		response.Reactions = append(response.Reactions, ReactionCountResponse{
+			Kind:    kind,
+			Emoji:   models.ReactionEmoji[kind],
+			Count:   counts[kind],
+			Reacted: reacted[kind],
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+/**
+ * recomputes the reaction_total that popularity search sorts by for every
+ * ranking with reactions
+ */
+func (h *AdminHandler) ReindexReactionTotals(w http.ResponseWriter, r *http.Request) {
+	updated, err := db.BackfillReactionTotals()
+	if err != nil {
+		logrus.WithError(err).Error("Failed to reindex reaction totals")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	h.audit(r, auditActionReindexReactionTotals, "", map[string]interface{}{
+		"rankings": updated,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ReindexReactionTotalsResponse{Rankings: updated})
+}
@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"encoding/json"
+	"eurovision-api/auth"
+	"eurovision-api/db"
+	"eurovision-api/models"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const auditActionSearchSecurityEvents = "search_security_events"
+
+// Request/Response structs
+type SecurityEventResponse struct {
+	Event     string                 `json:"event"`
+	Outcome   string                 `json:"outcome"`
+	Reason    string                 `json:"reason,omitempty"`
+	ByAdmin   bool                   `json:"by_admin"`
+	IP        string                 `json:"ip,omitempty"`
+	UserAgent string                 `json:"user_agent,omitempty"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	Timestamp time.Time              `json:"timestamp"`
+}
+
+type SecurityEventListResponse struct {
+	Total  int64                   `json:"total"`
+	Events []SecurityEventResponse `json:"events"`
+}
+
+type AdminSecurityEventSearchResponse struct {
+	Total  int64                  `json:"total"`
+	Events []models.SecurityEvent `json:"events"`
+}
+
+/**
+ * shapes an event for the user it concerns. The IP and user agent of admins
+ * acting on the account are left out.
+ */
+func newSecurityEventResponse(event *models.SecurityEvent) SecurityEventResponse {
+	response := SecurityEventResponse{
+		Event:     event.Event,
+		Outcome:   event.Outcome,
+		Reason:    event.Reason,
+		ByAdmin:   event.ActorID != "" && event.ActorID != event.UserID,
+		Details:   event.Details,
+		Timestamp: event.Timestamp,
+	}
+	if !response.ByAdmin {
+		response.IP = event.IP
+		response.UserAgent = event.UserAgent
+	}
+	return response
+}
+
+/**
+ * lists the security events for the authenticated user's account, newest first
+ */
+func (h *AccountHandler) ListSecurityEvents(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	from, size := getPagination(r)
+
+	events, total, err := h.authService.ListSecurityEvents(userID, from, size)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to list security events")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := SecurityEventListResponse{Total: total, Events: []SecurityEventResponse{}}
+	for i := range events {
+		response.Events = append(response.Events, newSecurityEventResponse(&events[i]))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+/**
+ * searches the security log by user, actor, email, event, outcome, IP and
+ * time range
+ */
+func (h *AdminHandler) SearchSecurityEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	filter := db.SecurityEventFilter{
+		UserID:  query.Get("user_id"),
+		ActorID: query.Get("actor_id"),
+		Email:   query.Get("email"),
+		Event:   query.Get("event"),
+		Outcome: query.Get("outcome"),
+		IP:      query.Get("ip"),
+	}
+
+	switch filter.Outcome {
+	case "", models.SecurityOutcomeSuccess, models.SecurityOutcomeFailure:
+	default:
+		http.Error(w, "outcome must be success or failure", http.StatusBadRequest)
+		return
+	}
+
+	for _, bound := range []struct {
+		param  string
+		target **time.Time
+	}{
+		{"since", &filter.Since},
+		{"until", &filter.Until},
+	} {
+		value := query.Get(bound.param)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			http.Error(w, bound.param+" must be an RFC 3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		*bound.target = &parsed
+	}
+
+	from, size := getPagination(r)
+
+	events, total, err := db.SearchSecurityEvents(filter, from, size)
+	if err != nil {
+		logrus.Error("Error searching security events: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	h.audit(r, auditActionSearchSecurityEvents, filter.UserID, map[string]interface{}{
+		"actor_id": filter.ActorID,
+		"email":    filter.Email,
+		"event":    filter.Event,
+		"outcome":  filter.Outcome,
+		"ip":       filter.IP,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AdminSecurityEventSearchResponse{Total: total, Events: events})
+}
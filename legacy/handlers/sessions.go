@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"encoding/json"
+	"eurovision-api/auth"
+	"eurovision-api/models"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// Request/Response structs
+type SessionResponse struct {
+	ID         string            `json:"id"`
+	Device     string            `json:"device"`
+	UserAgent  string            `json:"user_agent"`
+	IP         string            `json:"ip,omitempty"`
+	Location   models.IPLocation `json:"location"`
+	CreatedAt  time.Time         `json:"created_at"`
+	LastSeenAt time.Time         `json:"last_seen_at"`
+	ExpiresAt  time.Time         `json:"expires_at"`
+	Current    bool              `json:"current"`
+}
+
+func newSessionResponse(session *models.Session, currentSessionID string) SessionResponse {
+	return SessionResponse{
+		ID:         session.ID,
+		Device:     session.Device,
+		UserAgent:  session.UserAgent,
+		IP:         session.IP,
+		Location:   session.Location,
+		CreatedAt:  session.CreatedAt,
+		LastSeenAt: session.LastSeenAt,
+		ExpiresAt:  session.ExpiresAt,
+		Current:    session.ID == currentSessionID,
+	}
+}
+
+/**
+ * lists the devices the authenticated user is signed in on
+ */
+func (h *AccountHandler) ListSessions(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	sessions, err := h.authService.ListSessions(userID)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to list sessions")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	currentSessionID := auth.GetSessionIDFromContext(r.Context())
+
+	response := []SessionResponse{}
+	for i := range sessions {
+		response = append(response, newSessionResponse(&sessions[i], currentSessionID))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+/**
+ * signs out one of the authenticated user's sessions
+ */
+func (h *AccountHandler) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	err = h.authService.RevokeSession(userID, mux.Vars(r)["sessionID"], clientInfo(r))
+	if err != nil {
+		switch err {
+		case auth.ErrSessionNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		default:
+			logrus.WithError(err).Error("Failed to revoke session")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	writeMessage(w, "Session signed out")
+}
+
+/**
+ * signs the authenticated user out everywhere. With ?keep_current=true the
+ * session making the request stays signed in.
+ */
+func (h *AccountHandler) RevokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	keepSessionID := ""
+	if r.URL.Query().Get("keep_current") == "true" {
+		keepSessionID = auth.GetSessionIDFromContext(r.Context())
+		if keepSessionID == "" {
+			http.Error(w, "keep_current requires a session token", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := h.authService.RevokeAllSessions(userID, keepSessionID, clientInfo(r)); err != nil {
+		logrus.WithError(err).Error("Failed to revoke sessions")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if keepSessionID != "" {
+		writeMessage(w, "Signed out of all other sessions")
+		return
+	}
+	writeMessage(w, "Signed out everywhere")
+}
@@ -0,0 +1,299 @@
+package handlers
+
+import (
+	"encoding/json"
+	"eurovision-api/auth"
+	"eurovision-api/db"
+	"eurovision-api/models"
+	"eurovision-api/utils"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// similarity metrics
+const (
+	metricKendall  = "kendall"
+	metricFootrule = "footrule"
+)
+
+const (
+	defaultSimilarSize = 10
+	maxSimilarSize     = 50
+
+	// the position vector prefilter in Elasticsearch returns this many candidates
+	// per requested result, which are then re-ranked exactly
+	similarCandidatesPerResult = 5
+	minSimilarCandidates       = 100
+
+	// taste twins look at more candidates since several may share a user
+	tasteTwinCandidates = 500
+)
+
+// Request/Response structs
+type SimilarRanking struct {
+	Ranking   models.UserRanking     `json:"ranking"`
+	Author    FeedAuthor             `json:"author"`
+	Score     float64                `json:"score"`
+	Agreement utils.RankingAgreement `json:"agreement"`
+}
+
+type SimilarRankingsResponse struct {
+	RankingID string           `json:"ranking_id"`
+	Metric    string           `json:"metric"`
+	Similar   []SimilarRanking `json:"similar"`
+}
+
+type TasteTwin struct {
+	User        FeedAuthor             `json:"user"`
+	RankingID   string                 `json:"ranking_id"`
+	RankingName string                 `json:"ranking_name"`
+	Score       float64                `json:"score"`
+	Agreement   utils.RankingAgreement `json:"agreement"`
+}
+
+type TasteTwinsResponse struct {
+	Year      int         `json:"year"`
+	RankingID string      `json:"ranking_id"`
+	Metric    string      `json:"metric"`
+	Twins     []TasteTwin `json:"twins"`
+}
+
+/**
+ * reads ?metric= and ?size=, writing a 400 for an unknown metric
+ */
+func getSimilarityParams(w http.ResponseWriter, r *http.Request) (string, int, bool) {
+	metric := r.URL.Query().Get("metric")
+	if metric == "" {
+		metric = metricKendall
+	}
+	if metric != metricKendall && metric != metricFootrule {
+		http.Error(w, "metric must be kendall or footrule", http.StatusBadRequest)
+		return "", 0, false
+	}
+
+	size, err := strconv.Atoi(r.URL.Query().Get("size"))
+	if err != nil || size <= 0 {
+		size = defaultSimilarSize
+	}
+	if size > maxSimilarSize {
+		size = maxSimilarSize
+	}
+
+	return metric, size, true
+}
+
+/**
+ * the score to sort by under the metric, from 0 to 1. Both metrics only look
+ * at the shared entries, so they are scaled by the overlap: two rankings
+ * agreeing on a handful of entries are not as similar as two that agree on
+ * nearly all of them. Kendall tau is first mapped from -1..1 to 0..1.
+ */
+func agreementScore(agreement utils.RankingAgreement, metric string) float64 {
+	score := (agreement.KendallTau + 1) / 2
+	if metric == metricFootrule {
+		score = agreement.FootruleSimilarity
+	}
+	return score * agreement.Overlap
+}
+
+/**
+ * scores each candidate against the ranking, most similar first. Ties go to
+ * the candidate sharing more entries.
+ */
+func rankBySimilarity(ranking *models.UserRanking, candidates []models.UserRanking, metric string) []SimilarRanking {
+	similar := make([]SimilarRanking, 0, len(candidates))
+	for _, candidate := range candidates {
+		agreement := utils.CompareRankingPositions(ranking.Positions, candidate.Positions)
+		similar = append(similar, SimilarRanking{
+			Ranking:   candidate,
+			Score:     agreementScore(agreement, metric),
+			Agreement: agreement,
+		})
+	}
+
+	sort.SliceStable(similar, func(i, j int) bool {
+		if similar[i].Score != similar[j].Score {
+			return similar[i].Score > similar[j].Score
+		}
+		return similar[i].Agreement.Overlap > similar[j].Agreement.Overlap
+	})
+
+	return similar
+}
+
+/**
+ * writes a 409 and returns false when the ranking has no decoded positions
+ */
+func requireDecodedRanking(w http.ResponseWriter, ranking *models.UserRanking) bool {
+	if len(ranking.Positions) == 0 {
+		http.Error(w, "Ranking has no decoded positions", http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+/**
+ * returns the public rankings from the same year that order their entries
+ * most like the given ranking, by Kendall tau or Spearman footrule
+ */
+func (h *RankingHandler) GetSimilarRankings(w http.ResponseWriter, r *http.Request) {
+	metric, size, ok := getSimilarityParams(w, r)
+	if !ok {
+		return
+	}
+
+	ranking := getAuthorizedRanking(w, r, mux.Vars(r)["rankingID"], true)
+	if ranking == nil || !requireDecodedRanking(w, ranking) {
+		return
+	}
+
+	candidates, err := db.FindSimilarRankings(ranking, "", max(size*similarCandidatesPerResult, minSimilarCandidates))
+	if err != nil {
+		logrus.WithError(err).Error("Failed to find similar rankings")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	similar := rankBySimilarity(ranking, candidates, metric)
+	if len(similar) > size {
+		similar = similar[:size]
+	}
+
+	authorIDs := make([]string, 0, len(similar))
+	for _, match := range similar {
+		authorIDs = append(authorIDs, match.Ranking.UserID)
+	}
+
+	profiles, err := db.GetProfilesByUserIDs(authorIDs)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to get profiles")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	for i := range similar {
+		profile := profiles[similar[i].Ranking.UserID]
+		similar[i].Author = FeedAuthor{
+			UserID:      similar[i].Ranking.UserID,
+			Handle:      profile.Handle,
+			DisplayName: profile.DisplayName,
+			AvatarURL:   profile.AvatarURL,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SimilarRankingsResponse{
+		RankingID: ranking.RankingID,
+		Metric:    metric,
+		Similar:   similar,
+	})
+}
+
+/**
+ * returns the users whose public rankings for the year match the
+ * authenticated user's most closely. The user's most recently changed
+ * ranking for the year is compared, or ?ranking_id= to pick another, and
+ * each twin is scored by their best matching ranking.
+ */
+func (h *RankingHandler) GetTasteTwins(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	year, ok := getStatsYear(w, r)
+	if !ok {
+		return
+	}
+
+	metric, size, ok := getSimilarityParams(w, r)
+	if !ok {
+		return
+	}
+
+	var ranking *models.UserRanking
+	if rankingID := r.URL.Query().Get("ranking_id"); rankingID != "" {
+		ranking = getAuthorizedRanking(w, r, rankingID, false)
+		if ranking == nil {
+			return
+		}
+		if ranking.Year != year {
+			http.Error(w, "ranking_id is not a ranking for this year", http.StatusBadRequest)
+			return
+		}
+	} else {
+		ranking, err = db.GetLatestDecodedRanking(userID, year)
+		if err == db.ErrNoDecodedRanking {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			logrus.WithError(err).Error("Failed to get latest ranking")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if !requireDecodedRanking(w, ranking) {
+		return
+	}
+
+	candidates, err := db.FindSimilarRankings(ranking, userID, tasteTwinCandidates)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to find similar rankings")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// candidates come back best first, so the first per user is their best
+	twins := []TasteTwin{}
+	seen := map[string]bool{}
+	for _, match := range rankBySimilarity(ranking, candidates, metric) {
+		if seen[match.Ranking.UserID] {
+			continue
+		}
+		seen[match.Ranking.UserID] = true
+		twins = append(twins, TasteTwin{
+			User:        FeedAuthor{UserID: match.Ranking.UserID},
+			RankingID:   match.Ranking.RankingID,
+			RankingName: match.Ranking.Name,
+			Score:       match.Score,
+			Agreement:   match.Agreement,
+		})
+		if len(twins) == size {
+			break
+		}
+	}
+
+	userIDs := make([]string, 0, len(twins))
+	for _, twin := range twins {
+		userIDs = append(userIDs, twin.User.UserID)
+	}
+
+	profiles, err := db.GetProfilesByUserIDs(userIDs)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to get profiles")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	for i := range twins {
+		profile := profiles[twins[i].User.UserID]
+		twins[i].User.Handle = profile.Handle
+		twins[i].User.DisplayName = profile.DisplayName
+		twins[i].User.AvatarURL = profile.AvatarURL
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TasteTwinsResponse{
+		Year:      year,
+		RankingID: ranking.RankingID,
+		Metric:    metric,
+		Twins:     twins,
+	})
+}
@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"encoding/json"
+	"eurovision-api/db"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+type StatsHandler struct {
+}
+
+func NewStatsHandler() *StatsHandler {
+	return &StatsHandler{}
+}
+
+// Request/Response structs
+type CountryStatsResponse struct {
+	Year int `json:"year"`
+	db.CountryPositionStats
+}
+
+type YearStatsResponse struct {
+	Year      int                       `json:"year"`
+	Countries []db.CountryPositionStats `json:"countries"`
+}
+
+/**
+ * reads the {year} path variable, writing a 400 if it isn't a number
+ */
+func getStatsYear(w http.ResponseWriter, r *http.Request) (int, bool) {
+	year, err := strconv.Atoi(mux.Vars(r)["year"])
+	if err != nil || year < 1 {
+		http.Error(w, "year must be a number", http.StatusBadRequest)
+		return 0, false
+	}
+	return year, true
+}
+
+/**
+ * describes how the year's public rankings placed one country: a histogram
+ * of its positions, percentiles, its share of top 10 placements and how
+ * controversial it was
+ */
+func (h *StatsHandler) GetCountryStats(w http.ResponseWriter, r *http.Request) {
+	year, ok := getStatsYear(w, r)
+	if !ok {
+		return
+	}
+
+	country := strings.ToUpper(mux.Vars(r)["code"])
+	if !countryPattern.MatchString(country) {
+		http.Error(w, "code must be an ISO 3166-1 alpha-2 code", http.StatusBadRequest)
+		return
+	}
+
+	stats, err := db.GetCountryPositionStats(year, country)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to get country stats")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if stats.Rankings == 0 {
+		http.Error(w, "No public rankings place this country in this year", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(CountryStatsResponse{Year: year, CountryPositionStats: *stats})
+}
+
+/**
+ * lists the statistics of every country placed by the year's public
+ * rankings, most controversial first. ?min_rankings= leaves out countries
+ * placed by fewer rankings.
+ */
+func (h *StatsHandler) GetYearStats(w http.ResponseWriter, r *http.Request) {
+	year, ok := getStatsYear(w, r)
+	if !ok {
+		return
+	}
+
+	minRankings := int64(1)
+	if value := r.URL.Query().Get("min_rankings"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 1 {
+			http.Error(w, "min_rankings must be a positive number", http.StatusBadRequest)
+			return
+		}
+		minRankings = parsed
+	}
+
+	countries, err := db.GetYearPositionStats(year, minRankings)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to get year stats")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(YearStatsResponse{Year: year, Countries: countries})
+}
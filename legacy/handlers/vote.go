@@ -6,9 +6,9 @@ import (
 	"net/http"
 	"time"
 
+	"eurovision-api/auth"
 	"eurovision-api/db"
 	"eurovision-api/models"
-	"strings"
 
 	"github.com/sirupsen/logrus"
 )
@@ -32,17 +32,11 @@ func (h *VoteHandler) HandleVote(w http.ResponseWriter, r *http.Request) {
 
 	vote.Timestamp = time.Now()
 
-	// index the vote in Elasticsearch
-	voteJSON, err := json.Marshal(vote)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	// attribute the vote so it can be exported or deleted with the account
+	vote.UserID, _ = auth.GetUserIDFromContext(r.Context())
 
-	_, err = db.Index(
-		"eurovision_votes",
-		strings.NewReader(string(voteJSON)),
-	)
+	// index the vote in Elasticsearch
+	_, err := db.Index(db.VotesIndex, vote)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -56,7 +50,7 @@ func (h *VoteHandler) HandleVote(w http.ResponseWriter, r *http.Request) {
  */
 func (h *VoteHandler) GetVoteCount(w http.ResponseWriter, r *http.Request) {
 	res, err := db.Count(
-		"eurovision_votes",
+		db.VotesIndex,
 	)
 	if err != nil {
 		logrus.Error("An error occurred while fetching vote count: ", err)
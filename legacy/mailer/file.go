@@ -0,0 +1,42 @@
+package mailer
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+/*
+FileMailer appends every message, MIME encoded, to a file instead of sending
+it. Useful in local development when no SMTP server is available.
+*/
+type FileMailer struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewFileMailer(path string) *FileMailer {
+	return &FileMailer{path: path}
+}
+
+func (m *FileMailer) Send(msg *Message) error {
+	body, err := buildMIME("eurovision-ranker@localhost", msg)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := os.OpenFile(m.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("error opening mail file: %v", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(body, "\r\n\r\n"...)); err != nil {
+		return fmt.Errorf("error writing mail file: %v", err)
+	}
+
+	return nil
+}
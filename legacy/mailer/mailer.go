@@ -0,0 +1,51 @@
+package mailer
+
+import (
+	"fmt"
+	"os"
+)
+
+/*
+Message is a rendered email. Text is always set, HTML is optional and is sent
+as the multipart/alternative counterpart of Text when present.
+*/
+type Message struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Text    string `json:"text"`
+	HTML    string `json:"html,omitempty"`
+}
+
+/*
+Mailer delivers rendered messages. The implementation is picked at startup
+with MAILER_DRIVER.
+*/
+type Mailer interface {
+	Send(msg *Message) error
+}
+
+/**
+ * builds the mailer configured by MAILER_DRIVER: "smtp" (the default),
+ * "file" to append messages to MAILER_FILE_PATH, or "memory"
+ */
+func NewFromEnv() (Mailer, error) {
+	switch driver := os.Getenv("MAILER_DRIVER"); driver {
+	case "", "smtp":
+		return NewSMTPMailer(
+			os.Getenv("SMTP_HOST"),
+			os.Getenv("SMTP_PORT"),
+			os.Getenv("EMAIL_USER"),
+			os.Getenv("EMAIL_PASSWORD"),
+		), nil
+	case "file":
+		path := os.Getenv("MAILER_FILE_PATH")
+		if path == "" {
+			path = "mail.log"
+		}
+		return NewFileMailer(path), nil
+	case "memory":
+		return NewMemoryMailer(), nil
+	default:
+		return nil, fmt.Errorf("unknown MAILER_DRIVER: %s", driver)
+	}
+}
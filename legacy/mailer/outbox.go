@@ -0,0 +1,289 @@
+package mailer
+
+import (
+	"crypto/cipher"
+	"errors"
+	"eurovision-api/db"
+	"eurovision-api/models"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	outboxPollInterval  = 10 * time.Second
+	outboxBatchSize     = 20
+	outboxLeaseDuration = 2 * time.Minute
+	outboxMaxAttempts   = 10
+	outboxBaseBackoff   = 30 * time.Second
+	outboxMaxBackoff    = time.Hour
+	outboxSentRetention = 7 * 24 * time.Hour
+
+	// dead messages keep their body this long so an admin can retry them,
+	// and are deleted after outboxDeadRetention
+	outboxDeadBodyRetention = 24 * time.Hour
+	outboxDeadRetention     = 30 * 24 * time.Hour
+)
+
+var (
+	ErrEmailNotDead     = errors.New("only dead emails can be retried")
+	ErrEmailBodyCleared = errors.New("the email's body has been cleared and it can no longer be sent")
+)
+
+/*
+Outbox is a Mailer that stores messages in the email outbox index instead of
+sending them. Run delivers them in the background through another Mailer,
+retrying failures with exponential backoff until they are sent or, after
+outboxMaxAttempts, marked dead.
+
+Bodies hold one-time links, so they are encrypted with the outbox key while
+queued and cleared once the message is sent, or a day after it died.
+*/
+type Outbox struct {
+	delivery Mailer
+	aead     cipher.AEAD
+	wake     chan struct{}
+}
+
+func NewOutbox(delivery Mailer, key []byte) (*Outbox, error) {
+	if delivery == nil {
+		panic("delivery mailer cannot be nil")
+	}
+
+	aead, err := newBodyCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid outbox key: %v", err)
+	}
+
+	return &Outbox{
+		delivery: delivery,
+		aead:     aead,
+		wake:     make(chan struct{}, 1),
+	}, nil
+}
+
+/**
+ * queues the message. It is delivered by the worker started with Run.
+ */
+func (o *Outbox) Send(msg *Message) error {
+	now := time.Now()
+
+	text, err := sealBody(o.aead, msg.Text)
+	if err != nil {
+		return err
+	}
+	html, err := sealBody(o.aead, msg.HTML)
+	if err != nil {
+		return err
+	}
+
+	email := models.OutboundEmail{
+		ID:            uuid.New().String(),
+		To:            msg.To,
+		Subject:       msg.Subject,
+		Text:          text,
+		HTML:          html,
+		Status:        models.EmailStatusPending,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+
+	if err := db.CreateOutboundEmail(&email); err != nil {
+		return err
+	}
+
+	// nudge the worker so new mail doesn't wait for the next poll
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+/**
+ * delivers queued messages until the process exits. Polls for due messages
+ * and also wakes up whenever a new one is queued. Sent messages are deleted
+ * once they are a week old, and dead ones lose their body after a day and
+ * are deleted after a month.
+ */
+func (o *Outbox) Run() {
+	poll := time.NewTicker(outboxPollInterval)
+	defer poll.Stop()
+
+	purge := time.NewTicker(24 * time.Hour)
+	defer purge.Stop()
+
+	for {
+		select {
+		case <-poll.C:
+		case <-o.wake:
+		case <-purge.C:
+			purgeOutbox()
+			continue
+		}
+
+		o.processDue()
+	}
+}
+
+func purgeOutbox() {
+	now := time.Now()
+
+	if err := db.DeleteSentOutboundEmails(now.Add(-outboxSentRetention)); err != nil {
+		logrus.WithError(err).Error("Failed to purge sent emails")
+	}
+
+	if err := db.ClearDeadOutboundEmailBodies(now.Add(-outboxDeadBodyRetention)); err != nil {
+		logrus.WithError(err).Error("Failed to clear dead email bodies")
+	}
+
+	if err := db.DeleteDeadOutboundEmails(now.Add(-outboxDeadRetention)); err != nil {
+		logrus.WithError(err).Error("Failed to purge dead emails")
+	}
+}
+
+/**
+ * attempts every message that is currently due
+ */
+func (o *Outbox) processDue() {
+	emails, err := db.GetDueOutboundEmails(time.Now(), outboxBatchSize)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to load due emails")
+		return
+	}
+
+	for i := range emails {
+		o.deliver(&emails[i])
+	}
+}
+
+/**
+ * claims the message with a lease, sends it and records the outcome. The
+ * claim is a conditional write, so when several instances run a worker only
+ * one of them sends each message.
+ */
+func (o *Outbox) deliver(email *models.OutboundEmail) {
+	now := time.Now()
+	lease := now.Add(outboxLeaseDuration)
+
+	email.Status = models.EmailStatusSending
+	email.Attempts++
+	email.LeaseExpiresAt = &lease
+	email.UpdatedAt = now
+
+	claimed, err := db.SaveOutboundEmail(email)
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to claim email %s", email.ID)
+		return
+	}
+	if !claimed {
+		return
+	}
+
+	sendErr := o.send(email)
+
+	now = time.Now()
+	email.LeaseExpiresAt = nil
+	email.UpdatedAt = now
+
+	switch {
+	case sendErr == nil:
+		email.Status = models.EmailStatusSent
+		email.SentAt = &now
+		email.LastError = ""
+		email.Text = ""
+		email.HTML = ""
+	case sendErr == errUndecryptable || email.Attempts >= outboxMaxAttempts:
+		email.Status = models.EmailStatusDead
+		email.LastError = sendErr.Error()
+		logrus.WithError(sendErr).Errorf("Giving up on email %s after %d attempts", email.ID, email.Attempts)
+	default:
+		email.Status = models.EmailStatusPending
+		email.NextAttemptAt = now.Add(outboxBackoff(email.Attempts))
+		email.LastError = sendErr.Error()
+		logrus.WithError(sendErr).Warnf("Failed to send email %s, attempt %d", email.ID, email.Attempts)
+	}
+
+	if _, err := db.SaveOutboundEmail(email); err != nil {
+		logrus.WithError(err).Errorf("Failed to record delivery of email %s", email.ID)
+	}
+}
+
+var errUndecryptable = errors.New("email body can't be decrypted with the outbox key")
+
+/**
+ * decrypts the stored message and hands it to the delivery mailer. A body
+ * that can't be decrypted, e.g. after the key changed, will never send.
+ */
+func (o *Outbox) send(email *models.OutboundEmail) error {
+	text, err := openBody(o.aead, email.Text)
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to decrypt email %s", email.ID)
+		return errUndecryptable
+	}
+	html, err := openBody(o.aead, email.HTML)
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to decrypt email %s", email.ID)
+		return errUndecryptable
+	}
+
+	return o.delivery.Send(&Message{
+		To:      email.To,
+		Subject: email.Subject,
+		Text:    text,
+		HTML:    html,
+	})
+}
+
+/**
+ * returns the wait before the next attempt, doubling from outboxBaseBackoff
+ * up to outboxMaxBackoff
+ */
+func outboxBackoff(attempts int) time.Duration {
+	backoff := outboxBaseBackoff
+	for i := 1; i < attempts && backoff < outboxMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > outboxMaxBackoff {
+		backoff = outboxMaxBackoff
+	}
+	return backoff
+}
+
+/**
+ * puts a dead message back in the queue with a fresh set of attempts
+ */
+func RetryDeadEmail(id string) (*models.OutboundEmail, error) {
+	email, err := db.GetOutboundEmailByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if email.Status != models.EmailStatusDead {
+		return nil, ErrEmailNotDead
+	}
+
+	if email.Text == "" {
+		return nil, ErrEmailBodyCleared
+	}
+
+	now := time.Now()
+	email.Status = models.EmailStatusPending
+	email.Attempts = 0
+	email.NextAttemptAt = now
+	email.UpdatedAt = now
+
+	saved, err := db.SaveOutboundEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	if !saved {
+		return nil, ErrEmailNotDead
+	}
+
+	return email, nil
+}
@@ -0,0 +1,91 @@
+package mailer
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+)
+
+var ErrOutboxKeyMissing = errors.New("EMAIL_OUTBOX_KEY or JWT_SECRET must be set to encrypt queued emails")
+
+/**
+ * returns the key queued message bodies are encrypted with. EMAIL_OUTBOX_KEY
+ * holds 32 base64 encoded bytes. Without it a key is derived from JWT_SECRET.
+ */
+func OutboxKeyFromEnv() ([]byte, error) {
+	if encoded := os.Getenv("EMAIL_OUTBOX_KEY"); encoded != "" {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("EMAIL_OUTBOX_KEY is not valid base64: %v", err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("EMAIL_OUTBOX_KEY must be 32 bytes, got %d", len(key))
+		}
+		return key, nil
+	}
+
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		// labelled so the key differs from anything else derived from the secret
+		key := sha256.Sum256([]byte("email-outbox:" + secret))
+		return key[:], nil
+	}
+
+	return nil, ErrOutboxKeyMissing
+}
+
+/**
+ * encrypts a message body for storage as base64 of the nonce followed by the
+ * AES-GCM ciphertext. Empty bodies stay empty.
+ */
+func sealBody(aead cipher.AEAD, body string) (string, error) {
+	if body == "" {
+		return "", nil
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(body), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+/**
+ * decrypts a body stored by sealBody
+ */
+func openBody(aead cipher.AEAD, stored string) (string, error) {
+	if stored == "" {
+		return "", nil
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(stored)
+	if err != nil {
+		return "", fmt.Errorf("error decoding email body: %v", err)
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("email body is too short")
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	body, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("error decrypting email body: %v", err)
+	}
+
+	return string(body), nil
+}
+
+func newBodyCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,31 @@
+package mailer
+
+import "net/smtp"
+
+// SMTPMailer sends messages through an SMTP server using PLAIN auth
+type SMTPMailer struct {
+	host     string
+	port     string
+	from     string
+	password string
+}
+
+func NewSMTPMailer(host, port, from, password string) *SMTPMailer {
+	return &SMTPMailer{
+		host:     host,
+		port:     port,
+		from:     from,
+		password: password,
+	}
+}
+
+func (m *SMTPMailer) Send(msg *Message) error {
+	body, err := buildMIME(m.from, msg)
+	if err != nil {
+		return err
+	}
+
+	auth := smtp.PlainAuth("", m.from, m.password, m.host)
+
+	return smtp.SendMail(m.host+":"+m.port, auth, m.from, []string{msg.To}, body)
+}
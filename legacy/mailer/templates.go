@@ -0,0 +1,108 @@
+package mailer
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"strings"
+	texttemplate "text/template"
+)
+
+/*
+Each email has a <name>.txt text template, which must also define a "subject"
+block, and optionally a <name>.html template, under templates/<locale>/.
+Locales without a template fall back to DefaultLocale.
+*/
+
+const DefaultLocale = "en"
+
+//go:embed templates
+var templateFS embed.FS
+
+/**
+ * renders the named email in the given locale. The returned message has no
+ * recipient set.
+ */
+func Render(name, locale string, data interface{}) (*Message, error) {
+	locale = resolveLocale(name, locale)
+	dir := "templates/" + locale + "/"
+
+	text, err := texttemplate.ParseFS(templateFS, dir+name+".txt")
+	if err != nil {
+		return nil, fmt.Errorf("error parsing email template %s: %v", name, err)
+	}
+
+	var subject, body bytes.Buffer
+	if err := text.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return nil, fmt.Errorf("error rendering subject of %s: %v", name, err)
+	}
+	if err := text.Execute(&body, data); err != nil {
+		return nil, fmt.Errorf("error rendering email %s: %v", name, err)
+	}
+
+	msg := &Message{
+		Subject: strings.TrimSpace(subject.String()),
+		Text:    strings.TrimSpace(body.String()) + "\n",
+	}
+
+	if _, err := fs.Stat(templateFS, dir+name+".html"); err == nil {
+		html, err := htmltemplate.ParseFS(templateFS, "templates/layout.html", dir+name+".html")
+		if err != nil {
+			return nil, fmt.Errorf("error parsing email template %s: %v", name, err)
+		}
+
+		var out bytes.Buffer
+		if err := html.ExecuteTemplate(&out, "layout", data); err != nil {
+			return nil, fmt.Errorf("error rendering email %s: %v", name, err)
+		}
+		msg.HTML = out.String()
+	}
+
+	return msg, nil
+}
+
+/**
+ * normalizes a locale such as "de-AT" to a supported one, falling back to
+ * the default when there is no such template
+ */
+func resolveLocale(name, locale string) string {
+	locale = NormalizeLocale(locale)
+	if _, err := fs.Stat(templateFS, "templates/"+locale+"/"+name+".txt"); err != nil {
+		return DefaultLocale
+	}
+	return locale
+}
+
+/**
+ * reduces a language tag to its lowercase primary language, "de-AT" to "de". Also accepts the first entry of an Accept-Language header.
+ * Returns an empty string for anything that isn't a plausible tag.
+ */
+func NormalizeLocale(locale string) string {
+	locale = strings.ToLower(strings.TrimSpace(locale))
+	if i := strings.IndexAny(locale, "-_,;"); i >= 0 {
+		locale = locale[:i]
+	}
+	if len(locale) < 2 || len(locale) > 3 {
+		return ""
+	}
+	for _, c := range locale {
+		if c < 'a' || c > 'z' {
+			return ""
+		}
+	}
+	return locale
+}
+
+/**
+ * reports whether there are templates for the locale
+ */
+func SupportedLocale(locale string) bool {
+	locale = NormalizeLocale(locale)
+	if locale == "" {
+		return false
+	}
+	info, err := fs.Stat(templateFS, "templates/"+locale)
+	return err == nil && info.IsDir()
+}
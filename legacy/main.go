@@ -4,6 +4,9 @@ import (
 	"eurovision-api/auth"
 	"eurovision-api/db"
 	"eurovision-api/handlers"
+	"eurovision-api/mailer"
+	"eurovision-api/models"
+	"eurovision-api/utils"
 	"log"
 	"net/http"
 	"os"
@@ -25,10 +28,43 @@ func main() {
 
 	handlers.InitRankingSettings()
 
-	jwtSecret := os.Getenv("JWT_SECRET")
+	if err := utils.InitTrustedProxies(); err != nil {
+		log.Fatalf("Failed to load trusted proxies: %v", err)
+	}
+
+	// optional codes for decoding ranking strings into positions
+	if err := utils.InitRankingCodec(); err != nil {
+		log.Fatalf("Failed to load ranking codes: %v", err)
+	}
+
+	if err := auth.CheckBreachedPasswordsDir(); err != nil {
+		log.Fatalf("Failed to load breached passwords: %v", err)
+	}
+
+	tokenIssuer, err := auth.NewTokenIssuerFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to initialize JWT signing keys: %v", err)
+	}
+
+	emailSender, err := mailer.NewFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to initialize mailer: %v", err)
+	}
 
-	auth.Initialize(jwtSecret)
-	authService := auth.NewService(jwtSecret)
+	outboxKey, err := mailer.OutboxKeyFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to load email outbox key: %v", err)
+	}
+
+	// emails are queued in the outbox and delivered in the background
+	outbox, err := mailer.NewOutbox(emailSender, outboxKey)
+	if err != nil {
+		log.Fatalf("Failed to initialize email outbox: %v", err)
+	}
+	go outbox.Run()
+
+	auth.Initialize(tokenIssuer)
+	authService := auth.NewService(tokenIssuer, outbox)
 
 	// Create handlers with dependencies
 	voteHandler := handlers.NewVoteHandler()
@@ -38,26 +74,131 @@ func main() {
 
 	// Auth routes
 	r.HandleFunc("/auth/register/initiate", authHandler.InitiateRegistration).Methods("POST")
+	r.HandleFunc("/auth/register/resend", authHandler.ResendVerification).Methods("POST")
 	r.HandleFunc("/auth/register/complete", authHandler.CompleteRegistration).Methods("POST")
 
 	r.HandleFunc("/auth/password/reset", authHandler.InitiatePasswordReset).Methods("POST")
 	r.HandleFunc("/auth/password/complete", authHandler.CompletePasswordReset).Methods("POST")
 
 	r.HandleFunc("/auth/login", authHandler.Login).Methods("POST")
+	r.HandleFunc("/auth/login/mfa", authHandler.CompleteMFALogin).Methods("POST")
+	r.HandleFunc("/auth/magic-link", authHandler.RequestMagicLink).Methods("POST")
+	r.HandleFunc("/auth/magic-link/complete", authHandler.CompleteMagicLinkLogin).Methods("POST")
+
+	r.HandleFunc("/auth/unlock", authHandler.UnlockAccount).Methods("POST")
+	r.HandleFunc("/auth/email/approve", authHandler.ApproveEmailChange).Methods("POST")
+	r.HandleFunc("/auth/email/confirm", authHandler.ConfirmEmailChange).Methods("POST")
+	r.HandleFunc("/auth/account/deletion/confirm", authHandler.ConfirmAccountDeletion).Methods("POST")
+	r.HandleFunc("/auth/account/deletion/cancel", authHandler.CancelAccountDeletion).Methods("POST")
+
+	r.HandleFunc("/auth/oidc/{provider}/login", authHandler.OIDCLogin).Methods("GET")
+	r.HandleFunc("/auth/oidc/{provider}/callback", authHandler.OIDCCallback).Methods("GET")
+
+	// public profile pages
+	profileHandler := handlers.NewProfileHandler()
+	followHandler := handlers.NewFollowHandler()
+	r.HandleFunc("/users/{handle}", profileHandler.GetPublicProfile).Methods("GET")
+	r.HandleFunc("/users/{handle}/followers", followHandler.GetFollowers).Methods("GET")
+	r.HandleFunc("/users/{handle}/following", followHandler.GetFollowing).Methods("GET")
+
+	// public ranking search
+	rankingHandler := handlers.NewRankingHandler()
+	r.HandleFunc("/rankings/search", rankingHandler.SearchRankings).Methods("GET")
+	r.HandleFunc("/rankings/positions", rankingHandler.SearchByPosition).Methods("GET")
+	r.HandleFunc("/rankings/positions/counts", rankingHandler.CountByPosition).Methods("GET")
 
-	// Vote routes - protected by auth middleware
+	// per-country statistics over public rankings
+	statsHandler := handlers.NewStatsHandler()
+	r.HandleFunc("/stats/{year}/countries", statsHandler.GetYearStats).Methods("GET")
+	r.HandleFunc("/stats/{year}/countries/{code}", statsHandler.GetCountryStats).Methods("GET")
+
+	// public keys for verifying the API's JWTs
+	r.HandleFunc("/.well-known/jwks.json", authHandler.JWKS).Methods("GET")
+
+	// Vote routes - protected by auth middleware. Routes registered with
+	// auth.RequireScope also accept personal access tokens with that scope
 	apiRouter := r.PathPrefix("/api").Subrouter()
 	apiRouter.Use(auth.AuthMiddleware)
-	apiRouter.HandleFunc("/vote", voteHandler.HandleVote).Methods("POST")
-	apiRouter.HandleFunc("/votes/count", voteHandler.GetVoteCount).Methods("GET")
-
-	rankingHandler := handlers.NewRankingHandler()
-	apiRouter.HandleFunc("/rankings", rankingHandler.CreateRanking).Methods("POST")
-	apiRouter.HandleFunc("/rankings", rankingHandler.UpdateRanking).Methods("PATCH")
-	apiRouter.HandleFunc("/rankings", rankingHandler.GetUserRankings).Methods("GET")
-	apiRouter.HandleFunc("/rankings", rankingHandler.GetUserRankings).Methods("GET")
-	apiRouter.HandleFunc("/rankings/{rankingID}", rankingHandler.GetRanking).Methods("GET")
-	apiRouter.HandleFunc("/rankings/{rankingID}", rankingHandler.DeleteRanking).Methods("DELETE")
+	apiRouter.Handle("/vote", auth.RequireScope(auth.ScopeVotesWrite, voteHandler.HandleVote)).Methods("POST")
+	apiRouter.Handle("/votes/count", auth.RequireScope(auth.ScopeVotesRead, voteHandler.GetVoteCount)).Methods("GET")
+
+	apiRouter.Handle("/rankings", auth.RequireScope(auth.ScopeRankingsWrite, rankingHandler.CreateRanking)).Methods("POST")
+	apiRouter.Handle("/rankings", auth.RequireScope(auth.ScopeRankingsWrite, rankingHandler.UpdateRanking)).Methods("PATCH")
+	apiRouter.Handle("/rankings", auth.RequireScope(auth.ScopeRankingsRead, rankingHandler.GetUserRankings)).Methods("GET")
+	apiRouter.Handle("/rankings/compare", auth.RequireScope(auth.ScopeRankingsRead, rankingHandler.CompareRankings)).Methods("GET")
+	apiRouter.Handle("/rankings/{rankingID}", auth.RequireScope(auth.ScopeRankingsRead, rankingHandler.GetRanking)).Methods("GET")
+	apiRouter.Handle("/rankings/{rankingID}", auth.RequireScope(auth.ScopeRankingsWrite, rankingHandler.DeleteRanking)).Methods("DELETE")
+	apiRouter.Handle("/rankings/{rankingID}/similar", auth.RequireScope(auth.ScopeRankingsRead, rankingHandler.GetSimilarRankings)).Methods("GET")
+	apiRouter.Handle("/rankings/{rankingID}/reactions", auth.RequireScope(auth.ScopeRankingsRead, rankingHandler.GetReactions)).Methods("GET")
+	apiRouter.Handle("/rankings/{rankingID}/reactions/{kind}", auth.RequireScope(auth.ScopeRankingsWrite, rankingHandler.AddReaction)).Methods("PUT")
+	apiRouter.Handle("/rankings/{rankingID}/reactions/{kind}", auth.RequireScope(auth.ScopeRankingsWrite, rankingHandler.RemoveReaction)).Methods("DELETE")
+
+	// Follows and the feed of followed users' public rankings
+	apiRouter.Handle("/feed", auth.RequireScope(auth.ScopeRankingsRead, followHandler.GetFeed)).Methods("GET")
+	apiRouter.HandleFunc("/users/{handle}/follow", followHandler.Follow).Methods("POST")
+	apiRouter.HandleFunc("/users/{handle}/follow", followHandler.Unfollow).Methods("DELETE")
+
+	// Comments on rankings
+	commentHandler := handlers.NewCommentHandler()
+	apiRouter.HandleFunc("/rankings/{rankingID}/comments", commentHandler.ListComments).Methods("GET")
+	apiRouter.HandleFunc("/rankings/{rankingID}/comments", commentHandler.CreateComment).Methods("POST")
+	apiRouter.HandleFunc("/rankings/{rankingID}/comments/lock", commentHandler.LockComments).Methods("PUT")
+	apiRouter.HandleFunc("/rankings/{rankingID}/comments/lock", commentHandler.UnlockComments).Methods("DELETE")
+	apiRouter.HandleFunc("/comments/{commentID}", commentHandler.EditComment).Methods("PATCH")
+	apiRouter.HandleFunc("/comments/{commentID}", commentHandler.DeleteComment).Methods("DELETE")
+	apiRouter.HandleFunc("/comments/{commentID}/report", commentHandler.ReportComment).Methods("POST")
+
+	// Account routes for the authenticated user
+	accountHandler := handlers.NewAccountHandler(authService)
+	apiRouter.HandleFunc("/me", accountHandler.DeleteAccount).Methods("DELETE")
+	apiRouter.HandleFunc("/me/export", accountHandler.ExportData).Methods("GET")
+	apiRouter.HandleFunc("/me/password", accountHandler.ChangePassword).Methods("POST")
+	apiRouter.HandleFunc("/me/email", accountHandler.ChangeEmail).Methods("POST")
+	apiRouter.HandleFunc("/me/security-events", accountHandler.ListSecurityEvents).Methods("GET")
+	apiRouter.HandleFunc("/me/sessions", accountHandler.ListSessions).Methods("GET")
+	apiRouter.HandleFunc("/me/sessions", accountHandler.RevokeAllSessions).Methods("DELETE")
+	apiRouter.HandleFunc("/me/sessions/{sessionID}", accountHandler.RevokeSession).Methods("DELETE")
+	apiRouter.HandleFunc("/me/profile", profileHandler.GetMyProfile).Methods("GET")
+	apiRouter.HandleFunc("/me/profile", profileHandler.UpdateMyProfile).Methods("PATCH")
+	apiRouter.HandleFunc("/me/following", followHandler.GetMyFollowing).Methods("GET")
+	apiRouter.HandleFunc("/me/followers", followHandler.GetMyFollowers).Methods("GET")
+	apiRouter.Handle("/me/taste-twins/{year}", auth.RequireScope(auth.ScopeRankingsRead, rankingHandler.GetTasteTwins)).Methods("GET")
+	apiRouter.HandleFunc("/me/tokens", accountHandler.CreateAccessToken).Methods("POST")
+	apiRouter.HandleFunc("/me/tokens", accountHandler.ListAccessTokens).Methods("GET")
+	apiRouter.HandleFunc("/me/tokens/{tokenID}", accountHandler.RevokeAccessToken).Methods("DELETE")
+	apiRouter.HandleFunc("/me/2fa/enroll", accountHandler.EnrollTOTP).Methods("POST")
+	apiRouter.HandleFunc("/me/2fa/verify", accountHandler.VerifyTOTP).Methods("POST")
+	apiRouter.HandleFunc("/me/2fa/disable", accountHandler.DisableTOTP).Methods("POST")
+	apiRouter.HandleFunc("/me/2fa/recovery-codes", accountHandler.RegenerateRecoveryCodes).Methods("POST")
+
+	// Admin routes - restricted to users with the admin role
+	adminHandler := handlers.NewAdminHandler(authService)
+	adminRouter := r.PathPrefix("/admin").Subrouter()
+	adminRouter.Use(auth.AuthMiddleware, auth.RequireRole(models.RoleAdmin))
+	adminRouter.HandleFunc("/users", adminHandler.SearchUsers).Methods("GET")
+	adminRouter.HandleFunc("/users/normalize-emails", adminHandler.NormalizeEmails).Methods("POST")
+	adminRouter.HandleFunc("/users/{userID}", adminHandler.GetUser).Methods("GET")
+	adminRouter.HandleFunc("/users/{userID}", adminHandler.DeleteUser).Methods("DELETE")
+	adminRouter.HandleFunc("/users/{userID}/rankings", adminHandler.GetUserRankings).Methods("GET")
+	adminRouter.HandleFunc("/users/{userID}/confirm", adminHandler.ConfirmUser).Methods("POST")
+	adminRouter.HandleFunc("/users/{userID}/disable", adminHandler.DisableUser).Methods("POST")
+	adminRouter.HandleFunc("/users/{userID}/enable", adminHandler.EnableUser).Methods("POST")
+	adminRouter.HandleFunc("/users/{userID}/unlock", adminHandler.UnlockUser).Methods("POST")
+	adminRouter.HandleFunc("/users/{userID}/password-reset", adminHandler.ForcePasswordReset).Methods("POST")
+	adminRouter.HandleFunc("/users/{userID}/ranking-quota", adminHandler.SetRankingQuota).Methods("PUT")
+	adminRouter.HandleFunc("/audit", adminHandler.GetAuditLog).Methods("GET")
+	adminRouter.HandleFunc("/security-events", adminHandler.SearchSecurityEvents).Methods("GET")
+	adminRouter.HandleFunc("/emails", adminHandler.SearchEmails).Methods("GET")
+	adminRouter.HandleFunc("/emails/{emailID}/retry", adminHandler.RetryEmail).Methods("POST")
+	adminRouter.HandleFunc("/rankings/reindex-positions", adminHandler.ReindexRankingPositions).Methods("POST")
+	adminRouter.HandleFunc("/rankings/reindex-reaction-totals", adminHandler.ReindexReactionTotals).Methods("POST")
+
+	// Moderation routes - open to moderators as well as admins
+	moderationRouter := r.PathPrefix("/moderation").Subrouter()
+	moderationRouter.Use(auth.AuthMiddleware, auth.RequireRole(models.RoleModerator, models.RoleAdmin))
+	moderationRouter.HandleFunc("/comments", adminHandler.GetModerationQueue).Methods("GET")
+	moderationRouter.HandleFunc("/comments/{commentID}/hide", adminHandler.HideComment).Methods("POST")
+	moderationRouter.HandleFunc("/comments/{commentID}/restore", adminHandler.RestoreComment).Methods("POST")
 
 	port := getPort()
 
@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+type AdminAuditEntry struct {
+	ID           string                 `json:"id"`
+	AdminID      string                 `json:"admin_id"`
+	Action       string                 `json:"action"`
+	TargetUserID string                 `json:"target_user_id,omitempty"`
+	Details      map[string]interface{} `json:"details,omitempty"`
+	Timestamp    time.Time              `json:"timestamp"`
+}
@@ -0,0 +1,24 @@
+package models
+
+import "time"
+
+/*
+AuthToken is a single-use token sent to a user by email, such as an email
+verification or password reset link. Only the SHA-256 hash of the token is
+stored, and it doubles as the document id. SeqNo and PrimaryTerm come from
+elasticsearch and make consuming the token a compare-and-set.
+*/
+type AuthToken struct {
+	TokenHash string     `json:"token_hash"`
+	UserID    string     `json:"user_id"`
+	Purpose   string     `json:"purpose"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+
+	// the address an email change token was issued for
+	Email string `json:"email,omitempty"`
+
+	SeqNo       int64 `json:"-"`
+	PrimaryTerm int64 `json:"-"`
+}
@@ -0,0 +1,40 @@
+package models
+
+import "time"
+
+/*
+Comment is a comment on a ranking. Top level comments start a thread and
+replies point at the comment they answer. ThreadID is the id of the top level
+comment, so a whole thread can be loaded with one query. Deleted comments
+keep their place in the thread with the body removed.
+*/
+type Comment struct {
+	ID             string     `json:"id"`
+	RankingID      string     `json:"ranking_id"`
+	RankingOwnerID string     `json:"ranking_owner_id"`
+	ThreadID       string     `json:"thread_id"`
+	ParentID       string     `json:"parent_id,omitempty"`
+	Depth          int        `json:"depth"`
+	UserID         string     `json:"user_id,omitempty"`
+	Body           string     `json:"body"`
+	CreatedAt      time.Time  `json:"created_at"`
+	EditedAt       *time.Time `json:"edited_at,omitempty"`
+	Deleted        bool       `json:"deleted"`
+	Hidden         bool       `json:"hidden"`
+	HiddenBy       string     `json:"hidden_by,omitempty"`
+	HiddenAt       *time.Time `json:"hidden_at,omitempty"`
+	HiddenReason   string     `json:"hidden_reason,omitempty"`
+	ReportCount    int        `json:"report_count"`
+	LastReportedAt *time.Time `json:"last_reported_at,omitempty"`
+}
+
+// a user flagging a comment for moderators. The document id is built from
+// the comment and the user, so each user can report a comment once.
+type CommentReport struct {
+	CommentID      string    `json:"comment_id"`
+	RankingID      string    `json:"ranking_id"`
+	RankingOwnerID string    `json:"ranking_owner_id"`
+	UserID         string    `json:"user_id"`
+	Reason         string    `json:"reason"`
+	CreatedAt      time.Time `json:"created_at"`
+}
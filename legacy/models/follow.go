@@ -0,0 +1,11 @@
+package models
+
+import "time"
+
+// one user following another. The document id is built from both user ids,
+// so a user can only follow someone once.
+type Follow struct {
+	FollowerID string    `json:"follower_id"`
+	FolloweeID string    `json:"followee_id"`
+	CreatedAt  time.Time `json:"created_at"`
+}
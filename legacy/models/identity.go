@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// links an external OpenID Connect identity to a local user
+type UserIdentity struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"subject"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
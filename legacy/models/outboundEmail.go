@@ -0,0 +1,36 @@
+package models
+
+import "time"
+
+const (
+	EmailStatusPending = "pending"
+	EmailStatusSending = "sending"
+	EmailStatusSent    = "sent"
+	EmailStatusDead    = "dead"
+)
+
+/*
+OutboundEmail is a message in the email outbox. It stays pending until the
+outbox worker delivers it, and is moved to dead after too many failed attempts.
+SeqNo and PrimaryTerm come from elasticsearch and guard against two workers
+claiming the same message. Text and HTML are encrypted by the outbox and
+emptied once the message no longer needs sending.
+*/
+type OutboundEmail struct {
+	ID             string     `json:"id"`
+	To             string     `json:"to"`
+	Subject        string     `json:"subject"`
+	Text           string     `json:"text"`
+	HTML           string     `json:"html,omitempty"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	NextAttemptAt  time.Time  `json:"next_attempt_at"`
+	LeaseExpiresAt *time.Time `json:"lease_expires_at,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+	SentAt         *time.Time `json:"sent_at,omitempty"`
+
+	SeqNo       int64 `json:"-"`
+	PrimaryTerm int64 `json:"-"`
+}
@@ -0,0 +1,26 @@
+package models
+
+import "time"
+
+/*
+Profile is the public face of a user. It is stored separately from User so
+nothing from the account record can leak through the public profile page.
+*/
+type Profile struct {
+	UserID      string    `json:"user_id"`
+	Handle      string    `json:"handle,omitempty"`
+	DisplayName string    `json:"display_name"`
+	Bio         string    `json:"bio"`
+	Country     string    `json:"country,omitempty"`
+	AvatarURL   string    `json:"avatar_url,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// claims a handle for a user. The handle is the document id, so two users
+// can never hold the same one.
+type HandleReservation struct {
+	Handle    string    `json:"handle"`
+	UserID    string    `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -15,4 +15,30 @@ type UserRanking struct {
 	GroupIDs    []string  `json:"group_ids"`
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
+
+	// set by the owner to stop new comments
+	CommentsLocked bool `json:"comments_locked"`
+
+	// decoded from Ranking when ranking codes are configured, and null when
+	// the ranking couldn't be decoded. Always set by the server.
+	Positions        []RankingPosition `json:"positions"`
+	CountryPositions map[string]int    `json:"country_positions"`
+}
+
+/**
+ * sets Positions and CountryPositions from the decoded positions, clearing
+ * them when there are none
+ */
+func (r *UserRanking) SetPositions(positions []RankingPosition) {
+	if len(positions) == 0 {
+		r.Positions = nil
+		r.CountryPositions = nil
+		return
+	}
+
+	r.Positions = positions
+	r.CountryPositions = map[string]int{}
+	for _, position := range positions {
+		r.CountryPositions[position.Country] = position.Position
+	}
 }
@@ -0,0 +1,9 @@
+package models
+
+// where one entry placed in a decoded ranking. FromBottom is 1 for the entry
+// ranked last, so "ranked last" can be queried without knowing the length.
+type RankingPosition struct {
+	Country    string `json:"country"`
+	Position   int    `json:"position"`
+	FromBottom int    `json:"from_bottom"`
+}
@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// snapshot of a ranking as it was before an update
+type RankingRevision struct {
+	RevisionID  string    `json:"revision_id"`
+	RankingID   string    `json:"ranking_id"`
+	UserID      string    `json:"user_id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Year        int       `json:"year"`
+	Ranking     string    `json:"ranking"`
+	Public      bool      `json:"public"`
+	GroupIDs    []string  `json:"group_ids"`
+	RevisedAt   time.Time `json:"revised_at"`
+}
@@ -0,0 +1,50 @@
+package models
+
+import "time"
+
+// reaction kinds, each with the emoji shown for it
+const (
+	ReactionLike  = "like"
+	ReactionHeart = "heart"
+	ReactionFire  = "fire"
+	ReactionClap  = "clap"
+	ReactionLaugh = "laugh"
+	ReactionCry   = "cry"
+)
+
+// the fixed set of reactions, in display order
+var ReactionKinds = []string{
+	ReactionLike,
+	ReactionHeart,
+	ReactionFire,
+	ReactionClap,
+	ReactionLaugh,
+	ReactionCry,
+}
+
+var ReactionEmoji = map[string]string{
+	ReactionLike:  "👍",
+	ReactionHeart: "❤️",
+	ReactionFire:  "🔥",
+	ReactionClap:  "👏",
+	ReactionLaugh: "😂",
+	ReactionCry:   "😢",
+}
+
+// one user's reaction of one kind to a ranking. The document id is built
+// from the ranking, user and kind, so each user can react once per kind.
+type Reaction struct {
+	RankingID      string    `json:"ranking_id"`
+	RankingOwnerID string    `json:"ranking_owner_id"`
+	UserID         string    `json:"user_id"`
+	Kind           string    `json:"kind"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// running totals of a ranking's reactions, kept in their own document so
+// they are never overwritten by ranking updates
+type ReactionCounts struct {
+	RankingID      string           `json:"ranking_id"`
+	RankingOwnerID string           `json:"ranking_owner_id"`
+	Counts         map[string]int64 `json:"counts"`
+}
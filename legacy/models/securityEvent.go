@@ -0,0 +1,28 @@
+package models
+
+import "time"
+
+const (
+	SecurityOutcomeSuccess = "success"
+	SecurityOutcomeFailure = "failure"
+)
+
+/*
+SecurityEvent records something that happened to an account: a login, a
+password or email change, an admin action and so on. UserID is the account the
+event concerns and ActorID who performed it, which differ for admin actions.
+Events are only ever appended.
+*/
+type SecurityEvent struct {
+	ID        string                 `json:"id"`
+	UserID    string                 `json:"user_id,omitempty"`
+	ActorID   string                 `json:"actor_id,omitempty"`
+	Email     string                 `json:"email,omitempty"`
+	Event     string                 `json:"event"`
+	Outcome   string                 `json:"outcome"`
+	Reason    string                 `json:"reason,omitempty"`
+	IP        string                 `json:"ip,omitempty"`
+	UserAgent string                 `json:"user_agent,omitempty"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	Timestamp time.Time              `json:"timestamp"`
+}
@@ -0,0 +1,28 @@
+package models
+
+import "time"
+
+/*
+Session is a signed in device. Every session JWT carries the session id in its
+sid claim and is only accepted while the session is active, so revoking a
+session signs that device out.
+*/
+type Session struct {
+	ID         string     `json:"id"`
+	UserID     string     `json:"user_id"`
+	Device     string     `json:"device"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `json:"ip,omitempty"`
+	Location   IPLocation `json:"location"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastSeenAt time.Time  `json:"last_seen_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+/**
+ * reports whether the session can still be used
+ */
+func (s *Session) IsActive(now time.Time) bool {
+	return s.RevokedAt == nil && s.ExpiresAt.After(now)
+}
@@ -2,12 +2,53 @@ package models
 
 import "time"
 
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
 type User struct {
-	ID                string    `json:"id"`
-	Email             string    `json:"email"`
-	PasswordHash      string    `json:"password_hash"`
-	Confirmed         bool      `json:"confirmed"`
-	ConfirmationToken string    `json:"confirmation_token,omitempty"`
-	TokenExpiry       time.Time `json:"token_expiry"`
-	CreatedAt         time.Time `json:"created_at"`
+	ID                    string     `json:"id"`
+	Email                 string     `json:"email"`
+	PasswordHash          string     `json:"password_hash"`
+	Role                  string     `json:"role,omitempty"`
+	Locale                string     `json:"locale,omitempty"`
+	Confirmed             bool       `json:"confirmed"`
+	Disabled              bool       `json:"disabled"`
+	DisabledAt            *time.Time `json:"disabled_at,omitempty"`
+	PasswordResetRequired bool       `json:"password_reset_required"`
+	RankingQuota          *int64     `json:"ranking_quota,omitempty"`
+	TOTPEnabled           bool       `json:"totp_enabled"`
+	TOTPSecret            string     `json:"totp_secret,omitempty"`
+	TOTPPendingSecret     string     `json:"totp_pending_secret,omitempty"`
+	TOTPLastUsedStep      int64      `json:"totp_last_used_step"`
+	RecoveryCodeHashes    []string   `json:"recovery_code_hashes,omitempty"`
+	FailedLoginAttempts   int        `json:"failed_login_attempts"`
+	LastFailedLoginAt     *time.Time `json:"last_failed_login_at,omitempty"`
+	LockedUntil           *time.Time `json:"locked_until,omitempty"`
+	SessionsRevokedAt     *time.Time `json:"sessions_revoked_at,omitempty"`
+	PendingEmail          string     `json:"pending_email,omitempty"`
+	DeletionRequestedAt   *time.Time `json:"deletion_requested_at,omitempty"`
+	DeletionScheduledFor  *time.Time `json:"deletion_scheduled_for,omitempty"`
+	VerificationSentAt    *time.Time `json:"verification_sent_at,omitempty"`
+	CreatedAt             time.Time  `json:"created_at"`
+}
+
+/**
+ * returns the user's role, falling back to the default user role for
+ * accounts created before roles were stored.
+ */
+func (u *User) EffectiveRole() string {
+	if u.Role == "" {
+		return RoleUser
+	}
+	return u.Role
+}
+
+/**
+ * reports whether the account is temporarily locked after too many failed logins
+ */
+func (u *User) IsLocked(now time.Time) bool {
+	return u.LockedUntil != nil && u.LockedUntil.After(now)
 }
@@ -3,6 +3,7 @@ package models
 import "time"
 
 type Vote struct {
+	UserID     string     `json:"user_id,omitempty"`
 	VoteString string     `json:"vote_string"`
 	IP         string     `json:"ip"`
 	Location   IPLocation `json:"location"`
@@ -3,29 +3,149 @@ package utils
 import (
 	"encoding/json"
 	"fmt"
-	"log"
+	"net"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"eurovision-api/models"
-
-	"github.com/sirupsen/logrus"
 )
 
+var ipLocationClient = &http.Client{Timeout: 5 * time.Second}
+
 /**
  * identifies the location of the given IP address using ipapi.co and returns
- * IPLocation object.
+ * IPLocation object. Private and loopback addresses are not looked up.
  */
-func fetchIPLocationFromIP(ip string) (ipLocation models.IPLocation, err error) {
+func FetchIPLocation(ip string) (models.IPLocation, error) {
+	var ipLocation models.IPLocation
+
+	parsed := net.ParseIP(ip)
+	if parsed == nil || parsed.IsLoopback() || parsed.IsPrivate() || parsed.IsUnspecified() {
+		return ipLocation, nil
+	}
+
 	locationURL := fmt.Sprintf("https://ipapi.co/%s/json/", ip)
-	resp, err := http.Get(locationURL)
+	resp, err := ipLocationClient.Get(locationURL)
+	if err != nil {
+		return ipLocation, fmt.Errorf("error getting location: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(&ipLocation); err != nil {
+		return ipLocation, fmt.Errorf("error decoding location: %v", err)
+	}
+
+	return ipLocation, nil
+}
+
+// proxies whose X-Forwarded-For entries are believed, from TRUSTED_PROXIES
+var trustedProxies []*net.IPNet
+
+/**
+ * loads TRUSTED_PROXIES, a comma separated list of the IP addresses or CIDR
+ * ranges of the proxies in front of the API. Without it X-Forwarded-For is
+ * ignored and the connecting address is the client's.
+ */
+func InitTrustedProxies() error {
+	proxies, err := ParseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		return err
+	}
+
+	trustedProxies = proxies
+	return nil
+}
+
+/**
+ * parses a comma separated list of IP addresses and CIDR ranges
+ */
+func ParseTrustedProxies(list string) ([]*net.IPNet, error) {
+	proxies := []*net.IPNet{}
+
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+		}
+		proxies = append(proxies, network)
+	}
+
+	return proxies, nil
+}
+
+func isTrustedProxy(proxies []*net.IPNet, ip net.IP) bool {
+	for _, network := range proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * returns the client's IP address. X-Forwarded-For is only believed when
+ * the request comes from a trusted proxy, and is read from the right since
+ * anything to the left of the last trusted hop could have been sent by the
+ * client itself.
+ */
+func ClientIP(r *http.Request) string {
+	return clientIP(r, trustedProxies)
+}
+
+func clientIP(r *http.Request, proxies []*net.IPNet) string {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		logrus.Printf("Error getting location: %v", err)
-	} else {
-		var ipLocation models.IPLocation
-		if err := json.NewDecoder(resp.Body).Decode(&ipLocation); err != nil {
-			log.Printf("Error decoding location: %v", err)
+		remote = r.RemoteAddr
+	}
+
+	remoteIP := net.ParseIP(remote)
+	if remoteIP == nil || !isTrustedProxy(proxies, remoteIP) {
+		return remote
+	}
+
+	// every X-Forwarded-For header, oldest hop first
+	hops := []string{}
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
 		}
-		resp.Body.Close()
 	}
-	return ipLocation, err
+
+	// walk back from the proxy to the first address it doesn't vouch for
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			// a garbled entry can't be trusted, nor anything before it
+			break
+		}
+
+		client = ip.String()
+		if !isTrustedProxy(proxies, ip) {
+			break
+		}
+	}
+
+	return client
 }
@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		name     string
+		list     string
+		valid    bool
+		trusted  []string
+		rejected []string
+	}{
+		{"empty", "", true, nil, []string{"10.0.0.1", "::1"}},
+		{"single ipv4", "10.0.0.1", true, []string{"10.0.0.1"}, []string{"10.0.0.2"}},
+		{"ipv4 mapped in ipv6", "10.0.0.1", true, []string{"::ffff:10.0.0.1"}, nil},
+		{"ipv4 range", "10.0.0.0/8, 192.168.1.0/24", true,
+			[]string{"10.255.0.1", "192.168.1.7"}, []string{"192.168.2.1", "11.0.0.1"}},
+		{"single ipv6", "2001:db8::1", true, []string{"2001:db8::1"}, []string{"2001:db8::2"}},
+		{"ipv6 range", "fd00::/8", true, []string{"fd12:3456::1"}, []string{"fe80::1", "10.0.0.1"}},
+		{"blank entries", " ,10.0.0.1,, ", true, []string{"10.0.0.1"}, nil},
+		{"invalid address", "10.0.0.256", false, nil, nil},
+		{"invalid range", "10.0.0.0/33", false, nil, nil},
+		{"hostname", "proxy.internal", false, nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxies, err := ParseTrustedProxies(tt.list)
+			if (err == nil) != tt.valid {
+				t.Fatalf("error = %v, want valid %v", err, tt.valid)
+			}
+
+			for _, ip := range tt.trusted {
+				if !isTrustedProxy(proxies, net.ParseIP(ip)) {
+					t.Errorf("%s isn't trusted", ip)
+				}
+			}
+			for _, ip := range tt.rejected {
+				if isTrustedProxy(proxies, net.ParseIP(ip)) {
+					t.Errorf("%s is trusted", ip)
+				}
+			}
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8, fd00::/8")
+	if err != nil {
+		t.Fatalf("ParseTrustedProxies: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		want         string
+	}{
+		{"direct client", "203.0.113.7:5123", nil, "203.0.113.7"},
+		{"untrusted remote with spoofed header", "203.0.113.7:5123", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"trusted proxy without header", "10.0.0.2:443", nil, "10.0.0.2"},
+		{"single trusted proxy", "10.0.0.2:443", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"client spoofing through a trusted proxy", "10.0.0.2:443", []string{"198.51.100.1, 203.0.113.7"}, "203.0.113.7"},
+		{"multi-hop trusted chain", "10.0.0.2:443", []string{"198.51.100.1, 203.0.113.7, 10.1.0.5, 10.2.0.9"}, "203.0.113.7"},
+		{"multiple headers", "10.0.0.2:443", []string{"198.51.100.1", "203.0.113.7, 10.1.0.5"}, "203.0.113.7"},
+		{"garbled last hop", "10.0.0.2:443", []string{"203.0.113.7, not-an-ip"}, "10.0.0.2"},
+		{"garbled entry before the client", "10.0.0.2:443", []string{"not-an-ip, 203.0.113.7"}, "203.0.113.7"},
+		{"garbled entry behind a trusted hop", "10.0.0.2:443", []string{"203.0.113.7, garbage, 10.1.0.5"}, "10.1.0.5"},
+		{"only trusted hops", "10.0.0.2:443", []string{"10.3.0.1, 10.1.0.5"}, "10.3.0.1"},
+		{"ipv6 proxy and client", "[fd00::2]:443", []string{"2001:db8::7, fd00::3"}, "2001:db8::7"},
+		{"untrusted ipv6 remote", "[2001:db8::9]:443", []string{"198.51.100.1"}, "2001:db8::9"},
+		{"remote without port", "10.0.0.2", []string{"203.0.113.7"}, "203.0.113.7"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, header := range tt.forwardedFor {
+				r.Header.Add("X-Forwarded-For", header)
+			}
+
+			if got := clientIP(r, proxies); got != tt.want {
+				t.Errorf("clientIP = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"eurovision-api/models"
+)
+
+var (
+	ErrRankingCodesNotConfigured = errors.New("ranking codes are not configured")
+	ErrUnknownRankingCode        = errors.New("ranking contains an unknown entry code")
+	ErrDuplicateRankingEntry     = errors.New("ranking lists an entry more than once")
+)
+
+/*
+RankingCodec turns the compact ranking strings stored on rankings into an
+ordered list of country codes. The codes are read from the JSON file named by
+RANKING_CODES_FILE, an object mapping each entry code used in ranking strings
+to the country it stands for:
+
+	{"f": "SE", "o": "IT", ".b": "UA"}
+
+Codes may be longer than one character. A ranking string is split by always
+taking the longest code that matches, so the set of codes must be prefix free.
+The file may name at most RankingVectorDims countries.
+*/
+type RankingCodec struct {
+	codes      map[string]string
+	maxCodeLen int
+
+	// each country's slot in position vectors, in alphabetical order
+	slots map[string]int
+}
+
+// length of the position vectors stored on rankings for similarity scoring.
+// Changing it needs the rankings index to be rebuilt.
+const RankingVectorDims = 64
+
+var rankingCodec *RankingCodec
+
+/**
+ * loads the ranking codes from RANKING_CODES_FILE. Without the setting,
+ * rankings are stored without decoded positions.
+ */
+func InitRankingCodec() error {
+	path := os.Getenv("RANKING_CODES_FILE")
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading ranking codes: %v", err)
+	}
+
+	var codes map[string]string
+	if err := json.Unmarshal(data, &codes); err != nil {
+		return fmt.Errorf("error parsing ranking codes: %v", err)
+	}
+
+	codec, err := NewRankingCodec(codes)
+	if err != nil {
+		return err
+	}
+
+	rankingCodec = codec
+	return nil
+}
+
+/**
+ * builds a codec from entry codes to country codes. Country codes are stored
+ * uppercase.
+ */
+func NewRankingCodec(codes map[string]string) (*RankingCodec, error) {
+	codec := &RankingCodec{codes: map[string]string{}, slots: map[string]int{}}
+
+	for code, country := range codes {
+		country = strings.ToUpper(strings.TrimSpace(country))
+		if code == "" || country == "" {
+			return nil, errors.New("ranking codes must not be empty")
+		}
+		codec.codes[code] = country
+		if len(code) > codec.maxCodeLen {
+			codec.maxCodeLen = len(code)
+		}
+	}
+
+	for code := range codec.codes {
+		for i := 1; i < len(code); i++ {
+			if _, ok := codec.codes[code[:i]]; ok {
+				return nil, fmt.Errorf("ranking code %q is a prefix of %q", code[:i], code)
+			}
+		}
+	}
+
+	countries := []string{}
+	for _, country := range codec.codes {
+		if _, ok := codec.slots[country]; !ok {
+			codec.slots[country] = 0
+			countries = append(countries, country)
+		}
+	}
+	if len(countries) > RankingVectorDims {
+		return nil, fmt.Errorf("ranking codes name %d countries, at most %d are supported", len(countries), RankingVectorDims)
+	}
+
+	sort.Strings(countries)
+	for i, country := range countries {
+		codec.slots[country] = i
+	}
+
+	return codec, nil
+}
+
+/**
+ * splits the ranking string into the countries it lists, best first
+ */
+func (c *RankingCodec) Decode(ranking string) ([]string, error) {
+	countries := []string{}
+	seen := map[string]bool{}
+
+	for rest := ranking; rest != ""; {
+		matched := false
+		for length := min(c.maxCodeLen, len(rest)); length > 0; length-- {
+			country, ok := c.codes[rest[:length]]
+			if !ok {
+				continue
+			}
+			if seen[country] {
+				return nil, ErrDuplicateRankingEntry
+			}
+			seen[country] = true
+			countries = append(countries, country)
+			rest = rest[length:]
+			matched = true
+			break
+		}
+		if !matched {
+			return nil, ErrUnknownRankingCode
+		}
+	}
+
+	return countries, nil
+}
+
+/**
+ * builds the fixed order vector of the positions, one slot per country in
+ * alphabetical order. Countries the positions leave out, and the unused
+ * slots, are placed one below the last country any ranking could list, so
+ * the L1 distance between two vectors is the footrule distance with
+ * unranked entries tied last. Returns nil when there are no positions or
+ * they name a country the codec doesn't know.
+ */
+func (c *RankingCodec) PositionVector(positions []models.RankingPosition) []float32 {
+	if len(positions) == 0 {
+		return nil
+	}
+
+	unranked := float32(len(c.slots) + 1)
+	vector := make([]float32, RankingVectorDims)
+	for i := range vector {
+		vector[i] = unranked
+	}
+
+	for _, position := range positions {
+		slot, ok := c.slots[position.Country]
+		if !ok {
+			return nil
+		}
+		vector[slot] = float32(position.Position)
+	}
+
+	return vector
+}
+
+/**
+ * decodes the ranking string into positions with the configured codec
+ */
+func DecodeRankingPositions(ranking string) ([]models.RankingPosition, error) {
+	if rankingCodec == nil {
+		return nil, ErrRankingCodesNotConfigured
+	}
+
+	countries, err := rankingCodec.Decode(ranking)
+	if err != nil {
+		return nil, err
+	}
+
+	positions := make([]models.RankingPosition, 0, len(countries))
+	for i, country := range countries {
+		positions = append(positions, models.RankingPosition{
+			Country:    country,
+			Position:   i + 1,
+			FromBottom: len(countries) - i,
+		})
+	}
+
+	return positions, nil
+}
+
+/**
+ * builds the position vector with the configured codec, or returns nil when
+ * ranking codes aren't configured
+ */
+func RankingPositionVector(positions []models.RankingPosition) []float32 {
+	if rankingCodec == nil {
+		return nil
+	}
+	return rankingCodec.PositionVector(positions)
+}
+
+/**
+ * reports whether ranking codes were configured
+ */
+func RankingCodecConfigured() bool {
+	return rankingCodec != nil
+}
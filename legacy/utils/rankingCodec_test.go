@@ -0,0 +1,226 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"eurovision-api/models"
+)
+
+var testRankingCodes = map[string]string{
+	"f":  "se",
+	"o":  "IT",
+	"n":  " no ",
+	".b": "UA",
+	".c": "CH",
+}
+
+func TestNewRankingCodecValidatesCodes(t *testing.T) {
+	tests := []struct {
+		name  string
+		codes map[string]string
+		valid bool
+	}{
+		{"single characters", map[string]string{"f": "SE", "o": "IT"}, true},
+		{"prefix free multi character", testRankingCodes, true},
+		{"empty code", map[string]string{"": "SE"}, false},
+		{"empty country", map[string]string{"f": " "}, false},
+		{"code is a prefix of another", map[string]string{".": "SE", ".b": "UA"}, false},
+		{"prefix of a longer code", map[string]string{"ab": "SE", "abc": "UA"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewRankingCodec(tt.codes)
+			if (err == nil) != tt.valid {
+				t.Errorf("error = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestRankingCodecDecode(t *testing.T) {
+	codec, err := NewRankingCodec(testRankingCodes)
+	if err != nil {
+		t.Fatalf("NewRankingCodec: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		ranking   string
+		countries []string
+		err       error
+	}{
+		{"empty", "", []string{}, nil},
+		{"single characters", "fon", []string{"SE", "IT", "NO"}, nil},
+		{"multi character codes", ".bf.c", []string{"UA", "SE", "CH"}, nil},
+		{"unknown code", "fx", nil, ErrUnknownRankingCode},
+		{"dangling prefix", "f.", nil, ErrUnknownRankingCode},
+		{"duplicate entry", "fof", nil, ErrDuplicateRankingEntry},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			countries, err := codec.Decode(tt.ranking)
+			if err != tt.err {
+				t.Fatalf("error = %v, want %v", err, tt.err)
+			}
+			if !reflect.DeepEqual(countries, tt.countries) {
+				t.Errorf("countries = %v, want %v", countries, tt.countries)
+			}
+		})
+	}
+}
+
+func TestRankingCodecPositionVector(t *testing.T) {
+	codec, err := NewRankingCodec(testRankingCodes)
+	if err != nil {
+		t.Fatalf("NewRankingCodec: %v", err)
+	}
+
+	// five countries, so anything unranked sits at 6
+	unranked := func(slots map[int]float32) []float32 {
+		vector := make([]float32, RankingVectorDims)
+		for i := range vector {
+			vector[i] = 6
+		}
+		for slot, position := range slots {
+			vector[slot] = position
+		}
+		return vector
+	}
+
+	tests := []struct {
+		name      string
+		positions []models.RankingPosition
+		want      []float32
+	}{
+		{"no positions", nil, nil},
+		{
+			name: "slots in alphabetical order",
+			positions: []models.RankingPosition{
+				{Country: "SE", Position: 1}, {Country: "UA", Position: 2}, {Country: "CH", Position: 3},
+			},
+			// CH, IT, NO, SE, UA
+			want: unranked(map[int]float32{0: 3, 3: 1, 4: 2}),
+		},
+		{"unknown country", []models.RankingPosition{{Country: "SE", Position: 1}, {Country: "FR", Position: 2}}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := codec.PositionVector(tt.positions); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("vector = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPositionVectorDistanceIsFootrule(t *testing.T) {
+	codec, err := NewRankingCodec(testRankingCodes)
+	if err != nil {
+		t.Fatalf("NewRankingCodec: %v", err)
+	}
+
+	a, _ := codec.Decode("fon.b")
+	b, _ := codec.Decode("nf.c")
+	va, vb := codec.PositionVector(positionsOf(a)), codec.PositionVector(positionsOf(b))
+
+	distance := float32(0)
+	for i := range va {
+		distance += max(va[i], vb[i]) - min(va[i], vb[i])
+	}
+
+	// SE 1-2, IT 2-6, NO 3-1, UA 4-6 and CH 6-3
+	if distance != 1+4+2+2+3 {
+		t.Errorf("distance = %v, want 12", distance)
+	}
+}
+
+func positionsOf(countries []string) []models.RankingPosition {
+	positions := make([]models.RankingPosition, 0, len(countries))
+	for i, country := range countries {
+		positions = append(positions, models.RankingPosition{Country: country, Position: i + 1})
+	}
+	return positions
+}
+
+func numberedCodes(countries int) map[string]string {
+	codes := map[string]string{}
+	for i := 0; i < countries; i++ {
+		codes[fmt.Sprintf("c%02d.", i)] = fmt.Sprintf("X%02d", i)
+	}
+	return codes
+}
+
+func TestDecodeRankingPositions(t *testing.T) {
+	codec, err := NewRankingCodec(testRankingCodes)
+	if err != nil {
+		t.Fatalf("NewRankingCodec: %v", err)
+	}
+	defer func(previous *RankingCodec) { rankingCodec = previous }(rankingCodec)
+
+	rankingCodec = nil
+	if _, err := DecodeRankingPositions("fon"); err != ErrRankingCodesNotConfigured {
+		t.Fatalf("error without codes = %v, want %v", err, ErrRankingCodesNotConfigured)
+	}
+
+	rankingCodec = codec
+	positions, err := DecodeRankingPositions("f.bo")
+	if err != nil {
+		t.Fatalf("DecodeRankingPositions: %v", err)
+	}
+
+	want := []models.RankingPosition{
+		{Country: "SE", Position: 1, FromBottom: 3},
+		{Country: "UA", Position: 2, FromBottom: 2},
+		{Country: "IT", Position: 3, FromBottom: 1},
+	}
+	if !reflect.DeepEqual(positions, want) {
+		t.Errorf("positions = %+v, want %+v", positions, want)
+	}
+}
+
+func TestInitRankingCodecReadsFile(t *testing.T) {
+	defer func(previous *RankingCodec) { rankingCodec = previous }(rankingCodec)
+
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "codes.json")
+	if err := os.WriteFile(valid, []byte(`{"f": "se", ".b": "UA"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	invalid := filepath.Join(dir, "invalid.json")
+	if err := os.WriteFile(invalid, []byte(`{"f": "SE", "f.": "UA"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		path       string
+		valid      bool
+		configured bool
+	}{
+		{"not configured", "", true, false},
+		{"valid file", valid, true, true},
+		{"missing file", filepath.Join(dir, "missing.json"), false, false},
+		{"prefix codes", invalid, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rankingCodec = nil
+			t.Setenv("RANKING_CODES_FILE", tt.path)
+
+			err := InitRankingCodec()
+			if (err == nil) != tt.valid {
+				t.Fatalf("error = %v, want valid %v", err, tt.valid)
+			}
+			if RankingCodecConfigured() != tt.configured {
+				t.Errorf("configured = %v, want %v", RankingCodecConfigured(), tt.configured)
+			}
+		})
+	}
+}
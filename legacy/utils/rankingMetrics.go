@@ -0,0 +1,96 @@
+package utils
+
+import (
+	"eurovision-api/models"
+	"math"
+)
+
+/*
+RankingAgreement measures how closely two decoded rankings agree. Both
+metrics only look at the entries the rankings have in common, renumbered
+1..Common in each ranking's order.
+
+KendallTau runs from -1 (one ranking is the other reversed) to 1 (same
+order), from the share of entry pairs both rankings put the same way round.
+FootruleSimilarity is 1 minus the Spearman footrule distance, the summed
+position differences, over its largest possible value: 1 for the same order
+and 0 for the most different. Overlap is the share of entries in either
+ranking that both contain.
+*/
+type RankingAgreement struct {
+	Common             int     `json:"common"`
+	Overlap            float64 `json:"overlap"`
+	KendallTau         float64 `json:"kendall_tau"`
+	FootruleDistance   int     `json:"footrule_distance"`
+	FootruleSimilarity float64 `json:"footrule_similarity"`
+}
+
+/**
+ * compares two decoded rankings
+ */
+func CompareRankingPositions(a, b []models.RankingPosition) RankingAgreement {
+	inB := map[string]bool{}
+	for _, position := range b {
+		inB[position.Country] = true
+	}
+
+	// the common entries in a's order, then their relative positions in b
+	common := []string{}
+	for _, position := range a {
+		if inB[position.Country] {
+			common = append(common, position.Country)
+		}
+	}
+
+	relativeA := map[string]int{}
+	for i, country := range common {
+		relativeA[country] = i + 1
+	}
+
+	relativeB := map[string]int{}
+	for _, position := range b {
+		if _, ok := relativeA[position.Country]; ok {
+			relativeB[position.Country] = len(relativeB) + 1
+		}
+	}
+
+	agreement := RankingAgreement{Common: len(common)}
+
+	union := len(a) + len(b) - len(common)
+	if union > 0 {
+		agreement.Overlap = float64(len(common)) / float64(union)
+	}
+
+	n := len(common)
+	if n < 2 {
+		// a single shared entry can't disagree with itself
+		if n == 1 {
+			agreement.KendallTau = 1
+			agreement.FootruleSimilarity = 1
+		}
+		return agreement
+	}
+
+	for _, country := range common {
+		agreement.FootruleDistance += int(math.Abs(float64(relativeA[country] - relativeB[country])))
+	}
+
+	// the footrule of a ranking against its reverse is floor(n^2 / 2)
+	maxFootrule := n * n / 2
+	agreement.FootruleSimilarity = 1 - float64(agreement.FootruleDistance)/float64(maxFootrule)
+
+	concordant, discordant := 0, 0
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			// common is in a's order, so a always puts i before j
+			if relativeB[common[i]] < relativeB[common[j]] {
+				concordant++
+			} else {
+				discordant++
+			}
+		}
+	}
+	agreement.KendallTau = float64(concordant-discordant) / float64(n*(n-1)/2)
+
+	return agreement
+}